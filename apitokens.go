@@ -0,0 +1,48 @@
+package fileshare
+
+import "time"
+
+const (
+	APITokenAccessFull   = "full"
+	APITokenAccessRead   = "read"
+	APITokenAccessUpload = "upload"
+)
+
+type APITokens struct {
+	File string `yaml:"file"`
+}
+
+// APITokenScope restricts what a token can do, on top of the permissions of its user.
+type APITokenScope struct {
+	// Access is one of full, read (read-only) or upload (upload-only)
+	Access string `json:"access"`
+	// Path limits the token to the files below it, if not empty
+	Path string `json:"path,omitempty"`
+}
+
+// APIToken is a personal access token, only the hash of the secret is stored.
+type APIToken struct {
+	ID         string        `json:"id"`
+	User       string        `json:"user"`
+	Name       string        `json:"name"`
+	Hash       string        `json:"hash"`
+	Scope      APITokenScope `json:"scope"`
+	CreatedAt  time.Time     `json:"created_at"`
+	ExpiresAt  time.Time     `json:"expires_at,omitempty"`
+	LastUsedAt time.Time     `json:"last_used_at,omitempty"`
+}
+
+// Expired reports whether the token has expired, tokens without expiry never do.
+func (t APIToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
+
+type APITokenStore interface {
+	// Create returns a new token for the user and its secret, which is not stored and cannot be shown again.
+	Create(user string, name string, scope APITokenScope, expiresAt time.Time) (*APIToken, string, error)
+	List(user string) ([]APIToken, error)
+	Revoke(user string, id string) error
+
+	// Authenticate returns the token with the secret and records its use.
+	Authenticate(secret string) (*APIToken, error)
+}
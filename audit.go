@@ -0,0 +1,57 @@
+package fileshare
+
+import "time"
+
+const (
+	AuditActionLogin    = "login"
+	AuditActionLogout   = "logout"
+	AuditActionList     = "list"
+	AuditActionRead     = "read"
+	AuditActionDownload = "download"
+	AuditActionUpload   = "upload"
+	AuditActionDelete   = "delete"
+	AuditActionRestore  = "restore"
+	AuditActionRename   = "rename"
+)
+
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeDenied  = "denied"
+	AuditOutcomeFailure = "failure"
+)
+
+type Audit struct {
+	File string `yaml:"file"`
+}
+
+// AuditEntry is a single record of the audit log, each entry includes the hash of the previous one.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Action   string    `json:"action"`
+	Path     string    `json:"path,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// AuditQuery filters the audit log, empty fields match everything and the path matches everything below it.
+type AuditQuery struct {
+	User    string
+	Action  string
+	Path    string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+type AuditLog interface {
+	Record(entry AuditEntry)
+	Query(query AuditQuery) ([]AuditEntry, error)
+	Verify() error
+}
@@ -0,0 +1,237 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultQueryLimit is how many entries are returned when the query does not specify a limit.
+const defaultQueryLimit = 100
+
+// maxQueryLimit is the most entries a query can return.
+const maxQueryLimit = 1000
+
+type fileAuditLog struct {
+	path string
+
+	lock sync.Mutex
+	file *os.File
+	last string
+	size int64
+}
+
+// NewFileAuditLog opens the audit log at path, entries are appended as JSON lines.
+func NewFileAuditLog(path string) (fileshare.AuditLog, error) {
+	l := &fileAuditLog{path: path}
+
+	// continue the chain even if it is broken, but make it known
+	last, err := l.verify(-1)
+	if errors.Is(err, errAuditTampered) {
+		log.WithError(err).WithField("module", "audit").Errorf("audit log %s is not valid", path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	l.last = last
+
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := l.file.Stat()
+	if err != nil {
+		_ = l.file.Close()
+		return nil, err
+	}
+
+	l.size = info.Size()
+	return l, nil
+}
+
+var errAuditTampered = errors.New("audit log tampered")
+
+// entryHash computes the hash of the entry, which covers the hash of the previous one.
+func entryHash(entry fileshare.AuditEntry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// scan calls fn for every entry in the first size bytes of the log, from the oldest. A negative
+// size reads the whole log.
+func (l *fileAuditLog) scan(size int64, fn func(line int, entry fileshare.AuditEntry) error) error {
+	file, err := os.Open(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	var r io.Reader = file
+	if size >= 0 {
+		r = io.LimitReader(file, size)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry fileshare.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("%w: invalid entry at line %d: %v", errAuditTampered, line, err)
+		}
+
+		if err := fn(line, entry); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (l *fileAuditLog) verify(size int64) (string, error) {
+	var last string
+	err := l.scan(size, func(line int, entry fileshare.AuditEntry) error {
+		if entry.PrevHash != last {
+			return fmt.Errorf("%w: broken chain at line %d", errAuditTampered, line)
+		}
+
+		hash, err := entryHash(entry)
+		if err != nil {
+			return err
+		} else if hash != entry.Hash {
+			return fmt.Errorf("%w: invalid hash at line %d", errAuditTampered, line)
+		}
+
+		last = entry.Hash
+		return nil
+	})
+	return last, err
+}
+
+func (l *fileAuditLog) Record(entry fileshare.AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	entry.Time = entry.Time.UTC()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry.PrevHash = l.last
+
+	var err error
+	if entry.Hash, err = entryHash(entry); err != nil {
+		log.WithError(err).WithField("module", "audit").Errorf("failed hashing audit entry")
+		return
+	}
+
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		log.WithError(err).WithField("module", "audit").Errorf("failed encoding audit entry")
+		return
+	}
+
+	n, err := l.file.Write(append(data, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		log.WithError(err).WithField("module", "audit").Errorf("failed writing audit entry")
+		return
+	}
+
+	l.last = entry.Hash
+}
+
+// Query scans the log without blocking Record, only the entries written before the query started are
+// considered. At most query.Limit of the newest matching entries are kept while scanning.
+func (l *fileAuditLog) Query(query fileshare.AuditQuery) ([]fileshare.AuditEntry, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultQueryLimit
+	}
+
+	query.Limit = min(query.Limit, maxQueryLimit)
+
+	var prefix string
+	if len(query.Path) > 0 {
+		prefix = filepath.Clean("/" + query.Path)
+	}
+
+	l.lock.Lock()
+	size := l.size
+	l.lock.Unlock()
+
+	// the matches wrap around once the limit is reached, so that only the newest are kept
+	entries := make([]fileshare.AuditEntry, 0, min(query.Limit, defaultQueryLimit))
+	var matches int
+	err := l.scan(size, func(_ int, entry fileshare.AuditEntry) error {
+		if len(query.User) > 0 && entry.User != query.User {
+			return nil
+		} else if len(query.Action) > 0 && entry.Action != query.Action {
+			return nil
+		} else if len(query.Outcome) > 0 && entry.Outcome != query.Outcome {
+			return nil
+		} else if !query.Since.IsZero() && entry.Time.Before(query.Since) {
+			return nil
+		} else if !query.Until.IsZero() && entry.Time.After(query.Until) {
+			return nil
+		}
+
+		if len(prefix) > 0 && prefix != "/" {
+			path := filepath.Clean("/" + entry.Path)
+			if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+				return nil
+			}
+		}
+
+		if len(entries) < query.Limit {
+			entries = append(entries, entry)
+		} else {
+			entries[matches%query.Limit] = entry
+		}
+
+		matches++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// newest first
+	result := make([]fileshare.AuditEntry, 0, len(entries))
+	for i := 1; i <= len(entries); i++ {
+		result = append(result, entries[(matches-i)%len(entries)])
+	}
+
+	return result, nil
+}
+
+// Verify checks the entries written before it started, without blocking Record.
+func (l *fileAuditLog) Verify() error {
+	l.lock.Lock()
+	size := l.size
+	l.lock.Unlock()
+
+	_, err := l.verify(size)
+	return err
+}
@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestAuditLog(t *testing.T) (*fileAuditLog, string) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := NewFileAuditLog(path)
+	if err != nil {
+		t.Fatalf("failed opening audit log: %v", err)
+	}
+
+	t.Cleanup(func() { _ = l.(*fileAuditLog).file.Close() })
+	return l.(*fileAuditLog), path
+}
+
+func TestFileAuditLog_Chain(t *testing.T) {
+	l, path := newTestAuditLog(t)
+
+	l.Record(fileshare.AuditEntry{User: "pippo", IP: "127.0.0.1", Action: fileshare.AuditActionLogin, Outcome: fileshare.AuditOutcomeSuccess})
+	l.Record(fileshare.AuditEntry{User: "pippo", Action: fileshare.AuditActionUpload, Path: "datasets/a.bin", Outcome: fileshare.AuditOutcomeSuccess, Bytes: 5})
+	l.Record(fileshare.AuditEntry{User: "pluto", Action: fileshare.AuditActionDownload, Path: "datasets/a.bin", Outcome: fileshare.AuditOutcomeDenied})
+
+	if err := l.Verify(); err != nil {
+		t.Fatalf("unexpected invalid chain: %v", err)
+	}
+
+	// the chain continues across restarts
+	_ = l.file.Close()
+	reopened, err := NewFileAuditLog(path)
+	if err != nil {
+		t.Fatalf("failed reopening audit log: %v", err)
+	}
+
+	l = reopened.(*fileAuditLog)
+	l.Record(fileshare.AuditEntry{User: "pippo", Action: fileshare.AuditActionList, Path: "datasets", Outcome: fileshare.AuditOutcomeSuccess})
+	if err := l.Verify(); err != nil {
+		t.Fatalf("unexpected invalid chain after reopening: %v", err)
+	}
+
+	entries, err := l.Query(fileshare.AuditQuery{User: "pippo", Path: "/datasets"})
+	if err != nil {
+		t.Fatalf("failed querying: %v", err)
+	} else if len(entries) != 2 || entries[0].Action != fileshare.AuditActionList || entries[1].Action != fileshare.AuditActionUpload {
+		t.Fatalf("unexpected entries: %+v", entries)
+	} else if entries[0].PrevHash == "" || entries[1].Bytes != 5 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	if entries, _ := l.Query(fileshare.AuditQuery{Outcome: fileshare.AuditOutcomeDenied}); len(entries) != 1 || entries[0].User != "pluto" {
+		t.Fatalf("unexpected denied entries: %+v", entries)
+	}
+
+	if entries, _ := l.Query(fileshare.AuditQuery{Limit: 1}); len(entries) != 1 || entries[0].Action != fileshare.AuditActionList {
+		t.Fatalf("unexpected limited entries: %+v", entries)
+	}
+}
+
+func TestFileAuditLog_Tampered(t *testing.T) {
+	l, path := newTestAuditLog(t)
+
+	l.Record(fileshare.AuditEntry{User: "pippo", Action: fileshare.AuditActionUpload, Path: "a.bin", Outcome: fileshare.AuditOutcomeSuccess, Bytes: 5})
+	l.Record(fileshare.AuditEntry{User: "pippo", Action: fileshare.AuditActionDelete, Path: "a.bin", Outcome: fileshare.AuditOutcomeSuccess})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed reading audit log: %v", err)
+	}
+
+	// rewriting an entry breaks its hash
+	if err := os.WriteFile(path, bytes.Replace(data, []byte(`"user":"pippo"`), []byte(`"user":"pluto"`), 1), 0600); err != nil {
+		t.Fatalf("failed writing audit log: %v", err)
+	} else if err := l.Verify(); !errors.Is(err, errAuditTampered) {
+		t.Fatalf("expected tampered log, got %v", err)
+	}
+
+	// dropping an entry breaks the chain
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if err := os.WriteFile(path, lines[1], 0600); err != nil {
+		t.Fatalf("failed writing audit log: %v", err)
+	} else if err := l.Verify(); !errors.Is(err, errAuditTampered) {
+		t.Fatalf("expected tampered log, got %v", err)
+	}
+}
+
+func TestFileAuditLog_QueryLimit(t *testing.T) {
+	l, _ := newTestAuditLog(t)
+
+	for i := 0; i < maxQueryLimit+10; i++ {
+		l.Record(fileshare.AuditEntry{User: "pippo", Action: fileshare.AuditActionUpload, Outcome: fileshare.AuditOutcomeSuccess, Bytes: int64(i)})
+	}
+
+	// only the newest entries are kept, up to the maximum
+	if entries, err := l.Query(fileshare.AuditQuery{Limit: 10 * maxQueryLimit}); err != nil {
+		t.Fatalf("failed querying: %v", err)
+	} else if len(entries) != maxQueryLimit || entries[0].Bytes != maxQueryLimit+9 || entries[len(entries)-1].Bytes != 10 {
+		t.Fatalf("unexpected entries: %d, %d to %d", len(entries), entries[0].Bytes, entries[len(entries)-1].Bytes)
+	}
+
+	if entries, _ := l.Query(fileshare.AuditQuery{Limit: 3}); len(entries) != 3 || entries[0].Bytes != maxQueryLimit+9 || entries[2].Bytes != maxQueryLimit+7 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestFileAuditLog_QueryCommitted(t *testing.T) {
+	l, path := newTestAuditLog(t)
+
+	l.Record(fileshare.AuditEntry{User: "pippo", Action: fileshare.AuditActionLogin, Outcome: fileshare.AuditOutcomeSuccess})
+
+	// a line being written is not read by queries
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("failed opening audit log: %v", err)
+	}
+
+	_, _ = file.WriteString(`{"user":"pluto"`)
+	_ = file.Close()
+
+	if entries, err := l.Query(fileshare.AuditQuery{}); err != nil || len(entries) != 1 || entries[0].User != "pippo" {
+		t.Fatalf("unexpected entries: %+v: %v", entries, err)
+	} else if err := l.Verify(); err != nil {
+		t.Fatalf("unexpected invalid chain: %v", err)
+	}
+}
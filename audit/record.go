@@ -0,0 +1,62 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"path/filepath"
+	"strings"
+)
+
+// NewEntry prepares an entry for the action of the user in ctx on the storage path name.
+func NewEntry(ctx context.Context, action string, name string) fileshare.AuditEntry {
+	entry := fileshare.AuditEntry{IP: fileshare.RemoteIPFromUserContext(ctx), Action: action}
+	if user := fileshare.UserFromUserContext(ctx); user != nil {
+		entry.User = user.Nickname
+	}
+
+	if len(name) > 0 {
+		entry.Path = cleanPath(name)
+	}
+
+	return entry
+}
+
+// NewRenameEntry prepares an entry for the user in ctx moving oldname to newname.
+func NewRenameEntry(ctx context.Context, oldname string, newname string) fileshare.AuditEntry {
+	entry := NewEntry(ctx, fileshare.AuditActionRename, oldname)
+	entry.Target = cleanPath(newname)
+	return entry
+}
+
+func cleanPath(name string) string {
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if len(name) == 0 {
+		return "."
+	}
+
+	return name
+}
+
+// Record completes the entry with the outcome given by err and adds it to the log, if any. Forbidden
+// storage accesses are skipped, they have already been recorded by the storage.
+func Record(log fileshare.AuditLog, entry fileshare.AuditEntry, bytes int64, err error) {
+	if log == nil {
+		return
+	} else if errors.Is(err, fileshare.ErrStorageReadForbidden) || errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		return
+	}
+
+	entry.Bytes = bytes
+	if err == nil {
+		entry.Outcome = fileshare.AuditOutcomeSuccess
+	} else if errors.Is(err, fileshare.ErrAuthInvalid) || errors.Is(err, fileshare.ErrAuthMalformed) {
+		entry.Outcome = fileshare.AuditOutcomeDenied
+		entry.Error = err.Error()
+	} else {
+		entry.Outcome = fileshare.AuditOutcomeFailure
+		entry.Error = err.Error()
+	}
+
+	log.Record(entry)
+}
@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"testing"
+)
+
+type memoryAuditLog struct {
+	entries []fileshare.AuditEntry
+}
+
+func (l *memoryAuditLog) Record(entry fileshare.AuditEntry) {
+	l.entries = append(l.entries, entry)
+}
+
+func (l *memoryAuditLog) Query(fileshare.AuditQuery) ([]fileshare.AuditEntry, error) {
+	return l.entries, nil
+}
+
+func (l *memoryAuditLog) Verify() error {
+	return nil
+}
+
+func TestRecord(t *testing.T) {
+	l := &memoryAuditLog{}
+
+	ctx := fileshare.ContextWithUser(context.Background(), &fileshare.User{Nickname: "pippo"})
+	ctx = fileshare.ContextWithRemoteIP(ctx, "127.0.0.1")
+
+	Record(l, NewEntry(ctx, fileshare.AuditActionUpload, "/dir/a.bin"), 5, nil)
+	Record(l, NewRenameEntry(ctx, "/dir/a.bin", "b.bin"), 0, fmt.Errorf("disk full"))
+	Record(l, fileshare.AuditEntry{User: "pluto", Action: fileshare.AuditActionLogin}, 0, fileshare.NewError("invalid credentials", fileshare.ErrAuthInvalid))
+	Record(l, NewEntry(ctx, fileshare.AuditActionDownload, "secret"), 0, fileshare.NewError("cannot read file", fileshare.ErrStorageReadForbidden))
+
+	if len(l.entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(l.entries))
+	}
+
+	if e := l.entries[0]; e.User != "pippo" || e.IP != "127.0.0.1" || e.Path != "dir/a.bin" || e.Bytes != 5 || e.Outcome != fileshare.AuditOutcomeSuccess {
+		t.Fatalf("unexpected entry: %+v", e)
+	} else if e := l.entries[1]; e.Action != fileshare.AuditActionRename || e.Target != "b.bin" || e.Outcome != fileshare.AuditOutcomeFailure || e.Error != "disk full" {
+		t.Fatalf("unexpected entry: %+v", e)
+	} else if e := l.entries[2]; e.User != "pluto" || e.Outcome != fileshare.AuditOutcomeDenied {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+
+	// nothing to record to
+	Record(nil, NewEntry(ctx, fileshare.AuditActionUpload, "a.bin"), 0, nil)
+}
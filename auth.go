@@ -1,13 +1,26 @@
 package fileshare
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var ErrAuthMalformed = errors.New("malformed authentication token")
 var ErrAuthInvalid = errors.New("invalid authentication token")
 
+// ErrAuthSuperseded is returned for a refresh token that was just replaced by a concurrent request.
+var ErrAuthSuperseded = errors.New("authentication token was just replaced")
+
 type TokenProvider interface {
+	// GetUser returns the user of the access token, if its session is still active.
 	GetUser(token string) (string, error)
-	GetToken(nickname string) (string, error)
+	// GetSession returns the ID of the session of the access token, even if it has expired.
+	GetSession(token string) (string, error)
+
+	// NewSession starts a session for the user and returns its first tokens.
+	NewSession(nickname string, ip string, userAgent string) (*SessionTokens, error)
+	// Refresh returns new tokens for the session of the refresh token, which cannot be used again.
+	Refresh(refreshToken string) (*SessionTokens, error)
 }
 
 type AuthPasswordUser struct {
@@ -19,20 +32,90 @@ type AuthPassword struct {
 	Users []AuthPasswordUser
 }
 
-type AuthGithub struct {
+type AuthOAuth2 struct {
+	// Preset fills in the endpoints of a known provider: github, github-enterprise, gitlab, gitea or forgejo
+	Preset string `yaml:"preset"`
+	// BaseURL is the address of a self-hosted provider, used by the presets
+	BaseURL         string `yaml:"base_url"`
 	CallbackBaseURL string `yaml:"callback_base_url"`
 	ClientID        string `yaml:"client_id"`
 	ClientSecret    string `yaml:"client_secret"`
+
+	// the endpoints override those of the preset
+	AuthURL     string   `yaml:"auth_url"`
+	TokenURL    string   `yaml:"token_url"`
+	UserInfoURL string   `yaml:"user_info_url"`
+	Scopes      []string `yaml:"scopes"`
+	// LoginField is the field of the user info JSON used as nickname
+	LoginField string `yaml:"login_field"`
+	// Timeout of the requests to the provider, defaults to 10 seconds
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Memberships allow the members of GitHub organizations and teams to log in, only for the GitHub presets
+	Memberships []OAuth2Membership `yaml:"memberships"`
+}
+
+// OAuth2Membership gives groups to the members of a GitHub organization or team.
+type OAuth2Membership struct {
+	Org string `yaml:"org"`
+	// Team is the slug of a team of the organization, the whole organization if empty
+	Team   string   `yaml:"team"`
+	Groups []string `yaml:"groups"`
+}
+
+type AuthOIDC struct {
+	CallbackBaseURL string   `yaml:"callback_base_url"`
+	IssuerURL       string   `yaml:"issuer_url"`
+	ClientID        string   `yaml:"client_id"`
+	ClientSecret    string   `yaml:"client_secret"`
+	Scopes          []string `yaml:"scopes"`
+	// NicknameClaim is the ID token claim used as nickname, defaults to "preferred_username"
+	NicknameClaim string `yaml:"nickname_claim"`
+}
+
+type AuthLDAP struct {
+	// URL of the server, ldap:// or ldaps://
+	URL string `yaml:"url"`
+	// StartTLS upgrades a ldap:// connection to TLS
+	StartTLS bool `yaml:"start_tls"`
+	// CACert is a PEM file with the certificates to trust instead of the system ones
+	CACert string `yaml:"ca_cert"`
+	// BindDN and BindPassword are used to search the users, anonymously if empty
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	BaseDN       string `yaml:"base_dn"`
+	// UserFilter finds the user, %s is replaced with the nickname, defaults to "(uid=%s)"
+	UserFilter string `yaml:"user_filter"`
+	// NicknameAttribute is the attribute of the user used as nickname, defaults to "uid"
+	NicknameAttribute string `yaml:"nickname_attribute"`
+	// GroupAttribute lists the groups of the user, defaults to "memberOf"
+	GroupAttribute string `yaml:"group_attribute"`
+	// GroupFilter finds the groups of the user if set, %s is replaced with the user DN
+	GroupFilter string `yaml:"group_filter"`
+	GroupBaseDN string `yaml:"group_base_dn"`
+	// Groups maps the DN of LDAP groups to groups
+	Groups map[string][]string `yaml:"groups"`
+	// Timeout of the requests to the server, defaults to 10 seconds
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// OAuth2Login holds the random values of a single login attempt.
+type OAuth2Login struct {
+	State string
+	// Verifier is the PKCE code verifier
+	Verifier string
+	// Nonce binds the OpenID Connect ID token to the login
+	Nonce string
 }
 
 type OAuth2ProviderPayload struct {
 	Code  string
-	State string
+	Login OAuth2Login
 }
 
 type OAuth2AuthProvider interface {
 	AuthProvider
-	Callback() (string, error)
+	Callback(login OAuth2Login) (string, error)
 }
 
 type AuthProvider interface {
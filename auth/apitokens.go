@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APITokenPrefix starts every API token secret, to tell them apart from session tokens.
+const APITokenPrefix = "fsp_"
+
+// apiTokenLastUsedInterval is how often the last use of a token is written to the file.
+const apiTokenLastUsedInterval = time.Minute
+
+type fileAPITokenStore struct {
+	path string
+
+	lock   sync.Mutex
+	tokens map[string]*fileshare.APIToken // by hash
+	// lastUsedSaved is when the last use of each token was last written to the file, by hash
+	lastUsedSaved map[string]time.Time
+}
+
+// NewFileAPITokenStore keeps the tokens in a JSON file at path, which is created if missing.
+func NewFileAPITokenStore(path string) (fileshare.APITokenStore, error) {
+	s := &fileAPITokenStore{path: path, tokens: map[string]*fileshare.APIToken{}, lastUsedSaved: map[string]time.Time{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var tokens []*fileshare.APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid tokens file %s: %w", path, err)
+	}
+
+	for _, token := range tokens {
+		s.tokens[token.Hash] = token
+	}
+
+	return s, nil
+}
+
+func hashAPIToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// save writes all tokens to the file, the lock must be held.
+func (s *fileAPITokenStore) save() error {
+	tokens := make([]*fileshare.APIToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *fileAPITokenStore) Create(user string, name string, scope fileshare.APITokenScope, expiresAt time.Time) (*fileshare.APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		return nil, "", fmt.Errorf("missing token name")
+	}
+
+	switch scope.Access {
+	case fileshare.APITokenAccessFull, fileshare.APITokenAccessRead, fileshare.APITokenAccessUpload:
+	default:
+		return nil, "", fmt.Errorf("invalid token access: %s", scope.Access)
+	}
+
+	if len(scope.Path) > 0 {
+		scope.Path = filepath.Clean("/" + scope.Path)
+	}
+
+	idBytes := make([]byte, 8)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, "", err
+	} else if _, err := rand.Read(secretBytes); err != nil {
+		return nil, "", err
+	}
+
+	secret := APITokenPrefix + base64.RawURLEncoding.EncodeToString(secretBytes)
+	token := &fileshare.APIToken{
+		ID:        hex.EncodeToString(idBytes),
+		User:      user,
+		Name:      name,
+		Hash:      hashAPIToken(secret),
+		Scope:     scope,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tokens[token.Hash] = token
+	if err := s.save(); err != nil {
+		delete(s.tokens, token.Hash)
+		return nil, "", err
+	}
+
+	return token, secret, nil
+}
+
+func (s *fileAPITokenStore) List(user string) ([]fileshare.APIToken, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var tokens []fileshare.APIToken
+	for _, token := range s.tokens {
+		if token.User == user {
+			tokens = append(tokens, *token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+
+	return tokens, nil
+}
+
+func (s *fileAPITokenStore) Revoke(user string, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for hash, token := range s.tokens {
+		if token.User != user || token.ID != id {
+			continue
+		}
+
+		delete(s.tokens, hash)
+		delete(s.lastUsedSaved, hash)
+		if err := s.save(); err != nil {
+			s.tokens[hash] = token
+			return err
+		}
+
+		return nil
+	}
+
+	return fileshare.NewError("token not found", fs.ErrNotExist)
+}
+
+func (s *fileAPITokenStore) Authenticate(secret string) (*fileshare.APIToken, error) {
+	if !strings.HasPrefix(secret, APITokenPrefix) {
+		return nil, fileshare.NewError("", fileshare.ErrAuthMalformed, fmt.Errorf("not an API token"))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	token, ok := s.tokens[hashAPIToken(secret)]
+	if !ok {
+		return nil, fileshare.NewError("", fileshare.ErrAuthInvalid, fmt.Errorf("unknown API token"))
+	} else if token.Expired() {
+		return nil, fileshare.NewError("", fileshare.ErrAuthInvalid, fmt.Errorf("API token %s of %s has expired", token.ID, token.User))
+	}
+
+	// avoid rewriting the file for every request, the last use is saved at most once per interval
+	token.LastUsedAt = time.Now().UTC()
+	if token.LastUsedAt.Sub(s.lastUsedSaved[token.Hash]) >= apiTokenLastUsedInterval {
+		if err := s.save(); err != nil {
+			log.WithError(err).WithField("module", "auth").Warnf("failed saving API tokens")
+		} else {
+			s.lastUsedSaved[token.Hash] = token.LastUsedAt
+		}
+	}
+
+	tokenCopy := *token
+	return &tokenCopy, nil
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileAPITokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	store, err := NewFileAPITokenStore(path)
+	if err != nil {
+		t.Fatalf("failed creating store: %v", err)
+	}
+
+	token, secret, err := store.Create("pippo", "backup", fileshare.APITokenScope{Access: fileshare.APITokenAccessRead, Path: "data/../backups/"}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed creating token: %v", err)
+	} else if token.Scope.Path != "/backups" || token.Hash == secret {
+		t.Fatalf("unexpected token: %+v", token)
+	}
+
+	expired, expiredSecret, err := store.Create("pippo", "old", fileshare.APITokenScope{Access: fileshare.APITokenAccessFull}, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("failed creating token: %v", err)
+	}
+
+	if _, _, err := store.Create("pippo", " ", fileshare.APITokenScope{Access: fileshare.APITokenAccessFull}, time.Time{}); err == nil {
+		t.Fatalf("expected error for missing name")
+	} else if _, _, err := store.Create("pippo", "bad", fileshare.APITokenScope{Access: "everything"}, time.Time{}); err == nil {
+		t.Fatalf("expected error for invalid access")
+	}
+
+	if authenticated, err := store.Authenticate(secret); err != nil || authenticated.ID != token.ID || authenticated.LastUsedAt.IsZero() {
+		t.Fatalf("unexpected token: %+v: %v", authenticated, err)
+	} else if _, err := store.Authenticate(expiredSecret); !errors.Is(err, fileshare.ErrAuthInvalid) {
+		t.Fatalf("expected invalid for expired token: %v", err)
+	} else if _, err := store.Authenticate(secret + "x"); !errors.Is(err, fileshare.ErrAuthInvalid) {
+		t.Fatalf("expected invalid for unknown token: %v", err)
+	} else if _, err := store.Authenticate("not-a-token"); !errors.Is(err, fileshare.ErrAuthMalformed) {
+		t.Fatalf("expected malformed: %v", err)
+	}
+
+	// tokens survive restarts, secrets are not stored
+	store, err = NewFileAPITokenStore(path)
+	if err != nil {
+		t.Fatalf("failed loading store: %v", err)
+	} else if tokens, _ := store.List("pippo"); len(tokens) != 2 || tokens[0].Name != "backup" || tokens[0].LastUsedAt.IsZero() {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	} else if tokens, _ := store.List("pluto"); len(tokens) != 0 {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	}
+
+	if err := store.Revoke("pluto", token.ID); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not found for other user: %v", err)
+	} else if err := store.Revoke("pippo", token.ID); err != nil {
+		t.Fatalf("failed revoking: %v", err)
+	} else if _, err := store.Authenticate(secret); !errors.Is(err, fileshare.ErrAuthInvalid) {
+		t.Fatalf("expected invalid for revoked token: %v", err)
+	} else if tokens, _ := store.List("pippo"); len(tokens) != 1 || tokens[0].ID != expired.ID {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	}
+}
+
+func TestFileAPITokenStore_LastUsed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	store, _ := NewFileAPITokenStore(path)
+	token, secret, err := store.Create("pippo", "script", fileshare.APITokenScope{Access: fileshare.APITokenAccessFull}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed creating token: %v", err)
+	}
+
+	first, _ := store.Authenticate(secret)
+
+	// a script using the token more often than the interval, for longer than the interval
+	s := store.(*fileAPITokenStore)
+	for i := 0; i < 3; i++ {
+		s.lastUsedSaved[token.Hash] = s.lastUsedSaved[token.Hash].Add(-apiTokenLastUsedInterval / 2)
+		s.tokens[token.Hash].LastUsedAt = s.tokens[token.Hash].LastUsedAt.Add(-apiTokenLastUsedInterval / 4)
+		if _, err := store.Authenticate(secret); err != nil {
+			t.Fatalf("failed authenticating: %v", err)
+		}
+	}
+
+	last, _ := store.Authenticate(secret)
+
+	store, _ = NewFileAPITokenStore(path)
+	if tokens, _ := store.List("pippo"); len(tokens) != 1 || !tokens[0].LastUsedAt.After(first.LastUsedAt) {
+		t.Fatalf("last use was not saved: %+v", tokens)
+	} else if tokens[0].LastUsedAt.Equal(last.LastUsedAt) {
+		t.Fatalf("last use was saved for every request: %+v", tokens)
+	}
+}
@@ -2,92 +2,110 @@ package auth
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/devgianlu/go-fileshare"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/github"
-	"net/http"
+	"slices"
+	"strings"
 )
 
 const AuthProviderTypeGithub = "github"
 
-type githubAuthProvider struct {
-	cfg *oauth2.Config
-
-	state string
-}
-
-func NewGithubAuthProvider(auth fileshare.AuthGithub) (fileshare.AuthProvider, error) {
-	if len(auth.ClientID) == 0 || len(auth.ClientSecret) == 0 {
-		return nil, fmt.Errorf("invalid config")
+// NewGithubAuthProvider creates an OAuth2 provider that defaults to the github.com preset.
+func NewGithubAuthProvider(auth fileshare.AuthOAuth2, users fileshare.ExternalUsersProvider) (fileshare.AuthProvider, error) {
+	if len(auth.Preset) == 0 {
+		auth.Preset = oauth2PresetGithub
 	}
 
-	// I think this is good enough for us
-	stateBytes := make([]byte, 16)
-	_, _ = rand.Read(stateBytes)
-
-	return &githubAuthProvider{
-		state: hex.EncodeToString(stateBytes),
-		cfg: &oauth2.Config{
-			RedirectURL:  fmt.Sprintf("%s/login/github/callback", auth.CallbackBaseURL),
-			ClientID:     auth.ClientID,
-			ClientSecret: auth.ClientSecret,
-			Scopes:       []string{}, // no scopes required, nickname is public info
-			Endpoint:     github.Endpoint,
-		},
-	}, nil
+	return newOAuth2AuthProvider(AuthProviderTypeGithub, auth, users)
 }
 
-func (p *githubAuthProvider) Callback() (string, error) {
-	url := p.cfg.AuthCodeURL(p.state)
-	return url, nil
-}
+// githubGroups returns the groups of the memberships the user has.
+func (p *oauth2AuthProvider) githubGroups(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	var orgs, teams []string
 
-func (p *githubAuthProvider) Authenticate(payload_ any) (string, error) {
-	payload, ok := payload_.(fileshare.OAuth2ProviderPayload)
-	if !ok {
-		panic("invalid payload type")
+	var needTeams bool
+	for _, membership := range p.memberships {
+		needTeams = needTeams || len(membership.Team) > 0
 	}
 
-	if payload.State != p.state {
-		return "", fmt.Errorf("invalid state")
+	if err := p.githubPages(ctx, token, p.apiURL+"/user/orgs", func(data []byte) (int, error) {
+		var page []struct {
+			Login string `json:"login"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return 0, err
+		}
+
+		for _, org := range page {
+			orgs = append(orgs, strings.ToLower(org.Login))
+		}
+
+		return len(page), nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed listing organizations: %w", err)
 	}
 
-	token, err := p.cfg.Exchange(context.Background(), payload.Code)
-	if err != nil {
-		return "", err
+	if needTeams {
+		if err := p.githubPages(ctx, token, p.apiURL+"/user/teams", func(data []byte) (int, error) {
+			var page []struct {
+				Slug         string `json:"slug"`
+				Organization struct {
+					Login string `json:"login"`
+				} `json:"organization"`
+			}
+			if err := json.Unmarshal(data, &page); err != nil {
+				return 0, err
+			}
+
+			for _, team := range page {
+				teams = append(teams, strings.ToLower(team.Organization.Login+"/"+team.Slug))
+			}
+
+			return len(page), nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed listing teams: %w", err)
+		}
 	}
 
-	req, err := http.NewRequest("GET", "https://api.github.com/user", nil)
-	if err != nil {
-		return "", err
+	var groups []string
+	for _, membership := range p.memberships {
+		var member bool
+		if len(membership.Team) > 0 {
+			member = slices.Contains(teams, strings.ToLower(membership.Org+"/"+membership.Team))
+		} else {
+			member = slices.Contains(orgs, strings.ToLower(membership.Org))
+		}
+
+		if !member {
+			continue
+		}
+
+		for _, group := range membership.Groups {
+			if !slices.Contains(groups, group) {
+				groups = append(groups, group)
+			}
+		}
 	}
 
-	token.SetAuthHeader(req)
-
-	req.Header.Set("Accept", "application/vnd.github+json")
-	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("github bad status code: %d", resp.StatusCode)
-	}
+	return groups, nil
+}
 
-	var body struct {
-		Login string `json:"login"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-		return "", err
+// githubPages calls handle for each page of the list until it returns less items than requested.
+func (p *oauth2AuthProvider) githubPages(ctx context.Context, token *oauth2.Token, url string, handle func(data []byte) (int, error)) error {
+	const perPage = 100
+
+	for page := 1; ; page++ {
+		data, err := p.get(ctx, token, fmt.Sprintf("%s?per_page=%d&page=%d", url, perPage, page))
+		if err != nil {
+			return err
+		}
+
+		if n, err := handle(data); err != nil {
+			return err
+		} else if n < perPage {
+			return nil
+		}
 	}
-
-	return body.Login, nil
 }
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// mockGithub serves the memberships of the user whose login is the token.
+type mockGithub struct {
+	server *httptest.Server
+	orgs   map[string][]string
+	teams  map[string][][2]string
+}
+
+func newMockGithub(t *testing.T) *mockGithub {
+	gh := &mockGithub{orgs: map[string][]string{}, teams: map[string][][2]string{}}
+
+	paginate := func(w http.ResponseWriter, r *http.Request, items []any) {
+		if r.URL.Query().Get("per_page") != "100" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		start, end := (page-1)*100, page*100
+		if start > len(items) {
+			start = len(items)
+		}
+		if end > len(items) {
+			end = len(items)
+		}
+
+		_ = json.NewEncoder(w).Encode(items[start:end])
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": r.FormValue("code"), "token_type": "bearer", "scope": "read:org"})
+	})
+	mux.HandleFunc("/api/v3/user", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"login": r.Header.Get("Authorization")[len("Bearer "):]})
+	})
+	mux.HandleFunc("/api/v3/user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		var items []any
+		for _, org := range gh.orgs[r.Header.Get("Authorization")[len("Bearer "):]] {
+			items = append(items, map[string]any{"login": org})
+		}
+
+		paginate(w, r, items)
+	})
+	mux.HandleFunc("/api/v3/user/teams", func(w http.ResponseWriter, r *http.Request) {
+		var items []any
+		for _, team := range gh.teams[r.Header.Get("Authorization")[len("Bearer "):]] {
+			items = append(items, map[string]any{"slug": team[1], "organization": map[string]any{"login": team[0]}})
+		}
+
+		paginate(w, r, items)
+	})
+
+	gh.server = httptest.NewServer(mux)
+	t.Cleanup(gh.server.Close)
+	return gh
+}
+
+func TestGithubAuthProvider_Memberships(t *testing.T) {
+	gh := newMockGithub(t)
+
+	// many organizations to need more than a page
+	for i := 0; i < 150; i++ {
+		gh.orgs["pippo"] = append(gh.orgs["pippo"], fmt.Sprintf("org%d", i))
+	}
+	gh.orgs["pippo"] = append(gh.orgs["pippo"], "Acme")
+	gh.teams["pippo"] = [][2]string{{"acme", "devs"}}
+	gh.orgs["pluto"] = []string{"acme"}
+
+	users := NewConfigUsersProvider([]fileshare.User{{Nickname: "admin", Admin: true}}, map[string]fileshare.Group{
+		"staff": {ACL: []fileshare.PathACL{{Path: "/acme", Read: true}}},
+		"devs":  {ACL: []fileshare.PathACL{{Path: "/acme", Read: true, Write: true}, {Path: "/devs", Read: true, Write: true}}},
+	})
+
+	provider, err := NewGithubAuthProvider(fileshare.AuthOAuth2{
+		Preset:       "github-enterprise",
+		BaseURL:      gh.server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Memberships: []fileshare.OAuth2Membership{
+			{Org: "acme", Groups: []string{"staff"}},
+			{Org: "acme", Team: "devs", Groups: []string{"devs"}},
+		},
+	}, users)
+	if err != nil {
+		t.Fatalf("failed creating provider: %v", err)
+	} else if scopes := provider.(*oauth2AuthProvider).cfg.Scopes; len(scopes) != 1 || scopes[0] != "read:org" {
+		t.Fatalf("unexpected scopes: %v", scopes)
+	}
+
+	login := func(nickname string) *fileshare.User {
+		if authenticated, err := provider.Authenticate(fileshare.OAuth2ProviderPayload{Code: nickname, Login: NewOAuth2Login()}); err != nil || authenticated != nickname {
+			t.Fatalf("expected %s, got %s: %v", nickname, authenticated, err)
+		}
+
+		user, err := users.GetUser(nickname)
+		if err != nil {
+			t.Fatalf("failed getting user: %v", err)
+		}
+
+		return user
+	}
+
+	if user := login("pippo"); user == nil || len(user.Groups) != 2 || len(user.ACL) != 2 || !user.ACL[0].Write {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	if user := login("pluto"); user == nil || len(user.Groups) != 1 || user.Groups[0] != "staff" || user.ACL[0].Write {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	// not a member, but configured
+	if user := login("admin"); user == nil || !user.Admin || len(user.Groups) != 0 {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	// not a member and not configured
+	if user := login("paperino"); user != nil {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	// memberships are refreshed at login
+	gh.orgs["pluto"] = nil
+	if user := login("pluto"); user != nil {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+}
+
+func TestOAuth2AuthProvider_MembershipsOnlyGithub(t *testing.T) {
+	if _, err := NewOAuth2AuthProvider(fileshare.AuthOAuth2{
+		Preset:       "gitlab",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Memberships:  []fileshare.OAuth2Membership{{Org: "acme", Groups: []string{"staff"}}},
+	}, nil); err == nil {
+		t.Fatalf("expected error for memberships without github")
+	}
+}
@@ -1,15 +1,32 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"github.com/devgianlu/go-fileshare"
 	"github.com/golang-jwt/jwt/v5"
 	"time"
 )
 
+// RefreshTokenPrefix starts every refresh token.
+const RefreshTokenPrefix = "fsr_"
+
+const (
+	defaultAccessTokenExpiry = 15 * time.Minute
+	defaultSessionExpiry     = 7 * 24 * time.Hour
+)
+
 type jsonWebTokenProvider struct {
-	secret []byte
-	parser *jwt.Parser
+	secret        []byte
+	parser        *jwt.Parser
+	expiredParser *jwt.Parser
+
+	sessions      fileshare.SessionStore
+	accessExpiry  time.Duration
+	sessionExpiry time.Duration
 }
 
 func (p *jsonWebTokenProvider) keyFunc(token *jwt.Token) (interface{}, error) {
@@ -21,7 +38,8 @@ func (p *jsonWebTokenProvider) keyFunc(token *jwt.Token) (interface{}, error) {
 }
 
 func (p *jsonWebTokenProvider) GetUser(tokenString string) (string, error) {
-	token, err := p.parser.Parse(tokenString, p.keyFunc)
+	var claims jwt.RegisteredClaims
+	token, err := p.parser.ParseWithClaims(tokenString, &claims, p.keyFunc)
 	if err != nil {
 		return "", fileshare.NewError("", fileshare.ErrAuthMalformed, err)
 	}
@@ -30,42 +48,143 @@ func (p *jsonWebTokenProvider) GetUser(tokenString string) (string, error) {
 		return "", fileshare.NewError("", fileshare.ErrAuthInvalid, err)
 	}
 
-	subject, err := token.Claims.GetSubject()
+	// the token is only as good as its session, which may have been revoked
+	session, err := p.sessions.Get(claims.ID)
 	if err != nil {
 		return "", err
+	} else if session == nil || session.User != claims.Subject {
+		return "", fileshare.NewError("", fileshare.ErrAuthInvalid, fmt.Errorf("session %s is not active", claims.ID))
+	}
+
+	return claims.Subject, nil
+}
+
+func (p *jsonWebTokenProvider) GetSession(tokenString string) (string, error) {
+	var claims jwt.RegisteredClaims
+	if _, err := p.expiredParser.ParseWithClaims(tokenString, &claims, p.keyFunc); err != nil {
+		return "", fileshare.NewError("", fileshare.ErrAuthMalformed, err)
+	}
+
+	return claims.ID, nil
+}
+
+// newRefreshToken returns a random refresh token and its hash.
+func newRefreshToken() (string, string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", "", err
 	}
 
-	return subject, nil
+	token := RefreshTokenPrefix + base64.RawURLEncoding.EncodeToString(tokenBytes)
+	return token, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
-func (p *jsonWebTokenProvider) GetToken(nickname string) (string, error) {
+// newTokens signs an access token for the session.
+func (p *jsonWebTokenProvider) newTokens(session fileshare.Session, refreshToken string) (*fileshare.SessionTokens, error) {
 	now := time.Now()
 
+	// the access token must not outlive its session
+	expiresAt := now.Add(p.accessExpiry)
+	if expiresAt.After(session.ExpiresAt) {
+		expiresAt = session.ExpiresAt
+	}
+
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.RegisteredClaims{
-		Subject:   nickname,
+		ID:        session.ID,
+		Subject:   session.User,
 		IssuedAt:  jwt.NewNumericDate(now),
-		ExpiresAt: jwt.NewNumericDate(now.Add(7 * 24 * time.Hour)),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
 	})
 
 	tokenString, err := token.SignedString(p.secret)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return &fileshare.SessionTokens{
+		Session:              session,
+		AccessToken:          tokenString,
+		AccessTokenExpiresAt: expiresAt,
+		RefreshToken:         refreshToken,
+	}, nil
+}
+
+func (p *jsonWebTokenProvider) NewSession(nickname string, ip string, userAgent string) (*fileshare.SessionTokens, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
 	}
 
-	return tokenString, nil
+	refreshToken, refreshHash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	session := fileshare.Session{
+		ID:          hex.EncodeToString(idBytes),
+		User:        nickname,
+		IP:          ip,
+		UserAgent:   userAgent,
+		CreatedAt:   now,
+		RefreshedAt: now,
+		ExpiresAt:   now.Add(p.sessionExpiry),
+	}
+
+	if err := p.sessions.Create(session, refreshHash); err != nil {
+		return nil, err
+	}
+
+	return p.newTokens(session, refreshToken)
+}
+
+func (p *jsonWebTokenProvider) Refresh(refreshToken string) (*fileshare.SessionTokens, error) {
+	newRefreshToken, newRefreshHash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := p.sessions.Rotate(hashRefreshToken(refreshToken), newRefreshHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.newTokens(*session, newRefreshToken)
 }
 
-func NewJsonWebTokenProvider(secret []byte) (fileshare.TokenProvider, error) {
+// NewJsonWebTokenProvider signs short-lived access tokens for the sessions in the store.
+func NewJsonWebTokenProvider(secret []byte, sessions fileshare.SessionStore, cfg fileshare.Sessions) (fileshare.TokenProvider, error) {
 	if len(secret) == 0 {
 		return nil, fmt.Errorf("missing secret")
 	}
 
 	p := jsonWebTokenProvider{}
 	p.secret = secret
+	p.sessions = sessions
 	p.parser = jwt.NewParser(
 		jwt.WithIssuedAt(),
 		jwt.WithExpirationRequired(),
 		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}),
 	)
+	p.expiredParser = jwt.NewParser(
+		jwt.WithoutClaimsValidation(),
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}),
+	)
+
+	p.accessExpiry = cfg.AccessTokenExpiry
+	if p.accessExpiry == 0 {
+		p.accessExpiry = defaultAccessTokenExpiry
+	}
+
+	p.sessionExpiry = cfg.Expiry
+	if p.sessionExpiry == 0 {
+		p.sessionExpiry = defaultSessionExpiry
+	}
+
 	return &p, nil
 }
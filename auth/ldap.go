@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const AuthProviderTypeLDAP = "ldap"
+
+type ldapGroupMapping struct {
+	dn     *ldap.DN
+	groups []string
+}
+
+type ldapAuthProvider struct {
+	cfg       fileshare.AuthLDAP
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	groups    []ldapGroupMapping
+	users     fileshare.ExternalUsersProvider
+}
+
+// NewLDAPAuthProvider creates a provider that checks the password by binding as the user found
+// with the search filter, the LDAP groups of the user are mapped to groups at every login.
+func NewLDAPAuthProvider(auth fileshare.AuthLDAP, users fileshare.ExternalUsersProvider) (fileshare.AuthProvider, error) {
+	if len(auth.URL) == 0 || len(auth.BaseDN) == 0 {
+		return nil, fmt.Errorf("invalid config")
+	}
+
+	serverUrl, err := url.Parse(auth.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	} else if serverUrl.Scheme != "ldap" && serverUrl.Scheme != "ldaps" {
+		return nil, fmt.Errorf("unsupported url scheme %s", serverUrl.Scheme)
+	} else if auth.StartTLS && serverUrl.Scheme == "ldaps" {
+		return nil, fmt.Errorf("cannot use StartTLS with ldaps")
+	}
+
+	p := ldapAuthProvider{cfg: auth, users: users}
+	p.tlsConfig = &tls.Config{ServerName: serverUrl.Hostname(), MinVersion: tls.VersionTLS12}
+	if len(auth.CACert) > 0 {
+		pem, err := os.ReadFile(auth.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading CA certificate: %w", err)
+		}
+
+		p.tlsConfig.RootCAs = x509.NewCertPool()
+		if !p.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", auth.CACert)
+		}
+	}
+
+	if len(p.cfg.UserFilter) == 0 {
+		p.cfg.UserFilter = "(uid=%s)"
+	} else if strings.Count(p.cfg.UserFilter, "%s") != 1 {
+		return nil, fmt.Errorf("user filter must contain %%s once")
+	}
+
+	if len(p.cfg.GroupFilter) > 0 && strings.Count(p.cfg.GroupFilter, "%s") != 1 {
+		return nil, fmt.Errorf("group filter must contain %%s once")
+	} else if len(p.cfg.GroupBaseDN) == 0 {
+		p.cfg.GroupBaseDN = p.cfg.BaseDN
+	}
+
+	if len(p.cfg.NicknameAttribute) == 0 {
+		p.cfg.NicknameAttribute = "uid"
+	}
+
+	if len(p.cfg.GroupAttribute) == 0 {
+		p.cfg.GroupAttribute = "memberOf"
+	}
+
+	p.timeout = auth.Timeout
+	if p.timeout == 0 {
+		p.timeout = 10 * time.Second
+	}
+
+	for groupDN, groups := range auth.Groups {
+		dn, err := ldap.ParseDN(groupDN)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group DN %s: %w", groupDN, err)
+		}
+
+		p.groups = append(p.groups, ldapGroupMapping{dn: dn, groups: groups})
+	}
+
+	return &p, nil
+}
+
+func (p *ldapAuthProvider) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(p.cfg.URL, ldap.DialWithTLSDialer(p.tlsConfig, &net.Dialer{Timeout: p.timeout}))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(p.timeout)
+
+	if p.cfg.StartTLS {
+		if err := conn.StartTLS(p.tlsConfig); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed starting TLS: %w", err)
+		}
+	}
+
+	if len(p.cfg.BindDN) > 0 {
+		if err := conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed binding as %s: %w", p.cfg.BindDN, err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (p *ldapAuthProvider) Authenticate(payload_ any) (string, error) {
+	payload, ok := payload_.(PasswordAuthProviderPayload)
+	if !ok {
+		panic("invalid payload type")
+	}
+
+	// an empty password would be an unauthenticated bind, which always succeeds
+	if len(payload.Nickname) == 0 || len(payload.Password) == 0 {
+		return "", fmt.Errorf("missing nickname or password")
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return "", err
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(p.timeout.Seconds()), false,
+		fmt.Sprintf(p.cfg.UserFilter, ldap.EscapeFilter(payload.Nickname)),
+		[]string{p.cfg.NicknameAttribute, p.cfg.GroupAttribute}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", fmt.Errorf("failed searching user: %w", err)
+	} else if res == nil || len(res.Entries) != 1 {
+		return "", fmt.Errorf("user %s not found", payload.Nickname)
+	}
+
+	entry := res.Entries[0]
+	nickname := entry.GetAttributeValue(p.cfg.NicknameAttribute)
+	if len(nickname) == 0 {
+		nickname = payload.Nickname
+	}
+
+	// the groups are searched before binding as the user, who may not be allowed to
+	groupDNs := entry.GetAttributeValues(p.cfg.GroupAttribute)
+	if len(p.cfg.GroupFilter) > 0 {
+		res, err := conn.Search(ldap.NewSearchRequest(
+			p.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(p.timeout.Seconds()), false,
+			fmt.Sprintf(p.cfg.GroupFilter, ldap.EscapeFilter(entry.DN)),
+			[]string{"1.1"}, nil, // no attributes
+		))
+		if err != nil {
+			return "", fmt.Errorf("failed searching groups: %w", err)
+		}
+
+		for _, group := range res.Entries {
+			groupDNs = append(groupDNs, group.DN)
+		}
+	}
+
+	if err := conn.Bind(entry.DN, payload.Password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return "", fmt.Errorf("wrong password for %s", nickname)
+	} else if err != nil {
+		return "", fmt.Errorf("failed binding as %s: %w", entry.DN, err)
+	}
+
+	p.users.SetExternalGroups(nickname, p.mapGroups(groupDNs))
+	return nickname, nil
+}
+
+// mapGroups returns the groups given by the LDAP groups, DNs are compared ignoring case.
+func (p *ldapAuthProvider) mapGroups(groupDNs []string) []string {
+	var groups []string
+	for _, groupDN := range groupDNs {
+		dn, err := ldap.ParseDN(groupDN)
+		if err != nil {
+			continue
+		}
+
+		for _, mapping := range p.groups {
+			if !mapping.dn.EqualFold(dn) {
+				continue
+			}
+
+			for _, group := range mapping.groups {
+				if !slices.Contains(groups, group) {
+					groups = append(groups, group)
+				}
+			}
+		}
+	}
+
+	return groups
+}
@@ -0,0 +1,391 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/devgianlu/go-fileshare"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockLDAPEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// mockLDAP is a minimal LDAP server supporting simple binds, searches with and, or, not, equality
+// and presence filters, StartTLS and LDAPS.
+type mockLDAP struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	entries   []mockLDAPEntry
+	anonymous bool
+}
+
+const (
+	ldapTagBindRequest      = 0
+	ldapTagBindResponse     = 1
+	ldapTagUnbindRequest    = 2
+	ldapTagSearchRequest    = 3
+	ldapTagSearchEntry      = 4
+	ldapTagSearchDone       = 5
+	ldapTagExtendedRequest  = 23
+	ldapTagExtendedResponse = 24
+
+	ldapOIDStartTLS = "1.3.6.1.4.1.1466.20037"
+)
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1 and writes it to a file.
+func newTestCertificate(t *testing.T) (*tls.Config, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed creating certificate: %v", err)
+	}
+
+	certFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed writing certificate: %v", err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, certFile
+}
+
+func newMockLDAP(t *testing.T, tlsConfig *tls.Config, ldaps bool, entries []mockLDAPEntry) *mockLDAP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed listening: %v", err)
+	}
+
+	if ldaps {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	m := &mockLDAP{listener: listener, tlsConfig: tlsConfig, entries: entries}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go m.serve(conn)
+		}
+	}()
+
+	return m
+}
+
+func (m *mockLDAP) addr() string {
+	return m.listener.Addr().String()
+}
+
+func ldapResult(msgId int64, tag ber.Tag, code int) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgId, ""))
+
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	packet.AppendChild(op)
+	return packet
+}
+
+func ldapSearchEntry(msgId int64, entry mockLDAPEntry, attributes []string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgId, ""))
+
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapTagSearchEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, ""))
+
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range entry.attrs {
+		var requested bool
+		for _, attribute := range attributes {
+			requested = requested || strings.EqualFold(attribute, name)
+		}
+
+		if !requested {
+			continue
+		}
+
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+
+	op.AppendChild(attrs)
+	packet.AppendChild(op)
+	return packet
+}
+
+func (e *mockLDAPEntry) matches(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case 0: // and
+		for _, child := range filter.Children {
+			if !e.matches(child) {
+				return false
+			}
+		}
+
+		return true
+	case 1: // or
+		for _, child := range filter.Children {
+			if e.matches(child) {
+				return true
+			}
+		}
+
+		return false
+	case 2: // not
+		return !e.matches(filter.Children[0])
+	case 3: // equality
+		name, value := filter.Children[0].Data.String(), filter.Children[1].Data.String()
+		for attr, values := range e.attrs {
+			if !strings.EqualFold(attr, name) {
+				continue
+			}
+
+			for _, v := range values {
+				if strings.EqualFold(v, value) {
+					return true
+				}
+			}
+		}
+
+		return false
+	case 7: // present
+		name := filter.Data.String()
+		for attr := range e.attrs {
+			if strings.EqualFold(attr, name) {
+				return true
+			}
+		}
+
+		return strings.EqualFold(name, "objectClass")
+	default:
+		return false
+	}
+}
+
+func (m *mockLDAP) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	bound := m.anonymous
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		msgId, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldapTagBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+
+			code := 49 // invalid credentials
+			for _, entry := range m.entries {
+				if strings.EqualFold(entry.dn, dn) && len(password) > 0 && entry.password == password {
+					code = 0
+				}
+			}
+
+			bound = code == 0
+			_, _ = conn.Write(ldapResult(msgId, ldapTagBindResponse, code).Bytes())
+		case ldapTagUnbindRequest:
+			return
+		case ldapTagSearchRequest:
+			if !bound {
+				_, _ = conn.Write(ldapResult(msgId, ldapTagSearchDone, 50).Bytes()) // insufficient access rights
+				continue
+			}
+
+			baseDN, sizeLimit := strings.ToLower(op.Children[0].Data.String()), op.Children[3].Value.(int64)
+
+			var attributes []string
+			for _, attr := range op.Children[7].Children {
+				attributes = append(attributes, attr.Data.String())
+			}
+
+			var found int64
+			code := 0
+			for _, entry := range m.entries {
+				if !strings.HasSuffix(strings.ToLower(entry.dn), baseDN) || !entry.matches(op.Children[6]) {
+					continue
+				} else if sizeLimit > 0 && found == sizeLimit {
+					code = 4 // size limit exceeded
+					break
+				}
+
+				found++
+				_, _ = conn.Write(ldapSearchEntry(msgId, entry, attributes).Bytes())
+			}
+
+			_, _ = conn.Write(ldapResult(msgId, ldapTagSearchDone, code).Bytes())
+		case ldapTagExtendedRequest:
+			if op.Children[0].Data.String() != ldapOIDStartTLS || m.tlsConfig == nil {
+				_, _ = conn.Write(ldapResult(msgId, ldapTagExtendedResponse, 2).Bytes()) // protocol error
+				continue
+			}
+
+			_, _ = conn.Write(ldapResult(msgId, ldapTagExtendedResponse, 0).Bytes())
+
+			tlsConn := tls.Server(conn, m.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+
+			conn = tlsConn
+		default:
+			return
+		}
+	}
+}
+
+var testLDAPEntries = []mockLDAPEntry{
+	{dn: "cn=service,dc=example,dc=com", password: "service"},
+	{dn: "uid=pippo,ou=people,dc=example,dc=com", password: "pippo-pass", attrs: map[string][]string{
+		"objectClass": {"inetOrgPerson"},
+		"uid":         {"pippo"},
+		"memberOf":    {"CN=Staff,OU=Groups,DC=example,DC=com", "cn=other,ou=groups,dc=example,dc=com"},
+	}},
+	{dn: "uid=pluto,ou=people,dc=example,dc=com", password: "pluto-pass", attrs: map[string][]string{
+		"objectClass": {"inetOrgPerson"},
+		"uid":         {"pluto"},
+	}},
+	{dn: "cn=devs,ou=groups,dc=example,dc=com", attrs: map[string][]string{
+		"objectClass": {"groupOfNames"},
+		"member":      {"uid=pluto,ou=people,dc=example,dc=com"},
+	}},
+}
+
+var testLDAPGroups = map[string]fileshare.Group{
+	"staff": {ACL: []fileshare.PathACL{{Path: "/staff", Read: true}}},
+	"devs":  {ACL: []fileshare.PathACL{{Path: "/devs", Read: true, Write: true}}},
+}
+
+func TestLDAPAuthProvider_StartTLS(t *testing.T) {
+	tlsConfig, caCert := newTestCertificate(t)
+	server := newMockLDAP(t, tlsConfig, false, testLDAPEntries)
+
+	users := NewConfigUsersProvider(nil, testLDAPGroups)
+	provider, err := NewLDAPAuthProvider(fileshare.AuthLDAP{
+		URL:          "ldap://" + server.addr(),
+		StartTLS:     true,
+		CACert:       caCert,
+		BindDN:       "cn=service,dc=example,dc=com",
+		BindPassword: "service",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		Groups:       map[string][]string{"cn=staff,ou=groups,dc=example,dc=com": {"staff"}},
+	}, users)
+	if err != nil {
+		t.Fatalf("failed creating provider: %v", err)
+	}
+
+	if nickname, err := provider.Authenticate(PasswordAuthProviderPayload{Nickname: "pippo", Password: "pippo-pass"}); err != nil || nickname != "pippo" {
+		t.Fatalf("expected pippo, got %s: %v", nickname, err)
+	} else if user, _ := users.GetUser("pippo"); user == nil || len(user.Groups) != 1 || user.Groups[0] != "staff" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	for _, payload := range []PasswordAuthProviderPayload{
+		{Nickname: "pippo", Password: "wrong"},
+		{Nickname: "pippo", Password: ""},
+		{Nickname: "paperino", Password: "pippo-pass"},
+		{Nickname: "*", Password: "pippo-pass"},
+		{Nickname: "pippo)(uid=*", Password: "pippo-pass"},
+	} {
+		if _, err := provider.Authenticate(payload); err == nil {
+			t.Fatalf("expected error for %+v", payload)
+		}
+	}
+
+	// authenticated, but without groups and not configured
+	if nickname, err := provider.Authenticate(PasswordAuthProviderPayload{Nickname: "pluto", Password: "pluto-pass"}); err != nil || nickname != "pluto" {
+		t.Fatalf("expected pluto, got %s: %v", nickname, err)
+	} else if user, _ := users.GetUser("pluto"); user != nil {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+}
+
+func TestLDAPAuthProvider_LDAPSGroupFilter(t *testing.T) {
+	tlsConfig, caCert := newTestCertificate(t)
+	server := newMockLDAP(t, tlsConfig, true, testLDAPEntries)
+	server.anonymous = true
+
+	users := NewConfigUsersProvider([]fileshare.User{{Nickname: "pluto", ACL: []fileshare.PathACL{{Path: "/pluto", Read: true}}}}, testLDAPGroups)
+	provider, err := NewLDAPAuthProvider(fileshare.AuthLDAP{
+		URL:         "ldaps://" + server.addr(),
+		CACert:      caCert,
+		BaseDN:      "dc=example,dc=com",
+		UserFilter:  "(&(objectClass=inetOrgPerson)(uid=%s))",
+		GroupFilter: "(&(objectClass=groupOfNames)(member=%s))",
+		Groups:      map[string][]string{"cn=devs,ou=groups,dc=example,dc=com": {"devs"}},
+	}, users)
+	if err != nil {
+		t.Fatalf("failed creating provider: %v", err)
+	}
+
+	if nickname, err := provider.Authenticate(PasswordAuthProviderPayload{Nickname: "pluto", Password: "pluto-pass"}); err != nil || nickname != "pluto" {
+		t.Fatalf("expected pluto, got %s: %v", nickname, err)
+	} else if user, _ := users.GetUser("pluto"); user == nil || len(user.Groups) != 1 || len(user.ACL) != 2 {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+}
+
+func TestLDAPAuthProvider_UntrustedCertificate(t *testing.T) {
+	tlsConfig, _ := newTestCertificate(t)
+	server := newMockLDAP(t, tlsConfig, false, testLDAPEntries)
+
+	provider, err := NewLDAPAuthProvider(fileshare.AuthLDAP{
+		URL:          "ldap://" + server.addr(),
+		StartTLS:     true,
+		BindDN:       "cn=service,dc=example,dc=com",
+		BindPassword: "service",
+		BaseDN:       "dc=example,dc=com",
+	}, NewConfigUsersProvider(nil, nil))
+	if err != nil {
+		t.Fatalf("failed creating provider: %v", err)
+	}
+
+	if _, err := provider.Authenticate(PasswordAuthProviderPayload{Nickname: "pippo", Password: "pippo-pass"}); err == nil {
+		t.Fatalf("expected certificate error")
+	}
+}
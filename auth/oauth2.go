@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"golang.org/x/oauth2"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const AuthProviderTypeOAuth2 = "oauth2"
+
+const (
+	oauth2PresetGithub           = "github"
+	oauth2PresetGithubEnterprise = "github-enterprise"
+	oauth2PresetGitlab           = "gitlab"
+	oauth2PresetGitea            = "gitea"
+	oauth2PresetForgejo          = "forgejo"
+)
+
+type oauth2Preset struct {
+	baseURL     string
+	authURL     string
+	tokenURL    string
+	userInfoURL string
+	loginField  string
+	scopes      []string
+	github      bool
+	apiURL      string
+}
+
+// the URLs of the presets are relative to the base URL
+var oauth2Presets = map[string]oauth2Preset{
+	oauth2PresetGithub: {
+		baseURL:     "https://github.com",
+		authURL:     "/login/oauth/authorize",
+		tokenURL:    "/login/oauth/access_token",
+		userInfoURL: "https://api.github.com/user",
+		loginField:  "login",
+		scopes:      []string{}, // no scopes required, nickname is public info
+		github:      true,
+		apiURL:      "https://api.github.com",
+	},
+	oauth2PresetGithubEnterprise: {
+		authURL:     "/login/oauth/authorize",
+		tokenURL:    "/login/oauth/access_token",
+		userInfoURL: "/api/v3/user",
+		loginField:  "login",
+		scopes:      []string{},
+		github:      true,
+		apiURL:      "/api/v3",
+	},
+	oauth2PresetGitlab: {
+		baseURL:     "https://gitlab.com",
+		authURL:     "/oauth/authorize",
+		tokenURL:    "/oauth/token",
+		userInfoURL: "/api/v4/user",
+		loginField:  "username",
+		scopes:      []string{"read_user"},
+	},
+	oauth2PresetGitea: {
+		authURL:     "/login/oauth/authorize",
+		tokenURL:    "/login/oauth/access_token",
+		userInfoURL: "/api/v1/user",
+		loginField:  "login",
+		scopes:      []string{"read:user"},
+	},
+	oauth2PresetForgejo: {
+		authURL:     "/login/oauth/authorize",
+		tokenURL:    "/login/oauth/access_token",
+		userInfoURL: "/api/v1/user",
+		loginField:  "login",
+		scopes:      []string{"read:user"},
+	},
+}
+
+type oauth2AuthProvider struct {
+	cfg         *oauth2.Config
+	client      *http.Client
+	userInfoURL string
+	loginField  string
+	github      bool
+
+	apiURL      string
+	memberships []fileshare.OAuth2Membership
+	users       fileshare.ExternalUsersProvider
+}
+
+// NewOAuth2AuthProvider creates a provider that takes the nickname from the user info endpoint of
+// a generic OAuth2 server, the endpoints are configured directly or through a preset.
+func NewOAuth2AuthProvider(auth fileshare.AuthOAuth2, users fileshare.ExternalUsersProvider) (fileshare.AuthProvider, error) {
+	return newOAuth2AuthProvider(AuthProviderTypeOAuth2, auth, users)
+}
+
+func newOAuth2AuthProvider(providerType string, auth fileshare.AuthOAuth2, users fileshare.ExternalUsersProvider) (fileshare.AuthProvider, error) {
+	if len(auth.ClientID) == 0 || len(auth.ClientSecret) == 0 {
+		return nil, fmt.Errorf("invalid config")
+	}
+
+	var preset oauth2Preset
+	if len(auth.Preset) > 0 {
+		var ok bool
+		if preset, ok = oauth2Presets[auth.Preset]; !ok {
+			return nil, fmt.Errorf("unknown preset %s", auth.Preset)
+		}
+	}
+
+	baseURL := strings.TrimSuffix(auth.BaseURL, "/")
+	if len(baseURL) == 0 {
+		baseURL = preset.baseURL
+	}
+
+	// explicit URLs win over the preset, whose URLs are relative to the base
+	resolve := func(explicit string, relative string) (string, error) {
+		if len(explicit) > 0 {
+			return explicit, nil
+		} else if len(relative) == 0 {
+			return "", fmt.Errorf("missing url")
+		} else if !strings.HasPrefix(relative, "/") {
+			return relative, nil
+		} else if len(baseURL) == 0 {
+			return "", fmt.Errorf("missing base url for preset %s", auth.Preset)
+		}
+
+		return baseURL + relative, nil
+	}
+
+	authURL, err := resolve(auth.AuthURL, preset.authURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth url: %w", err)
+	}
+
+	tokenURL, err := resolve(auth.TokenURL, preset.tokenURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token url: %w", err)
+	}
+
+	p := oauth2AuthProvider{}
+	if p.userInfoURL, err = resolve(auth.UserInfoURL, preset.userInfoURL); err != nil {
+		return nil, fmt.Errorf("invalid user info url: %w", err)
+	}
+
+	p.loginField = auth.LoginField
+	if len(p.loginField) == 0 {
+		p.loginField = preset.loginField
+	}
+	if len(p.loginField) == 0 {
+		return nil, fmt.Errorf("missing login field")
+	}
+
+	scopes := auth.Scopes
+	if scopes == nil {
+		scopes = preset.scopes
+	}
+
+	if len(auth.Memberships) > 0 {
+		if !preset.github {
+			return nil, fmt.Errorf("memberships are supported only by the github presets")
+		} else if p.apiURL, err = resolve("", preset.apiURL); err != nil {
+			return nil, fmt.Errorf("invalid api url: %w", err)
+		}
+
+		for _, membership := range auth.Memberships {
+			if len(membership.Org) == 0 || len(membership.Groups) == 0 {
+				return nil, fmt.Errorf("invalid membership for %s", membership.Org)
+			}
+		}
+
+		// private memberships are visible only with this scope
+		if !slices.Contains(scopes, "read:org") {
+			scopes = append(slices.Clone(scopes), "read:org")
+		}
+
+		p.memberships = auth.Memberships
+		p.users = users
+	}
+
+	timeout := auth.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	p.github = preset.github
+	p.client = &http.Client{Timeout: timeout}
+	p.cfg = &oauth2.Config{
+		RedirectURL:  fmt.Sprintf("%s/login/%s/callback", auth.CallbackBaseURL, providerType),
+		ClientID:     auth.ClientID,
+		ClientSecret: auth.ClientSecret,
+		Scopes:       scopes,
+		Endpoint:     oauth2.Endpoint{AuthURL: authURL, TokenURL: tokenURL},
+	}
+
+	return &p, nil
+}
+
+func (p *oauth2AuthProvider) Callback(login fileshare.OAuth2Login) (string, error) {
+	url := p.cfg.AuthCodeURL(login.State, oauth2.S256ChallengeOption(login.Verifier))
+	return url, nil
+}
+
+func (p *oauth2AuthProvider) Authenticate(payload_ any) (string, error) {
+	payload, ok := payload_.(fileshare.OAuth2ProviderPayload)
+	if !ok {
+		panic("invalid payload type")
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, p.client)
+	token, err := p.cfg.Exchange(ctx, payload.Code, oauth2.VerifierOption(payload.Login.Verifier))
+	if err != nil {
+		return "", err
+	}
+
+	data, err := p.get(ctx, token, p.userInfoURL)
+	if err != nil {
+		return "", err
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal(data, &body); err != nil {
+		return "", err
+	}
+
+	login, ok := body[p.loginField].(string)
+	if !ok || len(login) == 0 {
+		return "", fmt.Errorf("missing %s in user info", p.loginField)
+	}
+
+	// memberships are refreshed at every login, users without any are known only if configured
+	if len(p.memberships) > 0 {
+		groups, err := p.githubGroups(ctx, token)
+		if err != nil {
+			return "", err
+		}
+
+		p.users.SetExternalGroups(login, groups)
+	}
+
+	return login, nil
+}
+
+// get calls the API of the provider with the token and returns the body.
+func (p *oauth2AuthProvider) get(ctx context.Context, token *oauth2.Token, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	token.SetAuthHeader(req)
+
+	if p.github {
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code from %s: %d", url, resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 10*1024*1024))
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewOAuth2Login generates the state, PKCE verifier and nonce for a new login attempt.
+func NewOAuth2Login() fileshare.OAuth2Login {
+	return fileshare.OAuth2Login{
+		State:    randomString(),
+		Verifier: oauth2.GenerateVerifier(),
+		Nonce:    randomString(),
+	}
+}
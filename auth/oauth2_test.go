@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/devgianlu/go-fileshare"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOAuth2AuthProvider_Presets(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         fileshare.AuthOAuth2
+		authURL     string
+		userInfoURL string
+		loginField  string
+	}{
+		{"github", fileshare.AuthOAuth2{Preset: "github"}, "https://github.com/login/oauth/authorize", "https://api.github.com/user", "login"},
+		{"github enterprise", fileshare.AuthOAuth2{Preset: "github-enterprise", BaseURL: "https://github.example.com/"}, "https://github.example.com/login/oauth/authorize", "https://github.example.com/api/v3/user", "login"},
+		{"gitlab", fileshare.AuthOAuth2{Preset: "gitlab"}, "https://gitlab.com/oauth/authorize", "https://gitlab.com/api/v4/user", "username"},
+		{"gitea", fileshare.AuthOAuth2{Preset: "gitea", BaseURL: "https://gitea.example.com"}, "https://gitea.example.com/login/oauth/authorize", "https://gitea.example.com/api/v1/user", "login"},
+		{"override", fileshare.AuthOAuth2{Preset: "gitea", BaseURL: "https://gitea.example.com", UserInfoURL: "https://other.example.com/me", LoginField: "name"}, "https://gitea.example.com/login/oauth/authorize", "https://other.example.com/me", "name"},
+		{"custom", fileshare.AuthOAuth2{AuthURL: "https://a.example.com/auth", TokenURL: "https://a.example.com/token", UserInfoURL: "https://a.example.com/user", LoginField: "sub"}, "https://a.example.com/auth", "https://a.example.com/user", "sub"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.cfg.ClientID, test.cfg.ClientSecret = "client", "secret"
+			provider, err := NewOAuth2AuthProvider(test.cfg, nil)
+			if err != nil {
+				t.Fatalf("failed creating provider: %v", err)
+			}
+
+			p := provider.(*oauth2AuthProvider)
+			if p.cfg.Endpoint.AuthURL != test.authURL || p.userInfoURL != test.userInfoURL || p.loginField != test.loginField {
+				t.Fatalf("unexpected endpoints: %s %s %s", p.cfg.Endpoint.AuthURL, p.userInfoURL, p.loginField)
+			}
+		})
+	}
+
+	for _, cfg := range []fileshare.AuthOAuth2{
+		{Preset: "unknown"},
+		{Preset: "gitea"},                          // missing base url
+		{AuthURL: "https://a.example.com/auth"},    // missing other urls
+		{Preset: "github-enterprise", BaseURL: ""}, // missing base url
+	} {
+		cfg.ClientID, cfg.ClientSecret = "client", "secret"
+		if _, err := NewOAuth2AuthProvider(cfg, nil); err == nil {
+			t.Fatalf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestOAuth2AuthProvider_Authenticate(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code" || len(r.FormValue("code_verifier")) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "token_type": "bearer"})
+	})
+	mux.HandleFunc("/api/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{"id": 1, "login": "pippo"})
+	})
+	mux.HandleFunc("/api/v1/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	provider, err := NewOAuth2AuthProvider(fileshare.AuthOAuth2{Preset: "forgejo", BaseURL: server.URL, ClientID: "client", ClientSecret: "secret"}, nil)
+	if err != nil {
+		t.Fatalf("failed creating provider: %v", err)
+	}
+
+	login := NewOAuth2Login()
+	callback, _ := provider.(fileshare.OAuth2AuthProvider).Callback(login)
+	if callbackUrl, err := url.Parse(callback); err != nil || callbackUrl.Query().Get("state") != login.State || callbackUrl.Query().Get("code_challenge") == "" {
+		t.Fatalf("unexpected callback url: %s", callback)
+	}
+
+	if nickname, err := provider.Authenticate(fileshare.OAuth2ProviderPayload{Code: "code", Login: login}); err != nil || nickname != "pippo" {
+		t.Fatalf("expected pippo, got %s: %v", nickname, err)
+	} else if _, err := provider.Authenticate(fileshare.OAuth2ProviderPayload{Code: "wrong", Login: login}); err == nil {
+		t.Fatalf("expected error for wrong code")
+	}
+
+	provider, err = NewOAuth2AuthProvider(fileshare.AuthOAuth2{Preset: "forgejo", BaseURL: server.URL, UserInfoURL: server.URL + "/api/v1/slow", ClientID: "client", ClientSecret: "secret", Timeout: 100 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatalf("failed creating provider: %v", err)
+	} else if _, err := provider.Authenticate(fileshare.OAuth2ProviderPayload{Code: "code", Login: login}); err == nil {
+		t.Fatalf("expected timeout")
+	}
+}
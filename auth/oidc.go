@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const AuthProviderTypeOIDC = "oidc"
+
+// oidcKeysRefreshInterval limits how often the keys are fetched again when a token is signed with an unknown key.
+const oidcKeysRefreshInterval = time.Minute
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type oidcAuthProvider struct {
+	cfg           *oauth2.Config
+	client        *http.Client
+	issuer        string
+	jwksURI       string
+	nicknameClaim string
+	parser        *jwt.Parser
+
+	keysLock    sync.Mutex
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// NewOIDCAuthProvider creates an OpenID Connect provider, the endpoints are discovered from the issuer.
+func NewOIDCAuthProvider(auth fileshare.AuthOIDC) (fileshare.AuthProvider, error) {
+	if len(auth.IssuerURL) == 0 || len(auth.ClientID) == 0 {
+		return nil, fmt.Errorf("invalid config")
+	}
+
+	p := oidcAuthProvider{}
+	p.client = &http.Client{Timeout: 10 * time.Second}
+	p.keys = map[string]crypto.PublicKey{}
+
+	p.nicknameClaim = auth.NicknameClaim
+	if len(p.nicknameClaim) == 0 {
+		p.nicknameClaim = "preferred_username"
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(context.Background(), strings.TrimSuffix(auth.IssuerURL, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("failed discovering issuer: %w", err)
+	} else if discovery.Issuer != auth.IssuerURL {
+		return nil, fmt.Errorf("issuer mismatch: %s", discovery.Issuer)
+	} else if len(discovery.AuthorizationEndpoint) == 0 || len(discovery.TokenEndpoint) == 0 || len(discovery.JwksURI) == 0 {
+		return nil, fmt.Errorf("incomplete discovery document")
+	}
+
+	p.issuer = discovery.Issuer
+	p.jwksURI = discovery.JwksURI
+	p.parser = jwt.NewParser(
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(auth.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+	)
+
+	scopes := []string{"openid"}
+	for _, scope := range auth.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	p.cfg = &oauth2.Config{
+		RedirectURL:  fmt.Sprintf("%s/login/%s/callback", auth.CallbackBaseURL, AuthProviderTypeOIDC),
+		ClientID:     auth.ClientID,
+		ClientSecret: auth.ClientSecret,
+		Scopes:       scopes,
+		Endpoint:     oauth2.Endpoint{AuthURL: discovery.AuthorizationEndpoint, TokenURL: discovery.TokenEndpoint},
+	}
+
+	return &p, nil
+}
+
+func (p *oidcAuthProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status code from %s: %d", url, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *oidcAuthProvider) Callback(login fileshare.OAuth2Login) (string, error) {
+	return p.cfg.AuthCodeURL(login.State, oauth2.S256ChallengeOption(login.Verifier), oauth2.SetAuthURLParam("nonce", login.Nonce)), nil
+}
+
+func (p *oidcAuthProvider) Authenticate(payload_ any) (string, error) {
+	payload, ok := payload_.(fileshare.OAuth2ProviderPayload)
+	if !ok {
+		panic("invalid payload type")
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, p.client)
+	token, err := p.cfg.Exchange(ctx, payload.Code, oauth2.VerifierOption(payload.Login.Verifier))
+	if err != nil {
+		return "", err
+	}
+
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok || len(idToken) == 0 {
+		return "", fmt.Errorf("missing id token")
+	}
+
+	return p.verify(ctx, idToken, payload.Login.Nonce)
+}
+
+// verify validates the ID token and returns the nickname claim.
+func (p *oidcAuthProvider) verify(ctx context.Context, idToken string, nonce string) (string, error) {
+	var claims jwt.MapClaims
+	if _, err := p.parser.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.getKey(ctx, kid)
+	}); err != nil {
+		return "", fmt.Errorf("invalid id token: %w", err)
+	}
+
+	if claims["nonce"] != nonce {
+		return "", fmt.Errorf("invalid id token nonce")
+	}
+
+	// the authorized party must be us if there are other audiences
+	if aud, err := claims.GetAudience(); err != nil {
+		return "", err
+	} else if len(aud) > 1 && claims["azp"] != p.cfg.ClientID {
+		return "", fmt.Errorf("invalid id token authorized party")
+	}
+
+	nickname, ok := claims[p.nicknameClaim].(string)
+	if !ok || len(nickname) == 0 {
+		return "", fmt.Errorf("missing %s claim in id token", p.nicknameClaim)
+	}
+
+	return nickname, nil
+}
+
+// getKey returns the signing key with the given id, the keys are fetched again if it is unknown.
+func (p *oidcAuthProvider) getKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.keysLock.Lock()
+	defer p.keysLock.Unlock()
+
+	if key := p.findKey(kid); key != nil {
+		return key, nil
+	} else if time.Since(p.keysFetched) < oidcKeysRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed fetching signing keys: %w", err)
+	}
+
+	p.keysFetched = time.Now()
+	p.keys = map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		// unsupported keys are skipped
+		if key, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = key
+		}
+	}
+
+	if key := p.findKey(kid); key != nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key %s", kid)
+}
+
+func (p *oidcAuthProvider) findKey(kid string) crypto.PublicKey {
+	if key, ok := p.keys[kid]; ok {
+		return key
+	}
+
+	// a token without key id can only be signed by the only key
+	if len(kid) == 0 && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		} else if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid rsa exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		} else if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid ec point")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
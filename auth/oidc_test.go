@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mockIdP is a minimal OpenID Connect provider, it returns the ID token that the test set for the code.
+type mockIdP struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	tokens   map[string]string
+	verifier string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating key: %v", err)
+	}
+
+	idp := &mockIdP{key: key, tokens: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "client" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		idToken, ok := idp.tokens[r.FormValue("code")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		idp.verifier = r.FormValue("code_verifier")
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "token_type": "Bearer", "id_token": idToken})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) sign(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed signing token: %v", err)
+	}
+
+	return signed
+}
+
+func TestOIDCAuthProvider(t *testing.T) {
+	idp := newMockIdP(t)
+
+	provider, err := NewOIDCAuthProvider(fileshare.AuthOIDC{
+		CallbackBaseURL: "http://localhost",
+		IssuerURL:       idp.server.URL,
+		ClientID:        "client",
+		ClientSecret:    "secret",
+		NicknameClaim:   "nickname",
+	})
+	if err != nil {
+		t.Fatalf("failed creating provider: %v", err)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating key: %v", err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		claims func(nonce string) jwt.MapClaims
+		ok     bool
+	}{
+		{"valid", idp.key, func(nonce string) jwt.MapClaims {
+			return jwt.MapClaims{"iss": idp.server.URL, "aud": "client", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "nonce": nonce, "nickname": "pippo"}
+		}, true},
+		{"wrong signature", otherKey, func(nonce string) jwt.MapClaims {
+			return jwt.MapClaims{"iss": idp.server.URL, "aud": "client", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "nonce": nonce, "nickname": "pippo"}
+		}, false},
+		{"wrong issuer", idp.key, func(nonce string) jwt.MapClaims {
+			return jwt.MapClaims{"iss": "http://evil", "aud": "client", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "nonce": nonce, "nickname": "pippo"}
+		}, false},
+		{"wrong audience", idp.key, func(nonce string) jwt.MapClaims {
+			return jwt.MapClaims{"iss": idp.server.URL, "aud": "other", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "nonce": nonce, "nickname": "pippo"}
+		}, false},
+		{"wrong authorized party", idp.key, func(nonce string) jwt.MapClaims {
+			return jwt.MapClaims{"iss": idp.server.URL, "aud": []string{"client", "other"}, "azp": "other", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "nonce": nonce, "nickname": "pippo"}
+		}, false},
+		{"wrong nonce", idp.key, func(nonce string) jwt.MapClaims {
+			return jwt.MapClaims{"iss": idp.server.URL, "aud": "client", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "nonce": "other", "nickname": "pippo"}
+		}, false},
+		{"expired", idp.key, func(nonce string) jwt.MapClaims {
+			return jwt.MapClaims{"iss": idp.server.URL, "aud": "client", "iat": now.Add(-2 * time.Hour).Unix(), "exp": now.Add(-time.Hour).Unix(), "nonce": nonce, "nickname": "pippo"}
+		}, false},
+		{"missing nickname", idp.key, func(nonce string) jwt.MapClaims {
+			return jwt.MapClaims{"iss": idp.server.URL, "aud": "client", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "nonce": nonce}
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			login := NewOAuth2Login()
+			callback, err := provider.(fileshare.OAuth2AuthProvider).Callback(login)
+			if err != nil {
+				t.Fatalf("failed getting callback: %v", err)
+			}
+
+			callbackUrl, err := url.Parse(callback)
+			if err != nil {
+				t.Fatalf("invalid callback url: %v", err)
+			}
+
+			query := callbackUrl.Query()
+			if query.Get("redirect_uri") != "http://localhost/login/oidc/callback" || query.Get("scope") != "openid" || query.Get("state") != login.State || query.Get("nonce") != login.Nonce {
+				t.Fatalf("unexpected callback url: %s", callback)
+			}
+
+			idp.tokens[test.name] = idp.sign(t, test.key, test.claims(login.Nonce))
+
+			nickname, err := provider.Authenticate(fileshare.OAuth2ProviderPayload{Code: test.name, Login: login})
+			if test.ok && (err != nil || nickname != "pippo") {
+				t.Fatalf("expected pippo, got %s: %v", nickname, err)
+			} else if !test.ok && err == nil {
+				t.Fatalf("expected error, got %s", nickname)
+			}
+		})
+	}
+}
+
+func TestOIDCAuthProvider_PKCE(t *testing.T) {
+	idp := newMockIdP(t)
+
+	provider, err := NewOIDCAuthProvider(fileshare.AuthOIDC{IssuerURL: idp.server.URL, ClientID: "client", ClientSecret: "secret"})
+	if err != nil {
+		t.Fatalf("failed creating provider: %v", err)
+	}
+
+	login := NewOAuth2Login()
+	callback, _ := provider.(fileshare.OAuth2AuthProvider).Callback(login)
+	callbackUrl, _ := url.Parse(callback)
+	query := callbackUrl.Query()
+
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") != oauth2.S256ChallengeFromVerifier(login.Verifier) {
+		t.Fatalf("missing code challenge: %s", callback)
+	}
+
+	now := time.Now()
+	idp.tokens["code"] = idp.sign(t, idp.key, jwt.MapClaims{"iss": idp.server.URL, "aud": "client", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "nonce": login.Nonce, "preferred_username": "pippo"})
+
+	if nickname, err := provider.Authenticate(fileshare.OAuth2ProviderPayload{Code: "code", Login: login}); err != nil || nickname != "pippo" {
+		t.Fatalf("expected pippo, got %s: %v", nickname, err)
+	} else if idp.verifier != login.Verifier {
+		t.Fatalf("unexpected code verifier: %s", idp.verifier)
+	}
+}
+
+func TestNewOIDCAuthProvider_IssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+
+	if _, err := NewOIDCAuthProvider(fileshare.AuthOIDC{IssuerURL: idp.server.URL + "/", ClientID: "client"}); err == nil {
+		t.Fatalf("expected issuer mismatch")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/devgianlu/go-fileshare"
 	"golang.org/x/crypto/bcrypt"
+	"sort"
 )
 
 const AuthProviderTypePassword = "passwd"
@@ -65,3 +66,28 @@ func (p *passwordAuthProvider) Authenticate(payload_ any) (string, error) {
 
 	return "", fmt.Errorf("user %s not found", payload.Nickname)
 }
+
+// AuthenticatePassword checks the credentials against all the providers that accept a nickname and
+// password, for protocols that cannot go through the login page.
+func AuthenticatePassword(providers map[string]fileshare.AuthProvider, nickname string, password string) (string, error) {
+	keys := make([]string, 0, len(providers))
+	for key := range providers {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	err := fmt.Errorf("no password auth provider")
+	for _, key := range keys {
+		if _, ok := providers[key].(fileshare.OAuth2AuthProvider); ok {
+			continue
+		}
+
+		var authenticated string
+		if authenticated, err = providers[key].Authenticate(PasswordAuthProviderPayload{Nickname: nickname, Password: password}); err == nil {
+			return authenticated, nil
+		}
+	}
+
+	return "", err
+}
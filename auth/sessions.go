@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// refreshReuseGrace is how long the previous refresh token of a session is rejected without revoking
+// the session, for concurrent requests refreshing at the same time.
+const refreshReuseGrace = 30 * time.Second
+
+type storedSession struct {
+	fileshare.Session
+
+	RefreshHash  string    `json:"refresh_hash"`
+	PreviousHash string    `json:"previous_hash,omitempty"`
+	UsedHashes   []string  `json:"used_hashes,omitempty"`
+	RotatedAt    time.Time `json:"rotated_at"`
+}
+
+type sessionStore struct {
+	path string
+
+	lock     sync.Mutex
+	sessions map[string]*storedSession
+	// refresh maps current and used refresh token hashes to their session
+	refresh map[string]string
+}
+
+// NewSessionStore keeps the sessions in a JSON file at path, or only in memory if empty.
+func NewSessionStore(path string) (fileshare.SessionStore, error) {
+	s := &sessionStore{path: path, sessions: map[string]*storedSession{}, refresh: map[string]string{}}
+	if len(path) == 0 {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sessions []*storedSession
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("invalid sessions file %s: %w", path, err)
+	}
+
+	for _, session := range sessions {
+		s.add(session)
+	}
+
+	return s, nil
+}
+
+// add indexes the session, the lock must be held.
+func (s *sessionStore) add(session *storedSession) {
+	s.sessions[session.ID] = session
+	s.refresh[session.RefreshHash] = session.ID
+	if len(session.PreviousHash) > 0 {
+		s.refresh[session.PreviousHash] = session.ID
+	}
+	for _, hash := range session.UsedHashes {
+		s.refresh[hash] = session.ID
+	}
+}
+
+// remove forgets the session and its refresh tokens, the lock must be held.
+func (s *sessionStore) remove(session *storedSession) {
+	delete(s.sessions, session.ID)
+	delete(s.refresh, session.RefreshHash)
+	delete(s.refresh, session.PreviousHash)
+	for _, hash := range session.UsedHashes {
+		delete(s.refresh, hash)
+	}
+}
+
+// save removes the expired sessions and writes the others to the file, the lock must be held.
+func (s *sessionStore) save() error {
+	now := time.Now()
+
+	sessions := make([]*storedSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			s.remove(session)
+			continue
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *sessionStore) Create(session fileshare.Session, refreshHash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.sessions[session.ID]; ok {
+		return fmt.Errorf("duplicate session %s", session.ID)
+	}
+
+	stored := &storedSession{Session: session, RefreshHash: refreshHash, RotatedAt: session.CreatedAt}
+	s.add(stored)
+	if err := s.save(); err != nil {
+		s.remove(stored)
+		return err
+	}
+
+	return nil
+}
+
+func (s *sessionStore) Get(id string) (*fileshare.Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return nil, nil
+	}
+
+	sessionCopy := session.Session
+	return &sessionCopy, nil
+}
+
+func (s *sessionStore) Rotate(refreshHash string, newRefreshHash string) (*fileshare.Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id, ok := s.refresh[refreshHash]
+	if !ok {
+		return nil, fileshare.NewError("", fileshare.ErrAuthInvalid, fmt.Errorf("unknown refresh token"))
+	}
+
+	session := s.sessions[id]
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
+		return nil, fileshare.NewError("", fileshare.ErrAuthInvalid, fmt.Errorf("session %s of %s has expired", session.ID, session.User))
+	} else if refreshHash == session.PreviousHash && now.Sub(session.RotatedAt) < refreshReuseGrace {
+		return nil, fileshare.NewError("", fileshare.ErrAuthSuperseded, fmt.Errorf("refresh token of session %s was just replaced", session.ID))
+	} else if refreshHash != session.RefreshHash {
+		s.remove(session)
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+
+		return nil, fileshare.NewError("", fileshare.ErrAuthInvalid, fmt.Errorf("reused refresh token, revoked session %s of %s", session.ID, session.User))
+	}
+
+	if len(session.PreviousHash) > 0 {
+		session.UsedHashes = append(session.UsedHashes, session.PreviousHash)
+	}
+
+	session.PreviousHash, session.RefreshHash = session.RefreshHash, newRefreshHash
+	session.RotatedAt, session.RefreshedAt = now, now.UTC()
+	s.refresh[newRefreshHash] = session.ID
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+
+	sessionCopy := session.Session
+	return &sessionCopy, nil
+}
+
+func (s *sessionStore) List(user string) ([]fileshare.Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	var sessions []fileshare.Session
+	for _, session := range s.sessions {
+		if (len(user) == 0 || session.User == user) && !now.After(session.ExpiresAt) {
+			sessions = append(sessions, session.Session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+
+	return sessions, nil
+}
+
+func (s *sessionStore) Revoke(user string, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.User != user {
+		return fileshare.NewError("session not found", fs.ErrNotExist)
+	}
+
+	s.remove(session)
+	return s.save()
+}
+
+func (s *sessionStore) RevokeUser(user string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var count int
+	for _, session := range s.sessions {
+		if session.User == user {
+			s.remove(session)
+			count++
+		}
+	}
+
+	return count, s.save()
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	sessions, err := NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("failed creating store: %v", err)
+	}
+
+	provider, err := NewJsonWebTokenProvider([]byte("secret"), sessions, fileshare.Sessions{})
+	if err != nil {
+		t.Fatalf("failed creating provider: %v", err)
+	}
+
+	tokens, err := provider.NewSession("pippo", "127.0.0.1", "curl")
+	if err != nil {
+		t.Fatalf("failed creating session: %v", err)
+	} else if time.Until(tokens.AccessTokenExpiresAt) > defaultAccessTokenExpiry || time.Until(tokens.Session.ExpiresAt) < defaultSessionExpiry-time.Minute {
+		t.Fatalf("unexpected expiry: %+v", tokens)
+	}
+
+	if nickname, err := provider.GetUser(tokens.AccessToken); err != nil || nickname != "pippo" {
+		t.Fatalf("expected pippo, got %s: %v", nickname, err)
+	} else if id, err := provider.GetSession(tokens.AccessToken); err != nil || id != tokens.Session.ID {
+		t.Fatalf("expected session %s, got %s: %v", tokens.Session.ID, id, err)
+	}
+
+	// the refresh token can be used once
+	refreshed, err := provider.Refresh(tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("failed refreshing: %v", err)
+	} else if refreshed.Session.ID != tokens.Session.ID || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("unexpected tokens: %+v", refreshed)
+	}
+
+	// a concurrent request with the previous token does not revoke the session
+	if _, err := provider.Refresh(tokens.RefreshToken); !errors.Is(err, fileshare.ErrAuthSuperseded) {
+		t.Fatalf("expected superseded refresh token: %v", err)
+	} else if _, err := provider.GetUser(refreshed.AccessToken); err != nil {
+		t.Fatalf("expected session to be active: %v", err)
+	}
+
+	refreshed2, err := provider.Refresh(refreshed.RefreshToken)
+	if err != nil {
+		t.Fatalf("failed refreshing: %v", err)
+	}
+
+	// sessions survive restarts
+	sessions, err = NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("failed loading store: %v", err)
+	}
+
+	provider, _ = NewJsonWebTokenProvider([]byte("secret"), sessions, fileshare.Sessions{})
+	if nickname, err := provider.GetUser(refreshed2.AccessToken); err != nil || nickname != "pippo" {
+		t.Fatalf("expected pippo, got %s: %v", nickname, err)
+	}
+
+	// reusing an old refresh token means it was stolen
+	if _, err := provider.Refresh(tokens.RefreshToken); !errors.Is(err, fileshare.ErrAuthInvalid) {
+		t.Fatalf("expected invalid refresh token: %v", err)
+	} else if _, err := provider.GetUser(refreshed2.AccessToken); !errors.Is(err, fileshare.ErrAuthInvalid) {
+		t.Fatalf("expected revoked session: %v", err)
+	} else if _, err := provider.Refresh(refreshed2.RefreshToken); !errors.Is(err, fileshare.ErrAuthInvalid) {
+		t.Fatalf("expected revoked session: %v", err)
+	}
+}
+
+func TestSessionTokens_Revoke(t *testing.T) {
+	sessions, _ := NewSessionStore("")
+	provider, err := NewJsonWebTokenProvider([]byte("secret"), sessions, fileshare.Sessions{AccessTokenExpiry: time.Hour, Expiry: 30 * time.Minute})
+	if err != nil {
+		t.Fatalf("failed creating provider: %v", err)
+	}
+
+	first, _ := provider.NewSession("pippo", "", "")
+	second, _ := provider.NewSession("pippo", "", "")
+	other, _ := provider.NewSession("pluto", "", "")
+
+	// access tokens do not outlive their session
+	if !first.AccessTokenExpiresAt.Equal(first.Session.ExpiresAt) {
+		t.Fatalf("unexpected access token expiry: %v", first.AccessTokenExpiresAt)
+	}
+
+	if list, _ := sessions.List("pippo"); len(list) != 2 {
+		t.Fatalf("unexpected sessions: %+v", list)
+	} else if list, _ := sessions.List(""); len(list) != 3 {
+		t.Fatalf("unexpected sessions: %+v", list)
+	}
+
+	if err := sessions.Revoke("pluto", first.Session.ID); err == nil {
+		t.Fatalf("expected error revoking session of another user")
+	} else if err := sessions.Revoke("pippo", first.Session.ID); err != nil {
+		t.Fatalf("failed revoking: %v", err)
+	} else if _, err := provider.GetUser(first.AccessToken); !errors.Is(err, fileshare.ErrAuthInvalid) {
+		t.Fatalf("expected revoked session: %v", err)
+	} else if _, err := provider.GetUser(second.AccessToken); err != nil {
+		t.Fatalf("expected active session: %v", err)
+	}
+
+	if count, err := sessions.RevokeUser("pippo"); err != nil || count != 1 {
+		t.Fatalf("expected 1 revoked session, got %d: %v", count, err)
+	} else if _, err := provider.GetUser(second.AccessToken); !errors.Is(err, fileshare.ErrAuthInvalid) {
+		t.Fatalf("expected revoked session: %v", err)
+	} else if _, err := provider.GetUser(other.AccessToken); err != nil {
+		t.Fatalf("expected active session: %v", err)
+	}
+}
@@ -2,22 +2,86 @@ package auth
 
 import (
 	"github.com/devgianlu/go-fileshare"
+	"slices"
+	"sync"
 )
 
 type configUsersProvider struct {
-	users []fileshare.User
+	users  []fileshare.User
+	groups map[string]fileshare.Group
+
+	externalLock sync.RWMutex
+	external     map[string][]string
 }
 
-func NewConfigUsersProvider(users []fileshare.User) fileshare.UsersProvider {
-	return &configUsersProvider{users}
+func NewConfigUsersProvider(users []fileshare.User, groups map[string]fileshare.Group) fileshare.ExternalUsersProvider {
+	return &configUsersProvider{users: users, groups: groups, external: map[string][]string{}}
 }
 
 func (p *configUsersProvider) GetUser(nickname string) (*fileshare.User, error) {
+	p.externalLock.RLock()
+	external, externalOk := p.external[nickname]
+	p.externalLock.RUnlock()
+
 	for _, user := range p.users {
 		if user.Nickname == nickname {
-			return &user, nil
+			return p.withGroups(user, external), nil
 		}
 	}
 
+	if externalOk {
+		return p.withGroups(fileshare.User{Nickname: nickname}, external), nil
+	}
+
 	return nil, nil
 }
+
+func (p *configUsersProvider) SetExternalGroups(nickname string, groups []string) {
+	p.externalLock.Lock()
+	defer p.externalLock.Unlock()
+
+	if len(groups) == 0 {
+		delete(p.external, nickname)
+	} else {
+		p.external[nickname] = groups
+	}
+}
+
+// withGroups returns a copy of the user with the permissions of its groups added, rules for the
+// same path are merged.
+func (p *configUsersProvider) withGroups(user fileshare.User, external []string) *fileshare.User {
+	names := append(append([]string{}, user.Groups...), external...)
+	if len(names) == 0 {
+		return &user
+	}
+
+	acl := append([]fileshare.PathACL{}, user.ACL...)
+	addACL := func(item fileshare.PathACL) {
+		for i := range acl {
+			if acl[i].Path == item.Path {
+				acl[i].Read = acl[i].Read || item.Read
+				acl[i].Write = acl[i].Write || item.Write
+				return
+			}
+		}
+
+		acl = append(acl, item)
+	}
+
+	user.Groups = nil
+	for _, name := range names {
+		group, ok := p.groups[name]
+		if !ok || slices.Contains(user.Groups, name) {
+			continue
+		}
+
+		user.Groups = append(user.Groups, name)
+		user.Admin = user.Admin || group.Admin
+		for _, item := range group.ACL {
+			addACL(item)
+		}
+	}
+
+	user.ACL = acl
+	return &user
+}
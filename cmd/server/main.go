@@ -1,29 +1,64 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/audit"
 	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/dav"
 	"github.com/devgianlu/go-fileshare/http"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"github.com/devgianlu/go-fileshare/s3"
+	"github.com/devgianlu/go-fileshare/sftpd"
 	"github.com/devgianlu/go-fileshare/storage"
+	"github.com/devgianlu/go-fileshare/tracing"
+	"github.com/devgianlu/go-fileshare/webhooks"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// defaultShutdownTimeout is how long active transfers are waited for when shutting down.
+const defaultShutdownTimeout = 30 * time.Second
+
 type Config struct {
 	Port     int    `yaml:"port"`
 	Secret   string `yaml:"secret"`
 	Path     string `yaml:"path"`
+	Storage  string `yaml:"storage"`
+	Symlinks string `yaml:"symlinks"`
 	LogLevel string `yaml:"log_level"`
 
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
 	AnonymousAccess bool `yaml:"anonymous_access"`
 
+	Encryption *fileshare.StorageEncryption `yaml:"encryption"`
+	Checksums  *fileshare.StorageChecksums  `yaml:"checksums"`
+	Versions   *fileshare.StorageVersions   `yaml:"versions"`
+	Trash      *fileshare.StorageTrash      `yaml:"trash"`
+
+	Webhooks  []fileshare.Webhook  `yaml:"webhooks"`
+	Audit     *fileshare.Audit     `yaml:"audit"`
+	Sessions  fileshare.Sessions   `yaml:"sessions"`
+	APITokens *fileshare.APITokens `yaml:"api_tokens"`
+	Metrics   *fileshare.Metrics   `yaml:"metrics"`
+	Tracing   *fileshare.Tracing   `yaml:"tracing"`
+	WebDAV    *fileshare.WebDAV    `yaml:"webdav"`
+	SFTP      *fileshare.SFTP      `yaml:"sftp"`
+	S3        *fileshare.S3        `yaml:"s3"`
+
 	DefaultACL []fileshare.PathACL `yaml:"default_acl"`
 
-	Users []fileshare.User     `yaml:"users"`
-	Auths map[string]yaml.Node `yaml:"auths"`
+	Users  []fileshare.User           `yaml:"users"`
+	Groups map[string]fileshare.Group `yaml:"groups"`
+	Auths  map[string]yaml.Node       `yaml:"auths"`
 }
 
 func loadConfig() (*Config, error) {
@@ -75,6 +110,13 @@ func validateConfig(cfg *Config) {
 		log.WithField("module", "config").WithError(err).Fatal("invalid default ACL")
 	}
 
+	// check groups ACL
+	for name, group := range cfg.Groups {
+		if err := checkAcl(group.ACL); err != nil {
+			log.WithField("module", "config").WithError(err).Fatalf("invalid ACL for group %s", name)
+		}
+	}
+
 	var anonymousOk bool
 	for i, user := range cfg.Users {
 		// check no duplicates
@@ -96,6 +138,13 @@ func validateConfig(cfg *Config) {
 			log.WithField("module", "config").WithError(err).Fatalf("invalid ACL for %s", user.Nickname)
 		}
 
+		// check user groups exist
+		for _, group := range user.Groups {
+			if _, ok := cfg.Groups[group]; !ok {
+				log.WithField("module", "config").Fatalf("unknown group %s for %s", group, user.Nickname)
+			}
+		}
+
 		// check if user is anonymous
 		if user.Anonymous() {
 			if cfg.AnonymousAccess {
@@ -110,14 +159,50 @@ func validateConfig(cfg *Config) {
 	if cfg.AnonymousAccess && !anonymousOk {
 		log.WithField("module", "config").Fatal("missing anonymous user")
 	}
+
+	// check WebDAV has its own address
+	if cfg.WebDAV != nil && len(cfg.WebDAV.Listen) == 0 {
+		log.WithField("module", "config").Fatal("missing WebDAV listen address")
+	}
+
+	// check SFTP has its own address and a host key
+	if cfg.SFTP != nil && (len(cfg.SFTP.Listen) == 0 || len(cfg.SFTP.HostKey) == 0) {
+		log.WithField("module", "config").Fatal("missing SFTP listen address or host key")
+	}
+
+	// check API tokens have a file
+	if cfg.APITokens != nil && len(cfg.APITokens.File) == 0 {
+		log.WithField("module", "config").Fatal("missing API tokens file")
+	}
+
+	// check S3 has its own address
+	if cfg.S3 != nil && len(cfg.S3.Listen) == 0 {
+		log.WithField("module", "config").Fatal("missing S3 listen address")
+	}
+}
+
+// validateGroups checks the groups given by an auth provider exist.
+func validateGroups(cfg *Config, groups []string, source string) {
+	for _, group := range groups {
+		if _, ok := cfg.Groups[group]; !ok {
+			log.WithField("module", "config").Fatalf("unknown group %s for %s", group, source)
+		}
+	}
 }
 
 type Server struct {
-	Storage fileshare.AuthenticatedStorageProvider
-	Auth    map[string]fileshare.AuthProvider
-	Users   fileshare.UsersProvider
-	Tokens  fileshare.TokenProvider
-	HTTP    fileshare.HttpServer
+	Storage   fileshare.AuthenticatedStorageProvider
+	Auth      map[string]fileshare.AuthProvider
+	Users     fileshare.ExternalUsersProvider
+	Tokens    fileshare.TokenProvider
+	Sessions  fileshare.SessionStore
+	APITokens fileshare.APITokenStore
+	Webhooks  fileshare.WebhookDispatcher
+	Audit     fileshare.AuditLog
+	HTTP      fileshare.HttpServer
+	WebDAV    fileshare.HttpServer
+	SFTP      fileshare.HttpServer
+	S3        fileshare.HttpServer
 }
 
 func main() {
@@ -134,19 +219,41 @@ func main() {
 	}
 	log.SetLevel(logLevel)
 
+	// optionally export traces
+	if cfg.Tracing != nil {
+		shutdown, err := tracing.Setup(*cfg.Tracing)
+		if err != nil {
+			log.WithError(err).WithField("module", "tracing").Fatalf("failed setting up tracing")
+		}
+
+		defer func() { _ = shutdown(context.Background()) }()
+	}
+
 	// validate config and log errors/warnings
 	validateConfig(cfg)
 
 	s := Server{}
 
 	// setup users provider
-	s.Users = auth.NewConfigUsersProvider(cfg.Users)
+	s.Users = auth.NewConfigUsersProvider(cfg.Users, cfg.Groups)
+
+	// setup sessions, checked for every token
+	if s.Sessions, err = auth.NewSessionStore(cfg.Sessions.File); err != nil {
+		log.WithError(err).WithField("module", "auth").Fatalf("failed loading sessions")
+	}
 
 	// setup tokens with JWT
-	if s.Tokens, err = auth.NewJsonWebTokenProvider([]byte(cfg.Secret)); err != nil {
+	if s.Tokens, err = auth.NewJsonWebTokenProvider([]byte(cfg.Secret), s.Sessions, cfg.Sessions); err != nil {
 		log.WithError(err).WithField("module", "auth").Fatalf("failed creating JWT provider")
 	}
 
+	// optionally let users create API tokens
+	if cfg.APITokens != nil {
+		if s.APITokens, err = auth.NewFileAPITokenStore(cfg.APITokens.File); err != nil {
+			log.WithError(err).WithField("module", "auth").Fatalf("failed loading API tokens")
+		}
+	}
+
 	// setup authentication providers
 	s.Auth = map[string]fileshare.AuthProvider{}
 	for key, val := range cfg.Auths {
@@ -160,12 +267,45 @@ func main() {
 
 			provider, err = auth.NewPasswordAuthProvider(providerCfg)
 		case auth.AuthProviderTypeGithub:
-			var providerCfg fileshare.AuthGithub
+			var providerCfg fileshare.AuthOAuth2
 			if err := val.Decode(&providerCfg); err != nil {
 				log.WithError(err).WithField("module", "auth").Fatal("failed unmarshalling github auth provider config")
 			}
 
-			provider, err = auth.NewGithubAuthProvider(providerCfg)
+			for _, membership := range providerCfg.Memberships {
+				validateGroups(cfg, membership.Groups, membership.Org)
+			}
+
+			provider, err = auth.NewGithubAuthProvider(providerCfg, s.Users)
+		case auth.AuthProviderTypeOAuth2:
+			var providerCfg fileshare.AuthOAuth2
+			if err := val.Decode(&providerCfg); err != nil {
+				log.WithError(err).WithField("module", "auth").Fatal("failed unmarshalling oauth2 auth provider config")
+			}
+
+			for _, membership := range providerCfg.Memberships {
+				validateGroups(cfg, membership.Groups, membership.Org)
+			}
+
+			provider, err = auth.NewOAuth2AuthProvider(providerCfg, s.Users)
+		case auth.AuthProviderTypeOIDC:
+			var providerCfg fileshare.AuthOIDC
+			if err := val.Decode(&providerCfg); err != nil {
+				log.WithError(err).WithField("module", "auth").Fatal("failed unmarshalling oidc auth provider config")
+			}
+
+			provider, err = auth.NewOIDCAuthProvider(providerCfg)
+		case auth.AuthProviderTypeLDAP:
+			var providerCfg fileshare.AuthLDAP
+			if err := val.Decode(&providerCfg); err != nil {
+				log.WithError(err).WithField("module", "auth").Fatal("failed unmarshalling ldap auth provider config")
+			}
+
+			for groupDN, groups := range providerCfg.Groups {
+				validateGroups(cfg, groups, groupDN)
+			}
+
+			provider, err = auth.NewLDAPAuthProvider(providerCfg, s.Users)
 		default:
 			err = fmt.Errorf("unknown provider %s", key)
 		}
@@ -177,14 +317,144 @@ func main() {
 		s.Auth[key] = provider
 	}
 
+	// setup storage backend
+	var backend fileshare.StorageProvider
+	switch cfg.Storage {
+	case "", storage.StorageProviderTypeLocal:
+		if backend, err = storage.NewLocalStorageProvider(cfg.Path, cfg.Symlinks); err != nil {
+			log.WithError(err).WithField("module", "storage").Fatalf("failed creating local storage")
+		}
+	case storage.StorageProviderTypeDedup:
+		if backend, err = storage.NewDedupStorageProvider(cfg.Path); err != nil {
+			log.WithError(err).WithField("module", "storage").Fatalf("failed creating dedup storage")
+		}
+	default:
+		log.WithField("module", "storage").Fatalf("unknown storage %s", cfg.Storage)
+	}
+
+	// trace the backend calls, spans are not recorded unless tracing is configured
+	backend = storage.NewTracingStorageProvider(backend)
+
+	// optionally encrypt storage
+	if cfg.Encryption != nil {
+		if backend, err = storage.NewEncryptedStorageProvider(backend, *cfg.Encryption); err != nil {
+			log.WithError(err).WithField("module", "storage").Fatalf("failed creating encrypted storage")
+		}
+	}
+
+	// optionally store checksums of files
+	if cfg.Checksums != nil {
+		if backend, err = storage.NewChecksumStorageProvider(backend, *cfg.Checksums); err != nil {
+			log.WithError(err).WithField("module", "storage").Fatalf("failed creating checksum storage")
+		}
+	}
+
+	// optionally call webhooks for changes made by users
+	if len(cfg.Webhooks) > 0 {
+		if s.Webhooks, err = webhooks.NewWebhookDispatcher(cfg.Webhooks); err != nil {
+			log.WithError(err).WithField("module", "webhooks").Fatalf("failed creating webhooks")
+		}
+
+		backend = storage.NewWebhookStorageProvider(backend, s.Webhooks)
+	}
+
+	// notify changes, below versions and trash so that their moves are seen too
+	backend = storage.NewEventsStorageProvider(backend)
+
+	// optionally keep old versions of files
+	if cfg.Versions != nil {
+		backend = storage.NewVersioningStorageProvider(backend, *cfg.Versions)
+	}
+
+	// optionally move deleted files to the trash
+	if cfg.Trash != nil {
+		backend = storage.NewTrashStorageProvider(backend, *cfg.Trash)
+	}
+
+	// optionally record accesses and changes
+	if cfg.Audit != nil {
+		if s.Audit, err = audit.NewFileAuditLog(cfg.Audit.File); err != nil {
+			log.WithError(err).WithField("module", "audit").Fatalf("failed opening audit log")
+		}
+	}
+
 	// setup storage with ACL
-	s.Storage = storage.NewACLStorageProvider(storage.NewLocalStorageProvider(cfg.Path), cfg.DefaultACL)
+	s.Storage = storage.NewACLStorageProvider(backend, cfg.DefaultACL, s.Audit)
+
+	// expose metrics on their own address if requested, otherwise to admins only
+	metricsAdmin := cfg.Metrics != nil && len(cfg.Metrics.Listen) == 0
+	if cfg.Metrics != nil && len(cfg.Metrics.Listen) > 0 {
+		go func() {
+			if err := metrics.ListenForever(cfg.Metrics.Listen); err != nil {
+				log.WithError(err).WithField("module", "metrics").Fatalf("failed listening")
+			}
+		}()
+	}
 
 	// setup HTTP server
-	s.HTTP = http.NewHTTPServer(cfg.Port, cfg.AnonymousAccess, s.Storage, s.Auth, s.Users, s.Tokens)
+	s.HTTP = http.NewHTTPServer(cfg.Port, cfg.AnonymousAccess, metricsAdmin, []byte(cfg.Secret), s.Storage, s.Auth, s.Users, s.Tokens, s.Sessions, s.APITokens, s.Webhooks, s.Audit)
+
+	// optionally setup WebDAV server
+	servers := []fileshare.HttpServer{s.HTTP}
+	if cfg.WebDAV != nil {
+		s.WebDAV = dav.NewWebDAVServer(*cfg.WebDAV, s.Storage, s.Auth, s.Users, s.Tokens, s.Audit)
+		servers = append(servers, s.WebDAV)
+	}
+
+	// optionally setup SFTP server
+	if cfg.SFTP != nil {
+		if s.SFTP, err = sftpd.NewSFTPServer(*cfg.SFTP, s.Storage, s.Auth, s.Users, s.Audit); err != nil {
+			log.WithError(err).WithField("module", "sftp").Fatalf("failed creating SFTP server")
+		}
+
+		servers = append(servers, s.SFTP)
+	}
+
+	// optionally setup S3 server
+	if cfg.S3 != nil {
+		if s.S3, err = s3.NewS3Server(*cfg.S3, s.Storage, s.Users, cfg.Users, s.Audit); err != nil {
+			log.WithError(err).WithField("module", "s3").Fatalf("failed creating S3 server")
+		}
+
+		servers = append(servers, s.S3)
+	}
 
-	// listen
-	if err := s.HTTP.ListenForever(); err != nil {
+	// listen until asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listenErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server fileshare.HttpServer) { listenErr <- server.ListenForever() }(server)
+	}
+
+	select {
+	case err := <-listenErr:
 		log.WithError(err).Fatalf("failed listening")
+	case <-ctx.Done():
 	}
+
+	// let active transfers drain
+	timeout := cfg.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	log.Infof("shutting down, waiting up to %s for active transfers", timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server fileshare.HttpServer) {
+			defer wg.Done()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.WithError(err).Warnf("failed shutting down gracefully")
+			}
+		}(server)
+	}
+
+	wg.Wait()
 }
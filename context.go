@@ -9,6 +9,7 @@ type contextKey int
 
 const (
 	userContextKey = contextKey(iota + 1)
+	remoteIPContextKey
 )
 
 func SetContextWithUser(ctx *fiber.Ctx, user *User) {
@@ -17,7 +18,26 @@ func SetContextWithUser(ctx *fiber.Ctx, user *User) {
 		parent = context.Background()
 	}
 
-	ctx.SetUserContext(context.WithValue(parent, userContextKey, user))
+	ctx.SetUserContext(ContextWithUser(parent, user))
+}
+
+// ContextWithUser returns a copy of parent carrying the user, for servers not based on fiber.
+func ContextWithUser(parent context.Context, user *User) context.Context {
+	return context.WithValue(parent, userContextKey, user)
+}
+
+func SetContextWithRemoteIP(ctx *fiber.Ctx, ip string) {
+	parent := ctx.UserContext()
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	ctx.SetUserContext(ContextWithRemoteIP(parent, ip))
+}
+
+// ContextWithRemoteIP returns a copy of parent carrying the IP of the client, for servers not based on fiber.
+func ContextWithRemoteIP(parent context.Context, ip string) context.Context {
+	return context.WithValue(parent, remoteIPContextKey, ip)
 }
 
 func UserFromContext(ctx *fiber.Ctx) *User {
@@ -26,6 +46,17 @@ func UserFromContext(ctx *fiber.Ctx) *User {
 		parent = context.Background()
 	}
 
-	user, _ := parent.Value(userContextKey).(*User)
+	return UserFromUserContext(parent)
+}
+
+// UserFromUserContext returns the user from the context passed down to storage providers, if any.
+func UserFromUserContext(ctx context.Context) *User {
+	user, _ := ctx.Value(userContextKey).(*User)
 	return user
 }
+
+// RemoteIPFromUserContext returns the IP of the client from the context passed down to storage providers, if any.
+func RemoteIPFromUserContext(ctx context.Context) string {
+	ip, _ := ctx.Value(remoteIPContextKey).(string)
+	return ip
+}
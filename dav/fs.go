@@ -0,0 +1,415 @@
+package dav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/audit"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"github.com/devgianlu/go-fileshare/storage"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+// davError converts the storage errors to the ones understood by the WebDAV handler, files that
+// cannot be read are reported as missing like the HTML routes do.
+func davError(err error) error {
+	if err == nil {
+		return nil
+	} else if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fileshare.ErrStorageReadForbidden) {
+		return &fs.PathError{Op: "webdav", Err: fs.ErrNotExist}
+	} else if errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		return &fs.PathError{Op: "webdav", Err: fs.ErrPermission}
+	} else if errors.Is(err, fs.ErrExist) {
+		return &fs.PathError{Op: "webdav", Err: fs.ErrExist}
+	}
+
+	return err
+}
+
+// davFileSystem exposes the storage of the user in the request context.
+type davFileSystem struct {
+	storage fileshare.AuthenticatedStorageProvider
+	audit   fileshare.AuditLog
+}
+
+func userFromContext(ctx context.Context) (*fileshare.User, error) {
+	user := fileshare.UserFromUserContext(ctx)
+	if user == nil {
+		return nil, fmt.Errorf("missing user")
+	}
+
+	return user, nil
+}
+
+func (d *davFileSystem) Mkdir(ctx context.Context, name string, _ os.FileMode) error {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return davError(d.storage.Mkdir(ctx, name, user))
+}
+
+func (d *davFileSystem) OpenFile(ctx context.Context, name string, flag int, _ os.FileMode) (webdav.File, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		entry := audit.NewEntry(ctx, fileshare.AuditActionUpload, name)
+		w, err := d.storage.CreateFile(ctx, name, user)
+		if err != nil {
+			audit.Record(d.audit, entry, 0, err)
+			return nil, davError(err)
+		}
+
+		return &davWriteFile{ctx: ctx, fs: d, name: name, w: w, entry: entry, done: metrics.TransferStarted(metrics.TransferUpload)}, nil
+	}
+
+	// the file is opened only once it is read since the handler opens every file it lists
+	stat, err := d.storage.Stat(ctx, name, user)
+	if err != nil {
+		return nil, davError(err)
+	}
+
+	return &davReadFile{ctx: ctx, fs: d, name: name, user: user, stat: stat}, nil
+}
+
+func (d *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = d.storage.Remove(ctx, name, user)
+	audit.Record(d.audit, audit.NewEntry(ctx, fileshare.AuditActionDelete, name), 0, err)
+	return davError(err)
+}
+
+func (d *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	entry := audit.NewRenameEntry(ctx, oldName, newName)
+	err = d.storage.Rename(ctx, oldName, newName, user)
+	audit.Record(d.audit, entry, 0, err)
+	return davError(err)
+}
+
+func (d *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := d.storage.Stat(ctx, name, user)
+	if err != nil {
+		return nil, davError(err)
+	}
+
+	return &fileInfo{stat}, nil
+}
+
+// fileInfo adapts the storage stat, providing the MIME type and checksum to the handler if available.
+type fileInfo struct {
+	stat *fileshare.FileStat
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.stat.Name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.stat.Size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.stat.IsDir {
+		return fs.ModeDir | 0755
+	}
+
+	return 0644
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.stat.ModTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.stat.IsDir
+}
+
+func (fi *fileInfo) Sys() any {
+	return nil
+}
+
+func (fi *fileInfo) ContentType(context.Context) (string, error) {
+	if len(fi.stat.MimeType) == 0 {
+		return "", webdav.ErrNotImplemented
+	}
+
+	return fi.stat.MimeType, nil
+}
+
+func (fi *fileInfo) ETag(context.Context) (string, error) {
+	sum := fi.stat.Checksums[storage.ChecksumSHA256]
+	if len(sum) == 0 {
+		return "", webdav.ErrNotImplemented
+	}
+
+	return `"` + sum + `"`, nil
+}
+
+// davReadFile reads a file or lists a directory, the file is opened lazily and seeking is emulated
+// if the storage does not support it.
+type davReadFile struct {
+	ctx  context.Context
+	fs   *davFileSystem
+	name string
+	user *fileshare.User
+	stat *fileshare.FileStat
+
+	r       io.ReadCloser
+	done    func(bytes int64)
+	pos     int64
+	readPos int64
+	read    int64
+	entries []fs.FileInfo
+	listed  bool
+
+	// the download is recorded once the file is closed, if it was ever opened
+	entry   *fileshare.AuditEntry
+	sent    int64
+	readErr error
+}
+
+// sync opens the file if needed and moves the reader to the requested position.
+func (f *davReadFile) sync() error {
+	if f.stat.IsDir {
+		return &fs.PathError{Op: "read", Path: f.name, Err: fmt.Errorf("is a directory")}
+	}
+
+	if f.r != nil && f.readPos == f.pos {
+		return nil
+	} else if f.r != nil {
+		if seeker, ok := f.r.(io.Seeker); ok {
+			pos, err := seeker.Seek(f.pos, io.SeekStart)
+			f.readPos = pos
+			return err
+		} else if f.pos < f.readPos {
+			// reopen the file to go back
+			if err := f.closeReader(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if f.r == nil {
+		if f.entry == nil {
+			entry := audit.NewEntry(f.ctx, fileshare.AuditActionDownload, f.name)
+			f.entry = &entry
+		}
+
+		r, _, err := f.fs.storage.OpenFile(f.ctx, f.name, f.user)
+		if err != nil {
+			f.readErr = err
+			return davError(err)
+		}
+
+		f.r = r
+		f.readPos = 0
+		f.done = metrics.TransferStarted(metrics.TransferDownload)
+
+		if seeker, ok := f.r.(io.Seeker); ok && f.pos > 0 {
+			pos, err := seeker.Seek(f.pos, io.SeekStart)
+			f.readPos = pos
+			return err
+		}
+	}
+
+	n, err := io.CopyN(io.Discard, f.r, f.pos-f.readPos)
+	f.readPos += n
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+func (f *davReadFile) Read(p []byte) (int, error) {
+	if err := f.sync(); err != nil {
+		return 0, err
+	}
+
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	f.readPos += int64(n)
+	f.read += int64(n)
+	f.sent += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		f.readErr = err
+	}
+
+	return n, err
+}
+
+// Seek only records the position, the file is moved there by the next read.
+func (f *davReadFile) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = f.pos + offset
+	case io.SeekEnd:
+		abs = f.stat.Size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if abs < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+
+	f.pos = abs
+	return abs, nil
+}
+
+func (f *davReadFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.stat.IsDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fmt.Errorf("not a directory")}
+	}
+
+	if !f.listed {
+		entries, err := f.fs.storage.ReadDir(f.ctx, f.name, f.user)
+		if err != nil {
+			return nil, davError(err)
+		}
+
+		for _, entry := range entries {
+			stat, err := f.fs.storage.Stat(f.ctx, path.Join(f.name, entry.Name()), f.user)
+			if errors.Is(err, fs.ErrNotExist) {
+				// removed in the meantime
+				continue
+			} else if err != nil {
+				return nil, davError(err)
+			}
+
+			f.entries = append(f.entries, &fileInfo{stat})
+		}
+
+		f.listed = true
+	}
+
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	} else if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	count = min(count, len(f.entries))
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+func (f *davReadFile) Stat() (fs.FileInfo, error) {
+	return &fileInfo{f.stat}, nil
+}
+
+func (f *davReadFile) Write([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *davReadFile) closeReader() error {
+	if f.r == nil {
+		return nil
+	}
+
+	f.done(f.read)
+	f.read = 0
+	err := f.r.Close()
+	f.r = nil
+	return err
+}
+
+func (f *davReadFile) Close() error {
+	if f.entry != nil {
+		audit.Record(f.fs.audit, *f.entry, f.sent, f.readErr)
+	}
+
+	return f.closeReader()
+}
+
+// davWriteFile writes a file to the storage, it is committed on Close unless writing or reading
+// the request body failed.
+type davWriteFile struct {
+	ctx     context.Context
+	fs      *davFileSystem
+	name    string
+	entry   fileshare.AuditEntry
+	w       fileshare.FileWriter
+	done    func(bytes int64)
+	written int64
+	err     error
+}
+
+func (f *davWriteFile) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.written += int64(n)
+	if err != nil {
+		f.err = err
+	}
+
+	return n, err
+}
+
+func (f *davWriteFile) Close() error {
+	f.done(f.written)
+
+	if body, ok := f.ctx.Value(requestBodyContextKey{}).(*requestBody); ok && body.err != nil {
+		f.err = body.err
+	}
+
+	if f.err != nil {
+		_ = f.w.Abort()
+		audit.Record(f.fs.audit, f.entry, f.written, f.err)
+		return f.err
+	}
+
+	err := f.w.Close()
+	audit.Record(f.fs.audit, f.entry, f.written, err)
+	return err
+}
+
+// Stat describes the file being written, the handler asks for it before the file is closed.
+func (f *davWriteFile) Stat() (fs.FileInfo, error) {
+	return &fileInfo{&fileshare.FileStat{Name: path.Base(f.name), Size: f.written, ModTime: time.Now()}}, nil
+}
+
+func (f *davWriteFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *davWriteFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && (whence == io.SeekCurrent || whence == io.SeekEnd) {
+		return f.written, nil
+	}
+
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *davWriteFile) Readdir(int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fmt.Errorf("not a directory")}
+}
@@ -0,0 +1,195 @@
+package dav
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/audit"
+	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/metrics"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialsCacheDuration is how long successful Basic credentials are remembered, clients send them
+// with every request and checking the password hash each time is slow.
+const credentialsCacheDuration = 5 * time.Minute
+
+type cachedCredentials struct {
+	nickname string
+	expires  time.Time
+}
+
+type requestBodyContextKey struct{}
+
+// requestBody remembers whether reading the body of the request failed, so that partial uploads
+// are not committed.
+type requestBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.err = err
+	}
+
+	return n, err
+}
+
+type davServer struct {
+	log     *log.Entry
+	storage fileshare.AuthenticatedStorageProvider
+	auth    map[string]fileshare.AuthProvider
+	users   fileshare.UsersProvider
+	tokens  fileshare.TokenProvider
+	audit   fileshare.AuditLog
+	handler *webdav.Handler
+	server  *http.Server
+
+	credentialsLock sync.Mutex
+	credentials     map[[sha256.Size]byte]cachedCredentials
+}
+
+// NewWebDAVServer serves the storage over WebDAV, users authenticate with Basic credentials checked
+// against the password providers or with Bearer tokens.
+func NewWebDAVServer(cfg fileshare.WebDAV, storage fileshare.AuthenticatedStorageProvider, auth map[string]fileshare.AuthProvider, users fileshare.UsersProvider, tokens fileshare.TokenProvider, auditLog fileshare.AuditLog) fileshare.HttpServer {
+	s := &davServer{}
+	s.log = log.WithField("module", "webdav")
+	s.storage = storage
+	s.auth = auth
+	s.users = users
+	s.tokens = tokens
+	s.audit = auditLog
+	s.credentials = map[[sha256.Size]byte]cachedCredentials{}
+
+	s.handler = &webdav.Handler{
+		Prefix:     strings.TrimSuffix(cfg.Prefix, "/"),
+		FileSystem: &davFileSystem{storage: storage, audit: auditLog},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				s.log.WithError(err).Debugf("%s %s failed", r.Method, r.URL.Path)
+			}
+		},
+	}
+
+	s.server = &http.Server{Addr: cfg.Listen, Handler: s}
+	return s
+}
+
+func (s *davServer) ListenForever() error {
+	s.log.Infof("listening on %s", s.server.Addr)
+	if err := s.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *davServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// checkPassword authenticates the Basic credentials, successful ones are cached for a while. Only
+// the logins that are not cached are recorded in the audit log.
+func (s *davServer) checkPassword(ip string, nickname string, password string) (string, error) {
+	key := sha256.Sum256([]byte(nickname + "\x00" + password))
+
+	s.credentialsLock.Lock()
+	cached, ok := s.credentials[key]
+	s.credentialsLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.nickname, nil
+	}
+
+	authenticated, err := auth.AuthenticatePassword(s.auth, nickname, password)
+	metrics.ObserveLogin("webdav", err == nil)
+	if err != nil {
+		err = fileshare.NewError("invalid credentials", fileshare.ErrAuthInvalid, err)
+	}
+
+	audit.Record(s.audit, fileshare.AuditEntry{User: nickname, IP: ip, Action: fileshare.AuditActionLogin}, 0, err)
+	if err != nil {
+		return "", err
+	}
+
+	s.credentialsLock.Lock()
+	now := time.Now()
+	for k, v := range s.credentials {
+		if now.After(v.expires) {
+			delete(s.credentials, k)
+		}
+	}
+
+	s.credentials[key] = cachedCredentials{nickname: authenticated, expires: now.Add(credentialsCacheDuration)}
+	s.credentialsLock.Unlock()
+
+	return authenticated, nil
+}
+
+func (s *davServer) getUser(r *http.Request, ip string) (*fileshare.User, error) {
+	var nickname string
+	if username, password, ok := r.BasicAuth(); ok {
+		var err error
+		if nickname, err = s.checkPassword(ip, username, password); err != nil {
+			return nil, err
+		}
+	} else if authHeader := r.Header.Get("Authorization"); len(authHeader) > 0 {
+		token, ok := strings.CutPrefix(authHeader, "Bearer ")
+		if !ok || len(token) == 0 {
+			return nil, fileshare.NewError("unsupported authorization header", fileshare.ErrAuthMalformed)
+		}
+
+		var err error
+		if nickname, err = s.tokens.GetUser(token); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, nil
+	}
+
+	user, err := s.users.GetUser(nickname)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting user: %w", err)
+	} else if user == nil {
+		return nil, fmt.Errorf("no user for nickname %s", nickname)
+	}
+
+	return user, nil
+}
+
+func (s *davServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	user, err := s.getUser(r, ip)
+	if errors.Is(err, fileshare.ErrAuthInvalid) || errors.Is(err, fileshare.ErrAuthMalformed) || (err == nil && user == nil) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="go-fileshare", charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		s.log.WithError(err).Errorf("failed authenticating")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	body := &requestBody{ReadCloser: r.Body}
+	r.Body = body
+
+	ctx := fileshare.ContextWithUser(r.Context(), user)
+	ctx = fileshare.ContextWithRemoteIP(ctx, ip)
+	ctx = context.WithValue(ctx, requestBodyContextKey{}, body)
+	s.handler.ServeHTTP(w, r.WithContext(ctx))
+}
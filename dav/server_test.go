@@ -0,0 +1,256 @@
+package dav
+
+import (
+	"context"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/storage"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type memoryAuditLog struct {
+	lock    sync.Mutex
+	entries []fileshare.AuditEntry
+}
+
+func (l *memoryAuditLog) Record(entry fileshare.AuditEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+func (l *memoryAuditLog) Query(fileshare.AuditQuery) ([]fileshare.AuditEntry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]fileshare.AuditEntry(nil), l.entries...), nil
+}
+
+func (l *memoryAuditLog) Verify() error {
+	return nil
+}
+
+// fakePasswordProvider accepts the password "secret" and counts how many times it was asked.
+type fakePasswordProvider struct {
+	calls atomic.Int32
+}
+
+func (p *fakePasswordProvider) Authenticate(payload_ any) (string, error) {
+	p.calls.Add(1)
+
+	payload := payload_.(auth.PasswordAuthProviderPayload)
+	if payload.Password != "secret" {
+		return "", fileshare.NewError("bad password", fileshare.ErrAuthInvalid)
+	}
+
+	return payload.Nickname, nil
+}
+
+// unseekableStorageProvider hides the ability to seek of the files and counts how many are opened.
+type unseekableStorageProvider struct {
+	fileshare.StorageProvider
+	opened atomic.Int32
+}
+
+func (p *unseekableStorageProvider) OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	file, info, err := p.StorageProvider.OpenFile(ctx, name)
+	if file != nil {
+		p.opened.Add(1)
+		file = struct{ io.ReadCloser }{file}
+	}
+
+	return file, info, err
+}
+
+type testDAVServer struct {
+	*davServer
+	base      string
+	passwords *fakePasswordProvider
+	files     *unseekableStorageProvider
+	audit     *memoryAuditLog
+}
+
+// newTestDAVServer serves a local directory to pippo, who cannot access the secret directory.
+func newTestDAVServer(t *testing.T) *testDAVServer {
+	base := t.TempDir()
+	for name, data := range map[string]string{"a.txt": "0123456789abcdefghijklmnopqrstuvwxyz", "dir/b.txt": "b", "secret/c.txt": "c"} {
+		_ = os.MkdirAll(filepath.Join(base, filepath.Dir(name)), 0755)
+		_ = os.WriteFile(filepath.Join(base, name), []byte(data), 0644)
+	}
+
+	local, err := storage.NewLocalStorageProvider(base, "")
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	s := &testDAVServer{base: base, passwords: &fakePasswordProvider{}, files: &unseekableStorageProvider{StorageProvider: local}, audit: &memoryAuditLog{}}
+
+	users := auth.NewConfigUsersProvider([]fileshare.User{{
+		Nickname: "pippo",
+		ACL:      []fileshare.PathACL{{Path: "/", Read: true, Write: true}, {Path: "/secret"}},
+	}}, nil)
+	st := storage.NewACLStorageProvider(s.files, nil, nil)
+	s.davServer = NewWebDAVServer(fileshare.WebDAV{}, st, map[string]fileshare.AuthProvider{"fake": s.passwords}, users, nil, s.audit).(*davServer)
+	return s
+}
+
+func (s *testDAVServer) request(method string, path string, body io.Reader, headers map[string]string) *http.Response {
+	req := httptest.NewRequest(method, path, body)
+	req.SetBasicAuth("pippo", "secret")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed reading response: %v", err)
+	}
+
+	return string(data)
+}
+
+// failingReader fails like a connection dropped in the middle of the body.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestWebDAVServer_Auth(t *testing.T) {
+	s := newTestDAVServer(t)
+
+	for _, password := range []string{"", "wrong"} {
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		if len(password) > 0 {
+			req.SetBasicAuth("pippo", password)
+		}
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized || len(rec.Header().Get("WWW-Authenticate")) == 0 {
+			t.Fatalf("unexpected response: %d %v", rec.Code, rec.Header())
+		}
+	}
+
+	// the credentials are checked once, clients send them with every request
+	for i := 0; i < 3; i++ {
+		if resp := s.request("PROPFIND", "/", nil, map[string]string{"Depth": "0"}); resp.StatusCode != http.StatusMultiStatus {
+			t.Fatalf("unexpected status code: %d", resp.StatusCode)
+		}
+	}
+
+	if calls := s.passwords.calls.Load(); calls != 2 {
+		t.Fatalf("unexpected password checks: %d", calls)
+	} else if entries, _ := s.audit.Query(fileshare.AuditQuery{}); len(entries) != 2 || entries[0].Outcome != fileshare.AuditOutcomeDenied || entries[1].Outcome != fileshare.AuditOutcomeSuccess {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+}
+
+func TestWebDAVServer_Read(t *testing.T) {
+	s := newTestDAVServer(t)
+
+	// listing does not open the files, hidden directories are not listed
+	resp := s.request("PROPFIND", "/", nil, map[string]string{"Depth": "1"})
+	if body := readBody(t, resp); resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if !strings.Contains(body, "<D:href>/a.txt</D:href>") || !strings.Contains(body, "<D:href>/dir/</D:href>") || strings.Contains(body, "secret") {
+		t.Fatalf("unexpected listing: %s", body)
+	} else if opened := s.files.opened.Load(); opened != 0 {
+		t.Fatalf("unexpected opened files: %d", opened)
+	}
+
+	resp = s.request("GET", "/a.txt", nil, nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "0123456789abcdefghijklmnopqrstuvwxyz" {
+		t.Fatalf("unexpected response: %d %s", resp.StatusCode, body)
+	}
+
+	// the file cannot seek, moving forward skips the content
+	resp = s.request("GET", "/a.txt", nil, map[string]string{"Range": "bytes=10-19"})
+	if body := readBody(t, resp); resp.StatusCode != http.StatusPartialContent || body != "abcdefghij" {
+		t.Fatalf("unexpected response: %d %s", resp.StatusCode, body)
+	}
+
+	// and going back opens the file again
+	opened := s.files.opened.Load()
+	resp = s.request("GET", "/a.txt", nil, map[string]string{"Range": "bytes=20-24,0-4"})
+	if body := readBody(t, resp); resp.StatusCode != http.StatusPartialContent || !strings.Contains(body, "klmno") || !strings.Contains(body, "01234") {
+		t.Fatalf("unexpected response: %d %s", resp.StatusCode, body)
+	} else if s.files.opened.Load()-opened != 2 {
+		t.Fatalf("unexpected opened files: %d", s.files.opened.Load()-opened)
+	}
+
+	// reading hidden files looks like they are missing
+	if resp := s.request("GET", "/secret/c.txt", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if resp := s.request("PROPFIND", "/secret", nil, map[string]string{"Depth": "1"}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+func TestWebDAVServer_Write(t *testing.T) {
+	s := newTestDAVServer(t)
+
+	if resp := s.request("PUT", "/new.txt", strings.NewReader("hello"), nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if data, _ := os.ReadFile(filepath.Join(s.base, "new.txt")); string(data) != "hello" {
+		t.Fatalf("unexpected content: %s", data)
+	}
+
+	// the upload is dropped if the body is incomplete
+	if resp := s.request("PUT", "/partial.txt", io.MultiReader(strings.NewReader("partial"), failingReader{}), nil); resp.StatusCode == http.StatusCreated {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if _, err := os.Stat(filepath.Join(s.base, "partial.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected partial upload not to be stored: %v", err)
+	}
+
+	if resp := s.request("MOVE", "/new.txt", nil, map[string]string{"Destination": "/dir/moved.txt"}); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if data, _ := os.ReadFile(filepath.Join(s.base, "dir", "moved.txt")); string(data) != "hello" {
+		t.Fatalf("unexpected moved content: %s", data)
+	}
+
+	if resp := s.request("DELETE", "/dir", nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if _, err := os.Stat(filepath.Join(s.base, "dir")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected directory to be removed: %v", err)
+	}
+
+	// nothing changes in the hidden directory
+	if resp := s.request("PUT", "/secret/new.txt", strings.NewReader("pwned"), nil); resp.StatusCode < 400 {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if resp := s.request("MOVE", "/a.txt", nil, map[string]string{"Destination": "/secret/a.txt"}); resp.StatusCode < 400 {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if resp := s.request("DELETE", "/secret", nil, nil); resp.StatusCode < 400 {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if entries, _ := os.ReadDir(filepath.Join(s.base, "secret")); len(entries) != 1 || entries[0].Name() != "c.txt" {
+		t.Fatalf("unexpected hidden entries: %v", entries)
+	} else if _, err := os.Stat(filepath.Join(s.base, "a.txt")); err != nil {
+		t.Fatalf("expected file not to be moved: %v", err)
+	}
+
+	// the denials are recorded by the ACL storage, which has no audit log here
+	var actions []string
+	entries, _ := s.audit.Query(fileshare.AuditQuery{})
+	for _, entry := range entries {
+		actions = append(actions, entry.Action+":"+entry.Outcome)
+	}
+
+	if strings.Join(actions, ",") != "login:success,upload:success,upload:failure,rename:success,delete:success" {
+		t.Fatalf("unexpected audit entries: %v", actions)
+	}
+}
@@ -1,5 +1,11 @@
 package fileshare
 
+import "context"
+
 type HttpServer interface {
 	ListenForever() error
+
+	// Shutdown stops accepting connections and waits for the active ones until ctx is done, after
+	// which the transfers still in progress are aborted.
+	Shutdown(ctx context.Context) error
 }
@@ -0,0 +1,153 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"github.com/gofiber/fiber/v2"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// newAuditEntry prepares an entry for the action of the current user, it must be created before
+// the handler returns since the request context is reused afterward.
+func (s *httpServer) newAuditEntry(ctx *fiber.Ctx, action string, path string) fileshare.AuditEntry {
+	entry := fileshare.AuditEntry{IP: ctx.IP(), Action: action, Path: path}
+	if user := fileshare.UserFromContext(ctx); user != nil {
+		entry.User = user.Nickname
+	}
+
+	return entry
+}
+
+// recordAudit completes the entry with the outcome given by err. Forbidden storage accesses are
+// skipped, they have already been recorded by the storage.
+func (s *httpServer) recordAudit(entry fileshare.AuditEntry, bytes int64, err error) {
+	if s.auditLog == nil {
+		return
+	} else if errors.Is(err, fileshare.ErrStorageReadForbidden) || errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		return
+	}
+
+	entry.Bytes = bytes
+	if err == nil {
+		entry.Outcome = fileshare.AuditOutcomeSuccess
+	} else if ok, statusCode, _ := asHttpError(err); ok && (statusCode == fiber.StatusUnauthorized || statusCode == fiber.StatusForbidden) {
+		entry.Outcome = fileshare.AuditOutcomeDenied
+		entry.Error = err.Error()
+	} else {
+		entry.Outcome = fileshare.AuditOutcomeFailure
+		entry.Error = err.Error()
+	}
+
+	s.auditLog.Record(entry)
+}
+
+// downloadReader records how much of the file has been sent once the response is done with it.
+type downloadReader struct {
+	io.ReadCloser
+	s     *httpServer
+	entry fileshare.AuditEntry
+	done  func(bytes int64)
+	bytes int64
+	err   error
+}
+
+func newDownloadReader(s *httpServer, file io.ReadCloser, entry fileshare.AuditEntry) *downloadReader {
+	return &downloadReader{ReadCloser: file, s: s, entry: entry, done: metrics.TransferStarted(metrics.TransferDownload)}
+}
+
+func (r *downloadReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.err = err
+	}
+
+	return n, err
+}
+
+func (r *downloadReader) Close() error {
+	r.done(r.bytes)
+	r.s.recordAudit(r.entry, r.bytes, r.err)
+	return r.ReadCloser.Close()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	io.Writer
+	bytes int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (s *httpServer) handleAudit(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || !user.Admin {
+		return newHttpError(http.StatusForbidden, "cannot see audit log", fmt.Errorf("only admins can see the audit log"))
+	} else if s.auditLog == nil {
+		return newHttpError(http.StatusNotFound, "audit log not available", fmt.Errorf("audit log is not configured"))
+	}
+
+	query := fileshare.AuditQuery{
+		User:    ctx.Query("user"),
+		Action:  ctx.Query("action"),
+		Path:    ctx.Query("path"),
+		Outcome: ctx.Query("outcome"),
+	}
+
+	var err error
+	if since := ctx.Query("since"); len(since) > 0 {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return newHttpError(http.StatusBadRequest, "invalid since", err)
+		}
+	}
+
+	if until := ctx.Query("until"); len(until) > 0 {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return newHttpError(http.StatusBadRequest, "invalid until", err)
+		}
+	}
+
+	if limit := ctx.Query("limit"); len(limit) > 0 {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return newHttpError(http.StatusBadRequest, "invalid limit", err)
+		}
+	}
+
+	entries, err := s.auditLog.Query(query)
+	if err != nil {
+		return err
+	} else if entries == nil {
+		entries = []fileshare.AuditEntry{}
+	}
+
+	return ctx.JSON(entries)
+}
+
+type auditVerifyResponse struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+func (s *httpServer) handleAuditVerify(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || !user.Admin {
+		return newHttpError(http.StatusForbidden, "cannot verify audit log", fmt.Errorf("only admins can verify the audit log"))
+	} else if s.auditLog == nil {
+		return newHttpError(http.StatusNotFound, "audit log not available", fmt.Errorf("audit log is not configured"))
+	}
+
+	if err := s.auditLog.Verify(); err != nil {
+		return ctx.JSON(&auditVerifyResponse{Valid: false, Error: err.Error()})
+	}
+
+	return ctx.JSON(&auditVerifyResponse{Valid: true})
+}
@@ -1,64 +1,304 @@
 package http
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/tracing"
 	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
+	"net/url"
 	"strings"
+	"time"
 )
 
 const authTokenCookieName = "token"
 
-func (s *httpServer) getUser(authHeader string, authCookie string) (*fileshare.User, error) {
+const refreshTokenCookieName = "refresh_token"
+
+// sessionLocalKey holds the ID of the session of the request, if authenticated with the cookies.
+const sessionLocalKey = "session"
+
+const oauth2LoginCookieName = "oauth2_login"
+
+// oauth2LoginExpiry is how long the user has to complete the login with the provider.
+const oauth2LoginExpiry = 10 * time.Minute
+
+// oauth2LoginCookie binds a login attempt to the browser that started it.
+type oauth2LoginCookie struct {
+	Provider string                `json:"provider"`
+	Login    fileshare.OAuth2Login `json:"login"`
+	ReturnTo string                `json:"return_to"`
+	Expires  int64                 `json:"expires"`
+}
+
+func (s *httpServer) signLoginCookie(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	_, _ = mac.Write([]byte("oauth2-login\x00"))
+	_, _ = mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (s *httpServer) setLoginCookie(ctx *fiber.Ctx, cookie *oauth2LoginCookie) error {
+	cookie.Expires = time.Now().Add(oauth2LoginExpiry).Unix()
+
+	payload, err := json.Marshal(cookie)
+	if err != nil {
+		return err
+	}
+
+	value := base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.signLoginCookie(payload))
+	ctx.Cookie(&fiber.Cookie{
+		Name:     oauth2LoginCookieName,
+		Value:    value,
+		Path:     "/login",
+		HTTPOnly: true,
+		Secure:   ctx.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteLaxMode, // must be sent when the provider redirects back
+		Expires:  time.Unix(cookie.Expires, 0),
+	})
+	return nil
+}
+
+// popLoginCookie returns the login attempt of the browser and clears it, so that it cannot be used twice.
+func (s *httpServer) popLoginCookie(ctx *fiber.Ctx) (*oauth2LoginCookie, error) {
+	value := ctx.Cookies(oauth2LoginCookieName)
+	ctx.Cookie(&fiber.Cookie{Name: oauth2LoginCookieName, Path: "/login", HTTPOnly: true, Expires: fasthttp.CookieExpireDelete})
+	if len(value) == 0 {
+		return nil, fmt.Errorf("missing login cookie")
+	}
+
+	payloadStr, sigStr, _ := strings.Cut(value, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(payloadStr)
+	if err != nil {
+		return nil, fmt.Errorf("malformed login cookie: %w", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(sigStr)
+	if err != nil {
+		return nil, fmt.Errorf("malformed login cookie: %w", err)
+	} else if !hmac.Equal(sig, s.signLoginCookie(payload)) {
+		return nil, fmt.Errorf("invalid login cookie signature")
+	}
+
+	var cookie oauth2LoginCookie
+	if err := json.Unmarshal(payload, &cookie); err != nil {
+		return nil, fmt.Errorf("malformed login cookie: %w", err)
+	} else if time.Now().Unix() > cookie.Expires {
+		return nil, fmt.Errorf("expired login cookie")
+	}
+
+	return &cookie, nil
+}
+
+// setSessionCookies gives the tokens to the browser, the access token cookie goes away with the access
+// token so that the refresh token is used to get a new one.
+func setSessionCookies(ctx *fiber.Ctx, tokens *fileshare.SessionTokens) {
+	ctx.Cookie(&fiber.Cookie{
+		Name:     authTokenCookieName,
+		Value:    tokens.AccessToken,
+		HTTPOnly: true,
+		Secure:   ctx.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteLaxMode,
+		Expires:  tokens.AccessTokenExpiresAt,
+	})
+	ctx.Cookie(&fiber.Cookie{
+		Name:     refreshTokenCookieName,
+		Value:    tokens.RefreshToken,
+		HTTPOnly: true,
+		Secure:   ctx.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteLaxMode,
+		Expires:  tokens.Session.ExpiresAt,
+	})
+	ctx.Locals(sessionLocalKey, tokens.Session.ID)
+}
+
+func clearSessionCookies(ctx *fiber.Ctx) {
+	ctx.ClearCookie(authTokenCookieName, refreshTokenCookieName)
+}
+
+// csrfFormField is the form field holding the CSRF token.
+const csrfFormField = "csrf"
+
+// csrfToken is sent back by the forms of the session, so that other sites cannot submit them.
+func (s *httpServer) csrfToken(sessionID string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	_, _ = mac.Write([]byte("csrf\x00"))
+	_, _ = mac.Write([]byte(sessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestCSRFToken is the CSRF token for the forms rendered in response to the request.
+func (s *httpServer) requestCSRFToken(ctx *fiber.Ctx) string {
+	sessionID, _ := ctx.Locals(sessionLocalKey).(string)
+	return s.csrfToken(sessionID)
+}
+
+func (s *httpServer) checkCSRF(ctx *fiber.Ctx) error {
+	sessionID, _ := ctx.Locals(sessionLocalKey).(string)
+	if !hmac.Equal([]byte(ctx.FormValue(csrfFormField)), []byte(s.csrfToken(sessionID))) {
+		return newHttpError(fiber.StatusForbidden, "invalid CSRF token", fmt.Errorf("invalid CSRF token for session %s", sessionID))
+	}
+
+	return nil
+}
+
+// newCSRFHandler checks the CSRF token of the requests authenticated with the cookies that change something,
+// the browser sends the cookies even with forms submitted by other sites.
+func (s *httpServer) newCSRFHandler() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		if ctx.Method() == fiber.MethodGet || ctx.Method() == fiber.MethodHead || ctx.Method() == fiber.MethodOptions {
+			return ctx.Next()
+		} else if sessionID, _ := ctx.Locals(sessionLocalKey).(string); len(sessionID) == 0 {
+			return ctx.Next()
+		}
+
+		if err := s.checkCSRF(ctx); err != nil {
+			return err
+		}
+
+		return ctx.Next()
+	}
+}
+
+// refreshSession gets new tokens with the refresh token cookie, the user is not authenticated if that fails.
+func (s *httpServer) refreshSession(ctx context.Context, fctx *fiber.Ctx, refreshToken string) (*fileshare.User, error) {
+	_, span := tracing.Start(ctx, "tokens.Refresh")
+	tokens, err := s.tokens.Refresh(refreshToken)
+	tracing.End(span, err)
+	if errors.Is(err, fileshare.ErrAuthSuperseded) {
+		// another request refreshed the session at the same time, its cookies are the good ones
+		s.log.WithError(err).Debugf("session already refreshed")
+		return nil, nil
+	} else if errors.Is(err, fileshare.ErrAuthInvalid) {
+		s.log.WithError(err).Debugf("failed refreshing session")
+		clearSessionCookies(fctx)
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed refreshing session: %w", err)
+	}
+
+	_, span = tracing.Start(ctx, "users.GetUser", attribute.String("fileshare.user", tokens.Session.User))
+	user, err := s.users.GetUser(tokens.Session.User)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed authenticating: %w", err)
+	} else if user == nil {
+		clearSessionCookies(fctx)
+		return nil, nil
+	}
+
+	setSessionCookies(fctx, tokens)
+	return user, nil
+}
+
+// safeReturnTo accepts only local paths, to avoid redirecting the user to another site after login.
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return "/"
+	}
+
+	if u, err := url.Parse(returnTo); err != nil || len(u.Scheme) > 0 || len(u.Host) > 0 {
+		return "/"
+	}
+
+	return returnTo
+}
+
+// getUser returns the user of the request and the API token used to authenticate, if any.
+func (s *httpServer) getUser(ctx context.Context, authHeader string, authCookie string) (*fileshare.User, *fileshare.APIToken, error) {
 	var token string
 	if len(authHeader) > 0 {
 		authParts := strings.Split(authHeader, " ")
 		if len(authParts) != 2 {
-			return nil, fmt.Errorf("invalid authorization header")
+			return nil, nil, fmt.Errorf("invalid authorization header")
 		} else if authParts[0] != "Bearer" {
-			return nil, fmt.Errorf("unsupported authorization header: %s", authParts[0])
+			return nil, nil, fmt.Errorf("unsupported authorization header: %s", authParts[0])
 		}
 
 		token = authParts[1]
 	} else if len(authCookie) > 0 {
 		token = authCookie
 	} else {
-		return nil, nil
+		return nil, nil, nil
+	}
+
+	var nickname string
+	var apiToken *fileshare.APIToken
+	var err error
+	if strings.HasPrefix(token, auth.APITokenPrefix) && len(authHeader) > 0 && s.apiTokens != nil {
+		_, span := tracing.Start(ctx, "apiTokens.Authenticate")
+		apiToken, err = s.apiTokens.Authenticate(token)
+		tracing.End(span, err)
+		if apiToken != nil {
+			nickname = apiToken.User
+		}
+	} else {
+		_, span := tracing.Start(ctx, "tokens.GetUser")
+		nickname, err = s.tokens.GetUser(token)
+		tracing.End(span, err)
 	}
 
-	nickname, err := s.tokens.GetUser(token)
 	if errors.Is(err, fileshare.ErrAuthMalformed) {
-		return nil, newHttpError(fiber.StatusBadRequest, "malformed bearer token", err)
+		return nil, nil, newHttpError(fiber.StatusBadRequest, "malformed bearer token", err)
 	} else if errors.Is(err, fileshare.ErrAuthInvalid) {
-		return nil, newHttpError(fiber.StatusUnauthorized, "invalid bearer token", err)
+		return nil, nil, newHttpError(fiber.StatusUnauthorized, "invalid bearer token", err)
 	} else if err != nil {
-		return nil, fmt.Errorf("failed authenticating: %w", err)
+		return nil, nil, fmt.Errorf("failed authenticating: %w", err)
 	}
 
-	// since the token is signed, we assume the user is authenticated
+	// since the token is signed or stored, we assume the user is authenticated
+	_, span := tracing.Start(ctx, "users.GetUser", attribute.String("fileshare.user", nickname))
 	user, err := s.users.GetUser(nickname)
+	tracing.End(span, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed authenticating: %w", err)
+		return nil, nil, fmt.Errorf("failed authenticating: %w", err)
 	} else if user == nil {
-		return nil, newHttpError(fiber.StatusForbidden, "unknown user", fmt.Errorf("no user for nickname %s", nickname))
+		return nil, nil, newHttpError(fiber.StatusForbidden, "unknown user", fmt.Errorf("no user for nickname %s", nickname))
 	}
 
-	return user, nil
+	return user, apiToken, nil
 }
 
 func (s *httpServer) newAuthHandler() fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
-		if user, err := s.getUser(ctx.Get("Authorization"), ctx.Cookies(authTokenCookieName)); err != nil {
-			return err
-		} else if user != nil {
-			fileshare.SetContextWithUser(ctx, user)
-		} else if s.anonymous {
+		fileshare.SetContextWithRemoteIP(ctx, ctx.IP())
+
+		authCtx, span := tracing.Start(ctx.UserContext(), "http.auth")
+		authHeader, authCookie, refreshCookie := ctx.Get("Authorization"), ctx.Cookies(authTokenCookieName), ctx.Cookies(refreshTokenCookieName)
+		user, apiToken, err := s.getUser(authCtx, authHeader, authCookie)
+		if len(authHeader) == 0 && (errors.Is(err, fileshare.ErrAuthInvalid) || errors.Is(err, fileshare.ErrAuthMalformed)) {
+			// the access token expired or its session was revoked
+			err = nil
+			clearSessionCookies(ctx)
+		}
+
+		if len(authHeader) == 0 && err == nil && user != nil {
+			sessionID, _ := s.tokens.GetSession(authCookie)
+			ctx.Locals(sessionLocalKey, sessionID)
+		} else if len(authHeader) == 0 && err == nil && len(refreshCookie) > 0 {
+			user, err = s.refreshSession(authCtx, ctx, refreshCookie)
+		}
+
+		if err == nil && user == nil && s.anonymous {
 			user, err = s.users.GetUser(fileshare.UserNicknameAnonymous)
-			if err != nil {
-				return err
-			}
+		}
+
+		if err == nil && apiToken != nil && !apiTokenAllows(apiToken.Scope, ctx.Method(), ctx.Path()) {
+			err = newHttpError(fiber.StatusForbidden, "outside of token scope", fmt.Errorf("token %s of %s does not allow %s %s", apiToken.ID, apiToken.User, ctx.Method(), ctx.Path()))
+		}
 
+		tracing.End(span, err)
+		if err != nil {
+			return err
+		} else if user != nil {
 			fileshare.SetContextWithUser(ctx, user)
 		}
 
@@ -0,0 +1,152 @@
+package http
+
+import (
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/auth"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeOAuth2Provider accepts the code "good" if it receives the verifier of the login.
+type fakeOAuth2Provider struct{}
+
+func (fakeOAuth2Provider) Callback(login fileshare.OAuth2Login) (string, error) {
+	return "https://provider.example.com/authorize?state=" + login.State + "&verifier=" + login.Verifier, nil
+}
+
+func (fakeOAuth2Provider) Authenticate(payload_ any) (string, error) {
+	payload := payload_.(fileshare.OAuth2ProviderPayload)
+	if payload.Code != "good" || len(payload.Login.Verifier) == 0 {
+		return "", fileshare.NewError("bad code", fileshare.ErrAuthInvalid)
+	}
+
+	return "pippo", nil
+}
+
+func newTestLoginServer(t *testing.T) *httpServer {
+	sessions, _ := auth.NewSessionStore("")
+	tokens, err := auth.NewJsonWebTokenProvider([]byte("secret"), sessions, fileshare.Sessions{})
+	if err != nil {
+		t.Fatalf("failed creating tokens provider: %v", err)
+	}
+
+	users := auth.NewConfigUsersProvider([]fileshare.User{{Nickname: "pippo"}}, nil)
+	providers := map[string]fileshare.AuthProvider{"fake": fakeOAuth2Provider{}, "other": fakeOAuth2Provider{}}
+	return NewHTTPServer(0, false, false, []byte("secret"), nil, providers, users, tokens, sessions, nil, nil, nil).(*httpServer)
+}
+
+func startTestLogin(t *testing.T, s *httpServer, returnTo string) (*http.Cookie, string) {
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"provider": {"fake"}, "return_to": {returnTo}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.app.Test(req)
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	} else if resp.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid location: %v", err)
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == oauth2LoginCookieName {
+			return cookie, location.Query().Get("state")
+		}
+	}
+
+	t.Fatalf("missing login cookie")
+	return nil, ""
+}
+
+func finishTestLogin(t *testing.T, s *httpServer, cookie *http.Cookie, provider string, state string) *http.Response {
+	req := httptest.NewRequest("GET", "/login/"+provider+"/callback?code=good&state="+url.QueryEscape(state), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := s.app.Test(req)
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+
+	return resp
+}
+
+func TestOAuth2Login(t *testing.T) {
+	s := newTestLoginServer(t)
+
+	cookie, state := startTestLogin(t, s, "/files/a/b/")
+	if len(state) == 0 {
+		t.Fatalf("missing state")
+	}
+
+	resp := finishTestLogin(t, s, cookie, "fake", state)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/files/a/b/" {
+		t.Fatalf("unexpected response: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	var cleared bool
+	for _, c := range resp.Cookies() {
+		if c.Name == oauth2LoginCookieName && len(c.Value) == 0 {
+			cleared = true
+		}
+	}
+
+	if !cleared {
+		t.Fatalf("login cookie not cleared")
+	}
+
+	// each login has its own state
+	if _, other := startTestLogin(t, s, "/"); other == state {
+		t.Fatalf("state reused")
+	}
+}
+
+func TestOAuth2Login_Invalid(t *testing.T) {
+	s := newTestLoginServer(t)
+	cookie, state := startTestLogin(t, s, "/")
+
+	tampered := *cookie
+	tampered.Value = strings.Replace(tampered.Value, ".", "x.", 1)
+
+	tests := []struct {
+		name     string
+		cookie   *http.Cookie
+		provider string
+		state    string
+	}{
+		{"missing cookie", nil, "fake", state},
+		{"wrong state", cookie, "fake", state + "x"},
+		{"tampered cookie", &tampered, "fake", state},
+		{"other provider", cookie, "other", state},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if resp := finishTestLogin(t, s, test.cookie, test.provider, test.state); resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("unexpected status code: %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestSafeReturnTo(t *testing.T) {
+	for returnTo, expected := range map[string]string{
+		"":                     "/",
+		"/files/a/":            "/files/a/",
+		"//evil.example.com":   "/",
+		"/\\evil.example.com":  "/",
+		"https://evil.example": "/",
+		"files":                "/",
+	} {
+		if actual := safeReturnTo(returnTo); actual != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, returnTo, actual)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package http
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+func (s *httpServer) handleHealthz(ctx *fiber.Ctx) error {
+	return ctx.JSON(&healthResponse{Status: "ok"})
+}
+
+func (s *httpServer) handleReadyz(ctx *fiber.Ctx) error {
+	if s.shuttingDown.Load() {
+		return ctx.Status(fiber.StatusServiceUnavailable).JSON(&healthResponse{Status: "shutting down"})
+	}
+
+	// the details are only logged since probes are not authenticated
+	if err := s.storage.CheckHealth(ctx.UserContext()); err != nil {
+		s.log.WithError(err).Warnf("storage is not ready")
+		return ctx.Status(fiber.StatusServiceUnavailable).JSON(&healthResponse{Status: "storage unavailable"})
+	}
+
+	return ctx.JSON(&healthResponse{Status: "ok"})
+}
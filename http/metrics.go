@@ -0,0 +1,45 @@
+package http
+
+import (
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func newMetricsHandler() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		start := time.Now()
+		err := ctx.Next()
+
+		metrics.ObserveRequest(routeName(ctx), strings.Clone(ctx.Method()), ctx.Response().StatusCode(), time.Since(start))
+		return err
+	}
+}
+
+// routeName returns the route that handled the request, requests that did not reach a handler are
+// grouped together since only the index is routed at the root.
+func routeName(ctx *fiber.Ctx) string {
+	route := ctx.Route().Path
+	if route == "/" && ctx.Path() != "/" {
+		return "unmatched"
+	}
+
+	return route
+}
+
+func (s *httpServer) handleMetrics() fiber.Handler {
+	handler := adaptor.HTTPHandler(metrics.Handler())
+	return func(ctx *fiber.Ctx) error {
+		user := fileshare.UserFromContext(ctx)
+		if user == nil || !user.Admin {
+			return newHttpError(http.StatusForbidden, "cannot see metrics", fmt.Errorf("only admins can see metrics"))
+		}
+
+		return handler(ctx)
+	}
+}
@@ -0,0 +1,90 @@
+package http
+
+import (
+	"bufio"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetric returns the value of the series, labels must be sorted by name like in the exposition format.
+func scrapeMetric(t *testing.T, series string) float64 {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("invalid value for %s: %v", series, err)
+			}
+
+			return v
+		}
+	}
+
+	return 0
+}
+
+func TestMetrics_Requests(t *testing.T) {
+	s, cookie := newTestStorageServer(t, t.TempDir())
+
+	files := `fileshare_http_requests_total{method="GET",route="/files/*",status="200"}`
+	missing := `fileshare_http_requests_total{method="GET",route="/files/*",status="404"}`
+	unmatched := `fileshare_http_requests_total{method="GET",route="unmatched",status="404"}`
+	before := map[string]float64{files: scrapeMetric(t, files), missing: scrapeMetric(t, missing), unmatched: scrapeMetric(t, unmatched)}
+
+	for _, path := range []string{"/files/", "/files/missing", "/does/not/exist"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(cookie)
+		if _, err := s.app.Test(req); err != nil {
+			t.Fatalf("failed request: %v", err)
+		}
+	}
+
+	// the route is used instead of the path to keep the labels bounded
+	for series, count := range before {
+		if after := scrapeMetric(t, series); after != count+1 {
+			t.Fatalf("unexpected count for %s: %v", series, after)
+		}
+	}
+}
+
+func TestMetrics_Logins(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("test1234"), bcrypt.MinCost)
+	passwd, err := auth.NewPasswordAuthProvider(fileshare.AuthPassword{Users: []fileshare.AuthPasswordUser{{Nickname: "pippo", Passwd: string(hash)}}})
+	if err != nil {
+		t.Fatalf("failed creating auth provider: %v", err)
+	}
+
+	sessions, _ := auth.NewSessionStore("")
+	tokens, _ := auth.NewJsonWebTokenProvider([]byte("secret"), sessions, fileshare.Sessions{})
+	users := auth.NewConfigUsersProvider([]fileshare.User{{Nickname: "pippo"}}, nil)
+	s := NewHTTPServer(0, false, false, []byte("secret"), nil, map[string]fileshare.AuthProvider{auth.AuthProviderTypePassword: passwd}, users, tokens, sessions, nil, nil, nil).(*httpServer)
+
+	success := `fileshare_logins_total{provider="passwd",result="success"}`
+	failure := `fileshare_logins_total{provider="passwd",result="failure"}`
+	successBefore, failureBefore := scrapeMetric(t, success), scrapeMetric(t, failure)
+
+	for _, password := range []string{"wrong", "test1234"} {
+		form := url.Values{"provider": {auth.AuthProviderTypePassword}, "nickname": {"pippo"}, "password": {password}}
+		resp := testSessionForm(t, s, "POST", "/login", form)
+		if password == "test1234" && resp.StatusCode != http.StatusFound {
+			t.Fatalf("unexpected status code: %d", resp.StatusCode)
+		}
+	}
+
+	if count := scrapeMetric(t, success); count != successBefore+1 {
+		t.Fatalf("unexpected successful logins: %v", count)
+	} else if count := scrapeMetric(t, failure); count != failureBefore+1 {
+		t.Fatalf("unexpected failed logins: %v", count)
+	}
+}
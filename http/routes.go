@@ -1,40 +1,80 @@
 package http
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/devgianlu/go-fileshare"
 	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"github.com/devgianlu/go-fileshare/storage"
+	"github.com/devgianlu/go-fileshare/tracing"
 	"github.com/gofiber/fiber/v2"
 	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/attribute"
+	"hash"
 	"io"
 	"io/fs"
 	"math"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+func (s *httpServer) listFiles(ctx context.Context, dir string, user *fileshare.User) ([]*fileshare.FileStat, error) {
+	entries, err := s.storage.ReadDir(ctx, dir, user)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*fileshare.FileStat, 0, len(entries))
+	for _, entry := range entries {
+		stat, err := s.storage.Stat(ctx, filepath.Join(dir, entry.Name()), user)
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		files = append(files, stat)
+	}
+
+	return files, nil
+}
+
 type indexViewData struct {
 	User              *fileshare.User
-	Files             []fs.DirEntry
+	Files             []*fileshare.FileStat
 	FilesPrefixURL    string
 	FilesCanWriteHere bool
+	FilesVersions     bool
+	FilesWatch        bool
+	Trash             bool
+	APITokens         bool
+	CSRF              string
 }
 
 func (s *httpServer) handleIndex(ctx *fiber.Ctx) error {
 	user := fileshare.UserFromContext(ctx)
 
 	var canWrite bool
-	var files []fs.DirEntry
+	var files []*fileshare.FileStat
 	if user != nil {
 		canWrite = s.storage.CanWrite(".", user)
 
 		var err error
-		files, err = s.storage.ReadDir(".", user)
+		files, err = s.listFiles(ctx.UserContext(), ".", user)
+		s.recordAudit(s.newAuditEntry(ctx, fileshare.AuditActionList, "."), 0, err)
 		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fileshare.ErrStorageReadForbidden) {
 			return newHttpError(fiber.StatusNotFound, "directory not found", err)
 		} else if err != nil {
@@ -47,40 +87,35 @@ func (s *httpServer) handleIndex(ctx *fiber.Ctx) error {
 		Files:             files,
 		FilesPrefixURL:    "/",
 		FilesCanWriteHere: canWrite,
+		FilesVersions:     s.storage.SupportsVersions(),
+		FilesWatch:        s.storage.SupportsWatch(),
+		Trash:             s.storage.SupportsTrash(),
+		APITokens:         s.apiTokens != nil,
+		CSRF:              s.requestCSRFToken(ctx),
 	})
 }
 
 type filesViewData struct {
-	Files             []fs.DirEntry
+	Anonymous         bool
+	Files             []*fileshare.FileStat
 	FilesPrefixURL    string
 	FilesCanWriteHere bool
+	FilesVersions     bool
+	FilesWatch        bool
+	CSRF              string
 }
 
 func (s *httpServer) handleFiles(ctx *fiber.Ctx) error {
 	user := fileshare.UserFromContext(ctx)
 	if user == nil {
-		return newHttpError(http.StatusForbidden, "cannot see files", fmt.Errorf("unauthenticated users cannot see files"))
+		// come back here after logging in
+		return ctx.Redirect("/login?return_to=" + url.QueryEscape(ctx.OriginalURL()))
 	}
 
-	var paths []string
-	for i := 1; true; i++ {
-		path := ctx.Params(fmt.Sprintf("*%d", i))
-		if len(path) == 0 {
-			break
-		}
+	dir, _ := pathFromParams(ctx)
 
-		path, _ = url.PathUnescape(path)
-		paths = append(paths, path)
-	}
-
-	var dir string
-	if len(paths) > 0 {
-		dir = filepath.Join(paths...)
-	} else {
-		dir = "."
-	}
-
-	files, err := s.storage.ReadDir(dir, user)
+	files, err := s.listFiles(ctx.UserContext(), dir, user)
+	s.recordAudit(s.newAuditEntry(ctx, fileshare.AuditActionList, dir), 0, err)
 	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fileshare.ErrStorageReadForbidden) {
 		return newHttpError(fiber.StatusNotFound, "directory not found", err)
 	} else if err != nil {
@@ -88,9 +123,13 @@ func (s *httpServer) handleFiles(ctx *fiber.Ctx) error {
 	}
 
 	return ctx.Render("files", &filesViewData{
+		Anonymous:         user.Anonymous(),
 		Files:             files,
 		FilesPrefixURL:    filepath.Clean(fmt.Sprintf("/%s", dir)) + "/",
 		FilesCanWriteHere: s.storage.CanWrite(dir, user),
+		FilesVersions:     s.storage.SupportsVersions(),
+		FilesWatch:        s.storage.SupportsWatch(),
+		CSRF:              s.requestCSRFToken(ctx),
 	})
 }
 
@@ -100,45 +139,96 @@ func (s *httpServer) handleDownload(ctx *fiber.Ctx) error {
 		return newHttpError(http.StatusForbidden, "cannot download files", fmt.Errorf("unauthenticated users cannot download files"))
 	}
 
-	var paths []string
-	for i := 1; true; i++ {
-		path := ctx.Params(fmt.Sprintf("*%d", i))
-		if len(path) == 0 {
-			break
-		}
+	path, _ := pathFromParams(ctx)
+	entry := s.newAuditEntry(ctx, fileshare.AuditActionDownload, path)
 
-		path, _ = url.PathUnescape(path)
-		paths = append(paths, path)
-	}
-
-	var path string
-	if len(paths) > 0 {
-		path = filepath.Join(paths...)
-	} else {
-		path = "."
+	stat, err := s.storage.Stat(ctx.UserContext(), path, user)
+	if err != nil {
+		s.recordAudit(entry, 0, err)
 	}
 
-	// open file for stats and eventually reading
-	file, stat, err := s.storage.OpenFile(path, user)
 	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fileshare.ErrStorageReadForbidden) {
 		return newHttpError(fiber.StatusNotFound, "file not found", err)
 	} else if err != nil {
 		return err
 	}
 
-	if stat.IsDir() {
+	if stat.IsDir {
 		// fix root archive name
-		name := stat.Name()
+		name := stat.Name
 		if name == "." {
 			name = "files"
 		}
 
 		ctx.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", strconv.Quote(name+".tar.gz")))
 
-		return compressFolderToArchive(s.storage, user, path, ctx)
+		s.streamBody(ctx, func(ctx context.Context, w io.Writer) error {
+			start, done := time.Now(), metrics.TransferStarted(metrics.TransferDownload)
+
+			counter := &countingWriter{Writer: w}
+			err := compressFolderToArchive(ctx, s.storage, user, path, counter)
+			metrics.ObserveArchive(time.Since(start))
+			done(counter.bytes)
+
+			s.recordAudit(entry, counter.bytes, err)
+			return err
+		})
+		return nil
 	} else {
-		ctx.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", strconv.Quote(stat.Name())))
+		ctx.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", strconv.Quote(stat.Name)))
+		ctx.Set("Last-Modified", stat.ModTime.UTC().Format(http.TimeFormat))
+		if len(stat.MimeType) > 0 {
+			ctx.Set("Content-Type", stat.MimeType)
+		}
+
+		if sum, err := hex.DecodeString(stat.Checksums[storage.ChecksumSHA256]); err == nil && len(sum) > 0 {
+			encoded := base64.StdEncoding.EncodeToString(sum)
+			ctx.Set("Repr-Digest", fmt.Sprintf("sha-256=:%s:", encoded))
+			ctx.Set("Digest", fmt.Sprintf("SHA-256=%s", encoded))
+		}
 
+		file, stat, err := s.storage.OpenFile(ctx.UserContext(), path, user)
+		if err != nil {
+			s.recordAudit(entry, 0, err)
+		}
+
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fileshare.ErrStorageReadForbidden) {
+			return newHttpError(fiber.StatusNotFound, "file not found", err)
+		} else if err != nil {
+			return err
+		}
+
+		// resume downloads from where they stopped, if the file can seek
+		if seeker, ok := file.(io.Seeker); ok && stat.Size() < math.MaxInt {
+			ctx.Set(fiber.HeaderAcceptRanges, "bytes")
+
+			if byteRange := ctx.Get(fiber.HeaderRange); len(byteRange) > 0 && ifRangeMatches(ctx) {
+				start, end, err := fasthttp.ParseByteRange([]byte(byteRange), int(stat.Size()))
+				if err != nil {
+					_ = file.Close()
+					s.recordAudit(entry, 0, err)
+					ctx.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", stat.Size()))
+					return newHttpError(fiber.StatusRequestedRangeNotSatisfiable, "invalid range", err)
+				}
+
+				if _, err := seeker.Seek(int64(start), io.SeekStart); err != nil {
+					_ = file.Close()
+					s.recordAudit(entry, 0, err)
+					return err
+				}
+
+				ctx.Status(fiber.StatusPartialContent)
+				ctx.Context().Response.Header.SetContentRange(start, end, int(stat.Size()))
+
+				file = newDownloadReader(s, struct {
+					io.Reader
+					io.Closer
+				}{io.LimitReader(file, int64(end-start+1)), file}, entry)
+				return ctx.SendStream(file, end-start+1)
+			}
+		}
+
+		file = newDownloadReader(s, file, entry)
 		if stat.Size() >= math.MaxInt {
 			// download file chunked
 			return ctx.SendStream(file)
@@ -148,29 +238,19 @@ func (s *httpServer) handleDownload(ctx *fiber.Ctx) error {
 	}
 }
 
+// ifRangeMatches checks the file did not change since the part the client has, otherwise it gets the whole file.
+func ifRangeMatches(ctx *fiber.Ctx) bool {
+	ifRange := ctx.Get(fiber.HeaderIfRange)
+	return len(ifRange) == 0 || ifRange == string(ctx.Response().Header.Peek(fiber.HeaderLastModified))
+}
+
 func (s *httpServer) handleUpload(ctx *fiber.Ctx) error {
 	user := fileshare.UserFromContext(ctx)
 	if user == nil {
 		return newHttpError(http.StatusForbidden, "cannot upload files", fmt.Errorf("unauthenticated users cannot upload files"))
 	}
 
-	var paths []string
-	for i := 1; true; i++ {
-		path := ctx.Params(fmt.Sprintf("*%d", i))
-		if len(path) == 0 {
-			break
-		}
-
-		path, _ = url.PathUnescape(path)
-		paths = append(paths, path)
-	}
-
-	var path string
-	if len(paths) > 0 {
-		path = filepath.Join(paths...)
-	} else {
-		path = "."
-	}
+	path, paths := pathFromParams(ctx)
 
 	form, err := ctx.MultipartForm()
 	if errors.Is(err, fasthttp.ErrNoMultipartForm) {
@@ -182,54 +262,355 @@ func (s *httpServer) handleUpload(ctx *fiber.Ctx) error {
 		return newHttpError(http.StatusBadRequest, "missing files", err)
 	}
 
-	for _, formFile := range formFiles {
-		uploadFile, err := formFile.Open()
+	expected, err := expectedDigests(ctx.Get("Repr-Digest"), form.Value, len(formFiles))
+	if err != nil {
+		return newHttpError(http.StatusBadRequest, "invalid digest", err)
+	}
+
+	for i, formFile := range formFiles {
+		name := filepath.Join(path, formFile.Filename)
+
+		done := metrics.TransferStarted(metrics.TransferUpload)
+		written, err := s.uploadFile(ctx.UserContext(), name, formFile, expected[i], user)
+		done(written)
+
+		s.recordAudit(s.newAuditEntry(ctx, fileshare.AuditActionUpload, name), written, err)
 		if err != nil {
 			return err
 		}
+	}
+
+	return ctx.Redirect("/files/" + strings.Join(paths, "/"))
+}
+
+// uploadFile stores a single file of the upload, verifying the expected digests if any.
+func (s *httpServer) uploadFile(ctx context.Context, name string, formFile *multipart.FileHeader, expected map[string][]byte, user *fileshare.User) (int64, error) {
+	uploadFile, err := formFile.Open()
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() { _ = uploadFile.Close() }()
+
+	localFile, err := s.storage.CreateFile(ctx, name, user)
+	if err != nil {
+		return 0, err
+	}
+
+	// compute the digests while copying to verify them before committing
+	var reader io.Reader = uploadFile
+	hashes := map[string]hash.Hash{}
+	for algorithm := range expected {
+		hashes[algorithm], _ = storage.NewChecksumHash(algorithm)
+		reader = io.TeeReader(reader, hashes[algorithm])
+	}
+
+	written, err := io.Copy(localFile, reader)
+	if err != nil {
+		_ = localFile.Abort()
+		return written, err
+	}
+
+	for algorithm, sum := range expected {
+		if actual := hashes[algorithm].Sum(nil); !bytes.Equal(actual, sum) {
+			_ = localFile.Abort()
+			return written, newHttpError(http.StatusBadRequest, "digest mismatch", fmt.Errorf("%s mismatch for %s: expected %x, got %x", algorithm, formFile.Filename, sum, actual))
+		}
+	}
+
+	if err := localFile.Close(); err != nil {
+		return written, err
+	}
+
+	return written, nil
+}
+
+func (s *httpServer) handleDelete(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil {
+		return newHttpError(http.StatusForbidden, "cannot delete files", fmt.Errorf("unauthenticated users cannot delete files"))
+	}
+
+	path, paths := pathFromParams(ctx)
+	if path == "." {
+		return newHttpError(fiber.StatusBadRequest, "cannot delete root", fmt.Errorf("cannot delete root directory"))
+	}
+
+	err := s.storage.Remove(ctx.UserContext(), path, user)
+	s.recordAudit(s.newAuditEntry(ctx, fileshare.AuditActionDelete, path), 0, err)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newHttpError(fiber.StatusNotFound, "file not found", err)
+	} else if errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		return newHttpError(fiber.StatusForbidden, "cannot delete file", err)
+	} else if err != nil {
+		return err
+	}
+
+	return ctx.Redirect("/files/" + strings.Join(paths[:len(paths)-1], "/"))
+}
+
+type trashViewData struct {
+	Items []fileshare.TrashItem
+	All   bool
+	CSRF  string
+}
+
+func (s *httpServer) handleTrash(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil {
+		return newHttpError(http.StatusForbidden, "cannot see trash", fmt.Errorf("unauthenticated users cannot see trash"))
+	}
+
+	items, err := s.storage.ListTrash(ctx.UserContext(), user)
+	if errors.Is(err, fileshare.ErrStorageTrashUnsupported) {
+		return newHttpError(fiber.StatusNotFound, "trash not available", err)
+	} else if err != nil {
+		return err
+	}
+
+	// most recent first
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+
+	return ctx.Render("trash", &trashViewData{
+		Items: items,
+		All:   user.Admin,
+		CSRF:  s.requestCSRFToken(ctx),
+	})
+}
+
+func (s *httpServer) handleRestoreTrash(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil {
+		return newHttpError(http.StatusForbidden, "cannot restore from trash", fmt.Errorf("unauthenticated users cannot restore from trash"))
+	}
+
+	nickname, _ := url.PathUnescape(ctx.Params("user"))
+	id := ctx.Params("id")
+
+	// find where the item goes for the audit log
+	var itemPath string
+	if items, err := s.storage.ListTrash(ctx.UserContext(), user); err == nil {
+		for _, item := range items {
+			if item.User == nickname && item.ID == id {
+				itemPath = item.Path
+				break
+			}
+		}
+	}
 
-		localFile, err := s.storage.CreateFile(filepath.Join(path, formFile.Filename), user)
+	err := s.storage.RestoreFromTrash(ctx.UserContext(), nickname, id, user)
+	s.recordAudit(s.newAuditEntry(ctx, fileshare.AuditActionRestore, itemPath), 0, err)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fileshare.ErrStorageTrashUnsupported) {
+		return newHttpError(fiber.StatusNotFound, "item not found", err)
+	} else if errors.Is(err, fs.ErrExist) {
+		return newHttpError(fiber.StatusConflict, "original location is not empty", err)
+	} else if errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		return newHttpError(fiber.StatusForbidden, "cannot restore item", err)
+	} else if err != nil {
+		return err
+	}
+
+	return ctx.Redirect("/trash")
+}
+
+func (s *httpServer) handleChecksums(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil {
+		return newHttpError(http.StatusForbidden, "cannot download checksums", fmt.Errorf("unauthenticated users cannot download checksums"))
+	}
+
+	path, _ := pathFromParams(ctx)
+
+	if !s.storage.CanRead(path, user) {
+		return newHttpError(fiber.StatusNotFound, "directory not found", fmt.Errorf("user %s cannot read %s", user.Nickname, path))
+	}
+
+	ctx.Set("Content-Type", "text/plain; charset=utf-8")
+	ctx.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", strconv.Quote("SHA256SUMS")))
+
+	s.streamBody(ctx, func(ctx context.Context, w io.Writer) error {
+		return writeChecksumsList(ctx, s.storage, user, path, w)
+	})
+	return nil
+}
+
+func (s *httpServer) handleEvents(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil {
+		return newHttpError(http.StatusForbidden, "cannot watch files", fmt.Errorf("unauthenticated users cannot watch files"))
+	} else if !s.storage.SupportsWatch() {
+		return newHttpError(http.StatusNotFound, "changes not available", fileshare.ErrStorageWatchUnsupported)
+	}
+
+	dir, _ := pathFromParams(ctx)
+
+	if !s.storage.CanRead(dir, user) {
+		return newHttpError(fiber.StatusNotFound, "directory not found", fmt.Errorf("user %s cannot read %s", user.Nickname, dir))
+	}
+
+	ctx.Set("Content-Type", "text/event-stream")
+	ctx.Set("Cache-Control", "no-cache")
+
+	s.streamBody(ctx, func(ctx context.Context, w io.Writer) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		// the stream ends when shutdown starts
+		stop := context.AfterFunc(s.watchCtx, cancel)
+		defer stop()
+
+		events, err := s.storage.Watch(ctx, dir, user)
 		if err != nil {
-			_ = uploadFile.Close()
 			return err
 		}
 
-		if _, err := io.Copy(localFile, uploadFile); err != nil {
-			_ = localFile.Close()
-			_ = uploadFile.Close()
+		return writeEvents(events, w)
+	})
+	return nil
+}
+
+func (s *httpServer) handleWebhookDeliveries(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || !user.Admin {
+		return newHttpError(http.StatusForbidden, "cannot see webhooks", fmt.Errorf("only admins can see webhooks"))
+	}
+
+	deliveries := []fileshare.WebhookDelivery{}
+	if s.webhooks != nil {
+		deliveries = s.webhooks.Deliveries()
+	}
+
+	return ctx.JSON(deliveries)
+}
+
+type versionsViewData struct {
+	Name       string
+	FileURL    string
+	Versions   []fileshare.FileVersion
+	CanRestore bool
+	ParentURL  string
+	CSRF       string
+}
+
+func (s *httpServer) handleVersions(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil {
+		return newHttpError(http.StatusForbidden, "cannot see versions", fmt.Errorf("unauthenticated users cannot see versions"))
+	}
+
+	path, paths := pathFromParams(ctx)
+
+	// download a specific version
+	if id := ctx.Query("id"); len(id) > 0 {
+		entry := s.newAuditEntry(ctx, fileshare.AuditActionDownload, path)
+
+		file, stat, err := s.storage.OpenVersion(ctx.UserContext(), path, id, user)
+		if err != nil {
+			s.recordAudit(entry, 0, err)
+		}
+
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fileshare.ErrStorageReadForbidden) || errors.Is(err, fileshare.ErrStorageVersionsUnsupported) {
+			return newHttpError(fiber.StatusNotFound, "version not found", err)
+		} else if err != nil {
 			return err
 		}
 
-		_ = localFile.Close()
-		_ = uploadFile.Close()
+		file = newDownloadReader(s, file, entry)
+
+		ctx.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", strconv.Quote(filepath.Base(path))))
+
+		if stat.Size() >= math.MaxInt {
+			return ctx.SendStream(file)
+		} else {
+			return ctx.SendStream(file, int(stat.Size()))
+		}
 	}
 
-	return ctx.Redirect("/files/" + strings.Join(paths, "/"))
+	versions, err := s.storage.ListVersions(ctx.UserContext(), path, user)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fileshare.ErrStorageReadForbidden) || errors.Is(err, fileshare.ErrStorageVersionsUnsupported) {
+		return newHttpError(fiber.StatusNotFound, "file not found", err)
+	} else if err != nil {
+		return err
+	}
+
+	return ctx.Render("versions", &versionsViewData{
+		Name:       filepath.Base(path),
+		FileURL:    "/" + strings.Join(paths, "/"),
+		Versions:   versions,
+		CanRestore: s.storage.CanWrite(path, user),
+		ParentURL:  "/" + strings.Join(paths[:max(len(paths)-1, 0)], "/"),
+		CSRF:       s.requestCSRFToken(ctx),
+	})
+}
+
+type restoreVersionBody struct {
+	ID string `schema:"id,required"`
+}
+
+func (s *httpServer) handleRestoreVersion(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil {
+		return newHttpError(http.StatusForbidden, "cannot restore versions", fmt.Errorf("unauthenticated users cannot restore versions"))
+	}
+
+	path, paths := pathFromParams(ctx)
+
+	var body restoreVersionBody
+	if err := ctx.BodyParser(&body); err != nil {
+		return newHttpError(fiber.StatusBadRequest, "invalid body", err)
+	}
+
+	err := s.storage.RestoreVersion(ctx.UserContext(), path, body.ID, user)
+	s.recordAudit(s.newAuditEntry(ctx, fileshare.AuditActionRestore, path), 0, err)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fileshare.ErrStorageVersionsUnsupported) {
+		return newHttpError(fiber.StatusNotFound, "version not found", err)
+	} else if errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		return newHttpError(fiber.StatusForbidden, "cannot restore version", err)
+	} else if err != nil {
+		return err
+	}
+
+	return ctx.Redirect("/versions/" + strings.Join(paths, "/"))
 }
 
 type loginViewData struct {
 	PasswordAuth bool
+	LDAPAuth     bool
 	GithubAuth   bool
+	OAuth2Auth   bool
+	OIDCAuth     bool
+	ReturnTo     string
 }
 
 func (s *httpServer) handleLogin(ctx *fiber.Ctx) error {
+	returnTo := safeReturnTo(ctx.Query("return_to"))
 	if user := fileshare.UserFromContext(ctx); user != nil && !user.Anonymous() {
-		return ctx.Redirect("/")
+		return ctx.Redirect(returnTo)
 	}
 
 	_, passwordOk := s.auth[auth.AuthProviderTypePassword]
+	_, ldapOk := s.auth[auth.AuthProviderTypeLDAP]
 	_, githubOk := s.auth[auth.AuthProviderTypeGithub]
+	_, oauth2Ok := s.auth[auth.AuthProviderTypeOAuth2]
+	_, oidcOk := s.auth[auth.AuthProviderTypeOIDC]
 
 	return ctx.Render("login", &loginViewData{
 		PasswordAuth: passwordOk,
+		LDAPAuth:     ldapOk,
 		GithubAuth:   githubOk,
+		OAuth2Auth:   oauth2Ok,
+		OIDCAuth:     oidcOk,
+		ReturnTo:     returnTo,
 	})
 }
 
 type loginBody struct {
 	Provider string `schema:"provider,required"`
+	ReturnTo string `schema:"return_to" form:"return_to"`
 
-	// Only for "passwd" provider
+	// Only for "passwd" and "ldap" providers
 	Nickname string `schema:"nickname"`
 	Password string `schema:"password"`
 }
@@ -247,41 +628,39 @@ func (s *httpServer) handlePostLogin(ctx *fiber.Ctx) error {
 
 	switch provider := provider.(type) {
 	case fileshare.OAuth2AuthProvider:
-		url, err := provider.Callback()
+		// each attempt has its own state and verifier, bound to this browser until the callback
+		login := auth.NewOAuth2Login()
+		url, err := provider.Callback(login)
 		if err != nil {
 			return err
 		}
 
+		if err := s.setLoginCookie(ctx, &oauth2LoginCookie{Provider: body.Provider, Login: login, ReturnTo: safeReturnTo(body.ReturnTo)}); err != nil {
+			return err
+		}
+
 		return ctx.Redirect(url)
 	default:
 		var providerPayload any
 		switch body.Provider {
-		case auth.AuthProviderTypePassword:
+		case auth.AuthProviderTypePassword, auth.AuthProviderTypeLDAP:
 			providerPayload = auth.PasswordAuthProviderPayload{Nickname: body.Nickname, Password: body.Password}
 		default:
 			panic("provider not implemented")
 		}
 
-		nickname, err := provider.Authenticate(providerPayload)
-		if err != nil {
-			return newHttpError(fiber.StatusUnauthorized, "invalid auth credentials", err)
-		}
-
-		// if we get here, authentication is good
-		user, err := s.users.GetUser(nickname)
-		if err != nil {
-			return err
-		} else if user == nil {
-			return newHttpError(fiber.StatusForbidden, "unknown user", fmt.Errorf("no user for nickname %s", body.Nickname))
-		}
+		entry := s.newAuditEntry(ctx, fileshare.AuditActionLogin, "")
+		entry.User = body.Nickname
 
-		token, err := s.tokens.GetToken(nickname)
+		_, tokens, err := s.login(ctx, body.Provider, provider, providerPayload)
+		metrics.ObserveLogin(body.Provider, err == nil)
+		s.recordAudit(entry, 0, err)
 		if err != nil {
 			return err
 		}
 
-		ctx.Cookie(&fiber.Cookie{Name: authTokenCookieName, Value: token, HTTPOnly: true, Expires: time.Now().Add(7 * 24 * time.Hour)})
-		return ctx.Redirect("/")
+		setSessionCookies(ctx, tokens)
+		return ctx.Redirect(safeReturnTo(body.ReturnTo))
 	}
 }
 
@@ -302,31 +681,64 @@ func (s *httpServer) handleOauthLoginCallback(ctx *fiber.Ctx) error {
 		return newHttpError(fiber.StatusBadRequest, "provider not available", fmt.Errorf("auth provider %s is not oauth2", providerKey))
 	}
 
-	nickname, err := provider.Authenticate(fileshare.OAuth2ProviderPayload{Code: code, State: state})
+	cookie, err := s.popLoginCookie(ctx)
 	if err != nil {
-		return newHttpError(fiber.StatusUnauthorized, "invalid auth credentials", err)
+		return newHttpError(fiber.StatusBadRequest, "invalid login attempt", err)
+	} else if cookie.Provider != providerKey {
+		return newHttpError(fiber.StatusBadRequest, "invalid login attempt", fmt.Errorf("login started with %s, not %s", cookie.Provider, providerKey))
+	} else if !hmac.Equal([]byte(cookie.Login.State), []byte(state)) {
+		return newHttpError(fiber.StatusBadRequest, "invalid login attempt", fmt.Errorf("invalid state"))
 	}
 
-	// if we get here, authentication is good
-	user, err := s.users.GetUser(nickname)
+	entry := s.newAuditEntry(ctx, fileshare.AuditActionLogin, "")
+
+	nickname, tokens, err := s.login(ctx, providerKey, provider, fileshare.OAuth2ProviderPayload{Code: code, Login: cookie.Login})
+	entry.User = nickname
+	metrics.ObserveLogin(providerKey, err == nil)
+	s.recordAudit(entry, 0, err)
 	if err != nil {
 		return err
-	} else if user == nil {
-		return newHttpError(fiber.StatusForbidden, "unknown user", fmt.Errorf("no user for nickname %s", nickname))
 	}
 
-	token, err := s.tokens.GetToken(nickname)
+	setSessionCookies(ctx, tokens)
+	return ctx.Redirect(cookie.ReturnTo)
+}
+
+// login authenticates the user with the provider and returns their nickname and the tokens of a new session.
+func (s *httpServer) login(ctx *fiber.Ctx, providerKey string, provider fileshare.AuthProvider, payload any) (string, *fileshare.SessionTokens, error) {
+	_, span := tracing.Start(ctx.UserContext(), "auth.Authenticate", attribute.String("fileshare.auth.provider", providerKey))
+	nickname, err := provider.Authenticate(payload)
+	tracing.End(span, err)
+	if err != nil {
+		return "", nil, newHttpError(fiber.StatusUnauthorized, "invalid auth credentials", err)
+	}
+
+	// if we get here, authentication is good
+	user, err := s.users.GetUser(nickname)
 	if err != nil {
-		return err
+		return nickname, nil, err
+	} else if user == nil {
+		return nickname, nil, newHttpError(fiber.StatusForbidden, "unknown user", fmt.Errorf("no user for nickname %s", nickname))
 	}
 
-	ctx.Cookie(&fiber.Cookie{Name: authTokenCookieName, Value: token, HTTPOnly: true, Expires: time.Now().Add(7 * 24 * time.Hour)})
-	return ctx.Redirect("/")
+	tokens, err := s.tokens.NewSession(nickname, ctx.IP(), string(ctx.Request().Header.UserAgent()))
+	return nickname, tokens, err
 }
 
 func (s *httpServer) handleLogout(ctx *fiber.Ctx) error {
+	if user := fileshare.UserFromContext(ctx); user != nil && !user.Anonymous() {
+		// the tokens of the session stop working, wherever they are
+		if sessionID, _ := ctx.Locals(sessionLocalKey).(string); len(sessionID) > 0 {
+			if err := s.sessions.Revoke(user.Nickname, sessionID); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+
+		s.recordAudit(s.newAuditEntry(ctx, fileshare.AuditActionLogout, ""), 0, nil)
+	}
+
 	fileshare.SetContextWithUser(ctx, nil)
 
-	ctx.ClearCookie(authTokenCookieName)
+	clearSessionCookies(ctx)
 	return ctx.Redirect("/")
 }
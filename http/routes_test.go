@@ -0,0 +1,165 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/storage"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestStorageServer serves a local directory with checksums, the returned cookie is of an admin.
+func newTestStorageServer(t *testing.T, base string) (*httpServer, *http.Cookie) {
+	local, err := storage.NewLocalStorageProvider(base, "")
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	checksums, err := storage.NewChecksumStorageProvider(local, fileshare.StorageChecksums{})
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	sessions, _ := auth.NewSessionStore("")
+	tokens, _ := auth.NewJsonWebTokenProvider([]byte("secret"), sessions, fileshare.Sessions{})
+	users := auth.NewConfigUsersProvider([]fileshare.User{{Nickname: "admin", Admin: true}}, nil)
+	st := storage.NewACLStorageProvider(checksums, nil, nil)
+	s := NewHTTPServer(0, false, false, []byte("secret"), st, nil, users, tokens, sessions, nil, nil, nil).(*httpServer)
+
+	login, err := tokens.NewSession("admin", "", "")
+	if err != nil {
+		t.Fatalf("failed creating session: %v", err)
+	}
+
+	return s, &http.Cookie{Name: authTokenCookieName, Value: login.AccessToken}
+}
+
+func testUpload(t *testing.T, s *httpServer, cookie *http.Cookie, name string, data string, digest string) *http.Response {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("csrf", testCSRFToken(s, cookie))
+	fw, _ := mw.CreateFormFile("file", name)
+	_, _ = fw.Write([]byte(data))
+	_ = mw.Close()
+
+	req := httptest.NewRequest("POST", "/upload/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Repr-Digest", digest)
+	req.AddCookie(cookie)
+
+	resp, err := s.app.Test(req)
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+
+	return resp
+}
+
+func TestUploadDigest(t *testing.T) {
+	base := t.TempDir()
+	s, cookie := newTestStorageServer(t, base)
+
+	sum := sha256.Sum256([]byte("hello"))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+
+	// a mismatching upload is not stored
+	if resp := testUpload(t, s, cookie, "bad.txt", "tampered", digest); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if _, err := os.Stat(filepath.Join(base, "bad.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected missing file: %v", err)
+	}
+
+	if resp := testUpload(t, s, cookie, "good.txt", "hello", digest); resp.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// the checksum computed while storing the file is served on download
+	req := httptest.NewRequest("GET", "/download/good.txt", nil)
+	req.AddCookie(cookie)
+	resp, err := s.app.Test(req)
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	} else if resp.Header.Get("Repr-Digest") != digest {
+		t.Fatalf("unexpected digest: %s", resp.Header.Get("Repr-Digest"))
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	local, err := storage.NewLocalStorageProvider(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	t.Setenv("FILESHARE_TEST_KEY", strings.Repeat("ab", 32))
+	encrypted, err := storage.NewEncryptedStorageProvider(local, fileshare.StorageEncryption{KeyEnv: "FILESHARE_TEST_KEY"})
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	sessions, _ := auth.NewSessionStore("")
+	tokens, _ := auth.NewJsonWebTokenProvider([]byte("secret"), sessions, fileshare.Sessions{})
+	users := auth.NewConfigUsersProvider([]fileshare.User{{Nickname: "admin", Admin: true}}, nil)
+	s := NewHTTPServer(0, false, false, []byte("secret"), storage.NewACLStorageProvider(encrypted, nil, nil), nil, users, tokens, sessions, nil, nil, nil).(*httpServer)
+	login, _ := tokens.NewSession("admin", "", "")
+
+	// three chunks of 64 KiB and a bit
+	data := make([]byte, 3*64*1024+100)
+	_, _ = rand.Read(data)
+
+	w, _ := encrypted.CreateFile(context.Background(), "big.bin")
+	_, _ = w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed writing file: %v", err)
+	}
+
+	download := func(byteRange string, ifRange string) *http.Response {
+		req := httptest.NewRequest("GET", "/download/big.bin", nil)
+		req.Header.Set("Range", byteRange)
+		req.Header.Set("If-Range", ifRange)
+		req.AddCookie(&http.Cookie{Name: authTokenCookieName, Value: login.AccessToken})
+
+		resp, err := s.app.Test(req)
+		if err != nil {
+			t.Fatalf("failed request: %v", err)
+		}
+
+		return resp
+	}
+
+	// the range crosses the end of the first chunk
+	resp := download("bytes=65000-70000", "")
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if resp.Header.Get("Content-Range") != "bytes 65000-70000/"+strconv.Itoa(len(data)) {
+		t.Fatalf("unexpected content range: %s", resp.Header.Get("Content-Range"))
+	} else if !bytes.Equal(body, data[65000:70001]) {
+		t.Fatalf("unexpected content of %d bytes", len(body))
+	}
+
+	if body, _ := io.ReadAll(download("bytes=-50", "").Body); !bytes.Equal(body, data[len(data)-50:]) {
+		t.Fatalf("unexpected suffix of %d bytes", len(body))
+	} else if resp := download("bytes=999999-", ""); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// the file changed since the client got the first part
+	if resp := download("bytes=100-", "Mon, 02 Jan 2006 15:04:05 GMT"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if body, _ := io.ReadAll(resp.Body); !bytes.Equal(body, data) {
+		t.Fatalf("unexpected content of %d bytes", len(body))
+	} else if resp := download("bytes=100-", resp.Header.Get("Last-Modified")); resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+}
@@ -1,36 +1,64 @@
 package http
 
 import (
+	"context"
 	"fmt"
 	"github.com/devgianlu/go-fileshare"
 	"github.com/devgianlu/go-fileshare/html"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type httpServer struct {
 	port      int
 	anonymous bool
+	metrics   bool
+	secret    []byte
 
 	log *logrus.Entry
 	app *fiber.App
 
-	storage fileshare.AuthenticatedStorageProvider
-	auth    map[string]fileshare.AuthProvider
-	tokens  fileshare.TokenProvider
-	users   fileshare.UsersProvider
+	storage   fileshare.AuthenticatedStorageProvider
+	auth      map[string]fileshare.AuthProvider
+	tokens    fileshare.TokenProvider
+	sessions  fileshare.SessionStore
+	apiTokens fileshare.APITokenStore
+	users     fileshare.UsersProvider
+	webhooks  fileshare.WebhookDispatcher
+	auditLog  fileshare.AuditLog
+
+	// ctx is the parent of all requests contexts, it is cancelled to abort them on shutdown
+	ctx          context.Context
+	cancel       context.CancelFunc
+	active       sync.WaitGroup
+	shuttingDown atomic.Bool
+
+	// watchCtx is cancelled as soon as shutdown starts, watches never end on their own
+	watchCtx    context.Context
+	watchCancel context.CancelFunc
 }
 
-func NewHTTPServer(port int, anonymous bool, storage fileshare.AuthenticatedStorageProvider, auth map[string]fileshare.AuthProvider, users fileshare.UsersProvider, tokens fileshare.TokenProvider) fileshare.HttpServer {
-	s := httpServer{}
+func NewHTTPServer(port int, anonymous bool, metrics bool, secret []byte, storage fileshare.AuthenticatedStorageProvider, auth map[string]fileshare.AuthProvider, users fileshare.UsersProvider, tokens fileshare.TokenProvider, sessions fileshare.SessionStore, apiTokens fileshare.APITokenStore, webhooks fileshare.WebhookDispatcher, auditLog fileshare.AuditLog) fileshare.HttpServer {
+	s := &httpServer{}
 	s.log = logrus.WithField("module", "http")
 	s.port = port
 	s.anonymous = anonymous
+	s.metrics = metrics
+	s.secret = secret
 	s.storage = storage
 	s.auth = auth
 	s.users = users
 	s.tokens = tokens
+	s.sessions = sessions
+	s.apiTokens = apiTokens
+	s.webhooks = webhooks
+	s.auditLog = auditLog
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.watchCtx, s.watchCancel = context.WithCancel(context.Background())
 
 	s.app = fiber.New(fiber.Config{
 		Views:             html.NewEngine(),
@@ -44,29 +72,101 @@ func NewHTTPServer(port int, anonymous bool, storage fileshare.AuthenticatedStor
 			return err
 		},
 	})
+	// probes are answered before any other middleware
+	s.app.Get("/healthz", s.handleHealthz)
+	s.app.Get("/readyz", s.handleReadyz)
+
 	s.app.Use(
-		newLogger(),       // logs requests
-		newErrorHandler(), // handles custom errors
+		s.newRequestHandler(), // tracks requests for shutdown
+		newTracingHandler(),   // traces requests
+		newLogger(),           // logs requests
+		newMetricsHandler(),   // measures requests
+		newErrorHandler(),     // handles custom errors
 		recover.New(recover.Config{EnableStackTrace: true}), // handles panics
 		s.newAuthHandler(), // handles authentication
+		s.newCSRFHandler(), // checks forms come from our pages
 	)
 
 	s.app.Get("/", s.handleIndex)
 	s.app.Get("/files/*", s.handleFiles)
 	s.app.Get("/download/*", s.handleDownload)
 	s.app.Post("/upload/*", s.handleUpload)
+	s.app.Get("/sums/*", s.handleChecksums)
+	s.app.Get("/events/*", s.handleEvents)
+	s.app.Post("/delete/*", s.handleDelete)
+	s.app.Get("/trash", s.handleTrash)
+	s.app.Post("/trash/:user/:id", s.handleRestoreTrash)
+	s.app.Get("/versions/*", s.handleVersions)
+	s.app.Post("/versions/*", s.handleRestoreVersion)
+	s.app.Get("/admin/webhooks", s.handleWebhookDeliveries)
+	s.app.Get("/admin/audit", s.handleAudit)
+	s.app.Get("/admin/audit/verify", s.handleAuditVerify)
+	s.app.Get("/admin/sessions", s.handleAdminSessions)
+	s.app.Post("/admin/sessions/:user/revoke", s.handleAdminRevokeSessions)
+	s.app.Get("/settings/sessions", s.handleSessions)
+	s.app.Post("/settings/sessions/revoke", s.handleRevokeAllSessions)
+	s.app.Post("/settings/sessions/:id/revoke", s.handleRevokeSession)
+	s.app.Get("/settings/tokens", s.handleAPITokens)
+	s.app.Post("/settings/tokens", s.handleCreateAPIToken)
+	s.app.Post("/settings/tokens/:id/revoke", s.handleRevokeAPIToken)
+	if s.metrics {
+		s.app.Get("/metrics", s.handleMetrics())
+	}
+
 	s.app.Get("/login", s.handleLogin)
 	s.app.Post("/login", s.handlePostLogin)
 	s.app.Get("/login/:provider/callback", s.handleOauthLoginCallback)
-	s.app.Get("/logout", s.handleLogout)
+	s.app.Post("/logout", s.handleLogout)
 	s.app.Use(func(ctx *fiber.Ctx) error {
 		ctx.Status(fiber.StatusNotFound)
 		return nil
 	})
 
-	return &s
+	return s
+}
+
+// abortGracePeriod is how long aborted requests have to clean up after themselves.
+const abortGracePeriod = 5 * time.Second
+
+func (s *httpServer) newRequestHandler() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		s.active.Add(1)
+		defer s.active.Done()
+
+		ctx.SetUserContext(s.ctx)
+		return ctx.Next()
+	}
 }
 
 func (s *httpServer) ListenForever() error {
 	return s.app.Listen(fmt.Sprintf("0.0.0.0:%d", s.port))
 }
+
+func (s *httpServer) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+
+	// event streams would hold the connections open until the timeout
+	s.watchCancel()
+
+	err := s.app.ShutdownWithContext(ctx)
+	if err != nil {
+		s.log.WithError(err).Warnf("aborting requests still in progress")
+	}
+
+	// aborted uploads discard their partial files
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(abortGracePeriod):
+		s.log.Warnf("some requests did not stop in time")
+	}
+
+	return err
+}
@@ -0,0 +1,112 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/storage"
+	"github.com/valyala/fasthttp"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	s, _ := newTestStorageServer(t, t.TempDir())
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if resp, err := s.app.Test(httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatalf("failed request: %v", err)
+		} else if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code for %s: %d", path, resp.StatusCode)
+		}
+	}
+
+	// the server is still alive, but should not get new requests
+	s.shuttingDown.Store(true)
+	if resp, err := s.app.Test(httptest.NewRequest("GET", "/readyz", nil)); err != nil {
+		t.Fatalf("failed request: %v", err)
+	} else if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if resp, _ := s.app.Test(httptest.NewRequest("GET", "/healthz", nil)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+func TestShutdown_EventStream(t *testing.T) {
+	local, err := storage.NewLocalStorageProvider(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	sessions, _ := auth.NewSessionStore("")
+	tokens, _ := auth.NewJsonWebTokenProvider([]byte("secret"), sessions, fileshare.Sessions{})
+	users := auth.NewConfigUsersProvider([]fileshare.User{{Nickname: "admin", Admin: true}}, nil)
+	st := storage.NewACLStorageProvider(storage.NewEventsStorageProvider(local), nil, nil)
+	s := NewHTTPServer(0, false, false, []byte("secret"), st, nil, users, tokens, sessions, nil, nil, nil).(*httpServer)
+	login, _ := tokens.NewSession("admin", "", "")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed listening: %v", err)
+	}
+
+	go func() { _ = s.app.Listener(listener) }()
+
+	req, _ := http.NewRequest("GET", "http://"+listener.Addr().String()+"/events/", nil)
+	req.AddCookie(&http.Cookie{Name: authTokenCookieName, Value: login.AccessToken})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	if line, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil || line != ": connected\n" {
+		t.Fatalf("unexpected stream start %q: %v", line, err)
+	}
+
+	// the open stream must not hold the shutdown until the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("failed shutdown: %v", err)
+	} else if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("shutdown took %v", elapsed)
+	}
+
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("stream did not end cleanly: %v", err)
+	}
+}
+
+func TestShutdown_WaitsForStreams(t *testing.T) {
+	s, _ := newTestStorageServer(t, t.TempDir())
+
+	ctx := s.app.AcquireCtx(&fasthttp.RequestCtx{})
+	defer s.app.ReleaseCtx(ctx)
+	ctx.SetUserContext(s.ctx)
+
+	// the stream keeps writing after the handler returned, until the requests are aborted
+	finished := make(chan struct{})
+	s.streamBody(ctx, func(ctx context.Context, w io.Writer) error {
+		<-ctx.Done()
+		time.Sleep(100 * time.Millisecond)
+		close(finished)
+		return ctx.Err()
+	})
+
+	_ = s.Shutdown(context.Background())
+
+	select {
+	case <-finished:
+	default:
+		t.Fatalf("shutdown did not wait for the stream")
+	}
+}
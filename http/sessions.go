@@ -0,0 +1,110 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/gofiber/fiber/v2"
+	"io/fs"
+	"net/http"
+	"net/url"
+)
+
+type sessionsViewData struct {
+	Sessions []fileshare.Session
+	Current  string
+	CSRF     string
+}
+
+func (s *httpServer) handleSessions(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || user.Anonymous() {
+		return newHttpError(http.StatusForbidden, "cannot manage sessions", fmt.Errorf("unauthenticated users cannot manage sessions"))
+	}
+
+	sessions, err := s.sessions.List(user.Nickname)
+	if err != nil {
+		return err
+	}
+
+	current, _ := ctx.Locals(sessionLocalKey).(string)
+	return ctx.Render("sessions", &sessionsViewData{
+		Sessions: sessions,
+		Current:  current,
+		CSRF:     s.requestCSRFToken(ctx),
+	})
+}
+
+func (s *httpServer) handleRevokeSession(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || user.Anonymous() {
+		return newHttpError(http.StatusForbidden, "cannot manage sessions", fmt.Errorf("unauthenticated users cannot manage sessions"))
+	}
+
+	id := ctx.Params("id")
+	err := s.sessions.Revoke(user.Nickname, id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newHttpError(fiber.StatusNotFound, "session not found", err)
+	} else if err != nil {
+		return err
+	}
+
+	if current, _ := ctx.Locals(sessionLocalKey).(string); current == id {
+		clearSessionCookies(ctx)
+		return ctx.Redirect("/")
+	}
+
+	return ctx.Redirect("/settings/sessions")
+}
+
+func (s *httpServer) handleRevokeAllSessions(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || user.Anonymous() {
+		return newHttpError(http.StatusForbidden, "cannot manage sessions", fmt.Errorf("unauthenticated users cannot manage sessions"))
+	}
+
+	if _, err := s.sessions.RevokeUser(user.Nickname); err != nil {
+		return err
+	}
+
+	s.recordAudit(s.newAuditEntry(ctx, fileshare.AuditActionLogout, ""), 0, nil)
+
+	clearSessionCookies(ctx)
+	return ctx.Redirect("/")
+}
+
+func (s *httpServer) handleAdminSessions(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || !user.Admin {
+		return newHttpError(http.StatusForbidden, "cannot see sessions", fmt.Errorf("only admins can see sessions"))
+	}
+
+	sessions, err := s.sessions.List(ctx.Query("user"))
+	if err != nil {
+		return err
+	} else if sessions == nil {
+		sessions = []fileshare.Session{}
+	}
+
+	return ctx.JSON(sessions)
+}
+
+type adminRevokeSessionsResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+func (s *httpServer) handleAdminRevokeSessions(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || !user.Admin {
+		return newHttpError(http.StatusForbidden, "cannot revoke sessions", fmt.Errorf("only admins can revoke sessions"))
+	}
+
+	nickname, _ := url.PathUnescape(ctx.Params("user"))
+	revoked, err := s.sessions.RevokeUser(nickname)
+	if err != nil {
+		return err
+	}
+
+	s.log.Infof("admin %s revoked %d sessions of %s", user.Nickname, revoked, nickname)
+	return ctx.JSON(&adminRevokeSessionsResponse{Revoked: revoked})
+}
@@ -0,0 +1,226 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/auth"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestSessionServer(t *testing.T) (*httpServer, fileshare.TokenProvider, fileshare.SessionStore) {
+	sessions, _ := auth.NewSessionStore("")
+	tokens, err := auth.NewJsonWebTokenProvider([]byte("secret"), sessions, fileshare.Sessions{})
+	if err != nil {
+		t.Fatalf("failed creating tokens provider: %v", err)
+	}
+
+	users := auth.NewConfigUsersProvider([]fileshare.User{{Nickname: "admin", Admin: true}, {Nickname: "pippo"}}, nil)
+	return NewHTTPServer(0, false, false, []byte("secret"), nil, nil, users, tokens, sessions, nil, nil, nil).(*httpServer), tokens, sessions
+}
+
+func testSessionRequest(t *testing.T, s *httpServer, method string, path string, cookies ...*http.Cookie) *http.Response {
+	return testSessionForm(t, s, method, path, nil, cookies...)
+}
+
+func testSessionForm(t *testing.T, s *httpServer, method string, path string, form url.Values, cookies ...*http.Cookie) *http.Response {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := s.app.Test(req)
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+
+	return resp
+}
+
+// testCSRFToken is the CSRF token the pages of the session of the cookie have.
+func testCSRFToken(s *httpServer, cookie *http.Cookie) string {
+	sessionID, _ := s.tokens.GetSession(cookie.Value)
+	return s.csrfToken(sessionID)
+}
+
+func responseCookie(resp *http.Response, name string) *http.Cookie {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+
+	return nil
+}
+
+func TestSessionRefreshAndLogout(t *testing.T) {
+	s, tokens, _ := newTestSessionServer(t)
+
+	login, _ := tokens.NewSession("pippo", "", "")
+	refreshCookie := &http.Cookie{Name: refreshTokenCookieName, Value: login.RefreshToken}
+
+	// the access token cookie expired, a new one is obtained with the refresh token
+	resp := testSessionRequest(t, s, "GET", "/settings/sessions", refreshCookie)
+	accessCookie, newRefreshCookie := responseCookie(resp, authTokenCookieName), responseCookie(resp, refreshTokenCookieName)
+	if resp.StatusCode != http.StatusOK || accessCookie == nil || newRefreshCookie == nil || newRefreshCookie.Value == login.RefreshToken {
+		t.Fatalf("unexpected response: %d %v %v", resp.StatusCode, accessCookie, newRefreshCookie)
+	}
+
+	if resp := testSessionRequest(t, s, "GET", "/settings/sessions", accessCookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// logging out needs the CSRF token of the session
+	if resp := testSessionForm(t, s, "POST", "/logout", url.Values{"csrf": {s.csrfToken("other")}}, accessCookie, newRefreshCookie); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if resp := testSessionRequest(t, s, "GET", "/settings/sessions", accessCookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// logging out revokes the session, not just the cookie
+	if resp := testSessionForm(t, s, "POST", "/logout", url.Values{"csrf": {s.csrfToken(login.Session.ID)}}, accessCookie, newRefreshCookie); resp.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	resp = testSessionRequest(t, s, "GET", "/settings/sessions", accessCookie, newRefreshCookie)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if cookie := responseCookie(resp, authTokenCookieName); cookie == nil || len(cookie.Value) > 0 {
+		t.Fatalf("expected cleared cookie: %v", cookie)
+	}
+}
+
+func TestSessionConcurrentRefresh(t *testing.T) {
+	s, tokens, sessions := newTestSessionServer(t)
+
+	login, _ := tokens.NewSession("pippo", "", "")
+	refreshCookie := &http.Cookie{Name: refreshTokenCookieName, Value: login.RefreshToken}
+
+	var wg sync.WaitGroup
+	responses := make([]*http.Response, 2)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := httptest.NewRequest("GET", "/settings/sessions", nil)
+			req.AddCookie(refreshCookie)
+			responses[i], _ = s.app.Test(req)
+		}(i)
+	}
+	wg.Wait()
+
+	// one request refreshes the session, the other one must not log the user out
+	var refreshed int
+	for _, resp := range responses {
+		if resp == nil {
+			t.Fatalf("failed request")
+		} else if cookie := responseCookie(resp, refreshTokenCookieName); cookie == nil {
+			continue
+		} else if len(cookie.Value) == 0 {
+			t.Fatalf("unexpected cleared cookie")
+		} else if cookie.Value != login.RefreshToken {
+			refreshed++
+		}
+	}
+
+	if refreshed != 1 {
+		t.Fatalf("expected one refresh, got %d", refreshed)
+	} else if list, _ := sessions.List("pippo"); len(list) != 1 {
+		t.Fatalf("unexpected sessions: %+v", list)
+	}
+}
+
+func TestSessionLogoutAll(t *testing.T) {
+	s, tokens, sessions := newTestSessionServer(t)
+
+	first, _ := tokens.NewSession("pippo", "", "")
+	second, _ := tokens.NewSession("pippo", "", "")
+
+	if resp := testSessionForm(t, s, "POST", "/settings/sessions/revoke", url.Values{"csrf": {s.csrfToken(first.Session.ID)}}, &http.Cookie{Name: authTokenCookieName, Value: first.AccessToken}); resp.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if list, _ := sessions.List("pippo"); len(list) != 0 {
+		t.Fatalf("unexpected sessions: %+v", list)
+	} else if _, err := tokens.GetUser(second.AccessToken); err == nil {
+		t.Fatalf("expected revoked session")
+	}
+}
+
+func TestAdminRevokeSessions(t *testing.T) {
+	s, tokens, sessions := newTestSessionServer(t)
+
+	admin, _ := tokens.NewSession("admin", "", "")
+	pippo, _ := tokens.NewSession("pippo", "", "")
+	adminCookie := &http.Cookie{Name: authTokenCookieName, Value: admin.AccessToken}
+	pippoCookie := &http.Cookie{Name: authTokenCookieName, Value: pippo.AccessToken}
+
+	if resp := testSessionForm(t, s, "POST", "/admin/sessions/admin/revoke", url.Values{"csrf": {testCSRFToken(s, pippoCookie)}}, pippoCookie); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var list []fileshare.Session
+	if resp := testSessionRequest(t, s, "GET", "/admin/sessions?user=pippo", adminCookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if err := json.NewDecoder(resp.Body).Decode(&list); err != nil || len(list) != 1 || list[0].ID != pippo.Session.ID {
+		t.Fatalf("unexpected sessions: %+v: %v", list, err)
+	}
+
+	var revoked adminRevokeSessionsResponse
+	if resp := testSessionForm(t, s, "POST", "/admin/sessions/pippo/revoke", url.Values{"csrf": {testCSRFToken(s, adminCookie)}}, adminCookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if err := json.NewDecoder(resp.Body).Decode(&revoked); err != nil || revoked.Revoked != 1 {
+		t.Fatalf("unexpected response: %+v: %v", revoked, err)
+	}
+
+	if resp := testSessionRequest(t, s, "GET", "/settings/sessions", pippoCookie); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if list, _ := sessions.List("admin"); len(list) != 1 {
+		t.Fatalf("unexpected sessions: %+v", list)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	base := t.TempDir()
+	s, cookie := newTestStorageServer(t, base)
+
+	if resp := testUpload(t, s, cookie, "a.txt", "hello", ""); resp.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// forms submitted by other sites carry the cookies, but not the token
+	for _, path := range []string{"/upload/", "/delete/a.txt", "/trash/admin/x", "/versions/a.txt", "/admin/sessions/admin/revoke", "/settings/sessions/revoke", "/settings/tokens", "/settings/tokens/x/revoke", "/logout"} {
+		if resp := testSessionForm(t, s, "POST", path, url.Values{}, cookie); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s: unexpected status code: %d", path, resp.StatusCode)
+		} else if resp := testSessionForm(t, s, "POST", path, url.Values{"csrf": {s.csrfToken("other")}}, cookie); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s: unexpected status code with token of another session: %d", path, resp.StatusCode)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(base, "a.txt")); err != nil {
+		t.Fatalf("expected file not to be deleted: %v", err)
+	} else if resp := testSessionForm(t, s, "POST", "/delete/a.txt", url.Values{"csrf": {testCSRFToken(s, cookie)}}, cookie); resp.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if _, err := os.Stat(filepath.Join(base, "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be deleted: %v", err)
+	}
+
+	// the authorization header is not sent by the browser on its own
+	login, _ := s.tokens.NewSession("admin", "", "")
+	req := httptest.NewRequest("POST", "/admin/sessions/nobody/revoke", nil)
+	req.Header.Set("Authorization", "Bearer "+login.AccessToken)
+	if resp, err := s.app.Test(req); err != nil {
+		t.Fatalf("failed request: %v", err)
+	} else if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+}
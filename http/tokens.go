@@ -0,0 +1,171 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/gofiber/fiber/v2"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	apiTokenActionRead   = "read"
+	apiTokenActionUpload = "upload"
+	apiTokenActionWrite  = "write"
+	apiTokenActionAdmin  = "admin"
+)
+
+// apiTokenAllows checks the request is within the scope of the API token that authenticated it, tokens
+// cannot be used to log in or out or to manage tokens.
+func apiTokenAllows(scope fileshare.APITokenScope, method string, path string) bool {
+	read := method == fiber.MethodGet || method == fiber.MethodHead
+
+	route, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+
+	var action string
+	var hasPath bool
+	switch route {
+	case "":
+		action, hasPath = apiTokenActionRead, true
+	case "files", "download", "sums", "events":
+		action, hasPath = apiTokenActionRead, true
+	case "versions":
+		if read {
+			action, hasPath = apiTokenActionRead, true
+		} else {
+			action, hasPath = apiTokenActionWrite, true
+		}
+	case "upload":
+		action, hasPath = apiTokenActionUpload, true
+	case "delete":
+		action, hasPath = apiTokenActionWrite, true
+	case "trash":
+		if read {
+			action = apiTokenActionRead
+		} else {
+			action = apiTokenActionWrite
+		}
+	case "admin", "metrics":
+		action = apiTokenActionAdmin
+	default:
+		return false
+	}
+
+	switch scope.Access {
+	case fileshare.APITokenAccessFull:
+	case fileshare.APITokenAccessRead:
+		if action != apiTokenActionRead || !read {
+			return false
+		}
+	case fileshare.APITokenAccessUpload:
+		if action != apiTokenActionUpload {
+			return false
+		}
+	default:
+		return false
+	}
+
+	if len(scope.Path) == 0 {
+		return true
+	} else if !hasPath {
+		return false
+	}
+
+	rest, err := url.PathUnescape(rest)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(scope.Path, filepath.Clean("/"+rest))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+type apiTokensViewData struct {
+	Tokens []fileshare.APIToken
+	// Secret of the token just created, shown only once
+	Secret string
+	CSRF   string
+}
+
+func (s *httpServer) handleAPITokens(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || user.Anonymous() {
+		return newHttpError(http.StatusForbidden, "cannot manage tokens", fmt.Errorf("unauthenticated users cannot manage tokens"))
+	} else if s.apiTokens == nil {
+		return newHttpError(http.StatusNotFound, "tokens not available", fmt.Errorf("API tokens are not configured"))
+	}
+
+	return s.renderAPITokens(ctx, user, "")
+}
+
+func (s *httpServer) renderAPITokens(ctx *fiber.Ctx, user *fileshare.User, secret string) error {
+	tokens, err := s.apiTokens.List(user.Nickname)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Render("tokens", &apiTokensViewData{
+		Tokens: tokens,
+		Secret: secret,
+		CSRF:   s.requestCSRFToken(ctx),
+	})
+}
+
+type createAPITokenBody struct {
+	Name   string `schema:"name,required"`
+	Access string `schema:"access,required"`
+	Path   string `schema:"path"`
+	// ExpiresIn is the validity in days, zero for no expiry
+	ExpiresIn int `schema:"expires_in" form:"expires_in"`
+}
+
+func (s *httpServer) handleCreateAPIToken(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || user.Anonymous() {
+		return newHttpError(http.StatusForbidden, "cannot manage tokens", fmt.Errorf("unauthenticated users cannot manage tokens"))
+	} else if s.apiTokens == nil {
+		return newHttpError(http.StatusNotFound, "tokens not available", fmt.Errorf("API tokens are not configured"))
+	}
+
+	var body createAPITokenBody
+	if err := ctx.BodyParser(&body); err != nil {
+		return newHttpError(fiber.StatusBadRequest, "invalid body", err)
+	} else if body.ExpiresIn < 0 {
+		return newHttpError(fiber.StatusBadRequest, "invalid expiry", fmt.Errorf("negative expiry: %d", body.ExpiresIn))
+	}
+
+	var expiresAt time.Time
+	if body.ExpiresIn > 0 {
+		expiresAt = time.Now().UTC().Add(time.Duration(body.ExpiresIn) * 24 * time.Hour)
+	}
+
+	_, secret, err := s.apiTokens.Create(user.Nickname, body.Name, fileshare.APITokenScope{Access: body.Access, Path: body.Path}, expiresAt)
+	if err != nil {
+		return newHttpError(fiber.StatusBadRequest, "cannot create token", err)
+	}
+
+	return s.renderAPITokens(ctx, user, secret)
+}
+
+func (s *httpServer) handleRevokeAPIToken(ctx *fiber.Ctx) error {
+	user := fileshare.UserFromContext(ctx)
+	if user == nil || user.Anonymous() {
+		return newHttpError(http.StatusForbidden, "cannot manage tokens", fmt.Errorf("unauthenticated users cannot manage tokens"))
+	} else if s.apiTokens == nil {
+		return newHttpError(http.StatusNotFound, "tokens not available", fmt.Errorf("API tokens are not configured"))
+	}
+
+	err := s.apiTokens.Revoke(user.Nickname, ctx.Params("id"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return newHttpError(fiber.StatusNotFound, "token not found", err)
+	} else if err != nil {
+		return err
+	}
+
+	return ctx.Redirect("/settings/tokens")
+}
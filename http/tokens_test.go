@@ -0,0 +1,128 @@
+package http
+
+import (
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/auth"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPITokenAllows(t *testing.T) {
+	full := fileshare.APITokenScope{Access: fileshare.APITokenAccessFull}
+	read := fileshare.APITokenScope{Access: fileshare.APITokenAccessRead}
+	upload := fileshare.APITokenScope{Access: fileshare.APITokenAccessUpload}
+	readPath := fileshare.APITokenScope{Access: fileshare.APITokenAccessRead, Path: "/data"}
+	uploadPath := fileshare.APITokenScope{Access: fileshare.APITokenAccessUpload, Path: "/data/in"}
+
+	tests := []struct {
+		scope   fileshare.APITokenScope
+		method  string
+		path    string
+		allowed bool
+	}{
+		{full, "GET", "/download/a.txt", true},
+		{full, "POST", "/delete/a.txt", true},
+		{full, "GET", "/admin/audit", true},
+		{full, "GET", "/settings/tokens", false},
+		{full, "POST", "/settings/tokens/abc/revoke", false},
+		{full, "GET", "/logout", false},
+		{read, "GET", "/", true},
+		{read, "GET", "/files/a", true},
+		{read, "GET", "/versions/a.txt", true},
+		{read, "POST", "/versions/a.txt", false},
+		{read, "POST", "/upload/a", false},
+		{read, "POST", "/delete/a.txt", false},
+		{read, "GET", "/admin/audit", false},
+		{upload, "POST", "/upload/a", true},
+		{upload, "GET", "/download/a.txt", false},
+		{readPath, "GET", "/download/data/a.txt", true},
+		{readPath, "GET", "/files/data", true},
+		{readPath, "GET", "/files/", false},
+		{readPath, "GET", "/", false},
+		{readPath, "GET", "/download/database.txt", false},
+		{readPath, "GET", "/download/data/../secret.txt", false},
+		{readPath, "GET", "/download/data/%2e%2e/secret.txt", false},
+		{readPath, "GET", "/trash", false},
+		{uploadPath, "POST", "/upload/data/in/today", true},
+		{uploadPath, "POST", "/upload/data", false},
+	}
+
+	for _, test := range tests {
+		if allowed := apiTokenAllows(test.scope, test.method, test.path); allowed != test.allowed {
+			t.Fatalf("expected %t for %+v %s %s", test.allowed, test.scope, test.method, test.path)
+		}
+	}
+}
+
+func TestAPITokenBearer(t *testing.T) {
+	sessions, _ := auth.NewSessionStore("")
+	tokens, err := auth.NewJsonWebTokenProvider([]byte("secret"), sessions, fileshare.Sessions{})
+	if err != nil {
+		t.Fatalf("failed creating tokens provider: %v", err)
+	}
+
+	apiTokens, err := auth.NewFileAPITokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("failed creating API tokens store: %v", err)
+	}
+
+	users := auth.NewConfigUsersProvider([]fileshare.User{{Nickname: "admin", Admin: true}}, nil)
+	s := NewHTTPServer(0, false, false, []byte("secret"), nil, nil, users, tokens, sessions, apiTokens, nil, nil).(*httpServer)
+
+	_, fullSecret, _ := apiTokens.Create("admin", "full", fileshare.APITokenScope{Access: fileshare.APITokenAccessFull}, time.Time{})
+	_, readSecret, _ := apiTokens.Create("admin", "read", fileshare.APITokenScope{Access: fileshare.APITokenAccessRead}, time.Time{})
+	_, expiredSecret, _ := apiTokens.Create("admin", "expired", fileshare.APITokenScope{Access: fileshare.APITokenAccessFull}, time.Now().Add(-time.Hour))
+
+	request := func(path string, token string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := s.app.Test(req)
+		if err != nil {
+			t.Fatalf("failed request: %v", err)
+		}
+
+		return resp.StatusCode
+	}
+
+	if status := request("/admin/webhooks", fullSecret); status != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", status)
+	} else if status := request("/admin/webhooks", readSecret); status != http.StatusForbidden {
+		t.Fatalf("unexpected status code: %d", status)
+	} else if status := request("/settings/tokens", fullSecret); status != http.StatusForbidden {
+		t.Fatalf("unexpected status code: %d", status)
+	} else if status := request("/admin/webhooks", expiredSecret); status != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code: %d", status)
+	} else if status := request("/admin/webhooks", auth.APITokenPrefix+"unknown"); status != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code: %d", status)
+	}
+
+	// session tokens still work
+	session, _ := tokens.NewSession("admin", "", "")
+	if status := request("/admin/webhooks", session.AccessToken); status != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", status)
+	}
+
+	// create a token from the settings page
+	req := httptest.NewRequest("POST", "/settings/tokens", strings.NewReader(url.Values{"name": {"script"}, "access": {"upload"}, "path": {"/in"}, "expires_in": {"7"}, "csrf": {s.csrfToken(session.Session.ID)}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: authTokenCookieName, Value: session.AccessToken})
+
+	resp, err := s.app.Test(req)
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	} else if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), auth.APITokenPrefix) {
+		t.Fatalf("unexpected response: %d %s", resp.StatusCode, body)
+	}
+
+	list, _ := apiTokens.List("admin")
+	if created := list[len(list)-1]; created.Name != "script" || created.Scope.Access != fileshare.APITokenAccessUpload || created.Scope.Path != "/in" || created.ExpiresAt.Sub(time.Now()) < 6*24*time.Hour {
+		t.Fatalf("unexpected token: %+v", created)
+	}
+}
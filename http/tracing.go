@@ -0,0 +1,62 @@
+package http
+
+import (
+	"github.com/devgianlu/go-fileshare/tracing"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"net/http"
+	"strings"
+)
+
+// headerCarrier exposes the request headers to the propagator.
+type headerCarrier struct {
+	ctx *fiber.Ctx
+}
+
+func (c headerCarrier) Get(key string) string {
+	return c.ctx.Get(key)
+}
+
+func (c headerCarrier) Set(key string, value string) {
+	c.ctx.Set(key, value)
+}
+
+func (c headerCarrier) Keys() []string {
+	var keys []string
+	c.ctx.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+func newTracingHandler() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		parent := tracing.Propagator.Extract(ctx.UserContext(), headerCarrier{ctx})
+
+		method := strings.Clone(ctx.Method())
+		spanCtx, span := tracing.StartServer(parent, "HTTP "+method,
+			semconv.HTTPMethod(method),
+			attribute.String("url.path", strings.Clone(ctx.Path())))
+		defer span.End()
+
+		ctx.SetUserContext(spanCtx)
+		err := ctx.Next()
+
+		// the route is known only after the request is handled
+		route := routeName(ctx)
+		status := ctx.Response().StatusCode()
+		span.SetName(method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPStatusCode(status))
+		if err != nil {
+			span.RecordError(err)
+		}
+
+		if status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+
+		return err
+	}
+}
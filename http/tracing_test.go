@@ -0,0 +1,84 @@
+package http
+
+import (
+	"github.com/devgianlu/go-fileshare/tracing"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	return exporter
+}
+
+func newTestTracingApp() *fiber.App {
+	app := fiber.New()
+	app.Use(newTracingHandler())
+	app.Get("/files/*", func(ctx *fiber.Ctx) error {
+		_, span := tracing.Start(ctx.UserContext(), "child")
+		span.End()
+		return ctx.SendString("ok")
+	})
+	app.Use(func(ctx *fiber.Ctx) error {
+		ctx.Status(fiber.StatusNotFound)
+		return nil
+	})
+	return app
+}
+
+func TestTracingHandler_Propagation(t *testing.T) {
+	exporter := newTestTracer(t)
+
+	req := httptest.NewRequest("GET", "/files/a/b.txt", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if _, err := newTestTracingApp().Test(req); err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %v", spans.Snapshots())
+	}
+
+	child, server := spans[0], spans[1]
+	if server.Name != "GET /files/*" || server.SpanKind != trace.SpanKindServer {
+		t.Fatalf("unexpected server span %s (%s)", server.Name, server.SpanKind)
+	} else if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("server span does not continue the incoming trace: %s", server.SpanContext.TraceID())
+	} else if child.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Fatalf("handler span is not a child of the server span")
+	}
+
+	var statusOk bool
+	for _, attr := range server.Attributes {
+		statusOk = statusOk || attr == semconv.HTTPStatusCode(fiber.StatusOK)
+	}
+
+	if !statusOk {
+		t.Fatalf("missing status code attribute: %v", server.Attributes)
+	}
+}
+
+func TestTracingHandler_Unmatched(t *testing.T) {
+	exporter := newTestTracer(t)
+
+	if _, err := newTestTracingApp().Test(httptest.NewRequest("GET", "/nope", nil)); err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "GET unmatched" || spans[0].Parent.IsValid() {
+		t.Fatalf("unexpected spans: %v", spans.Snapshots())
+	}
+}
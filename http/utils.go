@@ -2,24 +2,99 @@ package http
 
 import (
 	"archive/tar"
+	"bufio"
 	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/storage"
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
 	"io"
+	"net/url"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-func compressFolderToArchive(storage fileshare.AuthenticatedStorageProvider, user *fileshare.User, path string, w io.Writer) error {
+// pathFromParams returns the path from the wildcard parameters, and the unescaped parts composing it.
+func pathFromParams(ctx *fiber.Ctx) (string, []string) {
+	var paths []string
+	for i := 1; true; i++ {
+		path := ctx.Params(fmt.Sprintf("*%d", i))
+		if len(path) == 0 {
+			break
+		}
+
+		path, _ = url.PathUnescape(path)
+		paths = append(paths, path)
+	}
+
+	if len(paths) > 0 {
+		// the path may outlive the request when streaming the response
+		return strings.Clone(filepath.Join(paths...)), paths
+	} else {
+		return ".", nil
+	}
+}
+
+// streamBody streams the response produced by fn after the handler returns, the context passed to it
+// is cancelled as soon as writing to the client fails. The stream counts as an active request until
+// fn returns.
+func (s *httpServer) streamBody(ctx *fiber.Ctx, fn func(ctx context.Context, w io.Writer) error) {
+	streamCtx, cancel := context.WithCancel(ctx.UserContext())
+
+	s.active.Add(1)
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer s.active.Done()
+		defer cancel()
+
+		// errors after the client went away are expected
+		if err := fn(streamCtx, &cancelWriter{w, cancel}); err != nil && streamCtx.Err() == nil {
+			log.WithError(err).WithField("module", "http").Errorf("failed streaming response")
+		}
+	})
+}
+
+// cancelWriter flushes every write to the client and cancels the context when that fails.
+type cancelWriter struct {
+	w      *bufio.Writer
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if err == nil {
+		err = w.w.Flush()
+	}
+
+	if err != nil {
+		w.cancel()
+	}
+
+	return n, err
+}
+
+func compressFolderToArchive(ctx context.Context, storage fileshare.AuthenticatedStorageProvider, user *fileshare.User, path string, w io.Writer) error {
 	gw := gzip.NewWriter(w)
 	aw := tar.NewWriter(gw)
 
 	var addFolderToArchive func(dir string) error
 	addFolderToArchive = func(dir string) error {
-		entries, err := storage.ReadDir(dir, user)
+		entries, err := storage.ReadDir(ctx, dir, user)
 		if err != nil {
 			return err
 		}
 
 		for _, entry := range entries {
+			// stop as soon as the request is gone
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			if entry.IsDir() {
 				// add sub-folders recursively
 				if err := addFolderToArchive(filepath.Join(dir, entry.Name())); err != nil {
@@ -29,23 +104,26 @@ func compressFolderToArchive(storage fileshare.AuthenticatedStorageProvider, use
 				continue
 			}
 
-			fileInfo, err := entry.Info()
-			if err != nil {
-				return err
-			}
-
-			header, err := tar.FileInfoHeader(fileInfo, fileInfo.Name())
+			name := filepath.Join(dir, entry.Name())
+			stat, err := storage.Stat(ctx, name, user)
 			if err != nil {
 				return err
 			}
 
 			// ensure we use the full path
-			header.Name = filepath.Join(dir, entry.Name())
+			header := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Size:     stat.Size,
+				Mode:     0644,
+				ModTime:  stat.ModTime,
+				Uname:    stat.Owner,
+			}
 			if err := aw.WriteHeader(header); err != nil {
 				return err
 			}
 
-			file, _, err := storage.OpenFile(header.Name, user)
+			file, _, err := storage.OpenFile(ctx, header.Name, user)
 			if err != nil {
 				return err
 			}
@@ -71,3 +149,158 @@ func compressFolderToArchive(storage fileshare.AuthenticatedStorageProvider, use
 
 	return gw.Close()
 }
+
+// expectedDigests returns the digests each uploaded file must match. They are taken from the form fields
+// named after the algorithm (one hex value per file, in order) or from the Repr-Digest header for single uploads.
+func expectedDigests(header string, values map[string][]string, count int) ([]map[string][]byte, error) {
+	expected := make([]map[string][]byte, count)
+	for i := range expected {
+		expected[i] = map[string][]byte{}
+	}
+
+	for _, algorithm := range []string{storage.ChecksumSHA256, storage.ChecksumBLAKE3} {
+		sums := values[algorithm]
+		if len(sums) == 0 {
+			continue
+		} else if len(sums) != count {
+			return nil, fmt.Errorf("expected %d %s digests, got %d", count, algorithm, len(sums))
+		}
+
+		for i, sum := range sums {
+			if len(sum) == 0 {
+				continue
+			}
+
+			decoded, err := hex.DecodeString(sum)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s digest: %w", algorithm, err)
+			}
+
+			expected[i][algorithm] = decoded
+		}
+	}
+
+	if len(header) > 0 {
+		if count != 1 {
+			return nil, fmt.Errorf("repr-digest header is only allowed with a single file")
+		}
+
+		for _, item := range strings.Split(header, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid repr-digest: %s", item)
+			} else if strings.ToLower(key) != "sha-256" {
+				// unsupported algorithms are ignored as per RFC 9530
+				continue
+			}
+
+			decoded, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid repr-digest: %w", err)
+			}
+
+			expected[0][storage.ChecksumSHA256] = decoded
+		}
+	}
+
+	return expected, nil
+}
+
+// writeChecksumsList writes the SHA-256 checksums of all the files in the folder in the sha256sum format,
+// checksums that are not stored are computed on the fly.
+func writeChecksumsList(ctx context.Context, st fileshare.AuthenticatedStorageProvider, user *fileshare.User, path string, w io.Writer) error {
+	var addFolderToList func(dir string) error
+	addFolderToList = func(dir string) error {
+		entries, err := st.ReadDir(ctx, dir, user)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			// stop as soon as the request is gone
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			name := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				if err := addFolderToList(name); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			checksums, err := st.Checksums(ctx, name, user)
+			if err != nil {
+				return err
+			}
+
+			sum, ok := checksums[storage.ChecksumSHA256]
+			if !ok {
+				file, _, err := st.OpenFile(ctx, name, user)
+				if err != nil {
+					return err
+				}
+
+				h, _ := storage.NewChecksumHash(storage.ChecksumSHA256)
+				if _, err := io.Copy(h, file); err != nil {
+					_ = file.Close()
+					return err
+				}
+
+				_ = file.Close()
+				sum = hex.EncodeToString(h.Sum(nil))
+			}
+
+			rel, err := filepath.Rel(path, name)
+			if err != nil {
+				return err
+			}
+
+			if _, err := fmt.Fprintf(w, "%s  %s\n", sum, filepath.ToSlash(rel)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return addFolderToList(path)
+}
+
+// eventsKeepAlive is how often a comment is sent to keep the stream open and notice when the client is gone.
+const eventsKeepAlive = 30 * time.Second
+
+// writeEvents writes the change events as Server-Sent Events until the channel is closed.
+func writeEvents(events <-chan fileshare.ChangeEvent, w io.Writer) error {
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+
+	// send something right away so that the client knows we are connected
+	if _, err := io.WriteString(w, ": connected\n\n"); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			data, err := json.Marshal(&event)
+			if err != nil {
+				return err
+			}
+
+			if _, err := fmt.Fprintf(w, "event: change\ndata: %s\n\n", data); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package fileshare
+
+// Metrics exposes the Prometheus metrics at /metrics, on a separate address without authentication
+// if Listen is set or on the main server to admins only.
+type Metrics struct {
+	Listen string `yaml:"listen"`
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "fileshare"
+
+const (
+	TransferUpload   = "upload"
+	TransferDownload = "download"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	requestDuration = promauto.With(registry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	transferredBytes = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transferred_bytes_total",
+		Help:      "Number of bytes uploaded and downloaded.",
+	}, []string{"direction"})
+
+	activeTransfers = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_transfers",
+		Help:      "Number of uploads and downloads in progress.",
+	}, []string{"direction"})
+
+	archiveDuration = promauto.With(registry).NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "archive_duration_seconds",
+		Help:      "Time spent generating directory archives.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+
+	loginsTotal = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Number of login attempts by auth provider and result.",
+	}, []string{"provider", "result"})
+
+	aclDenialsTotal = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "acl_denials_total",
+		Help:      "Number of accesses denied by the ACL by action.",
+	}, []string{"action"})
+)
+
+func init() {
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func ObserveRequest(route string, method string, status int, duration time.Duration) {
+	statusStr := strconv.Itoa(status)
+	requestsTotal.WithLabelValues(route, method, statusStr).Inc()
+	requestDuration.WithLabelValues(route, method, statusStr).Observe(duration.Seconds())
+}
+
+// TransferStarted marks a transfer in the direction as in progress, the returned function must be called
+// once it is done with the number of bytes transferred.
+func TransferStarted(direction string) func(bytes int64) {
+	activeTransfers.WithLabelValues(direction).Inc()
+	return func(bytes int64) {
+		activeTransfers.WithLabelValues(direction).Dec()
+		transferredBytes.WithLabelValues(direction).Add(float64(bytes))
+	}
+}
+
+func ObserveArchive(duration time.Duration) {
+	archiveDuration.Observe(duration.Seconds())
+}
+
+func ObserveLogin(provider string, success bool) {
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+
+	loginsTotal.WithLabelValues(provider, result).Inc()
+}
+
+func ObserveACLDenial(action string) {
+	aclDenialsTotal.WithLabelValues(action).Inc()
+}
+
+// ListenForever serves the metrics on a separate address, without authentication.
+func ListenForever(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(addr, mux)
+}
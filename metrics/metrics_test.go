@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserveRequest(t *testing.T) {
+	before := testutil.ToFloat64(requestsTotal.WithLabelValues("/files/*", "GET", "200"))
+	ObserveRequest("/files/*", "GET", 200, 10*time.Millisecond)
+	ObserveRequest("/files/*", "GET", 404, 10*time.Millisecond)
+
+	if count := testutil.ToFloat64(requestsTotal.WithLabelValues("/files/*", "GET", "200")); count != before+1 {
+		t.Fatalf("unexpected request count: %v", count)
+	} else if count := testutil.ToFloat64(requestsTotal.WithLabelValues("/files/*", "GET", "404")); count < 1 {
+		t.Fatalf("unexpected request count: %v", count)
+	}
+}
+
+func TestObserveLogin(t *testing.T) {
+	success := testutil.ToFloat64(loginsTotal.WithLabelValues("passwd", "success"))
+	failure := testutil.ToFloat64(loginsTotal.WithLabelValues("passwd", "failure"))
+
+	ObserveLogin("passwd", true)
+	ObserveLogin("passwd", false)
+	ObserveLogin("passwd", false)
+
+	if count := testutil.ToFloat64(loginsTotal.WithLabelValues("passwd", "success")); count != success+1 {
+		t.Fatalf("unexpected successful logins: %v", count)
+	} else if count := testutil.ToFloat64(loginsTotal.WithLabelValues("passwd", "failure")); count != failure+2 {
+		t.Fatalf("unexpected failed logins: %v", count)
+	}
+}
+
+func TestTransferStarted(t *testing.T) {
+	bytes := testutil.ToFloat64(transferredBytes.WithLabelValues(TransferUpload))
+
+	done := TransferStarted(TransferUpload)
+	if active := testutil.ToFloat64(activeTransfers.WithLabelValues(TransferUpload)); active != 1 {
+		t.Fatalf("unexpected active transfers: %v", active)
+	}
+
+	done(123)
+	if active := testutil.ToFloat64(activeTransfers.WithLabelValues(TransferUpload)); active != 0 {
+		t.Fatalf("unexpected active transfers: %v", active)
+	} else if count := testutil.ToFloat64(transferredBytes.WithLabelValues(TransferUpload)); count != bytes+123 {
+		t.Fatalf("unexpected transferred bytes: %v", count)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ObserveACLDenial("read")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `fileshare_acl_denials_total{action="read"}`) || !strings.Contains(rec.Body.String(), "go_goroutines") {
+		t.Fatalf("unexpected metrics: %s", rec.Body.String())
+	}
+
+	if problems, err := testutil.GatherAndLint(registry); err != nil {
+		t.Fatalf("failed linting: %v", err)
+	} else if len(problems) > 0 {
+		t.Fatalf("unexpected problems: %+v", problems)
+	}
+}
@@ -0,0 +1,15 @@
+package fileshare
+
+// S3 serves the storage over a subset of the S3 API on its own address, with the top-level
+// directories as buckets. Parts of multipart uploads are kept in PartsDir until completed.
+type S3 struct {
+	Listen   string `yaml:"listen"`
+	Region   string `yaml:"region"`
+	PartsDir string `yaml:"parts_dir"`
+}
+
+// S3Key is an access key pair for signing S3 requests with SigV4.
+type S3Key struct {
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
@@ -0,0 +1,75 @@
+package s3
+
+import (
+	"encoding/xml"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"io/fs"
+	"net/http"
+)
+
+// s3Error is an error in the form the S3 clients expect.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newS3Error(status int, code string, message string) *s3Error {
+	return &s3Error{Status: status, Code: code, Message: message}
+}
+
+var (
+	errAccessDenied          = newS3Error(http.StatusForbidden, "AccessDenied", "Access Denied")
+	errInvalidAccessKeyId    = newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records.")
+	errSignatureDoesNotMatch = newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+	errRequestTimeTooSkewed  = newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.")
+	errExpiredRequest        = newS3Error(http.StatusForbidden, "AccessDenied", "Request has expired")
+	errContentSHA256Mismatch = newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.")
+	errBadDigest             = newS3Error(http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
+	errNoSuchBucket          = newS3Error(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+	errNoSuchKey             = newS3Error(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	errNoSuchUpload          = newS3Error(http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist.")
+	errBucketNotEmpty        = newS3Error(http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty")
+	errBucketAlreadyExists   = newS3Error(http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it.")
+	errInvalidRange          = newS3Error(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+	errInvalidPart           = newS3Error(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+	errInvalidPartOrder      = newS3Error(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order.")
+	errMalformedXML          = newS3Error(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+	errNotImplemented        = newS3Error(http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented.")
+	errMethodNotAllowed      = newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	errInternalError         = newS3Error(http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+)
+
+func errInvalidArgument(message string) *s3Error {
+	return newS3Error(http.StatusBadRequest, "InvalidArgument", message)
+}
+
+func errAuthorizationMalformed(message string) *s3Error {
+	return newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", message)
+}
+
+type errorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// toS3Error converts the storage errors, anything unknown is an internal error.
+func toS3Error(err error, notFound *s3Error) *s3Error {
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) {
+		return s3Err
+	} else if errors.Is(err, fileshare.ErrStorageReadForbidden) || errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		return errAccessDenied
+	} else if errors.Is(err, fs.ErrNotExist) {
+		return notFound
+	}
+
+	return errInternalError
+}
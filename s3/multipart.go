@@ -0,0 +1,281 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPartNumber is the highest part number, like S3.
+const maxPartNumber = 10000
+
+// multipartExpiry is how long an unfinished upload is kept.
+const multipartExpiry = 24 * time.Hour
+
+// multipartUpload tracks the parts of an upload, each of them is a file in dir.
+type multipartUpload struct {
+	id       string
+	nickname string
+	bucket   string
+	key      string
+	created  time.Time
+	dir      string
+	parts    map[int]string
+}
+
+func (u *multipartUpload) partPath(number int) string {
+	return filepath.Join(u.dir, fmt.Sprintf("part-%05d", number))
+}
+
+// getUpload returns the upload if it belongs to the user and object.
+func (s *s3Server) getUpload(r *http.Request, user *fileshare.User, bucket string, key string) (*multipartUpload, error) {
+	s.uploadsLock.Lock()
+	defer s.uploadsLock.Unlock()
+
+	upload, ok := s.uploads[r.URL.Query().Get("uploadId")]
+	if !ok || upload.nickname != user.Nickname || upload.bucket != bucket || upload.key != key {
+		return nil, errNoSuchUpload
+	}
+
+	return upload, nil
+}
+
+func (s *s3Server) removeUpload(upload *multipartUpload) {
+	s.uploadsLock.Lock()
+	delete(s.uploads, upload.id)
+	s.uploadsLock.Unlock()
+
+	if err := os.RemoveAll(upload.dir); err != nil {
+		s.log.WithError(err).Warnf("failed removing parts of upload %s", upload.id)
+	}
+}
+
+// purgeUploads removes the uploads that have not been completed in time.
+func (s *s3Server) purgeUploads() {
+	s.uploadsLock.Lock()
+	var expired []*multipartUpload
+	for _, upload := range s.uploads {
+		if time.Since(upload.created) > multipartExpiry {
+			expired = append(expired, upload)
+		}
+	}
+	s.uploadsLock.Unlock()
+
+	for _, upload := range expired {
+		s.removeUpload(upload)
+	}
+}
+
+type initiateMultipartUploadResponse struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+func (s *s3Server) handleCreateMultipartUpload(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string, key string) {
+	s.purgeUploads()
+
+	if err := s.checkBucket(r.Context(), user, bucket); err != nil {
+		s.writeError(w, r, err, errNoSuchBucket)
+		return
+	} else if strings.HasSuffix(key, "/") || !s.storage.CanWrite(path.Join(bucket, key), user) {
+		// the storage checks again when the upload is completed
+		s.writeError(w, r, errAccessDenied, nil)
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		s.writeError(w, r, err, nil)
+		return
+	}
+
+	upload := &multipartUpload{
+		id:       hex.EncodeToString(id),
+		nickname: user.Nickname,
+		bucket:   bucket,
+		key:      key,
+		created:  time.Now(),
+		parts:    map[int]string{},
+	}
+
+	upload.dir = filepath.Join(s.partsDir, upload.id)
+	if err := os.Mkdir(upload.dir, 0700); err != nil {
+		s.writeError(w, r, err, nil)
+		return
+	}
+
+	s.uploadsLock.Lock()
+	s.uploads[upload.id] = upload
+	s.uploadsLock.Unlock()
+
+	s.writeXML(w, http.StatusOK, &initiateMultipartUploadResponse{Xmlns: xmlns, Bucket: bucket, Key: key, UploadId: upload.id})
+}
+
+func (s *s3Server) handleUploadPart(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string, key string) {
+	upload, err := s.getUpload(r, user, bucket, key)
+	if err != nil {
+		s.writeError(w, r, err, nil)
+		return
+	}
+
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		s.writeError(w, r, errInvalidArgument("Part number must be an integer between 1 and 10000, inclusive"), nil)
+		return
+	} else if err := checkContentMD5(r); err != nil {
+		s.writeError(w, r, err, nil)
+		return
+	}
+
+	// write to a temporary file so that a failed retry does not replace a good part
+	file, err := os.CreateTemp(upload.dir, "tmp-")
+	if err != nil {
+		s.writeError(w, r, err, errNoSuchUpload)
+		return
+	}
+
+	defer func() { _ = os.Remove(file.Name()) }()
+
+	done := metrics.TransferStarted(metrics.TransferUpload)
+
+	sum := md5.New()
+	n, err := io.Copy(io.MultiWriter(file, sum), r.Body)
+	done(n)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		s.writeError(w, r, err, nil)
+		return
+	} else if err := os.Rename(file.Name(), upload.partPath(number)); err != nil {
+		s.writeError(w, r, err, errNoSuchUpload)
+		return
+	}
+
+	etag := hex.EncodeToString(sum.Sum(nil))
+
+	s.uploadsLock.Lock()
+	upload.parts[number] = etag
+	s.uploadsLock.Unlock()
+
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+type completeMultipartUploadRequest struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResponse struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (s *s3Server) handleCompleteMultipartUpload(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string, key string) {
+	upload, err := s.getUpload(r, user, bucket, key)
+	if err != nil {
+		s.writeError(w, r, err, nil)
+		return
+	}
+
+	var req completeMultipartUploadRequest
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1024*1024)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		s.writeError(w, r, errMalformedXML, nil)
+		return
+	}
+
+	// the final ETag is the MD5 of the binary MD5 of the parts, followed by their number
+	s.uploadsLock.Lock()
+	sums := md5.New()
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			s.uploadsLock.Unlock()
+			s.writeError(w, r, errInvalidPartOrder, nil)
+			return
+		}
+
+		etag, ok := upload.parts[part.PartNumber]
+		if !ok || strings.Trim(part.ETag, `"`) != etag {
+			s.uploadsLock.Unlock()
+			s.writeError(w, r, errInvalidPart, nil)
+			return
+		}
+
+		sum, _ := hex.DecodeString(etag)
+		sums.Write(sum)
+	}
+	s.uploadsLock.Unlock()
+
+	if err := s.mkdirAll(r.Context(), user, bucket, path.Dir(key)); err != nil {
+		s.writeError(w, r, err, errNoSuchKey)
+		return
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		for _, part := range req.Parts {
+			file, err := os.Open(upload.partPath(part.PartNumber))
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+
+			_, err = io.Copy(pw, file)
+			_ = file.Close()
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+
+		_ = pw.Close()
+	}()
+
+	// the parts have been counted already as they were uploaded
+	_, err = s.writeObject(r.Context(), user, path.Join(bucket, key), pr, false)
+	_ = pr.Close()
+	if err != nil {
+		s.writeError(w, r, err, errNoSuchUpload)
+		return
+	}
+
+	s.removeUpload(upload)
+
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sums.Sum(nil)), len(req.Parts))
+	s.writeXML(w, http.StatusOK, &completeMultipartUploadResponse{Xmlns: xmlns, Location: "/" + bucket + "/" + key, Bucket: bucket, Key: key, ETag: etag})
+}
+
+func (s *s3Server) handleAbortMultipartUpload(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string, key string) {
+	upload, err := s.getUpload(r, user, bucket, key)
+	if err != nil {
+		s.writeError(w, r, err, nil)
+		return
+	}
+
+	s.removeUpload(upload)
+	w.WriteHeader(http.StatusNoContent)
+}
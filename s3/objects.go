@@ -0,0 +1,606 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/audit"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxListKeys is the largest page of a listing, like S3.
+const maxListKeys = 1000
+
+type bucketEntry struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listBucketsResponse struct {
+	XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	Owner   owner         `xml:"Owner"`
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+func (s *s3Server) handleListBuckets(w http.ResponseWriter, r *http.Request, user *fileshare.User) {
+	entries, err := s.storage.ReadDir(r.Context(), ".", user)
+	if err != nil {
+		s.writeError(w, r, err, errNoSuchBucket)
+		return
+	}
+
+	resp := listBucketsResponse{Xmlns: xmlns, Owner: owner{ID: user.Nickname, DisplayName: user.Nickname}, Buckets: []bucketEntry{}}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		stat, err := s.storage.Stat(r.Context(), entry.Name(), user)
+		if err != nil {
+			continue
+		}
+
+		resp.Buckets = append(resp.Buckets, bucketEntry{Name: entry.Name(), CreationDate: stat.ModTime.UTC().Format(time.RFC3339)})
+	}
+
+	s.writeXML(w, http.StatusOK, &resp)
+}
+
+type locationResponse struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+func (s *s3Server) handleGetBucketLocation(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string) {
+	if err := s.checkBucket(r.Context(), user, bucket); err != nil {
+		s.writeError(w, r, err, errNoSuchBucket)
+		return
+	}
+
+	s.writeXML(w, http.StatusOK, &locationResponse{Xmlns: xmlns, Location: s.region})
+}
+
+func (s *s3Server) handleHeadBucket(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string) {
+	if err := s.checkBucket(r.Context(), user, bucket); err != nil {
+		s.writeError(w, r, err, errNoSuchBucket)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *s3Server) handleCreateBucket(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string) {
+	if err := s.storage.Mkdir(r.Context(), bucket, user); errors.Is(err, fs.ErrExist) {
+		s.writeError(w, r, errBucketAlreadyExists, nil)
+		return
+	} else if err != nil {
+		s.writeError(w, r, err, errNoSuchBucket)
+		return
+	}
+
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *s3Server) handleDeleteBucket(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string) {
+	entries, err := s.storage.ReadDir(r.Context(), bucket, user)
+	if err != nil {
+		s.writeError(w, r, err, errNoSuchBucket)
+		return
+	} else if len(entries) > 0 {
+		s.writeError(w, r, errBucketNotEmpty, nil)
+		return
+	}
+
+	err = s.storage.Remove(r.Context(), bucket, user)
+	audit.Record(s.audit, audit.NewEntry(r.Context(), fileshare.AuditActionDelete, bucket), 0, err)
+	if err != nil {
+		s.writeError(w, r, err, errNoSuchBucket)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listEntry is an object or a common prefix of a listing.
+type listEntry struct {
+	Key    string
+	Stat   *fileshare.FileStat
+	Prefix bool
+}
+
+// listKeys walks the bucket for the keys starting with prefix. Directories are not descended into
+// if they would be grouped in a common prefix anyway.
+func (s *s3Server) listKeys(ctx context.Context, user *fileshare.User, bucket string, prefix string, delimiter string) ([]listEntry, error) {
+	var result []listEntry
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := s.storage.ReadDir(ctx, path.Join(bucket, dir), user)
+		if errors.Is(err, fs.ErrNotExist) && len(dir) > 0 {
+			// removed in the meantime
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			key := dir + entry.Name()
+			if entry.IsDir() {
+				key += "/"
+				if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+					continue
+				} else if delimiter == "/" && strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+					result = append(result, listEntry{Key: key, Prefix: true})
+					continue
+				}
+
+				if err := walk(key); err != nil {
+					return err
+				}
+
+				continue
+			} else if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+
+			stat, err := s.storage.Stat(ctx, path.Join(bucket, key), user)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			result = append(result, listEntry{Key: key, Stat: stat})
+		}
+
+		return nil
+	}
+
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+
+	// group the objects by delimiter, directories already are
+	if len(delimiter) > 0 {
+		seen := map[string]bool{}
+		grouped := result[:0]
+		for _, entry := range result {
+			if !entry.Prefix {
+				if idx := strings.Index(entry.Key[len(prefix):], delimiter); idx >= 0 {
+					entry = listEntry{Key: entry.Key[:len(prefix)+idx+len(delimiter)], Prefix: true}
+				}
+			}
+
+			if entry.Prefix {
+				if seen[entry.Key] {
+					continue
+				}
+
+				seen[entry.Key] = true
+			}
+
+			grouped = append(grouped, entry)
+		}
+
+		result = grouped
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
+
+type objectEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+	Owner        *owner `xml:"Owner,omitempty"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listObjectsResponse struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Marker                *string        `xml:"Marker"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	KeyCount              *int           `xml:"KeyCount"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	Contents              []objectEntry  `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// handleListObjects serves both ListObjectsV2 and the older ListObjects.
+func (s *s3Server) handleListObjects(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string) {
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+	maxKeys := maxListKeys
+	if str := query.Get("max-keys"); len(str) > 0 {
+		var err error
+		if maxKeys, err = strconv.Atoi(str); err != nil || maxKeys < 0 {
+			s.writeError(w, r, errInvalidArgument("invalid max-keys"), nil)
+			return
+		}
+
+		maxKeys = min(maxKeys, maxListKeys)
+	}
+
+	resp := listObjectsResponse{Xmlns: xmlns, Name: bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys}
+
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		resp.EncodingType = "url"
+		encode = func(s string) string { return uriEncode(s, false) }
+	}
+
+	var marker string
+	if v2 {
+		resp.StartAfter = query.Get("start-after")
+		resp.ContinuationToken = query.Get("continuation-token")
+		marker = resp.StartAfter
+
+		if len(resp.ContinuationToken) > 0 {
+			token, err := base64.RawURLEncoding.DecodeString(resp.ContinuationToken)
+			if err != nil {
+				s.writeError(w, r, errInvalidArgument("invalid continuation token"), nil)
+				return
+			}
+
+			marker = string(token)
+		}
+	} else {
+		marker = query.Get("marker")
+		resp.Marker = &marker
+	}
+
+	if err := s.checkBucket(r.Context(), user, bucket); err != nil {
+		s.writeError(w, r, err, errNoSuchBucket)
+		return
+	}
+
+	entries, err := s.listKeys(r.Context(), user, bucket, prefix, delimiter)
+	if err != nil {
+		s.writeError(w, r, err, errNoSuchBucket)
+		return
+	}
+
+	// skip up to the marker, then take a page
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].Key > marker })
+	entries = entries[start:]
+	if len(entries) > maxKeys {
+		entries = entries[:maxKeys]
+		resp.IsTruncated = true
+	}
+
+	for _, entry := range entries {
+		if entry.Prefix {
+			resp.CommonPrefixes = append(resp.CommonPrefixes, commonPrefix{Prefix: encode(entry.Key)})
+			continue
+		}
+
+		object := objectEntry{
+			Key:          encode(entry.Key),
+			LastModified: entry.Stat.ModTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         etag(entry.Stat),
+			Size:         entry.Stat.Size,
+			StorageClass: "STANDARD",
+		}
+
+		if !v2 || query.Get("fetch-owner") == "true" {
+			object.Owner = &owner{ID: entry.Stat.Owner, DisplayName: entry.Stat.Owner}
+		}
+
+		resp.Contents = append(resp.Contents, object)
+	}
+
+	if resp.IsTruncated {
+		last := entries[len(entries)-1].Key
+		if v2 {
+			resp.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else {
+			resp.NextMarker = encode(last)
+		}
+	}
+
+	if v2 {
+		keyCount := len(entries)
+		resp.KeyCount = &keyCount
+		resp.StartAfter = encode(resp.StartAfter)
+	} else {
+		encodedMarker := encode(marker)
+		resp.Marker = &encodedMarker
+	}
+
+	resp.Prefix = encode(prefix)
+	resp.Delimiter = encode(delimiter)
+	s.writeXML(w, http.StatusOK, &resp)
+}
+
+// parseRange parses a single "bytes=" range, nil is returned for no or unsupported ranges.
+func parseRange(header string, size int64) (*[2]int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+
+	startStr, endStr, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, errInvalidRange
+	}
+
+	if len(startStr) == 0 {
+		// the last n bytes
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, errInvalidRange
+		}
+
+		return &[2]int64{max(size-n, 0), size - 1}, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return nil, errInvalidRange
+	}
+
+	end := size - 1
+	if len(endStr) > 0 {
+		if end, err = strconv.ParseInt(endStr, 10, 64); err != nil || end < start {
+			return nil, errInvalidRange
+		}
+
+		end = min(end, size-1)
+	}
+
+	return &[2]int64{start, end}, nil
+}
+
+func (s *s3Server) handleGetObject(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string, key string, head bool) {
+	name := path.Join(bucket, key)
+	stat, err := s.storage.Stat(r.Context(), name, user)
+	if err != nil {
+		s.writeError(w, r, err, errNoSuchKey)
+		return
+	} else if stat.IsDir != strings.HasSuffix(key, "/") {
+		s.writeError(w, r, errNoSuchKey, nil)
+		return
+	}
+
+	contentType := stat.MimeType
+	if len(contentType) == 0 || stat.IsDir {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag(stat))
+	w.Header().Set("Last-Modified", stat.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if stat.IsDir {
+		// directory markers are empty objects
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rng, err := parseRange(r.Header.Get("Range"), stat.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(stat.Size, 10))
+		s.writeError(w, r, err, nil)
+		return
+	}
+
+	status, offset, length := http.StatusOK, int64(0), stat.Size
+	if rng != nil {
+		status, offset, length = http.StatusPartialContent, rng[0], rng[1]-rng[0]+1
+		w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(rng[0], 10)+"-"+strconv.FormatInt(rng[1], 10)+"/"+strconv.FormatInt(stat.Size, 10))
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if head {
+		w.WriteHeader(status)
+		return
+	}
+
+	entry := audit.NewEntry(r.Context(), fileshare.AuditActionDownload, name)
+	file, _, err := s.storage.OpenFile(r.Context(), name, user)
+	if err != nil {
+		audit.Record(s.audit, entry, 0, err)
+		w.Header().Del("Content-Range")
+		w.Header().Del("Content-Length")
+		s.writeError(w, r, err, errNoSuchKey)
+		return
+	}
+
+	defer func() { _ = file.Close() }()
+
+	if offset > 0 {
+		if seeker, ok := file.(io.Seeker); ok {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, file, offset)
+		}
+
+		if err != nil {
+			audit.Record(s.audit, entry, 0, err)
+			w.Header().Del("Content-Range")
+			w.Header().Del("Content-Length")
+			s.writeError(w, r, err, errNoSuchKey)
+			return
+		}
+	}
+
+	done := metrics.TransferStarted(metrics.TransferDownload)
+	w.WriteHeader(status)
+	n, err := io.CopyN(w, file, length)
+	done(n)
+	audit.Record(s.audit, entry, n, err)
+	if err != nil {
+		s.log.WithError(err).Debugf("failed sending %s", name)
+	}
+}
+
+// checkContentMD5 wraps the body to fail at its end if it does not match the Content-MD5 header.
+func checkContentMD5(r *http.Request) error {
+	header := r.Header.Get("Content-MD5")
+	if len(header) == 0 {
+		return nil
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(expected) != md5.Size {
+		return newS3Error(http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid.")
+	}
+
+	r.Body = &hashReader{ReadCloser: r.Body, hash: md5.New(), expected: expected, mismatch: errBadDigest}
+	return nil
+}
+
+// writeObject writes the body to the file, returning its MD5. The upload is recorded in the audit log.
+func (s *s3Server) writeObject(ctx context.Context, user *fileshare.User, name string, body io.Reader, countTransfer bool) (string, error) {
+	entry := audit.NewEntry(ctx, fileshare.AuditActionUpload, name)
+	file, err := s.storage.CreateFile(ctx, name, user)
+	if err != nil {
+		audit.Record(s.audit, entry, 0, err)
+		return "", err
+	}
+
+	var done func(bytes int64)
+	if countTransfer {
+		done = metrics.TransferStarted(metrics.TransferUpload)
+	}
+
+	sum := md5.New()
+	n, err := io.Copy(io.MultiWriter(file, sum), body)
+	if done != nil {
+		done(n)
+	}
+
+	if err != nil {
+		_ = file.Abort()
+		audit.Record(s.audit, entry, n, err)
+		return "", err
+	}
+
+	err = file.Close()
+	audit.Record(s.audit, entry, n, err)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+func (s *s3Server) handlePutObject(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string, key string) {
+	if err := s.checkBucket(r.Context(), user, bucket); err != nil {
+		s.writeError(w, r, err, errNoSuchBucket)
+		return
+	} else if err := checkContentMD5(r); err != nil {
+		s.writeError(w, r, err, nil)
+		return
+	}
+
+	// keys ending with a slash are directory markers
+	if strings.HasSuffix(key, "/") {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			s.writeError(w, r, err, nil)
+			return
+		} else if err := s.mkdirAll(r.Context(), user, bucket, key); err != nil {
+			s.writeError(w, r, err, errNoSuchKey)
+			return
+		}
+
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := s.mkdirAll(r.Context(), user, bucket, path.Dir(key)); err != nil {
+		s.writeError(w, r, err, errNoSuchKey)
+		return
+	}
+
+	sum, err := s.writeObject(r.Context(), user, path.Join(bucket, key), r.Body, true)
+	if err != nil {
+		s.writeError(w, r, err, errNoSuchKey)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *s3Server) handleDeleteObject(w http.ResponseWriter, r *http.Request, user *fileshare.User, bucket string, key string) {
+	name := path.Join(bucket, key)
+	stat, err := s.storage.Stat(r.Context(), name, user)
+	if errors.Is(err, fs.ErrNotExist) {
+		// deleting a missing object succeeds
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		s.writeError(w, r, err, errNoSuchKey)
+		return
+	} else if stat.IsDir != strings.HasSuffix(key, "/") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// directory markers are removed only if nothing is below them
+	if stat.IsDir {
+		if entries, err := s.storage.ReadDir(r.Context(), name, user); err != nil {
+			s.writeError(w, r, err, errNoSuchKey)
+			return
+		} else if len(entries) > 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	err = s.storage.Remove(r.Context(), name, user)
+	if errors.Is(err, fs.ErrNotExist) {
+		// removed in the meantime
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	audit.Record(s.audit, audit.NewEntry(r.Context(), fileshare.AuditActionDelete, name), 0, err)
+	if err != nil {
+		s.writeError(w, r, err, errNoSuchKey)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
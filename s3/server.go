@@ -0,0 +1,365 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/audit"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"github.com/devgianlu/go-fileshare/storage"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRegion = "us-east-1"
+
+const xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// loginRecordInterval is how often the successful logins of an access key from an address are
+// recorded, every request is signed and would otherwise be a login.
+const loginRecordInterval = 5 * time.Minute
+
+type s3Account struct {
+	nickname string
+	secret   string
+}
+
+type s3Server struct {
+	log      *log.Entry
+	region   string
+	partsDir string
+	storage  fileshare.AuthenticatedStorageProvider
+	users    fileshare.UsersProvider
+	accounts map[string]s3Account
+	audit    fileshare.AuditLog
+	server   *http.Server
+
+	loginsLock sync.Mutex
+	logins     map[string]time.Time
+
+	uploadsLock sync.Mutex
+	uploads     map[string]*multipartUpload
+}
+
+// NewS3Server serves the storage over a subset of the S3 API, requests are signed with SigV4 using
+// the access keys of the given users.
+func NewS3Server(cfg fileshare.S3, storage fileshare.AuthenticatedStorageProvider, users fileshare.UsersProvider, accounts []fileshare.User, auditLog fileshare.AuditLog) (fileshare.HttpServer, error) {
+	s := &s3Server{}
+	s.log = log.WithField("module", "s3")
+	s.region = cfg.Region
+	s.storage = storage
+	s.users = users
+	s.audit = auditLog
+	s.logins = map[string]time.Time{}
+	s.uploads = map[string]*multipartUpload{}
+
+	s.accounts = map[string]s3Account{}
+	for _, user := range accounts {
+		for _, key := range user.S3Keys {
+			if _, ok := s.accounts[key.AccessKey]; ok {
+				return nil, fmt.Errorf("duplicate access key %s", key.AccessKey)
+			}
+
+			s.accounts[key.AccessKey] = s3Account{nickname: user.Nickname, secret: key.SecretKey}
+		}
+	}
+
+	// parts of unfinished uploads are lost on restart
+	s.partsDir = cfg.PartsDir
+	if len(s.partsDir) == 0 {
+		s.partsDir = filepath.Join(os.TempDir(), "go-fileshare-s3")
+	}
+
+	if err := os.RemoveAll(s.partsDir); err != nil {
+		return nil, fmt.Errorf("failed cleaning parts directory: %w", err)
+	} else if err := os.MkdirAll(s.partsDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed creating parts directory: %w", err)
+	}
+
+	s.server = &http.Server{Addr: cfg.Listen, Handler: s}
+	return s, nil
+}
+
+func (s *s3Server) ListenForever() error {
+	s.log.Infof("listening on %s", s.server.Addr)
+	if err := s.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *s3Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+func (s *s3Server) writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		s.log.WithError(err).Debugf("failed writing response")
+	}
+}
+
+func (s *s3Server) writeError(w http.ResponseWriter, r *http.Request, err error, notFound *s3Error) {
+	s3Err := toS3Error(err, notFound)
+	if s3Err == errInternalError {
+		s.log.WithError(err).Errorf("%s %s failed", r.Method, r.URL.Path)
+	} else {
+		s.log.WithError(err).Debugf("%s %s failed", r.Method, r.URL.Path)
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3Err.Status)
+		return
+	}
+
+	s.writeXML(w, s3Err.Status, &errorResponse{Code: s3Err.Code, Message: s3Err.Message, Resource: r.URL.Path})
+}
+
+// authenticate verifies the signature of the request and returns its user. Failed logins are
+// recorded in the audit log, successful ones once in a while.
+func (s *s3Server) authenticate(r *http.Request, ip string) (*fileshare.User, error) {
+	sig, err := parseSignature(r)
+	if err != nil {
+		return nil, err
+	} else if sig == nil {
+		return nil, errAccessDenied
+	}
+
+	user, err := s.verifySignature(r, sig)
+	if err != nil {
+		var nickname string
+		if account, ok := s.accounts[sig.AccessKey]; ok {
+			nickname = account.nickname
+		}
+
+		var s3Err *s3Error
+		if errors.As(err, &s3Err) {
+			metrics.ObserveLogin("s3", false)
+			audit.Record(s.audit, fileshare.AuditEntry{User: nickname, IP: ip, Action: fileshare.AuditActionLogin}, 0, fileshare.NewError("invalid credentials", fileshare.ErrAuthInvalid, err))
+		} else {
+			audit.Record(s.audit, fileshare.AuditEntry{User: nickname, IP: ip, Action: fileshare.AuditActionLogin}, 0, err)
+		}
+
+		return nil, err
+	}
+
+	if s.shouldRecordLogin(sig.AccessKey, ip) {
+		metrics.ObserveLogin("s3", true)
+		audit.Record(s.audit, fileshare.AuditEntry{User: user.Nickname, IP: ip, Action: fileshare.AuditActionLogin}, 0, nil)
+	}
+
+	return user, nil
+}
+
+// verifySignature checks the signature against the secret of the access key.
+func (s *s3Server) verifySignature(r *http.Request, sig *signature) (*fileshare.User, error) {
+	account, ok := s.accounts[sig.AccessKey]
+	if !ok {
+		return nil, errInvalidAccessKeyId
+	}
+
+	region := s.region
+	if len(region) == 0 {
+		region = defaultRegion
+	}
+
+	if sig.Region != region {
+		return nil, errAuthorizationMalformed(fmt.Sprintf("the region '%s' is wrong; expecting '%s'", sig.Region, region))
+	} else if err := sig.checkTime(time.Now()); err != nil {
+		return nil, err
+	} else if err := sig.verify(r, account.secret); err != nil {
+		return nil, err
+	}
+
+	user, err := s.users.GetUser(account.nickname)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting user: %w", err)
+	} else if user == nil {
+		return nil, errInvalidAccessKeyId
+	}
+
+	return user, nil
+}
+
+// shouldRecordLogin reports whether the access key has not been seen from the address recently.
+func (s *s3Server) shouldRecordLogin(accessKey string, ip string) bool {
+	s.loginsLock.Lock()
+	defer s.loginsLock.Unlock()
+
+	now := time.Now()
+	for k, last := range s.logins {
+		if now.Sub(last) > loginRecordInterval {
+			delete(s.logins, k)
+		}
+	}
+
+	key := accessKey + "\x00" + ip
+	if _, ok := s.logins[key]; ok {
+		return false
+	}
+
+	s.logins[key] = now
+	return true
+}
+
+// validName checks the bucket or key maps to a clean path, a trailing slash is allowed in keys.
+func validName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+
+	for _, segment := range strings.Split(strings.TrimSuffix(name, "/"), "/") {
+		if len(segment) == 0 || segment == "." || segment == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	user, err := s.authenticate(r, ip)
+	if err != nil {
+		s.writeError(w, r, err, errAccessDenied)
+		return
+	}
+
+	ctx := fileshare.ContextWithUser(r.Context(), user)
+	ctx = fileshare.ContextWithRemoteIP(ctx, ip)
+	r = r.WithContext(ctx)
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(bucket) == 0 {
+		if r.Method != http.MethodGet {
+			s.writeError(w, r, errMethodNotAllowed, nil)
+			return
+		}
+
+		s.handleListBuckets(w, r, user)
+		return
+	} else if !validName(bucket) || strings.Contains(bucket, "/") || (len(key) > 0 && !validName(key)) {
+		s.writeError(w, r, errInvalidArgument("invalid bucket or key"), nil)
+		return
+	}
+
+	query := r.URL.Query()
+	if len(key) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			if query.Has("location") {
+				s.handleGetBucketLocation(w, r, user, bucket)
+			} else if query.Has("uploads") || query.Has("versions") || query.Has("policy") || query.Has("acl") {
+				s.writeError(w, r, errNotImplemented, nil)
+			} else {
+				s.handleListObjects(w, r, user, bucket)
+			}
+		case http.MethodHead:
+			s.handleHeadBucket(w, r, user, bucket)
+		case http.MethodPut:
+			s.handleCreateBucket(w, r, user, bucket)
+		case http.MethodDelete:
+			s.handleDeleteBucket(w, r, user, bucket)
+		default:
+			s.writeError(w, r, errMethodNotAllowed, nil)
+		}
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if query.Has("uploadId") || query.Has("acl") || query.Has("tagging") {
+			s.writeError(w, r, errNotImplemented, nil)
+		} else {
+			s.handleGetObject(w, r, user, bucket, key, false)
+		}
+	case http.MethodHead:
+		s.handleGetObject(w, r, user, bucket, key, true)
+	case http.MethodPut:
+		if len(r.Header.Get("X-Amz-Copy-Source")) > 0 {
+			s.writeError(w, r, errNotImplemented, nil)
+		} else if query.Has("uploadId") {
+			s.handleUploadPart(w, r, user, bucket, key)
+		} else {
+			s.handlePutObject(w, r, user, bucket, key)
+		}
+	case http.MethodPost:
+		if query.Has("uploads") {
+			s.handleCreateMultipartUpload(w, r, user, bucket, key)
+		} else if query.Has("uploadId") {
+			s.handleCompleteMultipartUpload(w, r, user, bucket, key)
+		} else {
+			s.writeError(w, r, errNotImplemented, nil)
+		}
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			s.handleAbortMultipartUpload(w, r, user, bucket, key)
+		} else {
+			s.handleDeleteObject(w, r, user, bucket, key)
+		}
+	default:
+		s.writeError(w, r, errMethodNotAllowed, nil)
+	}
+}
+
+// checkBucket verifies the bucket exists and is a directory.
+func (s *s3Server) checkBucket(ctx context.Context, user *fileshare.User, bucket string) error {
+	stat, err := s.storage.Stat(ctx, bucket, user)
+	if err != nil {
+		return toS3Error(err, errNoSuchBucket)
+	} else if !stat.IsDir {
+		return errNoSuchBucket
+	}
+
+	return nil
+}
+
+// mkdirAll creates the directory and its missing parents below the bucket.
+func (s *s3Server) mkdirAll(ctx context.Context, user *fileshare.User, bucket string, dir string) error {
+	current := bucket
+	for _, segment := range strings.Split(dir, "/") {
+		if len(segment) == 0 || segment == "." {
+			continue
+		}
+
+		current += "/" + segment
+		if stat, err := s.storage.Stat(ctx, current, user); err == nil && stat.IsDir {
+			continue
+		} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if err := s.storage.Mkdir(ctx, current, user); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// etag returns the ETag of a file, the MD5 if available like S3 does or another checksum.
+func etag(stat *fileshare.FileStat) string {
+	if sum := stat.Checksums[storage.ChecksumMD5]; len(sum) > 0 {
+		return `"` + sum + `"`
+	} else if sum := stat.Checksums[storage.ChecksumSHA256]; len(sum) > 0 {
+		return `"` + sum + `"`
+	}
+
+	return fmt.Sprintf(`"%x-%x"`, stat.ModTime.UnixNano(), stat.Size)
+}
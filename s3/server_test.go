@@ -0,0 +1,272 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "pippo-key"
+	testSecretKey = "pippo-secret"
+)
+
+type memoryAuditLog struct {
+	lock    sync.Mutex
+	entries []fileshare.AuditEntry
+}
+
+func (l *memoryAuditLog) Record(entry fileshare.AuditEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+func (l *memoryAuditLog) Query(fileshare.AuditQuery) ([]fileshare.AuditEntry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]fileshare.AuditEntry(nil), l.entries...), nil
+}
+
+func (l *memoryAuditLog) Verify() error {
+	return nil
+}
+
+// newTestS3Server serves a local directory to pippo, the buckets are its top level directories.
+func newTestS3Server(t *testing.T, base string) (*s3Server, string) {
+	st, err := storage.NewLocalStorageProvider(base, "")
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	accounts := []fileshare.User{{
+		Nickname: "pippo",
+		ACL:      []fileshare.PathACL{{Path: "/", Read: true, Write: true}},
+		S3Keys:   []fileshare.S3Key{{AccessKey: testAccessKey, SecretKey: testSecretKey}},
+	}}
+
+	s, err := NewS3Server(fileshare.S3{PartsDir: filepath.Join(t.TempDir(), "parts")}, storage.NewACLStorageProvider(st, nil, nil), auth.NewConfigUsersProvider(accounts, nil), accounts, &memoryAuditLog{})
+	if err != nil {
+		t.Fatalf("failed creating server: %v", err)
+	}
+
+	server := httptest.NewServer(s.(*s3Server))
+	t.Cleanup(server.Close)
+	return s.(*s3Server), server.URL
+}
+
+// testS3Request sends a request signed with the secret, like the S3 clients do.
+func testS3Request(t *testing.T, method string, url string, body string, secret string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed creating request: %v", err)
+	}
+
+	if len(secret) > 0 {
+		now := time.Now().UTC()
+		sig := &signature{
+			AccessKey:     testAccessKey,
+			Date:          now.Format("20060102"),
+			Region:        defaultRegion,
+			Service:       "s3",
+			SignedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+			Time:          now,
+		}
+
+		req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+		req.Header.Set("X-Amz-Content-Sha256", sha256Hex([]byte(body)))
+
+		key := signingKey(secret, sig.Date, sig.Region, sig.Service)
+		signature := hex.EncodeToString(hmacSHA256(key, stringToSign(sig, canonicalRequest(req, sig, sha256Hex([]byte(body))))))
+		req.Header.Set("Authorization", signatureAlgorithm+" Credential="+testAccessKey+"/"+sig.scope()+",SignedHeaders="+strings.Join(sig.SignedHeaders, ";")+",Signature="+signature)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func decodeXML(t *testing.T, resp *http.Response, v any) {
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("failed decoding response: %v", err)
+	}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed reading response: %v", err)
+	}
+
+	return string(data)
+}
+
+func TestS3Server_Auth(t *testing.T) {
+	s, url := newTestS3Server(t, t.TempDir())
+
+	var errResp errorResponse
+	if resp := testS3Request(t, "GET", url+"/", "", ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if resp := testS3Request(t, "GET", url+"/", "", "wrong"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if decodeXML(t, resp, &errResp); errResp.Code != "SignatureDoesNotMatch" {
+		t.Fatalf("unexpected error: %+v", errResp)
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := testS3Request(t, "GET", url+"/", "", testSecretKey); resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", resp.StatusCode)
+		}
+	}
+
+	// every request is signed, but only the first one is a login
+	entries, _ := s.audit.Query(fileshare.AuditQuery{})
+	if len(entries) != 2 {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	} else if entries[0].Action != fileshare.AuditActionLogin || entries[0].User != "pippo" || entries[0].Outcome != fileshare.AuditOutcomeDenied {
+		t.Fatalf("unexpected failed login: %+v", entries[0])
+	} else if entries[1].Action != fileshare.AuditActionLogin || entries[1].User != "pippo" || entries[1].Outcome != fileshare.AuditOutcomeSuccess {
+		t.Fatalf("unexpected login: %+v", entries[1])
+	}
+}
+
+func TestS3Server_Objects(t *testing.T) {
+	base := t.TempDir()
+	s, url := newTestS3Server(t, base)
+
+	if resp := testS3Request(t, "PUT", url+"/bucket", "", testSecretKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	sum := md5.Sum([]byte("hello world"))
+	if resp := testS3Request(t, "PUT", url+"/bucket/dir/a.txt", "hello world", testSecretKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if resp.Header.Get("ETag") != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Fatalf("unexpected ETag: %s", resp.Header.Get("ETag"))
+	} else if data, _ := os.ReadFile(filepath.Join(base, "bucket", "dir", "a.txt")); string(data) != "hello world" {
+		t.Fatalf("unexpected stored content: %s", data)
+	}
+
+	if resp := testS3Request(t, "GET", url+"/bucket/dir/a.txt", "", testSecretKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if body := readBody(t, resp); body != "hello world" {
+		t.Fatalf("unexpected content: %s", body)
+	}
+
+	// the directories are grouped with the delimiter
+	var list listObjectsResponse
+	if resp := testS3Request(t, "GET", url+"/bucket?list-type=2&delimiter=%2F", "", testSecretKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if decodeXML(t, resp, &list); len(list.Contents) != 0 || len(list.CommonPrefixes) != 1 || list.CommonPrefixes[0].Prefix != "dir/" {
+		t.Fatalf("unexpected listing: %+v", list)
+	}
+
+	list = listObjectsResponse{}
+	if resp := testS3Request(t, "GET", url+"/bucket?list-type=2&prefix=dir%2F", "", testSecretKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if decodeXML(t, resp, &list); len(list.Contents) != 1 || list.Contents[0].Key != "dir/a.txt" || list.Contents[0].Size != 11 {
+		t.Fatalf("unexpected listing: %+v", list)
+	}
+
+	if resp := testS3Request(t, "DELETE", url+"/bucket/dir/a.txt", "", testSecretKey); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if _, err := os.Stat(filepath.Join(base, "bucket", "dir", "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected object to be removed: %v", err)
+	}
+
+	var errResp errorResponse
+	if resp := testS3Request(t, "GET", url+"/bucket/dir/a.txt", "", testSecretKey); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if decodeXML(t, resp, &errResp); errResp.Code != "NoSuchKey" {
+		t.Fatalf("unexpected error: %+v", errResp)
+	}
+
+	var actions []string
+	entries, _ := s.audit.Query(fileshare.AuditQuery{})
+	for _, entry := range entries {
+		if entry.Action == fileshare.AuditActionLogin {
+			continue
+		} else if entry.User != "pippo" || entry.Path != "bucket/dir/a.txt" || entry.Outcome != fileshare.AuditOutcomeSuccess {
+			t.Fatalf("unexpected entry: %+v", entry)
+		}
+
+		actions = append(actions, entry.Action)
+	}
+
+	if strings.Join(actions, ",") != "upload,download,delete" {
+		t.Fatalf("unexpected audit entries: %v", actions)
+	}
+}
+
+func TestS3Server_Multipart(t *testing.T) {
+	base := t.TempDir()
+	_, url := newTestS3Server(t, base)
+	_ = os.Mkdir(filepath.Join(base, "bucket"), 0755)
+
+	var initiate initiateMultipartUploadResponse
+	if resp := testS3Request(t, "POST", url+"/bucket/big.bin?uploads", "", testSecretKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if decodeXML(t, resp, &initiate); len(initiate.UploadId) == 0 {
+		t.Fatalf("unexpected response: %+v", initiate)
+	}
+
+	var complete bytes.Buffer
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i, part := range []string{"hello", " world"} {
+		resp := testS3Request(t, "PUT", url+"/bucket/big.bin?partNumber="+strconv.Itoa(i+1)+"&uploadId="+initiate.UploadId, part, testSecretKey)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", resp.StatusCode)
+		}
+
+		complete.WriteString("<Part><PartNumber>" + strconv.Itoa(i+1) + "</PartNumber><ETag>" + resp.Header.Get("ETag") + "</ETag></Part>")
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+
+	// nothing is visible until the upload is completed
+	if _, err := os.Stat(filepath.Join(base, "bucket", "big.bin")); !os.IsNotExist(err) {
+		t.Fatalf("expected missing object: %v", err)
+	}
+
+	var completed completeMultipartUploadResponse
+	if resp := testS3Request(t, "POST", url+"/bucket/big.bin?uploadId="+initiate.UploadId, complete.String(), testSecretKey); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if decodeXML(t, resp, &completed); !strings.HasSuffix(completed.ETag, `-2"`) {
+		t.Fatalf("unexpected response: %+v", completed)
+	} else if data, _ := os.ReadFile(filepath.Join(base, "bucket", "big.bin")); string(data) != "hello world" {
+		t.Fatalf("unexpected content: %s", data)
+	}
+
+	// an aborted upload cannot be used anymore
+	initiate = initiateMultipartUploadResponse{}
+	decodeXML(t, testS3Request(t, "POST", url+"/bucket/other.bin?uploads", "", testSecretKey), &initiate)
+	if resp := testS3Request(t, "DELETE", url+"/bucket/other.bin?uploadId="+initiate.UploadId, "", testSecretKey); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var errResp errorResponse
+	if resp := testS3Request(t, "PUT", url+"/bucket/other.bin?partNumber=1&uploadId="+initiate.UploadId, "data", testSecretKey); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	} else if decodeXML(t, resp, &errResp); errResp.Code != "NoSuchUpload" {
+		t.Fatalf("unexpected error: %+v", errResp)
+	} else if _, err := os.Stat(filepath.Join(base, "bucket", "other.bin")); !os.IsNotExist(err) {
+		t.Fatalf("expected missing object: %v", err)
+	}
+}
@@ -0,0 +1,438 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signatureAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat      = "20060102T150405Z"
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// maxClockSkew is how far the request time can be from the server time.
+	maxClockSkew = 15 * time.Minute
+	// maxPresignedExpiry is the longest validity of a presigned URL.
+	maxPresignedExpiry = 7 * 24 * time.Hour
+)
+
+// emptySHA256 is the hash of an empty payload.
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// signature is the parsed SigV4 authorization of a request, from its header or presigned query.
+type signature struct {
+	AccessKey     string
+	Date          string
+	Region        string
+	Service       string
+	SignedHeaders []string
+	Signature     string
+	Time          time.Time
+	Expires       time.Duration
+	Presigned     bool
+}
+
+func (sig *signature) scope() string {
+	return sig.Date + "/" + sig.Region + "/" + sig.Service + "/aws4_request"
+}
+
+// parseCredential parses "<access key>/<date>/<region>/<service>/aws4_request".
+func parseCredential(sig *signature, credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || parts[3] != "s3" {
+		return errAuthorizationMalformed("invalid credential scope")
+	}
+
+	sig.AccessKey, sig.Date, sig.Region, sig.Service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+// parseSignature extracts the signature from the Authorization header or the presigned URL query,
+// nil is returned if the request is not signed.
+func parseSignature(r *http.Request) (*signature, error) {
+	var sig signature
+
+	if query := r.URL.Query(); query.Has("X-Amz-Algorithm") {
+		if query.Get("X-Amz-Algorithm") != signatureAlgorithm {
+			return nil, errAuthorizationMalformed("unsupported algorithm")
+		} else if err := parseCredential(&sig, query.Get("X-Amz-Credential")); err != nil {
+			return nil, err
+		}
+
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignedExpiry {
+			return nil, errAuthorizationMalformed("invalid expiry")
+		}
+
+		sig.Expires = time.Duration(expires) * time.Second
+		sig.SignedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+		sig.Signature = query.Get("X-Amz-Signature")
+		sig.Presigned = true
+
+		if sig.Time, err = time.Parse(amzDateFormat, query.Get("X-Amz-Date")); err != nil {
+			return nil, errAuthorizationMalformed("invalid date")
+		}
+	} else if header := r.Header.Get("Authorization"); len(header) > 0 {
+		algorithm, fields, _ := strings.Cut(header, " ")
+		if algorithm != signatureAlgorithm {
+			return nil, errAuthorizationMalformed("unsupported algorithm")
+		}
+
+		for _, field := range strings.Split(fields, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "Credential":
+				if err := parseCredential(&sig, value); err != nil {
+					return nil, err
+				}
+			case "SignedHeaders":
+				sig.SignedHeaders = strings.Split(value, ";")
+			case "Signature":
+				sig.Signature = value
+			}
+		}
+
+		date := r.Header.Get("X-Amz-Date")
+		if len(date) == 0 {
+			date = r.Header.Get("Date")
+		}
+
+		var err error
+		if sig.Time, err = time.Parse(amzDateFormat, date); err != nil {
+			if sig.Time, err = http.ParseTime(date); err != nil {
+				return nil, errAuthorizationMalformed("invalid date")
+			}
+		}
+	} else {
+		return nil, nil
+	}
+
+	if len(sig.AccessKey) == 0 || len(sig.Signature) == 0 || len(sig.SignedHeaders) == 0 {
+		return nil, errAuthorizationMalformed("incomplete signature")
+	} else if sig.Time.UTC().Format("20060102") != sig.Date {
+		return nil, errAuthorizationMalformed("date does not match credential scope")
+	}
+
+	return &sig, nil
+}
+
+// checkTime verifies the request is not too old, or expired if presigned.
+func (sig *signature) checkTime(now time.Time) error {
+	if sig.Presigned {
+		if now.Before(sig.Time.Add(-maxClockSkew)) {
+			return errRequestTimeTooSkewed
+		} else if now.After(sig.Time.Add(sig.Expires)) {
+			return errExpiredRequest
+		}
+	} else if diff := now.Sub(sig.Time); diff > maxClockSkew || diff < -maxClockSkew {
+		return errRequestTimeTooSkewed
+	}
+
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func signingKey(secret string, date string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// uriEncode encodes everything except the unreserved characters, as SigV4 requires.
+func uriEncode(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			_, _ = fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+
+	return buf.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+
+		for _, value := range values {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func canonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var buf strings.Builder
+	for _, name := range signedHeaders {
+		// the host is moved out of the headers, as the length when the request is not chunked
+		values := append([]string(nil), r.Header.Values(name)...)
+		if name == "host" {
+			values = []string{r.Host}
+		} else if name == "content-length" && len(values) == 0 && r.ContentLength >= 0 {
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+
+		for i, value := range values {
+			values[i] = strings.Join(strings.Fields(value), " ")
+		}
+
+		buf.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+
+	return buf.String()
+}
+
+func canonicalRequest(r *http.Request, sig *signature, payloadHash string) string {
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders(r, sig.SignedHeaders),
+		strings.Join(sig.SignedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func stringToSign(sig *signature, canonical string) string {
+	return signatureAlgorithm + "\n" + sig.Time.UTC().Format(amzDateFormat) + "\n" + sig.scope() + "\n" + sha256Hex([]byte(canonical))
+}
+
+// payloadHash is the hash the client declared for the body.
+func payloadHash(r *http.Request, sig *signature) string {
+	if sig.Presigned {
+		if hash := r.URL.Query().Get("X-Amz-Content-Sha256"); len(hash) > 0 {
+			return hash
+		}
+
+		return unsignedPayload
+	}
+
+	return r.Header.Get("X-Amz-Content-Sha256")
+}
+
+// verify checks the signature with the secret and wraps the body so that it is verified while read.
+func (sig *signature) verify(r *http.Request, secret string) error {
+	hash := payloadHash(r, sig)
+	if len(hash) == 0 {
+		return newS3Error(http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256")
+	}
+
+	key := signingKey(secret, sig.Date, sig.Region, sig.Service)
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign(sig, canonicalRequest(r, sig, hash))))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sig.Signature)) != 1 {
+		return errSignatureDoesNotMatch
+	}
+
+	switch hash {
+	case unsignedPayload:
+	case streamingPayload:
+		r.Body = &chunkedReader{body: r.Body, r: bufio.NewReader(r.Body), signed: true, key: key, sig: sig, prevSignature: sig.Signature, hash: sha256.New()}
+	case streamingUnsignedTrailer:
+		r.Body = &chunkedReader{body: r.Body, r: bufio.NewReader(r.Body)}
+	default:
+		expectedSum, err := hex.DecodeString(hash)
+		if err != nil || len(expectedSum) != sha256.Size {
+			return errContentSHA256Mismatch
+		}
+
+		r.Body = &hashReader{ReadCloser: r.Body, hash: sha256.New(), expected: expectedSum, mismatch: errContentSHA256Mismatch}
+	}
+
+	return nil
+}
+
+// hashReader fails with mismatch at the end of the body if its hash is not the expected one.
+type hashReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+	mismatch error
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.ReadCloser.Read(p)
+	h.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) && !bytes.Equal(h.hash.Sum(nil), h.expected) {
+		return n, h.mismatch
+	}
+
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body, verifying the signature of each chunk if signed.
+type chunkedReader struct {
+	body   io.Closer
+	r      *bufio.Reader
+	signed bool
+
+	key           []byte
+	sig           *signature
+	prevSignature string
+	hash          hash.Hash
+
+	remaining      int64
+	chunkSignature string
+	done           bool
+	err            error
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func (c *chunkedReader) verifyChunk() error {
+	if !c.signed {
+		return nil
+	}
+
+	toSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.sig.Time.UTC().Format(amzDateFormat) + "\n" + c.sig.scope() + "\n" +
+		c.prevSignature + "\n" + emptySHA256 + "\n" + hex.EncodeToString(c.hash.Sum(nil))
+	expected := hex.EncodeToString(hmacSHA256(c.key, toSign))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(c.chunkSignature)) != 1 {
+		return errSignatureDoesNotMatch
+	}
+
+	c.prevSignature = c.chunkSignature
+	c.hash.Reset()
+	return nil
+}
+
+// nextChunk reads the header of the next chunk, the trailers are skipped after the last one.
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+
+	sizeStr, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil || size < 0 {
+		return errInvalidArgument("invalid chunk size")
+	}
+
+	if c.signed {
+		var ok bool
+		if c.chunkSignature, ok = strings.CutPrefix(ext, "chunk-signature="); !ok {
+			return errSignatureDoesNotMatch
+		}
+	}
+
+	c.remaining = size
+	if size > 0 {
+		return nil
+	}
+
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+
+	for {
+		if line, err := c.readLine(); err != nil {
+			return err
+		} else if len(line) == 0 {
+			break
+		}
+	}
+
+	c.done = true
+	return nil
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if c.remaining == 0 && !c.done {
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+	}
+
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.signed {
+		c.hash.Write(p[:n])
+	}
+
+	if errors.Is(err, io.EOF) && c.remaining > 0 {
+		c.err = io.ErrUnexpectedEOF
+		return n, c.err
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		c.err = err
+		return n, err
+	}
+
+	if c.remaining == 0 {
+		if line, err := c.readLine(); err != nil {
+			c.err = err
+		} else if len(line) > 0 {
+			c.err = errInvalidArgument("invalid chunk terminator")
+		} else {
+			c.err = c.verifyChunk()
+		}
+
+		if c.err != nil {
+			return n, c.err
+		}
+	}
+
+	return n, nil
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
@@ -0,0 +1,47 @@
+package fileshare
+
+import "time"
+
+type Sessions struct {
+	// File keeps the sessions across restarts, they are only in memory if empty
+	File string `yaml:"file"`
+	// AccessTokenExpiry is how long access tokens are valid, defaults to 15 minutes
+	AccessTokenExpiry time.Duration `yaml:"access_token_expiry"`
+	// Expiry is how long a session lasts after login, defaults to 7 days
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+// Session is a login of a user, its access tokens are valid until it expires or is revoked.
+type Session struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	IP          string    `json:"ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// SessionTokens are given to the client at login and at every refresh.
+type SessionTokens struct {
+	Session              Session
+	AccessToken          string
+	AccessTokenExpiresAt time.Time
+	RefreshToken         string
+}
+
+type SessionStore interface {
+	// Create stores a new session whose refresh token has the given hash.
+	Create(session Session, refreshHash string) error
+	// Get returns the session if it is still active.
+	Get(id string) (*Session, error)
+	// Rotate replaces the refresh token of its session and returns the session. Reusing a replaced
+	// token revokes the session, since it must have been stolen.
+	Rotate(refreshHash string, newRefreshHash string) (*Session, error)
+
+	// List returns the active sessions of the user, or of everyone if empty.
+	List(user string) ([]Session, error)
+	Revoke(user string, id string) error
+	// RevokeUser revokes all sessions of the user and returns how many there were.
+	RevokeUser(user string) (int, error)
+}
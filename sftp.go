@@ -0,0 +1,7 @@
+package fileshare
+
+// SFTP serves the storage over SFTP on its own address, the host key is generated at HostKey if missing.
+type SFTP struct {
+	Listen  string `yaml:"listen"`
+	HostKey string `yaml:"host_key"`
+}
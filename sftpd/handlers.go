@@ -0,0 +1,388 @@
+package sftpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/audit"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"time"
+)
+
+// maxPendingWrite is how much out of order data is buffered for an upload, clients send several
+// write requests at once but the storage is written sequentially.
+const maxPendingWrite = 32 * 1024 * 1024
+
+// readHistory is how much already read data is kept around for reads that arrive out of order.
+const readHistory = 4 * 1024 * 1024
+
+// sftpError converts the storage errors to SFTP status codes, files that cannot be read are
+// reported as missing like the HTML routes do.
+func sftpError(err error) error {
+	if err == nil {
+		return nil
+	} else if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fileshare.ErrStorageReadForbidden) {
+		return sftp.ErrSSHFxNoSuchFile
+	} else if errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		return sftp.ErrSSHFxPermissionDenied
+	} else if errors.Is(err, fileshare.ErrStorageDirNotEmpty) {
+		return sftp.ErrSSHFxFailure
+	}
+
+	return err
+}
+
+type handlers struct {
+	ctx     context.Context
+	storage fileshare.AuthenticatedStorageProvider
+	user    *fileshare.User
+	audit   fileshare.AuditLog
+}
+
+func newHandlers(ctx context.Context, storage fileshare.AuthenticatedStorageProvider, user *fileshare.User, auditLog fileshare.AuditLog) sftp.Handlers {
+	h := &handlers{ctx: ctx, storage: storage, user: user, audit: auditLog}
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+func (h *handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	stat, err := h.storage.Stat(h.ctx, r.Filepath, h.user)
+	if err != nil {
+		return nil, sftpError(err)
+	} else if stat.IsDir {
+		return nil, sftp.ErrSSHFxFailure
+	}
+
+	return &readerAt{h: h, name: r.Filepath, entry: audit.NewEntry(h.ctx, fileshare.AuditActionDownload, r.Filepath)}, nil
+}
+
+func (h *handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	entry := audit.NewEntry(h.ctx, fileshare.AuditActionUpload, r.Filepath)
+	w, err := h.storage.CreateFile(h.ctx, r.Filepath, h.user)
+	if err != nil {
+		audit.Record(h.audit, entry, 0, err)
+		return nil, sftpError(err)
+	}
+
+	return &writerAt{w: w, pending: map[int64][]byte{}, done: metrics.TransferStarted(metrics.TransferUpload), audit: h.audit, entry: entry}, nil
+}
+
+func (h *handlers) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		// permissions and times are not stored
+		return nil
+	case "Rename", "PosixRename":
+		err := h.storage.Rename(h.ctx, r.Filepath, r.Target, h.user)
+		audit.Record(h.audit, audit.NewRenameEntry(h.ctx, r.Filepath, r.Target), 0, err)
+		return sftpError(err)
+	case "Mkdir":
+		return sftpError(h.storage.Mkdir(h.ctx, r.Filepath, h.user))
+	case "Rmdir":
+		err := h.storage.RemoveDir(h.ctx, r.Filepath, h.user)
+		audit.Record(h.audit, audit.NewEntry(h.ctx, fileshare.AuditActionDelete, r.Filepath), 0, err)
+		return sftpError(err)
+	case "Remove":
+		stat, err := h.storage.Stat(h.ctx, r.Filepath, h.user)
+		if err != nil {
+			return sftpError(err)
+		} else if stat.IsDir {
+			return fmt.Errorf("is a directory")
+		}
+
+		err = h.storage.Remove(h.ctx, r.Filepath, h.user)
+		audit.Record(h.audit, audit.NewEntry(h.ctx, fileshare.AuditActionDelete, r.Filepath), 0, err)
+		return sftpError(err)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (h *handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := h.storage.ReadDir(h.ctx, r.Filepath, h.user)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+
+		files := make(listerAt, 0, len(entries))
+		for _, entry := range entries {
+			stat, err := h.storage.Stat(h.ctx, path.Join(r.Filepath, entry.Name()), h.user)
+			if errors.Is(err, fs.ErrNotExist) {
+				// removed in the meantime
+				continue
+			} else if err != nil {
+				return nil, sftpError(err)
+			}
+
+			files = append(files, &fileInfo{stat})
+		}
+
+		return files, nil
+	case "Stat":
+		stat, err := h.storage.Stat(h.ctx, r.Filepath, h.user)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+
+		return listerAt{&fileInfo{stat}}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+type listerAt []fs.FileInfo
+
+func (l listerAt) ListAt(ls []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// fileInfo adapts the storage stat.
+type fileInfo struct {
+	stat *fileshare.FileStat
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.stat.Name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.stat.Size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.stat.IsDir {
+		return fs.ModeDir | 0755
+	}
+
+	return 0644
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.stat.ModTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.stat.IsDir
+}
+
+func (fi *fileInfo) Sys() any {
+	return nil
+}
+
+// readerAt reads the file sequentially, reads behind the last one are served from the recently read
+// data or by reopening the file.
+type readerAt struct {
+	h     *handlers
+	name  string
+	entry fileshare.AuditEntry
+
+	lock    sync.Mutex
+	r       io.ReadCloser
+	done    func(bytes int64)
+	pos     int64
+	read    int64
+	history []byte
+	err     error
+}
+
+func (r *readerAt) open() error {
+	file, _, err := r.h.storage.OpenFile(r.h.ctx, r.name, r.h.user)
+	if err != nil {
+		r.err = err
+		return sftpError(err)
+	}
+
+	r.r = file
+	r.pos = 0
+	r.history = r.history[:0]
+	if r.done == nil {
+		r.done = metrics.TransferStarted(metrics.TransferDownload)
+	}
+
+	return nil
+}
+
+// fill reads from the file up to offset end, keeping the data in the history.
+func (r *readerAt) fill(end int64) error {
+	for r.pos < end {
+		if len(r.history) == cap(r.history) {
+			// drop the oldest half when full
+			if cap(r.history) == 0 {
+				r.history = make([]byte, 0, readHistory)
+			} else {
+				r.history = r.history[:copy(r.history, r.history[len(r.history)/2:])]
+			}
+		}
+
+		buf := r.history[len(r.history):min(cap(r.history), len(r.history)+int(end-r.pos))]
+		n, err := r.r.Read(buf)
+		r.history = r.history[:len(r.history)+n]
+		r.pos += int64(n)
+		r.read += int64(n)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				r.err = err
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.r == nil || off < r.pos-int64(len(r.history)) {
+		if r.r != nil {
+			_ = r.r.Close()
+		}
+
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	err := r.fill(off + int64(len(p)))
+	start := r.pos - int64(len(r.history))
+	if off < start {
+		return 0, fmt.Errorf("read too large")
+	}
+
+	var n int
+	if off < r.pos {
+		n = copy(p, r.history[off-start:])
+	}
+
+	if n < len(p) {
+		if err == nil {
+			err = io.EOF
+		}
+
+		return n, err
+	}
+
+	return n, nil
+}
+
+func (r *readerAt) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.done != nil {
+		r.done(r.read)
+	}
+
+	if r.done != nil || r.err != nil {
+		audit.Record(r.h.audit, r.entry, r.read, r.err)
+	}
+
+	if r.r == nil {
+		return nil
+	}
+
+	return r.r.Close()
+}
+
+// writerAt writes the file sequentially, data arriving out of order is buffered until the
+// gap before it is filled.
+type writerAt struct {
+	lock         sync.Mutex
+	w            fileshare.FileWriter
+	done         func(bytes int64)
+	pos          int64
+	pending      map[int64][]byte
+	pendingBytes int
+	err          error
+
+	audit fileshare.AuditLog
+	entry fileshare.AuditEntry
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	} else if off < w.pos {
+		w.err = fmt.Errorf("cannot write before offset %d", w.pos)
+		return 0, w.err
+	} else if off > w.pos {
+		if w.pendingBytes+len(p) > maxPendingWrite {
+			w.err = fmt.Errorf("too much data out of order")
+			return 0, w.err
+		}
+
+		w.pending[off] = append([]byte(nil), p...)
+		w.pendingBytes += len(p)
+		return len(p), nil
+	}
+
+	if _, err := w.w.Write(p); err != nil {
+		w.err = err
+		return 0, err
+	}
+
+	w.pos += int64(len(p))
+
+	// flush what can follow now
+	for {
+		next, ok := w.pending[w.pos]
+		if !ok {
+			break
+		}
+
+		delete(w.pending, w.pos)
+		w.pendingBytes -= len(next)
+
+		if _, err := w.w.Write(next); err != nil {
+			w.err = err
+			return len(p), nil
+		}
+
+		w.pos += int64(len(next))
+	}
+
+	return len(p), nil
+}
+
+// Close commits the file unless a write failed or some data never arrived.
+func (w *writerAt) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.done(w.pos)
+
+	if w.err == nil && len(w.pending) > 0 {
+		w.err = fmt.Errorf("missing data at offset %d", w.pos)
+	}
+
+	if w.err != nil {
+		_ = w.w.Abort()
+		audit.Record(w.audit, w.entry, w.pos, w.err)
+		return w.err
+	}
+
+	err := w.w.Close()
+	audit.Record(w.audit, w.entry, w.pos, err)
+	return err
+}
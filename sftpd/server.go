@@ -0,0 +1,296 @@
+package sftpd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/audit"
+	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// nicknameExtension carries the authenticated nickname from the auth callbacks to the connection.
+const nicknameExtension = "fileshare-nickname"
+
+type sftpServer struct {
+	log     *log.Entry
+	listen  string
+	storage fileshare.AuthenticatedStorageProvider
+	auth    map[string]fileshare.AuthProvider
+	users   fileshare.UsersProvider
+	audit   fileshare.AuditLog
+	config  *ssh.ServerConfig
+
+	listener     net.Listener
+	shuttingDown atomic.Bool
+	connsLock    sync.Mutex
+	conns        map[*ssh.ServerConn]struct{}
+	active       sync.WaitGroup
+}
+
+// NewSFTPServer serves the storage over SFTP, users authenticate with the password providers or with
+// the SSH keys attached to them.
+func NewSFTPServer(cfg fileshare.SFTP, storage fileshare.AuthenticatedStorageProvider, auth map[string]fileshare.AuthProvider, users fileshare.UsersProvider, auditLog fileshare.AuditLog) (fileshare.HttpServer, error) {
+	s := &sftpServer{}
+	s.log = log.WithField("module", "sftp")
+	s.listen = cfg.Listen
+	s.storage = storage
+	s.auth = auth
+	s.users = users
+	s.audit = auditLog
+	s.conns = map[*ssh.ServerConn]struct{}{}
+
+	hostKey, err := loadHostKey(cfg.HostKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading host key: %w", err)
+	}
+
+	s.config = &ssh.ServerConfig{
+		PasswordCallback:  s.passwordCallback,
+		PublicKeyCallback: s.publicKeyCallback,
+	}
+	s.config.AddHostKey(hostKey)
+
+	return s, nil
+}
+
+// loadHostKey reads the private key at path, an ed25519 key is generated there if it does not exist.
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed generating key: %w", err)
+		}
+
+		block, err := ssh.MarshalPrivateKey(key, "go-fileshare")
+		if err != nil {
+			return nil, fmt.Errorf("failed marshalling key: %w", err)
+		}
+
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed writing key: %w", err)
+		}
+
+		log.WithField("module", "sftp").Infof("generated host key at %s", path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(data)
+}
+
+// remoteIP returns the address of the client without the port.
+func remoteIP(addr net.Addr) string {
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return ip
+}
+
+func (s *sftpServer) passwordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	nickname, err := auth.AuthenticatePassword(s.auth, conn.User(), string(password))
+	metrics.ObserveLogin("sftp", err == nil)
+	if err != nil {
+		err = fileshare.NewError("invalid credentials", fileshare.ErrAuthInvalid, err)
+	}
+
+	audit.Record(s.audit, fileshare.AuditEntry{User: conn.User(), IP: remoteIP(conn.RemoteAddr()), Action: fileshare.AuditActionLogin}, 0, err)
+	if err != nil {
+		s.log.WithError(err).Debugf("password authentication failed for %s", conn.User())
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	return &ssh.Permissions{Extensions: map[string]string{nicknameExtension: nickname}}, nil
+}
+
+func (s *sftpServer) publicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	user, err := s.users.GetUser(conn.User())
+	if err != nil || user == nil {
+		return nil, fmt.Errorf("unknown user %s", conn.User())
+	}
+
+	marshalled := key.Marshal()
+	for _, authorizedKey := range user.SSHKeys {
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+		if err != nil {
+			s.log.WithError(err).Warnf("invalid SSH key for %s", user.Nickname)
+			continue
+		}
+
+		if bytes.Equal(parsed.Marshal(), marshalled) {
+			metrics.ObserveLogin("sftp", true)
+			audit.Record(s.audit, fileshare.AuditEntry{User: user.Nickname, IP: remoteIP(conn.RemoteAddr()), Action: fileshare.AuditActionLogin}, 0, nil)
+			return &ssh.Permissions{Extensions: map[string]string{nicknameExtension: user.Nickname}}, nil
+		}
+	}
+
+	// clients try several keys, only the final outcome is a failed login
+	return nil, fmt.Errorf("unknown key for %s", user.Nickname)
+}
+
+func (s *sftpServer) ListenForever() error {
+	listener, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return err
+	}
+
+	s.connsLock.Lock()
+	s.listener = listener
+	s.connsLock.Unlock()
+
+	s.log.Infof("listening on %s", s.listen)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.shuttingDown.Load() {
+				return nil
+			}
+
+			return err
+		}
+
+		s.active.Add(1)
+		go func() {
+			defer s.active.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for the active ones until ctx is done, after
+// which they are closed.
+func (s *sftpServer) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+
+	s.connsLock.Lock()
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	s.connsLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.connsLock.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.connsLock.Unlock()
+
+	<-done
+	return ctx.Err()
+}
+
+func (s *sftpServer) handleConn(netConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		s.log.WithError(err).Debugf("handshake failed with %s", netConn.RemoteAddr())
+		_ = netConn.Close()
+		return
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	s.connsLock.Lock()
+	s.conns[conn] = struct{}{}
+	s.connsLock.Unlock()
+
+	defer func() {
+		s.connsLock.Lock()
+		delete(s.conns, conn)
+		s.connsLock.Unlock()
+	}()
+
+	go ssh.DiscardRequests(reqs)
+
+	nickname := conn.Permissions.Extensions[nicknameExtension]
+	user, err := s.users.GetUser(nickname)
+	if err != nil || user == nil {
+		s.log.WithError(err).Errorf("no user for nickname %s", nickname)
+		return
+	}
+
+	ip := remoteIP(conn.RemoteAddr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx = fileshare.ContextWithUser(ctx, user)
+	ctx = fileshare.ContextWithRemoteIP(ctx, ip)
+
+	s.log.Debugf("%s logged in from %s", user.Nickname, ip)
+
+	var wg sync.WaitGroup
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			s.log.WithError(err).Warnf("failed accepting channel")
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleSession(ctx, user, channel, requests)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// handleSession serves the SFTP subsystem, shells and commands are refused.
+func (s *sftpServer) handleSession(ctx context.Context, user *fileshare.User, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer func() { _ = channel.Close() }()
+
+	for req := range requests {
+		var subsystem struct{ Name string }
+		if req.Type != "subsystem" || ssh.Unmarshal(req.Payload, &subsystem) != nil || subsystem.Name != "sftp" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+
+		_ = req.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+
+		server := sftp.NewRequestServer(channel, newHandlers(ctx, s.storage, user, s.audit))
+		if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+			s.log.WithError(err).Debugf("session of %s ended", user.Nickname)
+		}
+
+		_ = server.Close()
+		return
+	}
+}
@@ -0,0 +1,264 @@
+package sftpd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/auth"
+	"github.com/devgianlu/go-fileshare/storage"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestSFTPServer serves a local directory to pippo, who cannot see /dir/hidden.
+func newTestSFTPServer(t *testing.T, base string, key ssh.PublicKey) *sftpServer {
+	st, err := storage.NewLocalStorageProvider(base, "")
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("test1234"), bcrypt.MinCost)
+	passwd, err := auth.NewPasswordAuthProvider(fileshare.AuthPassword{Users: []fileshare.AuthPasswordUser{{Nickname: "pippo", Passwd: string(hash)}}})
+	if err != nil {
+		t.Fatalf("failed creating auth provider: %v", err)
+	}
+
+	users := auth.NewConfigUsersProvider([]fileshare.User{{
+		Nickname: "pippo",
+		ACL:      []fileshare.PathACL{{Path: "/", Read: true, Write: true}, {Path: "/dir/hidden"}},
+		SSHKeys:  []string{string(ssh.MarshalAuthorizedKey(key))},
+	}}, nil)
+
+	s, err := NewSFTPServer(fileshare.SFTP{HostKey: filepath.Join(t.TempDir(), "host_key")}, storage.NewACLStorageProvider(st, nil, nil), map[string]fileshare.AuthProvider{"passwd": passwd}, users, &memoryAuditLog{})
+	if err != nil {
+		t.Fatalf("failed creating server: %v", err)
+	}
+
+	return s.(*sftpServer)
+}
+
+type memoryAuditLog struct {
+	lock    sync.Mutex
+	entries []fileshare.AuditEntry
+}
+
+func (l *memoryAuditLog) Record(entry fileshare.AuditEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+func (l *memoryAuditLog) Query(fileshare.AuditQuery) ([]fileshare.AuditEntry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]fileshare.AuditEntry(nil), l.entries...), nil
+}
+
+func (l *memoryAuditLog) Verify() error {
+	return nil
+}
+
+// dialTestSFTPServer connects to the server with the given authentication method.
+func dialTestSFTPServer(t *testing.T, s *sftpServer, method ssh.AuthMethod) (*sftp.Client, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed listening: %v", err)
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			s.handleConn(conn)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "pippo",
+		Auth:            []ssh.AuthMethod{method},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.Cleanup(func() { _ = client.Close() })
+	return sftp.NewClient(client)
+}
+
+func newTestKey(t *testing.T) ssh.Signer {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed creating key: %v", err)
+	}
+
+	return signer
+}
+
+func TestSFTPServer_Auth(t *testing.T) {
+	key, otherKey := newTestKey(t), newTestKey(t)
+	s := newTestSFTPServer(t, t.TempDir(), key.PublicKey())
+
+	if _, err := dialTestSFTPServer(t, s, ssh.Password("wrong")); err == nil {
+		t.Fatalf("expected wrong password to fail")
+	} else if _, err := dialTestSFTPServer(t, s, ssh.PublicKeys(otherKey)); err == nil {
+		t.Fatalf("expected unknown key to fail")
+	}
+
+	if client, err := dialTestSFTPServer(t, s, ssh.Password("test1234")); err != nil {
+		t.Fatalf("failed password login: %v", err)
+	} else if _, err := client.ReadDir("/"); err != nil {
+		t.Fatalf("failed listing: %v", err)
+	}
+
+	if client, err := dialTestSFTPServer(t, s, ssh.PublicKeys(key)); err != nil {
+		t.Fatalf("failed key login: %v", err)
+	} else if _, err := client.ReadDir("/"); err != nil {
+		t.Fatalf("failed listing: %v", err)
+	}
+}
+
+func TestSFTPServer_UploadDownload(t *testing.T) {
+	key := newTestKey(t)
+	base := t.TempDir()
+	s := newTestSFTPServer(t, base, key.PublicKey())
+
+	client, err := dialTestSFTPServer(t, s, ssh.PublicKeys(key))
+	if err != nil {
+		t.Fatalf("failed login: %v", err)
+	}
+
+	// large enough for the client to send several concurrent writes and reads
+	data := make([]byte, 4*1024*1024+123)
+	_, _ = rand.Read(data)
+
+	w, err := client.Create("/file.bin")
+	if err != nil {
+		t.Fatalf("failed creating file: %v", err)
+	} else if _, err := w.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed writing file: %v", err)
+	} else if err := w.Close(); err != nil {
+		t.Fatalf("failed closing file: %v", err)
+	}
+
+	if stored, err := os.ReadFile(filepath.Join(base, "file.bin")); err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("stored file differs: %v", err)
+	}
+
+	r, err := client.Open("/file.bin")
+	if err != nil {
+		t.Fatalf("failed opening file: %v", err)
+	}
+
+	var read bytes.Buffer
+	if _, err := r.WriteTo(&read); err != nil {
+		t.Fatalf("failed reading file: %v", err)
+	} else if !bytes.Equal(read.Bytes(), data) {
+		t.Fatalf("downloaded file differs")
+	}
+
+	_ = r.Close()
+
+	// the server closes the file after answering the client
+	var actions []string
+	for deadline := time.Now().Add(time.Second); len(actions) < 3 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		entries, _ := s.audit.Query(fileshare.AuditQuery{})
+		actions = actions[:0]
+		for _, entry := range entries {
+			if entry.User != "pippo" || entry.Outcome != fileshare.AuditOutcomeSuccess {
+				t.Fatalf("unexpected entry: %+v", entry)
+			} else if entry.Action != fileshare.AuditActionLogin && (entry.Path != "file.bin" || entry.Bytes != int64(len(data))) {
+				t.Fatalf("unexpected entry: %+v", entry)
+			}
+
+			actions = append(actions, entry.Action)
+		}
+	}
+
+	if len(actions) != 3 || actions[0] != fileshare.AuditActionLogin || actions[1] != fileshare.AuditActionUpload || actions[2] != fileshare.AuditActionDownload {
+		t.Fatalf("unexpected audit entries: %v", actions)
+	}
+}
+
+func TestSFTPServer_Rmdir(t *testing.T) {
+	key := newTestKey(t)
+	base := t.TempDir()
+	s := newTestSFTPServer(t, base, key.PublicKey())
+
+	_ = os.MkdirAll(filepath.Join(base, "dir", "hidden"), 0755)
+	_ = os.WriteFile(filepath.Join(base, "dir", "hidden", "secret.txt"), []byte("secret"), 0644)
+	_ = os.Mkdir(filepath.Join(base, "empty"), 0755)
+
+	client, err := dialTestSFTPServer(t, s, ssh.PublicKeys(key))
+	if err != nil {
+		t.Fatalf("failed login: %v", err)
+	}
+
+	// the directory looks empty to pippo, but it is not
+	if entries, err := client.ReadDir("/dir"); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no visible entries, got %d: %v", len(entries), err)
+	} else if err := client.RemoveDirectory("/dir"); err == nil {
+		t.Fatalf("expected non empty directory not to be removed")
+	} else if _, err := os.Stat(filepath.Join(base, "dir", "hidden", "secret.txt")); err != nil {
+		t.Fatalf("hidden file was removed: %v", err)
+	}
+
+	if err := client.RemoveDirectory("/empty"); err != nil {
+		t.Fatalf("failed removing empty directory: %v", err)
+	} else if _, err := os.Stat(filepath.Join(base, "empty")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected directory to be removed: %v", err)
+	}
+}
+
+type bufferFileWriter struct {
+	bytes.Buffer
+	closed  bool
+	aborted bool
+}
+
+func (w *bufferFileWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func (w *bufferFileWriter) Abort() error {
+	w.aborted = true
+	return nil
+}
+
+func TestWriterAt_OutOfOrder(t *testing.T) {
+	file := &bufferFileWriter{}
+	w := &writerAt{w: file, pending: map[int64][]byte{}, done: func(int64) {}}
+
+	for _, off := range []int64{6, 3, 0, 9} {
+		if _, err := w.WriteAt([]byte("abcdefghijkl")[off:off+3], off); err != nil {
+			t.Fatalf("failed writing at %d: %v", off, err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed closing: %v", err)
+	} else if !file.closed || file.String() != "abcdefghijkl" {
+		t.Fatalf("unexpected content: %s", file.String())
+	}
+
+	// a gap that is never filled aborts the upload
+	file = &bufferFileWriter{}
+	w = &writerAt{w: file, pending: map[int64][]byte{}, done: func(int64) {}}
+	_, _ = w.WriteAt([]byte("abc"), 0)
+	_, _ = w.WriteAt([]byte("ghi"), 6)
+	if err := w.Close(); err == nil || !file.aborted || file.closed {
+		t.Fatalf("expected aborted upload: %v", err)
+	}
+}
@@ -1,13 +1,19 @@
 package fileshare
 
 import (
+	"context"
 	"errors"
 	"io"
 	"io/fs"
+	"time"
 )
 
 var ErrStorageReadForbidden = errors.New("user is not allowed to read from this location")
 var ErrStorageWriteForbidden = errors.New("user is not allowed to write to this location")
+var ErrStorageVersionsUnsupported = errors.New("storage does not support versions")
+var ErrStorageTrashUnsupported = errors.New("storage does not support trash")
+var ErrStorageWatchUnsupported = errors.New("storage does not support watching changes")
+var ErrStorageDirNotEmpty = errors.New("directory is not empty")
 
 type PathACL struct {
 	Path  string
@@ -15,16 +21,128 @@ type PathACL struct {
 	Write bool
 }
 
+type StorageEncryption struct {
+	KeyFile      string `yaml:"key_file"`
+	KeyEnv       string `yaml:"key_env"`
+	EncryptNames bool   `yaml:"encrypt_names"`
+}
+
+type StorageVersions struct {
+	Keep   int           `yaml:"keep"`
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+type StorageChecksums struct {
+	Algorithms []string `yaml:"algorithms"`
+}
+
+// FileStat describes a file or directory, fields the storage cannot provide are left empty.
+type FileStat struct {
+	Name      string
+	Size      int64
+	ModTime   time.Time
+	IsDir     bool
+	MimeType  string
+	Owner     string
+	Checksums map[string]string
+}
+
+const (
+	ChangeCreated  = "created"
+	ChangeModified = "modified"
+	ChangeDeleted  = "deleted"
+	ChangeRenamed  = "renamed"
+)
+
+// ChangeEvent describes a change to a file or directory, OldPath is set only for renames.
+type ChangeEvent struct {
+	Type    string `json:"type"`
+	Path    string `json:"path"`
+	OldPath string `json:"old_path,omitempty"`
+}
+
+type FileVersion struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+}
+
+type StorageTrash struct {
+	Retention time.Duration `yaml:"retention"`
+}
+
+type TrashItem struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	User      string    `json:"user"`
+	DeletedAt time.Time `json:"deleted_at"`
+	Dir       bool      `json:"dir"`
+}
+
+// FileWriter writes a file to the storage, the file becomes visible at its location only after
+// a successful Close. Abort discards the file, Close has no effect afterwards.
+type FileWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
 type StorageProvider interface {
-	CreateFile(name string) (io.WriteCloser, error)
-	OpenFile(name string) (io.ReadCloser, fs.FileInfo, error)
-	ReadDir(name string) ([]fs.DirEntry, error)
+	CreateFile(ctx context.Context, name string) (FileWriter, error)
+	OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error)
+	Stat(ctx context.Context, name string) (*FileStat, error)
+	ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error)
+	Mkdir(ctx context.Context, name string) error
+	Rename(ctx context.Context, oldname string, newname string) error
+	Remove(ctx context.Context, name string) error
+}
+
+type VersionedStorageProvider interface {
+	StorageProvider
+	ListVersions(ctx context.Context, name string) ([]FileVersion, error)
+	OpenVersion(ctx context.Context, name string, id string) (io.ReadCloser, fs.FileInfo, error)
+	RestoreVersion(ctx context.Context, name string, id string) error
+}
+
+type ChecksumStorageProvider interface {
+	StorageProvider
+	Checksums(ctx context.Context, name string) (map[string]string, error)
+}
+
+type WatchableStorageProvider interface {
+	StorageProvider
+	Watch(ctx context.Context, name string) (<-chan ChangeEvent, error)
+}
+
+type TrashStorageProvider interface {
+	StorageProvider
+	MoveToTrash(ctx context.Context, name string, nickname string) error
+	ListTrash(ctx context.Context, nickname string) ([]TrashItem, error)
+	GetTrashItem(ctx context.Context, nickname string, id string) (*TrashItem, error)
+	RestoreFromTrash(ctx context.Context, nickname string, id string) error
+	PurgeTrash(ctx context.Context, before time.Time) error
 }
 
 type AuthenticatedStorageProvider interface {
-	CreateFile(name string, user *User) (io.WriteCloser, error)
-	OpenFile(name string, user *User) (io.ReadCloser, fs.FileInfo, error)
-	ReadDir(name string, user *User) ([]fs.DirEntry, error)
+	CreateFile(ctx context.Context, name string, user *User) (FileWriter, error)
+	OpenFile(ctx context.Context, name string, user *User) (io.ReadCloser, fs.FileInfo, error)
+	Stat(ctx context.Context, name string, user *User) (*FileStat, error)
+	ReadDir(ctx context.Context, name string, user *User) ([]fs.DirEntry, error)
+	Remove(ctx context.Context, name string, user *User) error
+	// RemoveDir removes the directory only if it is empty, even of entries the user cannot see.
+	RemoveDir(ctx context.Context, name string, user *User) error
+	Mkdir(ctx context.Context, name string, user *User) error
+	Rename(ctx context.Context, oldname string, newname string, user *User) error
+	Checksums(ctx context.Context, name string, user *User) (map[string]string, error)
+	SupportsVersions() bool
+	ListVersions(ctx context.Context, name string, user *User) ([]FileVersion, error)
+	OpenVersion(ctx context.Context, name string, id string, user *User) (io.ReadCloser, fs.FileInfo, error)
+	RestoreVersion(ctx context.Context, name string, id string, user *User) error
+	SupportsTrash() bool
+	ListTrash(ctx context.Context, user *User) ([]TrashItem, error)
+	RestoreFromTrash(ctx context.Context, nickname string, id string, user *User) error
+	SupportsWatch() bool
+	Watch(ctx context.Context, name string, user *User) (<-chan ChangeEvent, error)
 	CanRead(name string, user *User) bool
 	CanWrite(name string, user *User) bool
+	CheckHealth(ctx context.Context) error
 }
@@ -1,9 +1,14 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/metrics"
+	"github.com/devgianlu/go-fileshare/tracing"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"io/fs"
 	"path/filepath"
@@ -13,10 +18,36 @@ import (
 type aclStorageProvider struct {
 	underlying fileshare.StorageProvider
 	defaultACL []fileshare.PathACL
+	audit      fileshare.AuditLog
 }
 
-func NewACLStorageProvider(storage fileshare.StorageProvider, defaultACL []fileshare.PathACL) fileshare.AuthenticatedStorageProvider {
-	return &aclStorageProvider{storage, defaultACL}
+// NewACLStorageProvider enforces the ACLs on the storage, denials are recorded to the audit log if not nil.
+func NewACLStorageProvider(storage fileshare.StorageProvider, defaultACL []fileshare.PathACL, audit fileshare.AuditLog) fileshare.AuthenticatedStorageProvider {
+	return &aclStorageProvider{storage, defaultACL, audit}
+}
+
+// deny records the denied action in the metrics and audit log and returns the error.
+func (p *aclStorageProvider) deny(ctx context.Context, action string, name string, user *fileshare.User, err error) error {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("fileshare.acl.denied", true))
+
+	metrics.ObserveACLDenial(action)
+
+	if p.audit != nil {
+		if len(name) > 0 {
+			name = cleanPath(name)
+		}
+
+		p.audit.Record(fileshare.AuditEntry{
+			User:    user.Nickname,
+			IP:      fileshare.RemoteIPFromUserContext(ctx),
+			Action:  action,
+			Path:    name,
+			Outcome: fileshare.AuditOutcomeDenied,
+			Error:   err.Error(),
+		})
+	}
+
+	return err
 }
 
 func (p *aclStorageProvider) evalACL(path string, user *fileshare.User, write bool) bool {
@@ -70,60 +101,160 @@ func (p *aclStorageProvider) evalACL(path string, user *fileshare.User, write bo
 	// no ACL defined for path, default deny
 	if len(acls) == 0 {
 		return false
-	} else if len(acls) == 1 {
-		if write {
-			return acls[0].Write
-		} else {
-			return acls[0].Read
+	}
+
+	// the deepest rule containing the path wins, rules for its children make it readable to see them
+	var best *fileshare.PathACL
+	var childRead bool
+	for i, acl := range acls {
+		if rel, _ := filepath.Rel(acl.Path, path); rel == ".." {
+			childRead = childRead || acl.Read
+		} else if best == nil || len(acl.Path) > len(best.Path) {
+			best = &acls[i]
 		}
 	}
 
-	panic("unsupported") // FIXME: support multiple rules matching the path
+	if write {
+		return best != nil && best.Write
+	} else {
+		return childRead || (best != nil && best.Read)
+	}
+}
+
+// evalNestedACL checks the rules below path, recursive operations must not bypass the ones that deny access.
+func (p *aclStorageProvider) evalNestedACL(path string, user *fileshare.User) bool {
+	path = filepath.Clean("/" + path)
+
+	for _, list := range [][]fileshare.PathACL{user.ACL, p.defaultACL} {
+		for _, acl := range list {
+			rel, err := filepath.Rel(path, filepath.Clean("/"+acl.Path))
+			if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+				continue
+			}
+
+			if !p.evalACL(acl.Path, user, true) || !p.evalACL(acl.Path, user, false) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// evalACLContext is evalACL traced as part of the operation in ctx.
+func (p *aclStorageProvider) evalACLContext(ctx context.Context, path string, user *fileshare.User, write bool) bool {
+	_, span := tracing.Start(ctx, "acl.evalACL", attribute.String("fileshare.path", path), attribute.Bool("fileshare.acl.write", write))
+	defer span.End()
+
+	allowed := p.evalACL(path, user, write)
+	span.SetAttributes(attribute.Bool("fileshare.acl.allowed", allowed))
+	return allowed
 }
 
-func (p *aclStorageProvider) CreateFile(name string, user *fileshare.User) (io.WriteCloser, error) {
+// checkReserved prevents everyone, including admins, from accessing the reserved directory.
+func checkReserved(name string) error {
+	if isReservedPath(name) {
+		return fileshare.NewError("reserved path", fs.ErrNotExist, fmt.Errorf("%s is reserved", name))
+	}
+
+	return nil
+}
+
+func (p *aclStorageProvider) CreateFile(ctx context.Context, name string, user *fileshare.User) (fileshare.FileWriter, error) {
+	ctx, span := tracing.Start(ctx, "acl.CreateFile", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return nil, err
+	}
+
 	if user.Admin {
-		return p.underlying.CreateFile(name)
+		return p.underlying.CreateFile(ctx, name)
 	}
 
-	write := p.evalACL(name, user, true)
+	write := p.evalACLContext(ctx, name, user, true)
 	if !write {
-		return nil, fileshare.NewError("cannot write file", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to write to %s", user.Nickname, name))
+		return nil, p.deny(ctx, fileshare.AuditActionUpload, name, user, fileshare.NewError("cannot write file", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to write to %s", user.Nickname, name)))
 	}
 
-	return p.underlying.CreateFile(name)
+	return p.underlying.CreateFile(ctx, name)
 }
 
-func (p *aclStorageProvider) OpenFile(name string, user *fileshare.User) (io.ReadCloser, fs.FileInfo, error) {
+func (p *aclStorageProvider) OpenFile(ctx context.Context, name string, user *fileshare.User) (io.ReadCloser, fs.FileInfo, error) {
+	ctx, span := tracing.Start(ctx, "acl.OpenFile", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return nil, nil, err
+	}
+
 	if user.Admin {
-		return p.underlying.OpenFile(name)
+		return p.underlying.OpenFile(ctx, name)
 	}
 
-	read := p.evalACL(name, user, false)
+	read := p.evalACLContext(ctx, name, user, false)
 	if !read {
-		return nil, nil, fileshare.NewError("cannot read file", fileshare.ErrStorageReadForbidden, fmt.Errorf("user %s is not allowed to read from %s", user.Nickname, name))
+		return nil, nil, p.deny(ctx, fileshare.AuditActionDownload, name, user, fileshare.NewError("cannot read file", fileshare.ErrStorageReadForbidden, fmt.Errorf("user %s is not allowed to read from %s", user.Nickname, name)))
+	}
+
+	return p.underlying.OpenFile(ctx, name)
+}
+
+func (p *aclStorageProvider) Stat(ctx context.Context, name string, user *fileshare.User) (*fileshare.FileStat, error) {
+	ctx, span := tracing.Start(ctx, "acl.Stat", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return nil, err
+	}
+
+	if !user.Admin && !p.evalACLContext(ctx, name, user, false) {
+		return nil, p.deny(ctx, fileshare.AuditActionRead, name, user, fileshare.NewError("cannot stat file", fileshare.ErrStorageReadForbidden, fmt.Errorf("user %s is not allowed to read from %s", user.Nickname, name)))
 	}
 
-	return p.underlying.OpenFile(name)
+	return p.underlying.Stat(ctx, name)
 }
 
-func (p *aclStorageProvider) ReadDir(name string, user *fileshare.User) ([]fs.DirEntry, error) {
+func (p *aclStorageProvider) ReadDir(ctx context.Context, name string, user *fileshare.User) ([]fs.DirEntry, error) {
+	ctx, span := tracing.Start(ctx, "acl.ReadDir", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return nil, err
+	}
+
 	if user.Admin {
-		return p.underlying.ReadDir(name)
+		entries, err := p.underlying.ReadDir(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		var allowedEntries []fs.DirEntry
+		for _, entry := range entries {
+			if !isReservedPath(filepath.Join(name, entry.Name())) {
+				allowedEntries = append(allowedEntries, entry)
+			}
+		}
+
+		return allowedEntries, nil
 	}
 
-	read := p.evalACL(name, user, false)
+	read := p.evalACLContext(ctx, name, user, false)
 	if !read {
-		return nil, fileshare.NewError("cannot read directory", fileshare.ErrStorageReadForbidden, fmt.Errorf("user %s is not allowed to read from directory %s", user.Nickname, name))
+		return nil, p.deny(ctx, fileshare.AuditActionList, name, user, fileshare.NewError("cannot read directory", fileshare.ErrStorageReadForbidden, fmt.Errorf("user %s is not allowed to read from directory %s", user.Nickname, name)))
 	}
 
-	entries, err := p.underlying.ReadDir(name)
+	entries, err := p.underlying.ReadDir(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 
 	var allowedEntries []fs.DirEntry
 	for _, entry := range entries {
+		if isReservedPath(filepath.Join(name, entry.Name())) {
+			continue
+		}
+
 		read := p.evalACL(filepath.Join(name, entry.Name()), user, false)
 		if !read {
 			continue
@@ -135,7 +266,293 @@ func (p *aclStorageProvider) ReadDir(name string, user *fileshare.User) ([]fs.Di
 	return allowedEntries, nil
 }
 
+func (p *aclStorageProvider) Remove(ctx context.Context, name string, user *fileshare.User) error {
+	ctx, span := tracing.Start(ctx, "acl.Remove", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return err
+	}
+
+	if !user.Admin && !p.evalACLContext(ctx, name, user, true) {
+		return p.deny(ctx, fileshare.AuditActionDelete, name, user, fileshare.NewError("cannot remove file", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to remove %s", user.Nickname, name)))
+	} else if !user.Admin && !p.evalNestedACL(name, user) {
+		return p.deny(ctx, fileshare.AuditActionDelete, name, user, fileshare.NewError("cannot remove file", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to remove everything inside %s", user.Nickname, name)))
+	}
+
+	// move to trash if possible
+	if trash, ok := findStorage[fileshare.TrashStorageProvider](p.underlying); ok {
+		return trash.MoveToTrash(ctx, name, user.Nickname)
+	}
+
+	return p.underlying.Remove(ctx, name)
+}
+
+func (p *aclStorageProvider) RemoveDir(ctx context.Context, name string, user *fileshare.User) error {
+	ctx, span := tracing.Start(ctx, "acl.RemoveDir", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return err
+	}
+
+	if !user.Admin && !p.evalACLContext(ctx, name, user, true) {
+		return p.deny(ctx, fileshare.AuditActionDelete, name, user, fileshare.NewError("cannot remove directory", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to remove %s", user.Nickname, name)))
+	}
+
+	if stat, err := p.underlying.Stat(ctx, name); err != nil {
+		return err
+	} else if !stat.IsDir {
+		return fmt.Errorf("not a directory: %s", name)
+	}
+
+	// the check must not be filtered by the ACL, hidden entries would be removed with the directory
+	if entries, err := p.underlying.ReadDir(ctx, name); err != nil {
+		return err
+	} else if len(entries) > 0 {
+		return fileshare.NewError("cannot remove directory", fileshare.ErrStorageDirNotEmpty, fmt.Errorf("directory %s has %d entries", name, len(entries)))
+	}
+
+	if trash, ok := findStorage[fileshare.TrashStorageProvider](p.underlying); ok {
+		return trash.MoveToTrash(ctx, name, user.Nickname)
+	}
+
+	return p.underlying.Remove(ctx, name)
+}
+
+func (p *aclStorageProvider) Mkdir(ctx context.Context, name string, user *fileshare.User) error {
+	ctx, span := tracing.Start(ctx, "acl.Mkdir", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return err
+	}
+
+	if !user.Admin && !p.evalACLContext(ctx, name, user, true) {
+		return p.deny(ctx, fileshare.AuditActionUpload, name, user, fileshare.NewError("cannot create directory", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to write to %s", user.Nickname, name)))
+	}
+
+	return p.underlying.Mkdir(ctx, name)
+}
+
+func (p *aclStorageProvider) Rename(ctx context.Context, oldname string, newname string, user *fileshare.User) error {
+	ctx, span := tracing.Start(ctx, "acl.Rename", attribute.String("fileshare.path", newname))
+	defer span.End()
+
+	if err := checkReserved(oldname); err != nil {
+		return err
+	} else if err := checkReserved(newname); err != nil {
+		return err
+	}
+
+	// moving a file removes it from its old location
+	if !user.Admin && !p.evalACLContext(ctx, oldname, user, true) {
+		return p.deny(ctx, fileshare.AuditActionDelete, oldname, user, fileshare.NewError("cannot move file", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to write to %s", user.Nickname, oldname)))
+	} else if !user.Admin && !p.evalACLContext(ctx, newname, user, true) {
+		return p.deny(ctx, fileshare.AuditActionUpload, newname, user, fileshare.NewError("cannot move file", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to write to %s", user.Nickname, newname)))
+	} else if !user.Admin && !p.evalNestedACL(oldname, user) {
+		return p.deny(ctx, fileshare.AuditActionDelete, oldname, user, fileshare.NewError("cannot move file", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to write to everything inside %s", user.Nickname, oldname)))
+	} else if !user.Admin && !p.evalNestedACL(newname, user) {
+		return p.deny(ctx, fileshare.AuditActionUpload, newname, user, fileshare.NewError("cannot move file", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to write to everything inside %s", user.Nickname, newname)))
+	}
+
+	return p.underlying.Rename(ctx, oldname, newname)
+}
+
+func (p *aclStorageProvider) Checksums(ctx context.Context, name string, user *fileshare.User) (map[string]string, error) {
+	ctx, span := tracing.Start(ctx, "acl.Checksums", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return nil, err
+	}
+
+	checksums, ok := findStorage[fileshare.ChecksumStorageProvider](p.underlying)
+	if !ok {
+		return nil, nil
+	}
+
+	if !user.Admin && !p.evalACLContext(ctx, name, user, false) {
+		return nil, p.deny(ctx, fileshare.AuditActionRead, name, user, fileshare.NewError("cannot read checksums", fileshare.ErrStorageReadForbidden, fmt.Errorf("user %s is not allowed to read from %s", user.Nickname, name)))
+	}
+
+	return checksums.Checksums(ctx, name)
+}
+
+func (p *aclStorageProvider) SupportsVersions() bool {
+	_, ok := findStorage[fileshare.VersionedStorageProvider](p.underlying)
+	return ok
+}
+
+func (p *aclStorageProvider) ListVersions(ctx context.Context, name string, user *fileshare.User) ([]fileshare.FileVersion, error) {
+	ctx, span := tracing.Start(ctx, "acl.ListVersions", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return nil, err
+	}
+
+	versioned, ok := findStorage[fileshare.VersionedStorageProvider](p.underlying)
+	if !ok {
+		return nil, fileshare.ErrStorageVersionsUnsupported
+	}
+
+	if !user.Admin && !p.evalACLContext(ctx, name, user, false) {
+		return nil, p.deny(ctx, fileshare.AuditActionList, name, user, fileshare.NewError("cannot list versions", fileshare.ErrStorageReadForbidden, fmt.Errorf("user %s is not allowed to read from %s", user.Nickname, name)))
+	}
+
+	return versioned.ListVersions(ctx, name)
+}
+
+func (p *aclStorageProvider) OpenVersion(ctx context.Context, name string, id string, user *fileshare.User) (io.ReadCloser, fs.FileInfo, error) {
+	ctx, span := tracing.Start(ctx, "acl.OpenVersion", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return nil, nil, err
+	}
+
+	versioned, ok := findStorage[fileshare.VersionedStorageProvider](p.underlying)
+	if !ok {
+		return nil, nil, fileshare.ErrStorageVersionsUnsupported
+	}
+
+	if !user.Admin && !p.evalACLContext(ctx, name, user, false) {
+		return nil, nil, p.deny(ctx, fileshare.AuditActionDownload, name, user, fileshare.NewError("cannot read version", fileshare.ErrStorageReadForbidden, fmt.Errorf("user %s is not allowed to read from %s", user.Nickname, name)))
+	}
+
+	return versioned.OpenVersion(ctx, name, id)
+}
+
+func (p *aclStorageProvider) RestoreVersion(ctx context.Context, name string, id string, user *fileshare.User) error {
+	ctx, span := tracing.Start(ctx, "acl.RestoreVersion", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return err
+	}
+
+	versioned, ok := findStorage[fileshare.VersionedStorageProvider](p.underlying)
+	if !ok {
+		return fileshare.ErrStorageVersionsUnsupported
+	}
+
+	if !user.Admin && !p.evalACLContext(ctx, name, user, true) {
+		return p.deny(ctx, fileshare.AuditActionRestore, name, user, fileshare.NewError("cannot restore version", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to write to %s", user.Nickname, name)))
+	}
+
+	return versioned.RestoreVersion(ctx, name, id)
+}
+
+func (p *aclStorageProvider) SupportsTrash() bool {
+	_, ok := findStorage[fileshare.TrashStorageProvider](p.underlying)
+	return ok
+}
+
+func (p *aclStorageProvider) ListTrash(ctx context.Context, user *fileshare.User) ([]fileshare.TrashItem, error) {
+	ctx, span := tracing.Start(ctx, "acl.ListTrash")
+	defer span.End()
+
+	trash, ok := findStorage[fileshare.TrashStorageProvider](p.underlying)
+	if !ok {
+		return nil, fileshare.ErrStorageTrashUnsupported
+	}
+
+	// admins can see all trashes
+	if user.Admin {
+		return trash.ListTrash(ctx, "")
+	}
+
+	return trash.ListTrash(ctx, user.Nickname)
+}
+
+func (p *aclStorageProvider) RestoreFromTrash(ctx context.Context, nickname string, id string, user *fileshare.User) error {
+	ctx, span := tracing.Start(ctx, "acl.RestoreFromTrash", attribute.String("fileshare.trash.user", nickname), attribute.String("fileshare.trash.id", id))
+	defer span.End()
+
+	trash, ok := findStorage[fileshare.TrashStorageProvider](p.underlying)
+	if !ok {
+		return fileshare.ErrStorageTrashUnsupported
+	}
+
+	if user.Admin {
+		return trash.RestoreFromTrash(ctx, nickname, id)
+	} else if nickname != user.Nickname {
+		return p.deny(ctx, fileshare.AuditActionRestore, "", user, fileshare.NewError("cannot restore item", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to restore from trash of %s", user.Nickname, nickname)))
+	}
+
+	item, err := trash.GetTrashItem(ctx, nickname, id)
+	if err != nil {
+		return err
+	}
+
+	// the user might have lost permission in the meantime
+	if !p.evalACLContext(ctx, item.Path, user, true) {
+		return p.deny(ctx, fileshare.AuditActionRestore, item.Path, user, fileshare.NewError("cannot restore item", fileshare.ErrStorageWriteForbidden, fmt.Errorf("user %s is not allowed to write to %s", user.Nickname, item.Path)))
+	}
+
+	return trash.RestoreFromTrash(ctx, nickname, id)
+}
+
+func (p *aclStorageProvider) SupportsWatch() bool {
+	_, ok := findStorage[fileshare.WatchableStorageProvider](p.underlying)
+	return ok
+}
+
+func (p *aclStorageProvider) Watch(ctx context.Context, name string, user *fileshare.User) (<-chan fileshare.ChangeEvent, error) {
+	ctx, span := tracing.Start(ctx, "acl.Watch", attribute.String("fileshare.path", name))
+	defer span.End()
+
+	if err := checkReserved(name); err != nil {
+		return nil, err
+	}
+
+	watchable, ok := findStorage[fileshare.WatchableStorageProvider](p.underlying)
+	if !ok {
+		return nil, fileshare.ErrStorageWatchUnsupported
+	}
+
+	if !user.Admin && !p.evalACLContext(ctx, name, user, false) {
+		return nil, p.deny(ctx, fileshare.AuditActionList, name, user, fileshare.NewError("cannot watch directory", fileshare.ErrStorageReadForbidden, fmt.Errorf("user %s is not allowed to read from directory %s", user.Nickname, name)))
+	}
+
+	events, err := watchable.Watch(ctx, name)
+	if err != nil || user.Admin {
+		return events, err
+	}
+
+	allowedEvents := make(chan fileshare.ChangeEvent, cap(events))
+	go func() {
+		defer close(allowedEvents)
+
+		for event := range events {
+			readOld := len(event.OldPath) > 0 && p.evalACL(event.OldPath, user, false)
+			readNew := p.evalACL(event.Path, user, false)
+
+			// renames across readable boundaries look like files appearing or disappearing
+			if !readOld && !readNew {
+				continue
+			} else if event.Type == fileshare.ChangeRenamed && !readNew {
+				event = fileshare.ChangeEvent{Type: fileshare.ChangeDeleted, Path: event.OldPath}
+			} else if event.Type == fileshare.ChangeRenamed && !readOld {
+				event = fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: event.Path}
+			}
+
+			select {
+			case allowedEvents <- event:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return allowedEvents, nil
+}
+
 func (p *aclStorageProvider) CanRead(name string, user *fileshare.User) bool {
+	if isReservedPath(name) {
+		return false
+	}
+
 	if user.Admin {
 		return true
 	}
@@ -145,6 +562,10 @@ func (p *aclStorageProvider) CanRead(name string, user *fileshare.User) bool {
 }
 
 func (p *aclStorageProvider) CanWrite(name string, user *fileshare.User) bool {
+	if isReservedPath(name) {
+		return false
+	}
+
 	if user.Admin {
 		return true
 	}
@@ -152,3 +573,25 @@ func (p *aclStorageProvider) CanWrite(name string, user *fileshare.User) bool {
 	write := p.evalACL(name, user, true)
 	return write
 }
+
+// CheckHealth verifies the storage can be listed and written to.
+func (p *aclStorageProvider) CheckHealth(ctx context.Context) error {
+	if _, err := p.underlying.ReadDir(ctx, "."); err != nil {
+		return err
+	}
+
+	// write a probe that is never committed, so nothing is left behind
+	if err := mkdirAll(ctx, p.underlying, reservedDir); err != nil {
+		return err
+	}
+
+	file, err := p.underlying.CreateFile(ctx, filepath.Join(reservedDir, "health"))
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = file.Abort() }()
+
+	_, err = file.Write([]byte("ok"))
+	return err
+}
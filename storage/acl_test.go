@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"github.com/devgianlu/go-fileshare"
 	"io"
@@ -33,18 +34,50 @@ type mockStorageProvider struct {
 	dirEntries []fs.DirEntry
 }
 
-func (p *mockStorageProvider) CreateFile(string) (io.WriteCloser, error) {
+func (p *mockStorageProvider) CreateFile(context.Context, string) (fileshare.FileWriter, error) {
 	return nil, nil
 }
 
-func (p *mockStorageProvider) OpenFile(string) (io.ReadCloser, fs.FileInfo, error) {
+func (p *mockStorageProvider) OpenFile(context.Context, string) (io.ReadCloser, fs.FileInfo, error) {
 	return nil, nil, nil
 }
 
-func (p *mockStorageProvider) ReadDir(string) ([]fs.DirEntry, error) {
+func (p *mockStorageProvider) Stat(context.Context, string) (*fileshare.FileStat, error) {
+	return nil, nil
+}
+
+func (p *mockStorageProvider) ReadDir(context.Context, string) ([]fs.DirEntry, error) {
 	return p.dirEntries, nil
 }
 
+func (p *mockStorageProvider) Mkdir(context.Context, string) error {
+	return nil
+}
+
+func (p *mockStorageProvider) Rename(context.Context, string, string) error {
+	return nil
+}
+
+func (p *mockStorageProvider) Remove(context.Context, string) error {
+	return nil
+}
+
+type mockAuditLog struct {
+	entries []fileshare.AuditEntry
+}
+
+func (l *mockAuditLog) Record(entry fileshare.AuditEntry) {
+	l.entries = append(l.entries, entry)
+}
+
+func (l *mockAuditLog) Query(fileshare.AuditQuery) ([]fileshare.AuditEntry, error) {
+	return l.entries, nil
+}
+
+func (l *mockAuditLog) Verify() error {
+	return nil
+}
+
 func TestAclStorageProvider_CanRead(t *testing.T) {
 	user := &fileshare.User{
 		Nickname: "test",
@@ -58,7 +91,7 @@ func TestAclStorageProvider_CanRead(t *testing.T) {
 		},
 	}
 
-	storage := NewACLStorageProvider(&mockStorageProvider{}, nil)
+	storage := NewACLStorageProvider(&mockStorageProvider{}, nil, nil)
 
 	truePayloads := []string{
 		"/test/foo/bar",
@@ -108,7 +141,7 @@ func TestAclStorageProvider_CanWrite(t *testing.T) {
 		},
 	}
 
-	storage := NewACLStorageProvider(&mockStorageProvider{}, nil)
+	storage := NewACLStorageProvider(&mockStorageProvider{}, nil, nil)
 
 	truePayloads := []string{
 		"/test/foo/bar",
@@ -145,6 +178,49 @@ func TestAclStorageProvider_CanWrite(t *testing.T) {
 	}
 }
 
+func TestAclStorageProvider_NestedRules(t *testing.T) {
+	user := &fileshare.User{
+		Nickname: "test",
+		Admin:    false,
+		ACL: []fileshare.PathACL{
+			{
+				Path:  "/team",
+				Read:  true,
+				Write: false,
+			},
+			{
+				Path:  "/team/shared",
+				Read:  true,
+				Write: true,
+			},
+			{
+				Path:  "/team/shared/secret",
+				Read:  false,
+				Write: false,
+			},
+		},
+	}
+
+	storage := NewACLStorageProvider(&mockStorageProvider{}, nil, nil)
+
+	for payload, expected := range map[string][2]bool{
+		"/team":                   {true, false},
+		"/team/foo":               {true, false},
+		"/team/shared":            {true, true},
+		"/team/shared/foo":        {true, true},
+		"/team/shared/secret":     {false, false},
+		"/team/shared/secret/foo": {false, false},
+		"/":                       {true, false},
+		"/other":                  {false, false},
+	} {
+		if actual := storage.CanRead(payload, user); actual != expected[0] {
+			t.Fatalf("%s: expected read %t, got %t", payload, expected[0], actual)
+		} else if actual := storage.CanWrite(payload, user); actual != expected[1] {
+			t.Fatalf("%s: expected write %t, got %t", payload, expected[1], actual)
+		}
+	}
+}
+
 func TestAclStorageProvider_ReadDir1(t *testing.T) {
 	user := &fileshare.User{
 		Nickname: "test",
@@ -164,7 +240,7 @@ func TestAclStorageProvider_ReadDir1(t *testing.T) {
 			&mockDirEntry{"foo", true},
 			&mockDirEntry{"test", true},
 		},
-	}, nil)
+	}, nil, nil)
 
 	payloads := []string{
 		"/",
@@ -176,7 +252,7 @@ func TestAclStorageProvider_ReadDir1(t *testing.T) {
 		"/test/foo/bar/../../..",
 	}
 	for _, payload := range payloads {
-		if entries, _ := storage.ReadDir(payload, user); len(entries) != 1 || entries[0].Name() != "test" {
+		if entries, _ := storage.ReadDir(context.Background(), payload, user); len(entries) != 1 || entries[0].Name() != "test" {
 			t.Fatalf("%s: expected \"test\" entry, got %v", payload, entries)
 		}
 	}
@@ -189,12 +265,13 @@ func TestAclStorageProvider_ReadDir2(t *testing.T) {
 		ACL:      []fileshare.PathACL{},
 	}
 
+	audit := &mockAuditLog{}
 	storage := NewACLStorageProvider(&mockStorageProvider{
 		dirEntries: []fs.DirEntry{
 			&mockDirEntry{"bar.txt", false},
 			&mockDirEntry{"baz.txt", false},
 		},
-	}, nil)
+	}, nil, audit)
 
 	payloads := []string{
 		"/test",
@@ -202,8 +279,65 @@ func TestAclStorageProvider_ReadDir2(t *testing.T) {
 		"/test/foo/bar",
 	}
 	for _, payload := range payloads {
-		if _, err := storage.ReadDir(payload, user); !errors.Is(err, fileshare.ErrStorageReadForbidden) {
+		if _, err := storage.ReadDir(context.Background(), payload, user); !errors.Is(err, fileshare.ErrStorageReadForbidden) {
 			t.Fatalf("%s: expected read forbidden error, got %v", payload, err)
 		}
 	}
+
+	if len(audit.entries) != len(payloads) {
+		t.Fatalf("expected %d audit entries, got %d", len(payloads), len(audit.entries))
+	} else if entry := audit.entries[0]; entry.User != "test" || entry.Path != "test" || entry.Outcome != fileshare.AuditOutcomeDenied {
+		t.Fatalf("unexpected audit entry: %+v", entry)
+	}
+}
+
+func TestAclStorageProvider_NestedDeny(t *testing.T) {
+	user := &fileshare.User{
+		Nickname: "test",
+		Admin:    false,
+		ACL: []fileshare.PathACL{
+			{
+				Path:  "/team",
+				Read:  true,
+				Write: true,
+			},
+			{
+				Path:  "/team/secret",
+				Read:  true,
+				Write: false,
+			},
+		},
+	}
+
+	audit := &mockAuditLog{}
+	storage := NewACLStorageProvider(&mockStorageProvider{}, []fileshare.PathACL{{Path: "/team/other/hidden"}}, audit)
+
+	// removing or moving the parent would take the protected directory with it
+	if err := storage.Remove(context.Background(), "/team", user); !errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		t.Fatalf("expected remove forbidden error, got %v", err)
+	} else if err := storage.Rename(context.Background(), "/team", "/team2", user); !errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		t.Fatalf("expected rename forbidden error, got %v", err)
+	} else if err := storage.Rename(context.Background(), "/team/foo", "/team/secret", user); !errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		t.Fatalf("expected rename forbidden error, got %v", err)
+	} else if len(audit.entries) != 3 {
+		t.Fatalf("expected 3 audit entries, got %d", len(audit.entries))
+	}
+
+	// the user rule on the parent wins over the default rule
+	for _, payload := range []string{"/team/foo", "/team/other", "/team/secretary"} {
+		if err := storage.Remove(context.Background(), payload, user); err != nil {
+			t.Fatalf("%s: unexpected remove error: %v", payload, err)
+		} else if err := storage.Rename(context.Background(), payload, payload+".bak", user); err != nil {
+			t.Fatalf("%s: unexpected rename error: %v", payload, err)
+		}
+	}
+
+	// the default rules apply when the user has none
+	other := &fileshare.User{Nickname: "other"}
+	storage = NewACLStorageProvider(&mockStorageProvider{}, []fileshare.PathACL{{Path: "/pub", Read: true, Write: true}, {Path: "/pub/locked", Read: true}}, nil)
+	if err := storage.Remove(context.Background(), "/pub", other); !errors.Is(err, fileshare.ErrStorageWriteForbidden) {
+		t.Fatalf("expected remove forbidden error, got %v", err)
+	} else if err := storage.Remove(context.Background(), "/pub/foo", other); err != nil {
+		t.Fatalf("unexpected remove error: %v", err)
+	}
 }
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"github.com/zeebo/blake3"
+	"hash"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumBLAKE3 = "blake3"
+	ChecksumMD5    = "md5"
+)
+
+// checksumsDir is where checksums are kept, it mirrors the tree with a JSON file for each file.
+const checksumsDir = reservedDir + "/checksums"
+
+func NewChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumBLAKE3:
+		return blake3.New(), nil
+	case ChecksumMD5:
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm: %s", algorithm)
+	}
+}
+
+type checksumsMetadata struct {
+	Size      int64             `json:"size"`
+	ModTime   time.Time         `json:"mod_time"`
+	Checksums map[string]string `json:"checksums"`
+}
+
+type checksumStorageProvider struct {
+	underlying fileshare.StorageProvider
+	algorithms []string
+}
+
+func NewChecksumStorageProvider(storage fileshare.StorageProvider, cfg fileshare.StorageChecksums) (fileshare.ChecksumStorageProvider, error) {
+	algorithms := cfg.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{ChecksumSHA256}
+	}
+
+	for _, algorithm := range algorithms {
+		if _, err := NewChecksumHash(algorithm); err != nil {
+			return nil, err
+		}
+	}
+
+	return &checksumStorageProvider{storage, algorithms}, nil
+}
+
+func (p *checksumStorageProvider) metadataPath(name string) string {
+	return filepath.Join(checksumsDir, filepath.Clean("/"+name))
+}
+
+func (p *checksumStorageProvider) Unwrap() fileshare.StorageProvider {
+	return p.underlying
+}
+
+func (p *checksumStorageProvider) CreateFile(ctx context.Context, name string) (fileshare.FileWriter, error) {
+	file, err := p.underlying.CreateFile(ctx, name)
+	if err != nil {
+		return nil, err
+	} else if isReservedPath(name) {
+		return file, nil
+	}
+
+	hashes := map[string]hash.Hash{}
+	for _, algorithm := range p.algorithms {
+		hashes[algorithm], _ = NewChecksumHash(algorithm)
+	}
+
+	return &checksumFileWriter{FileWriter: file, ctx: ctx, p: p, name: name, hashes: hashes}, nil
+}
+
+func (p *checksumStorageProvider) OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	return p.underlying.OpenFile(ctx, name)
+}
+
+func (p *checksumStorageProvider) Stat(ctx context.Context, name string) (*fileshare.FileStat, error) {
+	stat, err := p.underlying.Stat(ctx, name)
+	if err != nil || stat.IsDir || isReservedPath(name) {
+		return stat, err
+	}
+
+	checksums, err := p.Checksums(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for algorithm, sum := range checksums {
+		if stat.Checksums == nil {
+			stat.Checksums = map[string]string{}
+		}
+
+		stat.Checksums[algorithm] = sum
+	}
+
+	return stat, nil
+}
+
+func (p *checksumStorageProvider) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	return p.underlying.ReadDir(ctx, name)
+}
+
+func (p *checksumStorageProvider) Mkdir(ctx context.Context, name string) error {
+	return p.underlying.Mkdir(ctx, name)
+}
+
+func (p *checksumStorageProvider) Rename(ctx context.Context, oldname string, newname string) error {
+	if err := p.underlying.Rename(ctx, oldname, newname); err != nil {
+		return err
+	}
+
+	// move the checksums along with the file
+	if _, err := p.underlying.Stat(ctx, p.metadataPath(oldname)); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err := mkdirAll(ctx, p.underlying, filepath.Dir(p.metadataPath(newname))); err != nil {
+		return err
+	} else if err := p.underlying.Rename(ctx, p.metadataPath(oldname), p.metadataPath(newname)); err != nil {
+		log.WithError(err).WithField("module", "storage").Warnf("failed moving checksums of %s", oldname)
+	}
+
+	return nil
+}
+
+func (p *checksumStorageProvider) Remove(ctx context.Context, name string) error {
+	if err := p.underlying.Remove(ctx, name); err != nil {
+		return err
+	}
+
+	if err := p.underlying.Remove(ctx, p.metadataPath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.WithError(err).WithField("module", "storage").Warnf("failed removing checksums of %s", name)
+	}
+
+	return nil
+}
+
+func (p *checksumStorageProvider) Checksums(ctx context.Context, name string) (map[string]string, error) {
+	file, info, err := p.underlying.OpenFile(ctx, name)
+	if err != nil {
+		return nil, err
+	} else if file != nil {
+		_ = file.Close()
+	}
+
+	metaFile, _, err := p.underlying.OpenFile(ctx, p.metadataPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if metaFile == nil {
+		return nil, nil
+	}
+
+	defer func() { _ = metaFile.Close() }()
+
+	var meta checksumsMetadata
+	if err := json.NewDecoder(metaFile).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("invalid checksums for %s: %w", name, err)
+	}
+
+	// the file was changed without us knowing
+	if meta.Size != info.Size() || !meta.ModTime.Equal(info.ModTime()) {
+		return nil, nil
+	}
+
+	return meta.Checksums, nil
+}
+
+func (p *checksumStorageProvider) store(ctx context.Context, name string, checksums map[string]string) error {
+	file, info, err := p.underlying.OpenFile(ctx, name)
+	if err != nil {
+		return err
+	} else if file != nil {
+		_ = file.Close()
+	}
+
+	data, err := json.Marshal(&checksumsMetadata{Size: info.Size(), ModTime: info.ModTime(), Checksums: checksums})
+	if err != nil {
+		return err
+	}
+
+	path := p.metadataPath(name)
+	if err := mkdirAll(ctx, p.underlying, filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	metaFile, err := p.underlying.CreateFile(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := metaFile.Write(data); err != nil {
+		_ = metaFile.Abort()
+		return err
+	}
+
+	return metaFile.Close()
+}
+
+type checksumFileWriter struct {
+	fileshare.FileWriter
+	ctx    context.Context
+	p      *checksumStorageProvider
+	name   string
+	hashes map[string]hash.Hash
+	done   bool
+}
+
+func (w *checksumFileWriter) Write(b []byte) (int, error) {
+	n, err := w.FileWriter.Write(b)
+	for _, h := range w.hashes {
+		h.Write(b[:n])
+	}
+
+	return n, err
+}
+
+func (w *checksumFileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	if err := w.FileWriter.Close(); err != nil {
+		return err
+	}
+
+	checksums := map[string]string{}
+	for algorithm, h := range w.hashes {
+		checksums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	// the file is already there, do not fail because of the metadata
+	if err := w.p.store(w.ctx, w.name, checksums); err != nil {
+		log.WithError(err).WithField("module", "storage").Warnf("failed storing checksums for %s", w.name)
+	}
+
+	return nil
+}
+
+func (w *checksumFileWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	return w.FileWriter.Abort()
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestChecksumStorageProvider(t *testing.T, local fileshare.StorageProvider) fileshare.ChecksumStorageProvider {
+	storage, err := NewChecksumStorageProvider(local, fileshare.StorageChecksums{Algorithms: []string{ChecksumSHA256, ChecksumMD5}})
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	return storage
+}
+
+func writeTestFile(t *testing.T, storage fileshare.StorageProvider, name string, data string) {
+	w, err := storage.CreateFile(context.Background(), name)
+	if err != nil {
+		t.Fatalf("failed creating %s: %v", name, err)
+	}
+
+	_, _ = w.Write([]byte(data))
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed closing %s: %v", name, err)
+	}
+}
+
+func TestChecksumStorageProvider(t *testing.T) {
+	base := t.TempDir()
+	storage := newTestChecksumStorageProvider(t, newTestLocalStorageProvider(t, base, ""))
+
+	writeTestFile(t, storage, "a.txt", "hello")
+
+	sum := sha256.Sum256([]byte("hello"))
+	checksums, err := storage.Checksums(context.Background(), "a.txt")
+	if err != nil {
+		t.Fatalf("failed getting checksums: %v", err)
+	} else if checksums[ChecksumSHA256] != hex.EncodeToString(sum[:]) || checksums[ChecksumMD5] != "5d41402abc4b2a76b9719d911017c592" {
+		t.Fatalf("unexpected checksums: %v", checksums)
+	}
+
+	stat, err := storage.Stat(context.Background(), "a.txt")
+	if err != nil {
+		t.Fatalf("failed stat: %v", err)
+	} else if stat.Checksums[ChecksumSHA256] != checksums[ChecksumSHA256] {
+		t.Fatalf("unexpected stat checksums: %v", stat.Checksums)
+	}
+
+	// files changed behind our back have no checksums
+	_ = os.WriteFile(filepath.Join(base, "a.txt"), []byte("changed"), 0644)
+	if checksums, err := storage.Checksums(context.Background(), "a.txt"); err != nil || checksums != nil {
+		t.Fatalf("expected no checksums, got %v: %v", checksums, err)
+	}
+}
+
+func TestChecksumStorageProvider_Rename(t *testing.T) {
+	local := newTestLocalStorageProvider(t, t.TempDir(), "")
+	storage := newTestChecksumStorageProvider(t, local)
+
+	writeTestFile(t, storage, "a.txt", "hello")
+	before, _ := storage.Checksums(context.Background(), "a.txt")
+
+	if err := storage.Mkdir(context.Background(), "dir"); err != nil {
+		t.Fatalf("failed creating directory: %v", err)
+	} else if err := storage.Rename(context.Background(), "a.txt", "dir/b.txt"); err != nil {
+		t.Fatalf("failed renaming: %v", err)
+	}
+
+	if after, err := storage.Checksums(context.Background(), "dir/b.txt"); err != nil || after[ChecksumSHA256] != before[ChecksumSHA256] {
+		t.Fatalf("expected moved checksums %v, got %v: %v", before, after, err)
+	} else if _, err := storage.Stat(context.Background(), "a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected missing file: %v", err)
+	}
+
+	// files without checksums are renamed too
+	writeTestFile(t, local, "c.txt", "world")
+	if err := storage.Rename(context.Background(), "c.txt", "d.txt"); err != nil {
+		t.Fatalf("failed renaming: %v", err)
+	} else if checksums, err := storage.Checksums(context.Background(), "d.txt"); err != nil || checksums != nil {
+		t.Fatalf("expected no checksums, got %v: %v", checksums, err)
+	}
+}
+
+func TestChecksumStorageProvider_Abort(t *testing.T) {
+	storage := newTestChecksumStorageProvider(t, newTestLocalStorageProvider(t, t.TempDir(), ""))
+
+	writeTestFile(t, storage, "a.txt", "hello")
+	before, _ := storage.Checksums(context.Background(), "a.txt")
+
+	w, err := storage.CreateFile(context.Background(), "a.txt")
+	if err != nil {
+		t.Fatalf("failed creating file: %v", err)
+	}
+
+	// the checksums of the aborted content must not replace the ones of the file
+	_, _ = w.Write([]byte("aborted"))
+	if err := w.Abort(); err != nil {
+		t.Fatalf("failed aborting: %v", err)
+	} else if err := w.Close(); err != nil {
+		t.Fatalf("expected close after abort to have no effect: %v", err)
+	} else if after, err := storage.Checksums(context.Background(), "a.txt"); err != nil || after[ChecksumSHA256] != before[ChecksumSHA256] {
+		t.Fatalf("unexpected checksums %v, expected %v: %v", after, before, err)
+	}
+}
@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const StorageProviderTypeDedup = "dedup"
+
+type dedupRef struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// dedupStorageProvider stores the content of each file once in a content store (indexed by SHA-256),
+// the directory tree only contains small JSON references to the blobs.
+type dedupStorageProvider struct {
+	blobs string
+	tree  string
+	tmp   string
+
+	lock sync.Mutex
+	refs map[string]int
+}
+
+func NewDedupStorageProvider(base string) (fileshare.StorageProvider, error) {
+	p := dedupStorageProvider{}
+	p.blobs = filepath.Join(base, "blobs")
+	p.tree = filepath.Join(base, "tree")
+	p.tmp = filepath.Join(base, "tmp")
+	p.refs = map[string]int{}
+
+	for _, dir := range []string{p.blobs, p.tree, p.tmp} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// rebuild reference counts from the tree
+	if err := filepath.WalkDir(p.tree, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		ref, err := p.readRef(path)
+		if err != nil {
+			return err
+		}
+
+		p.refs[ref.SHA256]++
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed building references index: %w", err)
+	}
+
+	// remove blobs left behind by an interrupted delete
+	if err := filepath.WalkDir(p.blobs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		if p.refs[d.Name()] == 0 {
+			log.WithField("module", "storage").Debugf("removing orphan blob %s", d.Name())
+			return os.Remove(path)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed collecting orphan blobs: %w", err)
+	}
+
+	// uploads cannot be resumed, discard the ones interrupted by a previous run
+	if err := removePartialUploads(p.tmp); err != nil {
+		return nil, fmt.Errorf("failed removing partial uploads: %w", err)
+	}
+
+	return &p, nil
+}
+
+func (p *dedupStorageProvider) treePath(name string) string {
+	return filepath.Join(p.tree, filepath.Clean("/"+name))
+}
+
+func (p *dedupStorageProvider) blobPath(sum string) string {
+	return filepath.Join(p.blobs, sum[:2], sum)
+}
+
+func (p *dedupStorageProvider) readRef(path string) (*dedupRef, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ref dedupRef
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return nil, fmt.Errorf("invalid reference %s: %w", path, err)
+	} else if len(ref.SHA256) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid reference %s: bad hash", path)
+	}
+
+	return &ref, nil
+}
+
+// release decrements the reference count for the blob and removes it if nobody references it anymore.
+// The lock must be held by the caller.
+func (p *dedupStorageProvider) release(sum string) {
+	p.refs[sum]--
+	if p.refs[sum] > 0 {
+		return
+	}
+
+	delete(p.refs, sum)
+	if err := os.Remove(p.blobPath(sum)); err != nil {
+		log.WithError(err).WithField("module", "storage").Warnf("failed removing blob %s", sum)
+	}
+}
+
+// writeRef replaces the reference at path in a single step, a partial reference would break the index.
+// The temporary file is in the same filesystem as the tree and is removed on startup if left behind.
+func (p *dedupStorageProvider) writeRef(path string, data []byte) error {
+	tmp, err := os.CreateTemp(p.tmp, "upload-ref-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	} else if err := tmp.Chmod(0644); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	} else if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (p *dedupStorageProvider) commit(tmpPath string, path string, sum string, size int64) error {
+	data, err := json.Marshal(&dedupRef{SHA256: sum, Size: size})
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// store blob if we do not have it already
+	if p.refs[sum] > 0 {
+		_ = os.Remove(tmpPath)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(p.blobPath(sum)), 0755); err != nil {
+			return err
+		} else if err := os.Rename(tmpPath, p.blobPath(sum)); err != nil {
+			return err
+		}
+	}
+
+	// keep track of the blob we are replacing
+	oldRef, _ := p.readRef(path)
+
+	if err := p.writeRef(path, data); err != nil {
+		if p.refs[sum] == 0 {
+			_ = os.Remove(p.blobPath(sum))
+		}
+
+		return err
+	}
+
+	p.refs[sum]++
+	if oldRef != nil {
+		p.release(oldRef.SHA256)
+	}
+
+	return nil
+}
+
+func (p *dedupStorageProvider) CreateFile(ctx context.Context, name string) (fileshare.FileWriter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	path := p.treePath(name)
+	if info, err := os.Stat(filepath.Dir(path)); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("parent is not a directory: %s", name)
+	}
+
+	file, err := os.CreateTemp(p.tmp, "upload-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &dedupWriter{ctx: ctx, p: p, path: path, file: file, hash: sha256.New()}, nil
+}
+
+func (p *dedupStorageProvider) OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	path := p.treePath(name)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	} else if info.IsDir() {
+		return nil, info, nil
+	}
+
+	ref, err := p.readRef(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(p.blobPath(ref.SHA256))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &contextFile{ctx, file}, &dedupFileInfo{info, ref.Size}, nil
+}
+
+func (p *dedupStorageProvider) Stat(ctx context.Context, name string) (*fileshare.FileStat, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	path := p.treePath(name)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		return newFileStat(info, nil), nil
+	}
+
+	ref, err := p.readRef(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stat := newFileStat(&dedupFileInfo{info, ref.Size}, func() (io.ReadCloser, error) { return os.Open(p.blobPath(ref.SHA256)) })
+	stat.Checksums = map[string]string{ChecksumSHA256: ref.SHA256}
+	return stat, nil
+}
+
+func (p *dedupStorageProvider) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	path := p.treePath(name)
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, entry := range entries {
+		if !entry.IsDir() {
+			entries[i] = &dedupDirEntry{entry, p, filepath.Join(path, entry.Name())}
+		}
+	}
+
+	return entries, nil
+}
+
+func (p *dedupStorageProvider) Mkdir(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return os.Mkdir(p.treePath(name), 0755)
+}
+
+func (p *dedupStorageProvider) Rename(ctx context.Context, oldname string, newname string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	oldpath, newpath := p.treePath(oldname), p.treePath(newname)
+	if oldpath == newpath {
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// the reference being overwritten goes away with its blob
+	var replacedRef *dedupRef
+	if info, err := os.Stat(newpath); err == nil && !info.IsDir() {
+		if replacedRef, err = p.readRef(newpath); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	if replacedRef != nil {
+		p.release(replacedRef.SHA256)
+	}
+
+	return nil
+}
+
+func (p *dedupStorageProvider) Remove(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return fmt.Errorf("cannot remove root directory")
+	}
+
+	path := p.treePath(name)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// collect all the blobs referenced under the path
+	var sums []string
+	if err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		ref, err := p.readRef(path)
+		if err != nil {
+			return err
+		}
+
+		sums = append(sums, ref.SHA256)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	for _, sum := range sums {
+		p.release(sum)
+	}
+
+	return nil
+}
+
+type dedupWriter struct {
+	ctx  context.Context
+	p    *dedupStorageProvider
+	path string
+	file *os.File
+	hash hash.Hash
+	size int64
+	done bool
+}
+
+func (w *dedupWriter) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := w.file.Write(b)
+	w.hash.Write(b[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *dedupWriter) Close() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	if err := w.ctx.Err(); err != nil {
+		// the upload was interrupted, the content is likely incomplete
+		_ = w.file.Close()
+		_ = os.Remove(w.file.Name())
+		return err
+	} else if err := w.file.Close(); err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+
+	if err := w.p.commit(w.file.Name(), w.path, hex.EncodeToString(w.hash.Sum(nil)), w.size); err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (w *dedupWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	_ = w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+type dedupFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i *dedupFileInfo) Size() int64 {
+	return i.size
+}
+
+type dedupDirEntry struct {
+	fs.DirEntry
+	p    *dedupStorageProvider
+	path string
+}
+
+func (e *dedupDirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := e.p.readRef(e.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dedupFileInfo{info, ref.Size}, nil
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedupStorageProvider(t *testing.T) {
+	base := t.TempDir()
+
+	storage, err := NewDedupStorageProvider(base)
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	countBlobs := func() int {
+		var count int
+		_ = filepath.WalkDir(filepath.Join(base, "blobs"), func(_ string, d os.DirEntry, _ error) error {
+			if !d.IsDir() {
+				count++
+			}
+			return nil
+		})
+		return count
+	}
+
+	_ = os.Mkdir(filepath.Join(base, "tree", "foo"), 0755)
+	for _, name := range []string{"a.bin", "b.bin", "foo/c.bin"} {
+		w, err := storage.CreateFile(context.Background(), name)
+		if err != nil {
+			t.Fatalf("%s: failed creating file: %v", name, err)
+		}
+
+		_, _ = w.Write([]byte("same content"))
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: failed closing file: %v", name, err)
+		}
+	}
+
+	if count := countBlobs(); count != 1 {
+		t.Fatalf("expected 1 blob, got %d", count)
+	}
+
+	r, info, err := storage.OpenFile(context.Background(), "foo/c.bin")
+	if err != nil {
+		t.Fatalf("failed opening file: %v", err)
+	} else if info.Size() != int64(len("same content")) {
+		t.Fatalf("wrong size: %d", info.Size())
+	} else if data, _ := io.ReadAll(r); string(data) != "same content" {
+		t.Fatalf("wrong content: %s", data)
+	}
+
+	_ = r.Close()
+
+	if err := storage.Remove(context.Background(), "a.bin"); err != nil {
+		t.Fatalf("failed removing file: %v", err)
+	} else if err := storage.Remove(context.Background(), "foo"); err != nil {
+		t.Fatalf("failed removing directory: %v", err)
+	} else if count := countBlobs(); count != 1 {
+		t.Fatalf("expected 1 blob, got %d", count)
+	}
+
+	if err := storage.Remove(context.Background(), "b.bin"); err != nil {
+		t.Fatalf("failed removing file: %v", err)
+	} else if count := countBlobs(); count != 0 {
+		t.Fatalf("expected no blobs, got %d", count)
+	}
+}
+
+func TestDedupStorageProvider_Replace(t *testing.T) {
+	base := t.TempDir()
+
+	storage, err := NewDedupStorageProvider(base)
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	for _, content := range []string{"first", "second"} {
+		writeTestFile(t, storage, "a.bin", content)
+	}
+
+	// a reference write interrupted by a crash leaves only a temporary file behind
+	_ = os.WriteFile(filepath.Join(base, "tmp", "upload-ref-123"), []byte(`{"sha2`), 0644)
+
+	storage, err = NewDedupStorageProvider(base)
+	if err != nil {
+		t.Fatalf("failed reopening storage: %v", err)
+	} else if entries, _ := os.ReadDir(filepath.Join(base, "tmp")); len(entries) != 0 {
+		t.Fatalf("expected no temporary files, got %d", len(entries))
+	}
+
+	r, _, err := storage.OpenFile(context.Background(), "a.bin")
+	if err != nil {
+		t.Fatalf("failed opening file: %v", err)
+	} else if data, _ := io.ReadAll(r); string(data) != "second" {
+		t.Fatalf("wrong content: %s", data)
+	}
+
+	_ = r.Close()
+
+	if blobs, _ := filepath.Glob(filepath.Join(base, "blobs", "*", "*")); len(blobs) != 1 {
+		t.Fatalf("expected 1 blob, got %d", len(blobs))
+	}
+}
+
+func TestDedupStorageProvider_RenameOverwrite(t *testing.T) {
+	base := t.TempDir()
+
+	storage, err := NewDedupStorageProvider(base)
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	writeTestFile(t, storage, "a.bin", "first")
+	writeTestFile(t, storage, "b.bin", "second")
+
+	if err := storage.Rename(context.Background(), "a.bin", "b.bin"); err != nil {
+		t.Fatalf("failed renaming file: %v", err)
+	} else if blobs, _ := filepath.Glob(filepath.Join(base, "blobs", "*", "*")); len(blobs) != 1 {
+		t.Fatalf("expected 1 blob, got %d", len(blobs))
+	}
+
+	// the remaining blob is still counted and goes away with its last reference
+	if err := storage.Remove(context.Background(), "b.bin"); err != nil {
+		t.Fatalf("failed removing file: %v", err)
+	} else if blobs, _ := filepath.Glob(filepath.Join(base, "blobs", "*", "*")); len(blobs) != 0 {
+		t.Fatalf("expected no blobs, got %d", len(blobs))
+	}
+}
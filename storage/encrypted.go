@@ -0,0 +1,537 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	encryptedMagic      = "FSE1"
+	encryptedChunkSize  = 64 * 1024
+	encryptedPrefixSize = chacha20poly1305.NonceSizeX - 5 // 4 bytes counter, 1 byte last chunk flag
+	encryptedHeaderSize = int64(len(encryptedMagic) + encryptedPrefixSize)
+	encryptedCipherSize = encryptedChunkSize + chacha20poly1305.Overhead
+)
+
+// encryptedPlainSize computes the size of the plaintext from the size of the encrypted file.
+func encryptedPlainSize(size int64) int64 {
+	size -= encryptedHeaderSize
+	if size <= 0 {
+		return 0
+	}
+
+	plain := (size / encryptedCipherSize) * encryptedChunkSize
+	if rem := size % encryptedCipherSize; rem > chacha20poly1305.Overhead {
+		plain += rem - chacha20poly1305.Overhead
+	}
+
+	return plain
+}
+
+// encryptedNonce builds the nonce for a chunk as described by the STREAM construction.
+func encryptedNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptedPrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+func loadEncryptionKey(cfg fileshare.StorageEncryption) ([]byte, error) {
+	var key []byte
+	if len(cfg.KeyFile) > 0 {
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading key file: %w", err)
+		}
+
+		key = data
+	} else if len(cfg.KeyEnv) > 0 {
+		key = []byte(os.Getenv(cfg.KeyEnv))
+	} else {
+		return nil, fmt.Errorf("missing key file or key env")
+	}
+
+	// accept both hex encoded and raw keys
+	trimmed := bytes.TrimSpace(key)
+	if decoded, err := hex.DecodeString(string(trimmed)); err == nil && len(decoded) == chacha20poly1305.KeySize {
+		return decoded, nil
+	} else if len(key) == chacha20poly1305.KeySize {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("key must be %d bytes (or hex encoded)", chacha20poly1305.KeySize)
+}
+
+type encryptedStorageProvider struct {
+	underlying fileshare.StorageProvider
+
+	content cipher.AEAD
+	names   cipher.AEAD
+	namesIV []byte
+}
+
+func NewEncryptedStorageProvider(storage fileshare.StorageProvider, cfg fileshare.StorageEncryption) (fileshare.StorageProvider, error) {
+	key, err := loadEncryptionKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// derive separate keys for the content and the names
+	deriveKey := func(info string) []byte {
+		derived := make([]byte, chacha20poly1305.KeySize)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(info)), derived); err != nil {
+			panic(fmt.Sprintf("cannot derive key: %v", err))
+		}
+
+		return derived
+	}
+
+	p := encryptedStorageProvider{}
+	p.underlying = storage
+	if p.content, err = chacha20poly1305.NewX(deriveKey("go-fileshare content")); err != nil {
+		return nil, err
+	}
+
+	if cfg.EncryptNames {
+		if p.names, err = chacha20poly1305.NewX(deriveKey("go-fileshare names")); err != nil {
+			return nil, err
+		}
+
+		p.namesIV = deriveKey("go-fileshare names iv")
+	}
+
+	return &p, nil
+}
+
+// encryptName encrypts a single path component deterministically, so that the same name always
+// maps to the same encrypted name. The nonce is derived from the name itself (like SIV).
+func (p *encryptedStorageProvider) encryptName(name string) string {
+	mac := hmac.New(sha256.New, p.namesIV)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:chacha20poly1305.NonceSizeX]
+
+	return base64.RawURLEncoding.EncodeToString(p.names.Seal(nonce, nonce, []byte(name), nil))
+}
+
+func (p *encryptedStorageProvider) decryptName(name string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil {
+		return "", err
+	} else if len(data) < chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return "", fmt.Errorf("encrypted name too short")
+	}
+
+	plain, err := p.names.Open(nil, data[:chacha20poly1305.NonceSizeX], data[chacha20poly1305.NonceSizeX:], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+func (p *encryptedStorageProvider) encryptPath(name string) string {
+	name = filepath.Clean("/" + name)
+	if p.names == nil || name == "/" {
+		return name
+	}
+
+	parts := strings.Split(name[1:], "/")
+	for i, part := range parts {
+		parts[i] = p.encryptName(part)
+	}
+
+	return "/" + strings.Join(parts, "/")
+}
+
+func (p *encryptedStorageProvider) decryptPath(name string) (string, error) {
+	name = cleanPath(name)
+	if p.names == nil || name == "." {
+		return name, nil
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		var err error
+		if parts[i], err = p.decryptName(part); err != nil {
+			return "", err
+		}
+	}
+
+	return strings.Join(parts, "/"), nil
+}
+
+func (p *encryptedStorageProvider) watchChanges(ctx context.Context) (<-chan fileshare.ChangeEvent, error) {
+	source, ok := findStorage[changeSource](p.underlying)
+	if !ok {
+		return nil, fileshare.ErrStorageWatchUnsupported
+	}
+
+	events, err := source.watchChanges(ctx)
+	if err != nil || p.names == nil {
+		return events, err
+	}
+
+	plainEvents := make(chan fileshare.ChangeEvent, eventsSubscriberBuffer)
+	go func() {
+		defer close(plainEvents)
+
+		for event := range events {
+			var err error
+			if event.Path, err = p.decryptPath(event.Path); err != nil {
+				// the reserved directory of the underlying storage is not encrypted
+				continue
+			} else if len(event.OldPath) > 0 {
+				if event.OldPath, err = p.decryptPath(event.OldPath); err != nil {
+					event = fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: event.Path}
+				}
+			}
+
+			plainEvents <- event
+		}
+	}()
+
+	return plainEvents, nil
+}
+
+func (p *encryptedStorageProvider) Unwrap() fileshare.StorageProvider {
+	return p.underlying
+}
+
+func (p *encryptedStorageProvider) CreateFile(ctx context.Context, name string) (fileshare.FileWriter, error) {
+	prefix := make([]byte, encryptedPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	file, err := p.underlying.CreateFile(ctx, p.encryptPath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Write(append([]byte(encryptedMagic), prefix...)); err != nil {
+		_ = file.Abort()
+		return nil, err
+	}
+
+	return &encryptedWriter{
+		underlying: file,
+		aead:       p.content,
+		prefix:     prefix,
+		buf:        make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (p *encryptedStorageProvider) OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	file, fileInfo, err := p.underlying.OpenFile(ctx, p.encryptPath(name))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// we already know the plaintext name, no need to decrypt it
+	plainInfo := &encryptedFileInfo{FileInfo: fileInfo, name: fileInfo.Name()}
+	if name = filepath.Clean("/" + name); name != "/" {
+		plainInfo.name = filepath.Base(name)
+	}
+
+	if fileInfo.IsDir() {
+		return file, plainInfo, nil
+	}
+
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		_ = file.Close()
+		return nil, nil, fmt.Errorf("failed reading encryption header: %w", err)
+	} else if string(header[:len(encryptedMagic)]) != encryptedMagic {
+		_ = file.Close()
+		return nil, nil, fmt.Errorf("invalid encryption header")
+	} else if fileInfo.Size() < encryptedHeaderSize+chacha20poly1305.Overhead {
+		_ = file.Close()
+		return nil, nil, fmt.Errorf("encrypted file is truncated")
+	}
+
+	plainInfo.size = encryptedPlainSize(fileInfo.Size())
+
+	return &encryptedReader{
+		underlying: file,
+		aead:       p.content,
+		prefix:     header[len(encryptedMagic):],
+		size:       plainInfo.size,
+		chunks:     (fileInfo.Size() - encryptedHeaderSize + encryptedCipherSize - 1) / encryptedCipherSize,
+		chunk:      -1,
+		cipherBuf:  make([]byte, encryptedCipherSize),
+	}, plainInfo, nil
+}
+
+func (p *encryptedStorageProvider) Stat(ctx context.Context, name string) (*fileshare.FileStat, error) {
+	cipherStat, err := p.underlying.Stat(ctx, p.encryptPath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	// checksums of the ciphertext are of no use
+	stat := &fileshare.FileStat{
+		Name:    cipherStat.Name,
+		Size:    cipherStat.Size,
+		ModTime: cipherStat.ModTime,
+		IsDir:   cipherStat.IsDir,
+		Owner:   cipherStat.Owner,
+	}
+
+	if name = filepath.Clean("/" + name); name != "/" {
+		stat.Name = filepath.Base(name)
+	}
+
+	if !stat.IsDir {
+		stat.Size = encryptedPlainSize(stat.Size)
+		stat.MimeType = detectMimeType(stat.Name, func() (io.ReadCloser, error) {
+			file, _, err := p.OpenFile(ctx, name)
+			return file, err
+		})
+	}
+
+	return stat, nil
+}
+
+func (p *encryptedStorageProvider) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	entries, err := p.underlying.ReadDir(ctx, p.encryptPath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	plainEntries := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		// the reserved directory of the underlying storage is not encrypted
+		if p.names != nil && isReservedPath(filepath.Join(name, entry.Name())) {
+			continue
+		}
+
+		plainName := entry.Name()
+		if p.names != nil {
+			plainName, err = p.decryptName(entry.Name())
+			if err != nil {
+				log.WithError(err).WithField("module", "storage").
+					Warnf("skipping entry with invalid encrypted name %s", entry.Name())
+				continue
+			}
+		}
+
+		plainEntries = append(plainEntries, &encryptedDirEntry{DirEntry: entry, name: plainName})
+	}
+
+	return plainEntries, nil
+}
+
+func (p *encryptedStorageProvider) Mkdir(ctx context.Context, name string) error {
+	return p.underlying.Mkdir(ctx, p.encryptPath(name))
+}
+
+func (p *encryptedStorageProvider) Rename(ctx context.Context, oldname string, newname string) error {
+	return p.underlying.Rename(ctx, p.encryptPath(oldname), p.encryptPath(newname))
+}
+
+func (p *encryptedStorageProvider) Remove(ctx context.Context, name string) error {
+	return p.underlying.Remove(ctx, p.encryptPath(name))
+}
+
+type encryptedFileInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (i *encryptedFileInfo) Name() string {
+	return i.name
+}
+
+func (i *encryptedFileInfo) Size() int64 {
+	if i.IsDir() {
+		return i.FileInfo.Size()
+	}
+
+	return i.size
+}
+
+type encryptedDirEntry struct {
+	fs.DirEntry
+	name string
+}
+
+func (e *encryptedDirEntry) Name() string {
+	return e.name
+}
+
+func (e *encryptedDirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedFileInfo{FileInfo: info, name: e.name, size: encryptedPlainSize(info.Size())}, nil
+}
+
+type encryptedWriter struct {
+	underlying fileshare.FileWriter
+	aead       cipher.AEAD
+	prefix     []byte
+	counter    uint32
+	buf        []byte
+	out        []byte
+}
+
+func (w *encryptedWriter) flush(last bool) error {
+	w.out = w.aead.Seal(w.out[:0], encryptedNonce(w.prefix, w.counter, last), w.buf, nil)
+	if _, err := w.underlying.Write(w.out); err != nil {
+		return err
+	}
+
+	w.counter++
+	if w.counter == 0 {
+		return fmt.Errorf("encrypted file is too large")
+	}
+
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *encryptedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// only flush a full chunk when more data comes, the last chunk must be marked as such
+		if len(w.buf) == encryptedChunkSize {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(w.buf[len(w.buf):encryptedChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+func (w *encryptedWriter) Close() error {
+	if err := w.flush(true); err != nil {
+		_ = w.underlying.Abort()
+		return err
+	}
+
+	return w.underlying.Close()
+}
+
+func (w *encryptedWriter) Abort() error {
+	return w.underlying.Abort()
+}
+
+type encryptedReader struct {
+	underlying io.ReadCloser
+	aead       cipher.AEAD
+	prefix     []byte
+
+	size   int64 // plaintext size
+	pos    int64 // plaintext position
+	chunks int64 // total number of chunks
+	chunk  int64 // index of the chunk in plain, -1 if none
+	next   int64 // index of the chunk the underlying reader is positioned at
+
+	plain     []byte
+	cipherBuf []byte
+}
+
+func (r *encryptedReader) load(idx int64) error {
+	if idx != r.next {
+		seeker, ok := r.underlying.(io.Seeker)
+		if !ok {
+			return fmt.Errorf("underlying file is not seekable")
+		}
+
+		if _, err := seeker.Seek(encryptedHeaderSize+idx*encryptedCipherSize, io.SeekStart); err != nil {
+			return err
+		}
+
+		r.next = idx
+	}
+
+	last := idx == r.chunks-1
+
+	n, err := io.ReadFull(r.underlying, r.cipherBuf)
+	if err != nil && !(last && errors.Is(err, io.ErrUnexpectedEOF)) {
+		return fmt.Errorf("failed reading chunk %d: %w", idx, err)
+	}
+
+	r.next = idx + 1
+
+	r.plain, err = r.aead.Open(r.plain[:0], encryptedNonce(r.prefix, uint32(idx), last), r.cipherBuf[:n], nil)
+	if err != nil {
+		r.chunk = -1
+		return fmt.Errorf("failed decrypting chunk %d: %w", idx, err)
+	}
+
+	r.chunk = idx
+	return nil
+}
+
+func (r *encryptedReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	idx := r.pos / encryptedChunkSize
+	if idx != r.chunk {
+		if err := r.load(idx); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain[r.pos-idx*encryptedChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *encryptedReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.pos + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+
+	if abs < 0 {
+		return 0, fmt.Errorf("negative position: %d", abs)
+	}
+
+	r.pos = abs
+	return abs, nil
+}
+
+func (r *encryptedReader) Close() error {
+	return r.underlying.Close()
+}
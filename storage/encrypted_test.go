@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/devgianlu/go-fileshare"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestEncryptedStorageProvider(t *testing.T, encryptNames bool) (fileshare.StorageProvider, string) {
+	base := t.TempDir()
+	t.Setenv("FILESHARE_TEST_KEY", strings.Repeat("ab", 32))
+
+	storage, err := NewEncryptedStorageProvider(newTestLocalStorageProvider(t, base, SymlinkPolicyInside), fileshare.StorageEncryption{KeyEnv: "FILESHARE_TEST_KEY", EncryptNames: encryptNames})
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	return storage, base
+}
+
+func TestEncryptedStorageProvider_RoundTrip(t *testing.T) {
+	storage, _ := newTestEncryptedStorageProvider(t, false)
+
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 17} {
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+
+		w, err := storage.CreateFile(context.Background(), "test.bin")
+		if err != nil {
+			t.Fatalf("%d: failed creating file: %v", size, err)
+		}
+
+		_, _ = w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatalf("%d: failed closing file: %v", size, err)
+		}
+
+		r, info, err := storage.OpenFile(context.Background(), "test.bin")
+		if err != nil {
+			t.Fatalf("%d: failed opening file: %v", size, err)
+		} else if info.Size() != int64(size) {
+			t.Fatalf("%d: wrong size, got %d", size, info.Size())
+		}
+
+		read, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatalf("%d: failed reading file: %v", size, err)
+		} else if !bytes.Equal(read, data) {
+			t.Fatalf("%d: content mismatch", size)
+		}
+	}
+}
+
+func TestEncryptedStorageProvider_Seek(t *testing.T) {
+	storage, _ := newTestEncryptedStorageProvider(t, false)
+
+	data := make([]byte, 3*encryptedChunkSize+100)
+	_, _ = rand.Read(data)
+
+	w, _ := storage.CreateFile(context.Background(), "test.bin")
+	_, _ = w.Write(data)
+	_ = w.Close()
+
+	r, _, err := storage.OpenFile(context.Background(), "test.bin")
+	if err != nil {
+		t.Fatalf("failed opening file: %v", err)
+	}
+
+	defer func() { _ = r.Close() }()
+
+	seeker := r.(io.ReadSeeker)
+	for _, offset := range []int64{2*encryptedChunkSize + 5, 10, encryptedChunkSize, int64(len(data)) - 1, 0} {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("%d: failed seeking: %v", offset, err)
+		}
+
+		buf := make([]byte, 50)
+		n, err := io.ReadFull(seeker, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatalf("%d: failed reading: %v", offset, err)
+		} else if !bytes.Equal(buf[:n], data[offset:offset+int64(n)]) {
+			t.Fatalf("%d: content mismatch", offset)
+		}
+	}
+}
+
+func TestEncryptedStorageProvider_Names(t *testing.T) {
+	storage, base := newTestEncryptedStorageProvider(t, true)
+
+	w, err := storage.CreateFile(context.Background(), "secret.txt")
+	if err != nil {
+		t.Fatalf("failed creating file: %v", err)
+	}
+
+	_, _ = w.Write([]byte("very secret content"))
+	_ = w.Close()
+
+	var raw []os.DirEntry
+	entries, _ := os.ReadDir(base)
+	for _, entry := range entries {
+		if entry.Name() != reservedDir {
+			raw = append(raw, entry)
+		}
+	}
+
+	if len(raw) != 1 || raw[0].Name() == "secret.txt" {
+		t.Fatalf("expected encrypted name on disk, got %v", raw)
+	}
+
+	if content, _ := os.ReadFile(filepath.Join(base, raw[0].Name())); bytes.Contains(content, []byte("secret")) {
+		t.Fatalf("expected encrypted content on disk")
+	}
+
+	entries, err = storage.ReadDir(context.Background(), ".")
+	if err != nil {
+		t.Fatalf("failed reading dir: %v", err)
+	} else if len(entries) != 1 || entries[0].Name() != "secret.txt" {
+		t.Fatalf("expected \"secret.txt\" entry, got %v", entries)
+	}
+
+	if info, err := entries[0].Info(); err != nil || info.Size() != int64(len("very secret content")) {
+		t.Fatalf("wrong entry info: %v, %v", info, err)
+	}
+}
+
+func TestEncryptedStorageProvider_Tamper(t *testing.T) {
+	storage, base := newTestEncryptedStorageProvider(t, false)
+
+	w, _ := storage.CreateFile(context.Background(), "test.txt")
+	_, _ = w.Write([]byte("hello world"))
+	_ = w.Close()
+
+	path := filepath.Join(base, "test.txt")
+	content, _ := os.ReadFile(path)
+	content[len(content)-1] ^= 0xff
+	_ = os.WriteFile(path, content, 0644)
+
+	r, _, err := storage.OpenFile(context.Background(), "test.txt")
+	if err != nil {
+		t.Fatalf("failed opening file: %v", err)
+	}
+
+	defer func() { _ = r.Close() }()
+
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatalf("expected authentication error")
+	}
+}
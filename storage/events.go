@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// eventsSubscriberBuffer is how many events a subscriber can lag behind before they are dropped.
+const eventsSubscriberBuffer = 64
+
+// changeSource is implemented by storage providers that can observe changes by themselves, including
+// those not made through the server. Paths are relative to the root of the storage.
+type changeSource interface {
+	watchChanges(ctx context.Context) (<-chan fileshare.ChangeEvent, error)
+}
+
+// cleanPath returns the path relative to the root, without leading slashes.
+func cleanPath(name string) string {
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if len(name) == 0 {
+		return "."
+	}
+
+	return name
+}
+
+type eventsSubscriber struct {
+	dir    string
+	events chan fileshare.ChangeEvent
+}
+
+func (s *eventsSubscriber) matches(event fileshare.ChangeEvent) bool {
+	if filepath.Dir(event.Path) == s.dir {
+		return true
+	}
+
+	return len(event.OldPath) > 0 && filepath.Dir(event.OldPath) == s.dir
+}
+
+type eventsStorageProvider struct {
+	underlying fileshare.StorageProvider
+	native     bool
+
+	lock        sync.Mutex
+	subscribers map[*eventsSubscriber]struct{}
+}
+
+func NewEventsStorageProvider(storage fileshare.StorageProvider) fileshare.WatchableStorageProvider {
+	p := &eventsStorageProvider{underlying: storage, subscribers: map[*eventsSubscriber]struct{}{}}
+
+	// prefer changes observed by the storage itself, fallback to the ones made through us
+	if source, ok := findStorage[changeSource](storage); ok {
+		events, err := source.watchChanges(context.Background())
+		if err == nil {
+			p.native = true
+			go p.forward(events)
+		} else if !errors.Is(err, fileshare.ErrStorageWatchUnsupported) {
+			log.WithError(err).WithField("module", "storage").Warnf("failed watching storage, only changes made by the server will be notified")
+		}
+	}
+
+	return p
+}
+
+func (p *eventsStorageProvider) forward(events <-chan fileshare.ChangeEvent) {
+	for event := range events {
+		p.publish(event)
+	}
+}
+
+// normalizeChange cleans the paths of the event and hides the reserved directory, it returns false
+// if the event should not be notified at all.
+func normalizeChange(event fileshare.ChangeEvent) (fileshare.ChangeEvent, bool) {
+	event.Path = cleanPath(event.Path)
+	if len(event.OldPath) > 0 {
+		event.OldPath = cleanPath(event.OldPath)
+	}
+
+	// moving from or to the reserved directory happens when restoring or trashing files
+	if event.Type == fileshare.ChangeRenamed {
+		switch oldReserved, newReserved := isReservedPath(event.OldPath), isReservedPath(event.Path); {
+		case oldReserved && newReserved:
+			return event, false
+		case oldReserved:
+			return fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: event.Path}, true
+		case newReserved:
+			return fileshare.ChangeEvent{Type: fileshare.ChangeDeleted, Path: event.OldPath}, true
+		}
+	} else if isReservedPath(event.Path) {
+		return event, false
+	}
+
+	return event, true
+}
+
+func (p *eventsStorageProvider) publish(event fileshare.ChangeEvent) {
+	event, ok := normalizeChange(event)
+	if !ok {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for sub := range p.subscribers {
+		if !sub.matches(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			log.WithField("module", "storage").Debugf("dropping change event for slow subscriber of %s", sub.dir)
+		}
+	}
+}
+
+func (p *eventsStorageProvider) Unwrap() fileshare.StorageProvider {
+	return p.underlying
+}
+
+func (p *eventsStorageProvider) Watch(ctx context.Context, name string) (<-chan fileshare.ChangeEvent, error) {
+	sub := &eventsSubscriber{dir: cleanPath(name), events: make(chan fileshare.ChangeEvent, eventsSubscriberBuffer)}
+
+	p.lock.Lock()
+	p.subscribers[sub] = struct{}{}
+	p.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		p.lock.Lock()
+		delete(p.subscribers, sub)
+		close(sub.events)
+		p.lock.Unlock()
+	}()
+
+	return sub.events, nil
+}
+
+func (p *eventsStorageProvider) CreateFile(ctx context.Context, name string) (fileshare.FileWriter, error) {
+	file, err := p.underlying.CreateFile(ctx, name)
+	if err != nil || p.native {
+		return file, err
+	}
+
+	changeType := fileshare.ChangeCreated
+	if _, err := p.underlying.Stat(ctx, name); err == nil {
+		changeType = fileshare.ChangeModified
+	}
+
+	return &eventsFileWriter{FileWriter: file, p: p, event: fileshare.ChangeEvent{Type: changeType, Path: name}}, nil
+}
+
+func (p *eventsStorageProvider) OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	return p.underlying.OpenFile(ctx, name)
+}
+
+func (p *eventsStorageProvider) Stat(ctx context.Context, name string) (*fileshare.FileStat, error) {
+	return p.underlying.Stat(ctx, name)
+}
+
+func (p *eventsStorageProvider) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	return p.underlying.ReadDir(ctx, name)
+}
+
+func (p *eventsStorageProvider) Mkdir(ctx context.Context, name string) error {
+	if err := p.underlying.Mkdir(ctx, name); err != nil {
+		return err
+	}
+
+	if !p.native {
+		p.publish(fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: name})
+	}
+
+	return nil
+}
+
+func (p *eventsStorageProvider) Rename(ctx context.Context, oldname string, newname string) error {
+	if err := p.underlying.Rename(ctx, oldname, newname); err != nil {
+		return err
+	}
+
+	if !p.native {
+		p.publish(fileshare.ChangeEvent{Type: fileshare.ChangeRenamed, Path: newname, OldPath: oldname})
+	}
+
+	return nil
+}
+
+func (p *eventsStorageProvider) Remove(ctx context.Context, name string) error {
+	if err := p.underlying.Remove(ctx, name); err != nil {
+		return err
+	}
+
+	if !p.native {
+		p.publish(fileshare.ChangeEvent{Type: fileshare.ChangeDeleted, Path: name})
+	}
+
+	return nil
+}
+
+type eventsFileWriter struct {
+	fileshare.FileWriter
+	p     *eventsStorageProvider
+	event fileshare.ChangeEvent
+	done  bool
+}
+
+func (w *eventsFileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	if err := w.FileWriter.Close(); err != nil {
+		return err
+	}
+
+	w.p.publish(w.event)
+	return nil
+}
+
+func (w *eventsFileWriter) Abort() error {
+	w.done = true
+	return w.FileWriter.Abort()
+}
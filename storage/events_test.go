@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"github.com/devgianlu/go-fileshare"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func expectEvent(t *testing.T, events <-chan fileshare.ChangeEvent, expected fileshare.ChangeEvent) {
+	select {
+	case event := <-events:
+		if event != expected {
+			t.Fatalf("expected event %v, got %v", expected, event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for event %v", expected)
+	}
+}
+
+func TestEventsStorageProvider(t *testing.T) {
+	base := t.TempDir()
+	storage := NewEventsStorageProvider(newTestLocalStorageProvider(t, base, SymlinkPolicyInside))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := storage.Watch(ctx, ".")
+	if err != nil {
+		t.Fatalf("failed watching: %v", err)
+	}
+
+	file, err := storage.CreateFile(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("failed creating file: %v", err)
+	} else if _, err := file.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed writing file: %v", err)
+	} else if err := file.Close(); err != nil {
+		t.Fatalf("failed closing file: %v", err)
+	}
+
+	expectEvent(t, events, fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: "a.txt"})
+
+	if err := storage.Rename(ctx, "a.txt", "b.txt"); err != nil {
+		t.Fatalf("failed renaming file: %v", err)
+	}
+
+	expectEvent(t, events, fileshare.ChangeEvent{Type: fileshare.ChangeRenamed, Path: "b.txt", OldPath: "a.txt"})
+
+	// moving to the reserved directory looks like a removal
+	if err := mkdirAll(ctx, storage, trashDir); err != nil {
+		t.Fatalf("failed creating trash: %v", err)
+	} else if err := storage.Rename(ctx, "b.txt", filepath.Join(trashDir, "b.txt")); err != nil {
+		t.Fatalf("failed trashing file: %v", err)
+	}
+
+	expectEvent(t, events, fileshare.ChangeEvent{Type: fileshare.ChangeDeleted, Path: "b.txt"})
+
+	// changes made outside the server are seen too on Linux
+	if storage.(*eventsStorageProvider).native {
+		if err := os.Mkdir(filepath.Join(base, "foo"), 0755); err != nil {
+			t.Fatalf("failed creating directory: %v", err)
+		}
+
+		expectEvent(t, events, fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: "foo"})
+	}
+
+	cancel()
+	for range events {
+	}
+}
@@ -1,30 +1,107 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"github.com/devgianlu/go-fileshare"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+)
+
+const StorageProviderTypeLocal = "local"
+
+const (
+	// SymlinkPolicyDeny does not follow any symlink.
+	SymlinkPolicyDeny = "deny"
+	// SymlinkPolicyInside follows relative symlinks as long as they resolve inside the base directory.
+	SymlinkPolicyInside = "inside"
+	// SymlinkPolicyFollow follows all symlinks, even outside the base directory.
+	SymlinkPolicyFollow = "follow"
 )
 
 type localStorageProvider struct {
-	base string
+	base     string
+	symlinks string
+
+	// walk resolves paths one element at a time, the kernel cannot do it for us
+	walk bool
 }
 
-func NewLocalStorageProvider(base string) fileshare.StorageProvider {
-	return &localStorageProvider{base}
+func NewLocalStorageProvider(base string, symlinks string) (fileshare.StorageProvider, error) {
+	switch symlinks {
+	case "":
+		symlinks = SymlinkPolicyInside
+	case SymlinkPolicyDeny, SymlinkPolicyInside, SymlinkPolicyFollow:
+	default:
+		return nil, fmt.Errorf("invalid symlink policy: %s", symlinks)
+	}
+
+	// uploads cannot be resumed, discard the ones interrupted by a previous run
+	if err := removePartialUploads(filepath.Join(base, uploadsDir)); err != nil {
+		return nil, fmt.Errorf("failed removing partial uploads: %w", err)
+	}
+
+	p := &localStorageProvider{base: base, symlinks: symlinks}
+	p.probe()
+	return p, nil
 }
 
-func (p *localStorageProvider) CreateFile(name string) (io.WriteCloser, error) {
-	path := filepath.Join(p.base, filepath.Clean("/"+name))
-	return os.Create(path)
+// relative returns the cleaned path relative to the base directory, never escaping it.
+func (p *localStorageProvider) relative(name string) string {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return "."
+	}
+
+	return name[1:]
+}
+
+// split returns the parent directory and the last element of the path.
+func (p *localStorageProvider) split(name string) (string, string, error) {
+	name = p.relative(name)
+	if name == "." {
+		return "", "", fmt.Errorf("invalid operation on root directory")
+	}
+
+	return filepath.Dir(name), filepath.Base(name), nil
+}
+
+func (p *localStorageProvider) CreateFile(ctx context.Context, name string) (fileshare.FileWriter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if parent, _, err := p.split(name); err != nil {
+		return nil, err
+	} else if info, err := p.stat(parent); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("parent is not a directory: %s", name)
+	}
+
+	// write to a temporary file on the same filesystem, so that it can be renamed atomically
+	uploads := filepath.Join(p.base, uploadsDir)
+	if err := os.MkdirAll(uploads, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(uploads, "upload-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &localFileWriter{ctx: ctx, p: p, file: file, name: name}, nil
 }
 
-func (p *localStorageProvider) OpenFile(name string) (io.ReadCloser, fs.FileInfo, error) {
-	path := filepath.Join(p.base, filepath.Clean("/"+name))
+func (p *localStorageProvider) OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
 
-	file, err := os.Open(path)
+	file, err := p.open(name)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -38,11 +115,139 @@ func (p *localStorageProvider) OpenFile(name string) (io.ReadCloser, fs.FileInfo
 		_ = file.Close()
 		return nil, fileInfo, nil
 	} else {
-		return file, fileInfo, nil
+		return &contextFile{ctx, file}, fileInfo, nil
+	}
+}
+
+func (p *localStorageProvider) Stat(ctx context.Context, name string) (*fileshare.FileStat, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	info, err := p.stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stat := newFileStat(info, func() (io.ReadCloser, error) { return p.open(name) })
+	stat.Owner = fileOwner(info)
+	return stat, nil
+}
+
+func (p *localStorageProvider) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dir, err := p.open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = dir.Close() }()
+
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedEntries := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type()&fs.ModeSymlink == 0 {
+			allowedEntries = append(allowedEntries, entry)
+			continue
+		} else if p.symlinks == SymlinkPolicyDeny {
+			continue
+		}
+
+		// show what the symlink points to, hide it if it is not allowed
+		info, err := p.stat(filepath.Join(name, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		allowedEntries = append(allowedEntries, fs.FileInfoToDirEntry(info))
+	}
+
+	sort.Slice(allowedEntries, func(i, j int) bool {
+		return allowedEntries[i].Name() < allowedEntries[j].Name()
+	})
+
+	return allowedEntries, nil
+}
+
+func (p *localStorageProvider) Mkdir(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return p.mkdir(name)
+}
+
+func (p *localStorageProvider) Rename(ctx context.Context, oldname string, newname string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+
+	return p.rename(oldname, newname)
+}
+
+func (p *localStorageProvider) Remove(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return p.remove(name)
 }
 
-func (p *localStorageProvider) ReadDir(name string) ([]fs.DirEntry, error) {
-	path := filepath.Join(p.base, filepath.Clean("/"+name))
-	return os.ReadDir(path)
+type localFileWriter struct {
+	ctx  context.Context
+	p    *localStorageProvider
+	file *os.File
+	name string
+	done bool
+}
+
+func (w *localFileWriter) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return w.file.Write(b)
+}
+
+func (w *localFileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	if err := w.ctx.Err(); err != nil {
+		// the upload was interrupted, the content is likely incomplete
+		_ = w.file.Close()
+		_ = os.Remove(w.file.Name())
+		return err
+	} else if err := w.file.Sync(); err != nil {
+		_ = w.file.Close()
+		_ = os.Remove(w.file.Name())
+		return err
+	} else if err := w.file.Close(); err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	} else if err := w.p.commit(w.file.Name(), w.name); err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (w *localFileWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	_ = w.file.Close()
+	return os.Remove(w.file.Name())
 }
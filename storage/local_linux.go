@@ -0,0 +1,327 @@
+//go:build linux
+
+package storage
+
+import (
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// maxSymlinks is how many symlinks are followed while resolving a path, like the kernel does.
+const maxSymlinks = 40
+
+// openat2Supported reports whether openat2(2) can be used, it was added in Linux 5.6 and some
+// seccomp filters still reject it.
+var openat2Supported = sync.OnceValue(func() bool {
+	fd, err := unix.Openat2(unix.AT_FDCWD, "/", &unix.OpenHow{Flags: unix.O_PATH | unix.O_CLOEXEC})
+	if err != nil {
+		return !errors.Is(err, unix.ENOSYS) && !errors.Is(err, unix.EPERM)
+	}
+
+	_ = unix.Close(fd)
+	return true
+})
+
+// probe falls back to resolving paths in userspace if the kernel cannot do it.
+func (p *localStorageProvider) probe() {
+	if !openat2Supported() {
+		log.WithField("module", "storage").Warnf("openat2 is not available, resolving paths one element at a time")
+		p.walk = true
+	}
+}
+
+// fileOwner returns the name of the user owning the file, or its id if it has no name.
+func fileOwner(info fs.FileInfo) string {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+
+	uid := strconv.FormatUint(uint64(sys.Uid), 10)
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+
+	return uid
+}
+
+func (p *localStorageProvider) resolveFlags() uint64 {
+	switch p.symlinks {
+	case SymlinkPolicyDeny:
+		return unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS
+	case SymlinkPolicyFollow:
+		return unix.RESOLVE_NO_MAGICLINKS
+	default:
+		return unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS
+	}
+}
+
+func (p *localStorageProvider) pathError(op string, name string, err error) error {
+	if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.EXDEV) {
+		// hide the existence of paths forbidden by the symlink policy
+		return fileshare.NewError("symlink not allowed", fs.ErrNotExist, &fs.PathError{Op: op, Path: name, Err: err})
+	}
+
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// openat opens the path relative to the base directory, the kernel enforces the symlink policy
+// for every component of the path (see openat2(2)).
+func (p *localStorageProvider) openat(name string, flags int) (*os.File, error) {
+	root, err := unix.Open(p.base, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: p.base, Err: err}
+	}
+
+	defer func() { _ = unix.Close(root) }()
+
+	rel := p.relative(name)
+
+	var fd int
+	if !p.walk {
+		fd, err = unix.Openat2(root, rel, &unix.OpenHow{
+			Flags:   uint64(flags | unix.O_CLOEXEC),
+			Resolve: p.resolveFlags(),
+		})
+	} else if p.symlinks == SymlinkPolicyFollow {
+		fd, err = unix.Openat(root, rel, flags|unix.O_CLOEXEC, 0)
+	} else {
+		fd, err = p.walkat(root, rel, flags)
+	}
+	if err != nil {
+		return nil, p.pathError("open", name, err)
+	}
+
+	return os.NewFile(uintptr(fd), filepath.Join(p.base, rel)), nil
+}
+
+// walkat opens the path relative to root like openat2(2) would with RESOLVE_BENEATH, resolving
+// one element at a time without following symlinks unless the policy allows it. Every directory is
+// kept open so that a concurrent rename cannot move the walk outside the base directory.
+func (p *localStorageProvider) walkat(root int, rel string, flags int) (int, error) {
+	var dirs []int
+	defer func() {
+		for _, dir := range dirs {
+			_ = unix.Close(dir)
+		}
+	}()
+
+	current := func() int {
+		if len(dirs) == 0 {
+			return root
+		}
+
+		return dirs[len(dirs)-1]
+	}
+
+	pending := strings.Split(rel, "/")
+	var links int
+	for len(pending) > 0 {
+		elem := pending[0]
+		pending = pending[1:]
+
+		if len(elem) == 0 || elem == "." {
+			continue
+		} else if elem == ".." {
+			if len(dirs) == 0 {
+				return -1, unix.EXDEV
+			}
+
+			_ = unix.Close(dirs[len(dirs)-1])
+			dirs = dirs[:len(dirs)-1]
+			continue
+		}
+
+		var stat unix.Stat_t
+		if err := unix.Fstatat(current(), elem, &stat, unix.AT_SYMLINK_NOFOLLOW); err == nil && stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+			links++
+			if p.symlinks == SymlinkPolicyDeny || links > maxSymlinks {
+				return -1, unix.ELOOP
+			}
+
+			buf := make([]byte, unix.PathMax)
+			n, err := unix.Readlinkat(current(), elem, buf)
+			if err != nil {
+				return -1, err
+			} else if strings.HasPrefix(string(buf[:n]), "/") {
+				return -1, unix.EXDEV
+			}
+
+			pending = append(strings.Split(string(buf[:n]), "/"), pending...)
+			continue
+		}
+
+		if len(pending) == 0 {
+			return openNoFollow(current(), elem, flags)
+		}
+
+		fd, err := unix.Openat(current(), elem, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, err
+		}
+
+		dirs = append(dirs, fd)
+	}
+
+	// the path ends in a directory reached through ".." or a symlink
+	return unix.Openat(current(), ".", flags|unix.O_CLOEXEC, 0)
+}
+
+// openNoFollow opens the last element of a path, failing if it has been replaced by a symlink.
+func openNoFollow(dirfd int, name string, flags int) (int, error) {
+	fd, err := unix.Openat(dirfd, name, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	} else if flags&unix.O_PATH == 0 {
+		return fd, nil
+	}
+
+	// with O_PATH the symlink itself is opened
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		_ = unix.Close(fd)
+		return -1, err
+	} else if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+		_ = unix.Close(fd)
+		return -1, unix.ELOOP
+	}
+
+	return fd, nil
+}
+
+// openParent opens the parent directory of the path, operations on the last element must not follow it.
+func (p *localStorageProvider) openParent(name string) (*os.File, string, error) {
+	parent, base, err := p.split(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dir, err := p.openat(parent, unix.O_PATH|unix.O_DIRECTORY)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return dir, base, nil
+}
+
+func (p *localStorageProvider) open(name string) (*os.File, error) {
+	return p.openat(name, unix.O_RDONLY)
+}
+
+func (p *localStorageProvider) stat(name string) (fs.FileInfo, error) {
+	file, err := p.openat(name, unix.O_PATH)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = file.Close() }()
+	return file.Stat()
+}
+
+func (p *localStorageProvider) mkdir(name string) error {
+	dir, base, err := p.openParent(name)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = dir.Close() }()
+
+	if err := unix.Mkdirat(int(dir.Fd()), base, 0755); err != nil {
+		return p.pathError("mkdir", name, err)
+	}
+
+	return nil
+}
+
+func (p *localStorageProvider) rename(oldname string, newname string) error {
+	oldDir, oldBase, err := p.openParent(oldname)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = oldDir.Close() }()
+
+	newDir, newBase, err := p.openParent(newname)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = newDir.Close() }()
+
+	if err := unix.Renameat(int(oldDir.Fd()), oldBase, int(newDir.Fd()), newBase); err != nil {
+		return p.pathError("rename", oldname, err)
+	}
+
+	return nil
+}
+
+func (p *localStorageProvider) remove(name string) error {
+	dir, base, err := p.openParent(name)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = dir.Close() }()
+
+	if err := removeAllAt(int(dir.Fd()), base); err != nil {
+		return p.pathError("remove", name, err)
+	}
+
+	return nil
+}
+
+// removeAllAt removes the entry and all its children, symlinks are removed and never followed.
+func removeAllAt(dirfd int, name string) error {
+	var stat unix.Stat_t
+	if err := unix.Fstatat(dirfd, name, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	} else if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return unix.Unlinkat(dirfd, name, 0)
+	}
+
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	dir := os.NewFile(uintptr(fd), name)
+	defer func() { _ = dir.Close() }()
+
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := removeAllAt(fd, entry.Name()); err != nil {
+			return err
+		}
+	}
+
+	return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+}
+
+func (p *localStorageProvider) commit(tmp string, name string) error {
+	dir, base, err := p.openParent(name)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = dir.Close() }()
+
+	if err := unix.Renameat(unix.AT_FDCWD, tmp, int(dir.Fd()), base); err != nil {
+		return p.pathError("rename", name, err)
+	}
+
+	return nil
+}
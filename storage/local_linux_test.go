@@ -0,0 +1,14 @@
+//go:build linux
+
+package storage
+
+import "testing"
+
+func TestLocalStorageProvider_WithoutOpenat2(t *testing.T) {
+	supported := openat2Supported
+	openat2Supported = func() bool { return false }
+	defer func() { openat2Supported = supported }()
+
+	t.Run("SymlinkEscape", TestLocalStorageProvider_SymlinkEscape)
+	t.Run("SymlinkPolicy", TestLocalStorageProvider_SymlinkPolicy)
+}
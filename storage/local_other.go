@@ -0,0 +1,163 @@
+//go:build !linux
+
+package storage
+
+import (
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileOwner is not supported outside Linux.
+func fileOwner(fs.FileInfo) string {
+	return ""
+}
+
+// probe does nothing, paths are always resolved one element at a time.
+func (p *localStorageProvider) probe() {}
+
+// resolve walks the path one element at a time enforcing the symlink policy. This is subject to
+// races with concurrent changes to the filesystem, on Linux openat2(2) is used instead.
+func (p *localStorageProvider) resolve(name string) (string, error) {
+	rel := p.relative(name)
+	if p.symlinks == SymlinkPolicyFollow || rel == "." {
+		return filepath.Join(p.base, rel), nil
+	}
+
+	base, err := filepath.EvalSymlinks(p.base)
+	if err != nil {
+		return "", err
+	}
+
+	current := base
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		next := filepath.Join(current, elem)
+
+		info, err := os.Lstat(next)
+		if err != nil {
+			// let the caller deal with it
+			return next, nil
+		} else if info.Mode()&fs.ModeSymlink == 0 {
+			current = next
+			continue
+		} else if p.symlinks == SymlinkPolicyDeny {
+			return "", fileshare.NewError("symlink not allowed", fs.ErrNotExist, fmt.Errorf("%s is a symlink", name))
+		}
+
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		} else if filepath.IsAbs(target) {
+			return "", fileshare.NewError("symlink not allowed", fs.ErrNotExist, fmt.Errorf("%s points to an absolute path", name))
+		}
+
+		resolved, err := filepath.EvalSymlinks(next)
+		if err != nil {
+			return "", err
+		} else if resolved != base && !strings.HasPrefix(resolved, base+string(filepath.Separator)) {
+			return "", fileshare.NewError("symlink not allowed", fs.ErrNotExist, fmt.Errorf("%s points outside of the base", name))
+		}
+
+		current = resolved
+	}
+
+	return current, nil
+}
+
+// resolveParent resolves the parent of the path, operations on the last element must not follow it.
+func (p *localStorageProvider) resolveParent(name string) (string, error) {
+	parent, base, err := p.split(name)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := p.resolve(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, base), nil
+}
+
+func (p *localStorageProvider) open(name string) (*os.File, error) {
+	path, err := p.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+// namedFileInfo is the information of a symlink target under the name of the symlink.
+type namedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i *namedFileInfo) Name() string {
+	return i.name
+}
+
+func (p *localStorageProvider) stat(name string) (fs.FileInfo, error) {
+	path, err := p.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	} else if base := filepath.Base(p.relative(name)); base != "." && info.Name() != base {
+		return &namedFileInfo{info, base}, nil
+	}
+
+	return info, nil
+}
+
+func (p *localStorageProvider) mkdir(name string) error {
+	path, err := p.resolveParent(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Mkdir(path, 0755)
+}
+
+func (p *localStorageProvider) rename(oldname string, newname string) error {
+	oldpath, err := p.resolveParent(oldname)
+	if err != nil {
+		return err
+	}
+
+	newpath, err := p.resolveParent(newname)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(oldpath, newpath)
+}
+
+func (p *localStorageProvider) remove(name string) error {
+	path, err := p.resolveParent(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(path)
+}
+
+func (p *localStorageProvider) commit(tmp string, name string) error {
+	path, err := p.resolveParent(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func newTestLocalStorageProvider(t *testing.T, base string, symlinks string) fileshare.StorageProvider {
+	storage, err := NewLocalStorageProvider(base, symlinks)
+	if err != nil {
+		t.Fatalf("failed creating storage: %v", err)
+	}
+
+	return storage
+}
+
+// setupSymlinks creates a base directory with symlinks pointing inside and outside of it.
+func setupSymlinks(t *testing.T) (string, string) {
+	root := t.TempDir()
+	base := filepath.Join(root, "base")
+	outside := filepath.Join(root, "outside")
+
+	for _, dir := range []string{base, outside, filepath.Join(base, "inner")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("failed creating directory: %v", err)
+		}
+	}
+
+	_ = os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	_ = os.WriteFile(filepath.Join(base, "inner", "public.txt"), []byte("public"), 0644)
+
+	links := map[string]string{
+		"abs":    outside,
+		"rel":    "../outside",
+		"etc":    "/etc",
+		"inside": "inner",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, name)); err != nil {
+			t.Fatalf("failed creating symlink: %v", err)
+		}
+	}
+
+	return base, outside
+}
+
+func TestLocalStorageProvider_SymlinkEscape(t *testing.T) {
+	escapes := []string{
+		"abs/secret.txt",
+		"rel/secret.txt",
+		"inner/../rel/secret.txt",
+		"etc/passwd",
+		"../outside/secret.txt",
+		"../../outside/secret.txt",
+	}
+
+	for _, policy := range []string{SymlinkPolicyDeny, SymlinkPolicyInside} {
+		base, outside := setupSymlinks(t)
+		storage := newTestLocalStorageProvider(t, base, policy)
+
+		for _, payload := range escapes {
+			if file, _, err := storage.OpenFile(context.Background(), payload); err == nil {
+				_ = file.Close()
+				t.Fatalf("%s: %s: expected open to fail", policy, payload)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("%s: %s: expected not exist error, got %v", policy, payload, err)
+			}
+
+			if _, err := storage.ReadDir(context.Background(), filepath.Dir(payload)); err == nil && filepath.Dir(payload) != "." && filepath.Dir(payload) != ".." && filepath.Dir(payload) != "../.." {
+				t.Fatalf("%s: %s: expected read dir to fail", policy, payload)
+			}
+
+			if file, err := storage.CreateFile(context.Background(), filepath.Join(filepath.Dir(payload), "new.txt")); err == nil {
+				_, _ = file.Write([]byte("pwned"))
+				_ = file.Close()
+			}
+
+			_ = storage.Remove(context.Background(), payload)
+			_ = storage.Rename(context.Background(), payload, "stolen.txt")
+			_ = storage.Mkdir(context.Background(), filepath.Join(filepath.Dir(payload), "newdir"))
+		}
+
+		// nothing outside must have changed
+		if entries, _ := os.ReadDir(outside); len(entries) != 1 || entries[0].Name() != "secret.txt" {
+			t.Fatalf("%s: outside directory was modified: %v", policy, entries)
+		}
+
+		// removing the symlink removes only the link
+		if err := storage.Remove(context.Background(), "abs"); err != nil {
+			t.Fatalf("%s: failed removing symlink: %v", policy, err)
+		} else if _, err := os.Stat(filepath.Join(outside, "secret.txt")); err != nil {
+			t.Fatalf("%s: symlink target was removed: %v", policy, err)
+		}
+	}
+}
+
+func TestLocalStorageProvider_SymlinkPolicy(t *testing.T) {
+	base, _ := setupSymlinks(t)
+
+	expect := map[string]map[string]bool{
+		SymlinkPolicyDeny:   {"inner/public.txt": true, "inside/public.txt": false, "abs/secret.txt": false},
+		SymlinkPolicyInside: {"inner/public.txt": true, "inside/public.txt": true, "abs/secret.txt": false},
+		SymlinkPolicyFollow: {"inner/public.txt": true, "inside/public.txt": true, "abs/secret.txt": true},
+	}
+
+	for policy, payloads := range expect {
+		storage := newTestLocalStorageProvider(t, base, policy)
+
+		for payload, ok := range payloads {
+			file, _, err := storage.OpenFile(context.Background(), payload)
+			if ok && err != nil {
+				t.Fatalf("%s: %s: expected open to succeed, got %v", policy, payload, err)
+			} else if !ok && err == nil {
+				t.Fatalf("%s: %s: expected open to fail", policy, payload)
+			}
+
+			if file != nil {
+				_ = file.Close()
+			}
+		}
+
+		entries, err := storage.ReadDir(context.Background(), ".")
+		if err != nil {
+			t.Fatalf("%s: failed reading dir: %v", policy, err)
+		}
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+
+		var expected int
+		switch policy {
+		case SymlinkPolicyDeny:
+			expected = 1 // inner
+		case SymlinkPolicyInside:
+			expected = 2 // inner, inside
+		case SymlinkPolicyFollow:
+			expected = 5 // everything
+		}
+
+		if len(entries) != expected {
+			t.Fatalf("%s: expected %d entries, got %v", policy, expected, names)
+		} else if policy != SymlinkPolicyDeny && !slices.Contains(names, "inside") {
+			t.Fatalf("%s: expected symlink to keep its name, got %v", policy, names)
+		}
+
+		// the symlink has the name of the link, not of the target
+		if stat, err := storage.Stat(context.Background(), "inside"); policy != SymlinkPolicyDeny && (err != nil || stat.Name != "inside") {
+			t.Fatalf("%s: unexpected stat of symlink: %+v: %v", policy, stat, err)
+		}
+	}
+}
+
+func TestLocalStorageProvider_CreateFile(t *testing.T) {
+	base := t.TempDir()
+	storage := newTestLocalStorageProvider(t, base, "")
+	writeTestFile(t, storage, "a.txt", "old")
+
+	// the previous content is untouched until the new one is complete
+	w, err := storage.CreateFile(context.Background(), "a.txt")
+	if err != nil {
+		t.Fatalf("failed creating file: %v", err)
+	}
+
+	_, _ = w.Write([]byte("new "))
+	if data, _ := os.ReadFile(filepath.Join(base, "a.txt")); string(data) != "old" {
+		t.Fatalf("unexpected content while writing: %s", data)
+	}
+
+	_, _ = w.Write([]byte("content"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed closing file: %v", err)
+	} else if data, _ := os.ReadFile(filepath.Join(base, "a.txt")); string(data) != "new content" {
+		t.Fatalf("unexpected content: %s", data)
+	} else if err := w.Abort(); err != nil {
+		t.Fatalf("expected abort after close to have no effect: %v", err)
+	} else if data, _ := os.ReadFile(filepath.Join(base, "a.txt")); string(data) != "new content" {
+		t.Fatalf("unexpected content after abort: %s", data)
+	}
+
+	if entries, _ := os.ReadDir(filepath.Join(base, uploadsDir)); len(entries) != 0 {
+		t.Fatalf("unexpected partial uploads: %v", entries)
+	}
+}
+
+func TestLocalStorageProvider_CreateFileAbort(t *testing.T) {
+	// the backends keep the partial uploads in a temporary directory
+	backends := map[string]func(t *testing.T, base string) (fileshare.StorageProvider, string){
+		"local": func(t *testing.T, base string) (fileshare.StorageProvider, string) {
+			return newTestLocalStorageProvider(t, base, ""), filepath.Join(base, uploadsDir)
+		},
+		"dedup": func(t *testing.T, base string) (fileshare.StorageProvider, string) {
+			storage, err := NewDedupStorageProvider(base)
+			if err != nil {
+				t.Fatalf("failed creating storage: %v", err)
+			}
+
+			return storage, filepath.Join(base, "tmp")
+		},
+	}
+
+	for backend, newBackend := range backends {
+		storage, uploads := newBackend(t, t.TempDir())
+
+		w, err := storage.CreateFile(context.Background(), "a.txt")
+		if err != nil {
+			t.Fatalf("%s: failed creating file: %v", backend, err)
+		}
+
+		_, _ = w.Write([]byte("partial"))
+		if err := w.Abort(); err != nil {
+			t.Fatalf("%s: failed aborting: %v", backend, err)
+		} else if err := w.Close(); err != nil {
+			t.Fatalf("%s: expected close after abort to have no effect: %v", backend, err)
+		}
+
+		// an interrupted upload is not published either
+		ctx, cancel := context.WithCancel(context.Background())
+		w, err = storage.CreateFile(ctx, "b.txt")
+		if err != nil {
+			t.Fatalf("%s: failed creating file: %v", backend, err)
+		}
+
+		_, _ = w.Write([]byte("partial"))
+		cancel()
+
+		if _, err := w.Write([]byte("more")); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: expected cancelled write: %v", backend, err)
+		} else if err := w.Close(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: expected cancelled close: %v", backend, err)
+		}
+
+		for _, name := range []string{"a.txt", "b.txt"} {
+			if _, err := storage.Stat(context.Background(), name); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("%s: expected %s not to exist: %v", backend, name, err)
+			}
+		}
+
+		if entries, _ := os.ReadDir(uploads); len(entries) != 0 {
+			t.Fatalf("%s: unexpected partial uploads: %v", backend, entries)
+		}
+	}
+}
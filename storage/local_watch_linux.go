@@ -0,0 +1,199 @@
+//go:build linux
+
+package storage
+
+import (
+	"context"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+const localWatchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW
+
+// localWatcher watches the whole tree with inotify(7), except for the reserved directory.
+type localWatcher struct {
+	p      *localStorageProvider
+	fd     int
+	paths  map[int]string
+	events chan fileshare.ChangeEvent
+}
+
+func (p *localStorageProvider) watchChanges(ctx context.Context) (<-chan fileshare.ChangeEvent, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, &os.SyscallError{Syscall: "inotify_init1", Err: err}
+	}
+
+	w := &localWatcher{p: p, fd: fd, paths: map[int]string{}, events: make(chan fileshare.ChangeEvent, eventsSubscriberBuffer)}
+	if err := w.add("."); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+
+	go w.run(ctx)
+	return w.events, nil
+}
+
+// add watches the directory and all its subdirectories, symlinks are not followed.
+func (w *localWatcher) add(rel string) error {
+	if isReservedPath(rel) {
+		return nil
+	}
+
+	path := filepath.Join(w.p.base, rel)
+	wd, err := unix.InotifyAddWatch(w.fd, path, localWatchMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+	}
+
+	w.paths[wd] = rel
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if err := w.add(filepath.Join(rel, entry.Name())); err != nil {
+			log.WithError(err).WithField("module", "storage").Warnf("failed watching %s", filepath.Join(rel, entry.Name()))
+		}
+	}
+
+	return nil
+}
+
+// forget stops watching the directory and all its subdirectories.
+func (w *localWatcher) forget(rel string) {
+	for wd, path := range w.paths {
+		if path == rel || strings.HasPrefix(path, rel+"/") {
+			_, _ = unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.paths, wd)
+		}
+	}
+}
+
+// move updates the watched paths after a directory has been renamed.
+func (w *localWatcher) move(oldrel string, newrel string) {
+	for wd, path := range w.paths {
+		if path == oldrel {
+			w.paths[wd] = newrel
+		} else if strings.HasPrefix(path, oldrel+"/") {
+			w.paths[wd] = newrel + path[len(oldrel):]
+		}
+	}
+}
+
+func (w *localWatcher) run(ctx context.Context) {
+	defer close(w.events)
+
+	// the file descriptor is non-blocking, reads go through the runtime poller and are interrupted by closing it
+	file := os.NewFile(uintptr(w.fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		_ = file.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).WithField("module", "storage").Errorf("failed reading inotify events")
+			}
+
+			return
+		}
+
+		w.handle(buf[:n])
+	}
+}
+
+func (w *localWatcher) handle(buf []byte) {
+	// a move is split in two events, the second one might never come if moved outside the tree
+	var moved *fileshare.ChangeEvent
+	var movedCookie uint32
+	var movedDir bool
+	flushMoved := func() {
+		if moved != nil {
+			if movedDir {
+				w.forget(moved.Path)
+			}
+
+			w.events <- *moved
+			moved = nil
+		}
+	}
+
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		name := strings.TrimRight(string(buf[offset+unix.SizeofInotifyEvent:offset+unix.SizeofInotifyEvent+int(raw.Len)]), "\x00")
+		offset += unix.SizeofInotifyEvent + int(raw.Len)
+
+		if raw.Mask&unix.IN_Q_OVERFLOW != 0 {
+			log.WithField("module", "storage").Warnf("inotify queue overflow, some changes were lost")
+			continue
+		} else if raw.Mask&unix.IN_IGNORED != 0 {
+			delete(w.paths, int(raw.Wd))
+			continue
+		}
+
+		dir, ok := w.paths[int(raw.Wd)]
+		if !ok || len(name) == 0 {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		isDir := raw.Mask&unix.IN_ISDIR != 0
+
+		if moved != nil && (raw.Mask&unix.IN_MOVED_TO == 0 || raw.Cookie != movedCookie) {
+			flushMoved()
+		}
+
+		switch {
+		case raw.Mask&unix.IN_CREATE != 0:
+			if isDir {
+				if err := w.add(path); err != nil {
+					log.WithError(err).WithField("module", "storage").Warnf("failed watching %s", path)
+				}
+			}
+
+			w.events <- fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: path}
+		case raw.Mask&unix.IN_CLOSE_WRITE != 0:
+			w.events <- fileshare.ChangeEvent{Type: fileshare.ChangeModified, Path: path}
+		case raw.Mask&unix.IN_DELETE != 0:
+			w.events <- fileshare.ChangeEvent{Type: fileshare.ChangeDeleted, Path: path}
+		case raw.Mask&unix.IN_MOVED_FROM != 0:
+			moved = &fileshare.ChangeEvent{Type: fileshare.ChangeDeleted, Path: path}
+			movedCookie, movedDir = raw.Cookie, isDir
+		case raw.Mask&unix.IN_MOVED_TO != 0:
+			if moved != nil {
+				if isDir {
+					w.move(moved.Path, path)
+				}
+
+				w.events <- fileshare.ChangeEvent{Type: fileshare.ChangeRenamed, Path: path, OldPath: moved.Path}
+				moved = nil
+			} else {
+				if isDir {
+					if err := w.add(path); err != nil {
+						log.WithError(err).WithField("module", "storage").Warnf("failed watching %s", path)
+					}
+				}
+
+				w.events <- fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: path}
+			}
+		}
+	}
+
+	flushMoved()
+}
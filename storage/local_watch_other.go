@@ -0,0 +1,13 @@
+//go:build !linux
+
+package storage
+
+import (
+	"context"
+	"github.com/devgianlu/go-fileshare"
+)
+
+// watchChanges is not supported outside Linux, only changes made through the server are notified.
+func (p *localStorageProvider) watchChanges(context.Context) (<-chan fileshare.ChangeEvent, error) {
+	return nil, fileshare.ErrStorageWatchUnsupported
+}
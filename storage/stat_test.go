@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStat(t *testing.T) {
+	backends := map[string]func(t *testing.T) fileshare.StorageProvider{
+		"local": func(t *testing.T) fileshare.StorageProvider {
+			return newTestLocalStorageProvider(t, t.TempDir(), "")
+		},
+		"dedup": func(t *testing.T) fileshare.StorageProvider {
+			storage, err := NewDedupStorageProvider(t.TempDir())
+			if err != nil {
+				t.Fatalf("failed creating storage: %v", err)
+			}
+
+			return storage
+		},
+		"encrypted": func(t *testing.T) fileshare.StorageProvider {
+			storage, _ := newTestEncryptedStorageProvider(t, true)
+			return storage
+		},
+	}
+
+	user := &fileshare.User{Nickname: "pippo", ACL: []fileshare.PathACL{{Path: "/", Read: true}, {Path: "/hidden"}}}
+	sum := sha256.Sum256([]byte("hello world"))
+
+	for backend, newBackend := range backends {
+		underlying := newTestChecksumStorageProvider(t, newBackend(t))
+		for _, dir := range []string{"dir", "hidden"} {
+			if err := underlying.Mkdir(context.Background(), dir); err != nil {
+				t.Fatalf("%s: failed creating %s: %v", backend, dir, err)
+			}
+		}
+
+		writeTestFile(t, underlying, "dir/a.txt", "hello world")
+		writeTestFile(t, underlying, "hidden/secret.txt", "secret")
+
+		storage := NewACLStorageProvider(underlying, nil, nil)
+
+		stat, err := storage.Stat(context.Background(), "dir/a.txt", user)
+		if err != nil {
+			t.Fatalf("%s: failed stat of file: %v", backend, err)
+		} else if stat.Name != "a.txt" || stat.Size != 11 || stat.IsDir || time.Since(stat.ModTime) > time.Minute {
+			t.Fatalf("%s: unexpected file stat: %+v", backend, stat)
+		} else if !strings.HasPrefix(stat.MimeType, "text/plain") {
+			t.Fatalf("%s: unexpected mime type: %s", backend, stat.MimeType)
+		} else if stat.Checksums[ChecksumSHA256] != hex.EncodeToString(sum[:]) {
+			t.Fatalf("%s: unexpected checksums: %v", backend, stat.Checksums)
+		}
+
+		stat, err = storage.Stat(context.Background(), "dir", user)
+		if err != nil {
+			t.Fatalf("%s: failed stat of directory: %v", backend, err)
+		} else if stat.Name != "dir" || !stat.IsDir || len(stat.MimeType) > 0 || len(stat.Checksums) > 0 {
+			t.Fatalf("%s: unexpected directory stat: %+v", backend, stat)
+		}
+
+		if _, err := storage.Stat(context.Background(), "dir/missing.txt", user); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s: expected missing file: %v", backend, err)
+		} else if _, err := storage.Stat(context.Background(), "hidden/secret.txt", user); !errors.Is(err, fileshare.ErrStorageReadForbidden) {
+			t.Fatalf("%s: expected hidden file: %v", backend, err)
+		} else if _, err := storage.Stat(context.Background(), "hidden", user); !errors.Is(err, fileshare.ErrStorageReadForbidden) {
+			t.Fatalf("%s: expected hidden directory: %v", backend, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"github.com/devgianlu/go-fileshare"
+	"github.com/devgianlu/go-fileshare/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"io"
+	"io/fs"
+)
+
+// tracingStorageProvider traces the calls to the storage backend.
+type tracingStorageProvider struct {
+	underlying fileshare.StorageProvider
+}
+
+func NewTracingStorageProvider(storage fileshare.StorageProvider) fileshare.StorageProvider {
+	return &tracingStorageProvider{storage}
+}
+
+func (p *tracingStorageProvider) start(ctx context.Context, op string, name string) (context.Context, func(err error)) {
+	ctx, span := tracing.Start(ctx, "storage."+op, attribute.String("fileshare.path", name))
+	return ctx, func(err error) { tracing.End(span, err) }
+}
+
+func (p *tracingStorageProvider) Unwrap() fileshare.StorageProvider {
+	return p.underlying
+}
+
+func (p *tracingStorageProvider) CreateFile(ctx context.Context, name string) (fileshare.FileWriter, error) {
+	ctx, end := p.start(ctx, "CreateFile", name)
+	file, err := p.underlying.CreateFile(ctx, name)
+	end(err)
+	return file, err
+}
+
+func (p *tracingStorageProvider) OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	ctx, end := p.start(ctx, "OpenFile", name)
+	file, info, err := p.underlying.OpenFile(ctx, name)
+	end(err)
+	return file, info, err
+}
+
+func (p *tracingStorageProvider) Stat(ctx context.Context, name string) (*fileshare.FileStat, error) {
+	ctx, end := p.start(ctx, "Stat", name)
+	stat, err := p.underlying.Stat(ctx, name)
+	end(err)
+	return stat, err
+}
+
+func (p *tracingStorageProvider) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	ctx, end := p.start(ctx, "ReadDir", name)
+	entries, err := p.underlying.ReadDir(ctx, name)
+	end(err)
+	return entries, err
+}
+
+func (p *tracingStorageProvider) Mkdir(ctx context.Context, name string) error {
+	ctx, end := p.start(ctx, "Mkdir", name)
+	err := p.underlying.Mkdir(ctx, name)
+	end(err)
+	return err
+}
+
+func (p *tracingStorageProvider) Rename(ctx context.Context, oldname string, newname string) error {
+	ctx, end := p.start(ctx, "Rename", newname)
+	err := p.underlying.Rename(ctx, oldname, newname)
+	end(err)
+	return err
+}
+
+func (p *tracingStorageProvider) Remove(ctx context.Context, name string) error {
+	ctx, end := p.start(ctx, "Remove", name)
+	err := p.underlying.Remove(ctx, name)
+	end(err)
+	return err
+}
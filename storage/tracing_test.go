@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io/fs"
+	"testing"
+)
+
+func newTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	return exporter
+}
+
+func findSpan(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+
+	return nil
+}
+
+func hasAttribute(span *tracetest.SpanStub, attr attribute.KeyValue) bool {
+	for _, a := range span.Attributes {
+		if a == attr {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestTracing_ReadDir(t *testing.T) {
+	exporter := newTestTracer(t)
+
+	user := &fileshare.User{Nickname: "test", ACL: []fileshare.PathACL{{Path: "/test", Read: true}}}
+	storage := NewACLStorageProvider(NewTracingStorageProvider(&mockStorageProvider{
+		dirEntries: []fs.DirEntry{&mockDirEntry{"bar.txt", false}},
+	}), nil, nil)
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "root")
+	if _, err := storage.ReadDir(ctx, "/test", user); err != nil {
+		t.Fatalf("failed reading directory: %v", err)
+	}
+	root.End()
+
+	spans := exporter.GetSpans()
+	acl, eval, backend := findSpan(spans, "acl.ReadDir"), findSpan(spans, "acl.evalACL"), findSpan(spans, "storage.ReadDir")
+	if acl == nil || eval == nil || backend == nil {
+		t.Fatalf("missing spans: %v", spans.Snapshots())
+	}
+
+	if acl.Parent.SpanID() != root.SpanContext().SpanID() {
+		t.Fatalf("acl span is not a child of the root span")
+	} else if eval.Parent.SpanID() != acl.SpanContext.SpanID() || backend.Parent.SpanID() != acl.SpanContext.SpanID() {
+		t.Fatalf("ACL evaluation and backend spans are not children of the acl span")
+	} else if !hasAttribute(eval, attribute.Bool("fileshare.acl.allowed", true)) {
+		t.Fatalf("unexpected ACL evaluation attributes: %v", eval.Attributes)
+	}
+}
+
+func TestTracing_Denied(t *testing.T) {
+	exporter := newTestTracer(t)
+
+	user := &fileshare.User{Nickname: "test"}
+	storage := NewACLStorageProvider(NewTracingStorageProvider(&mockStorageProvider{}), nil, nil)
+
+	if _, _, err := storage.OpenFile(context.Background(), "/secret/a.txt", user); !errors.Is(err, fileshare.ErrStorageReadForbidden) {
+		t.Fatalf("expected read forbidden error, got %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if acl := findSpan(spans, "acl.OpenFile"); acl == nil || !hasAttribute(acl, attribute.Bool("fileshare.acl.denied", true)) {
+		t.Fatalf("missing denied acl span: %v", spans.Snapshots())
+	} else if findSpan(spans, "storage.OpenFile") != nil {
+		t.Fatalf("unexpected backend span for denied access")
+	}
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// trashDir is where deleted items are moved, each user has a directory containing the items
+// and a JSON file for each item with its metadata.
+const trashDir = reservedDir + "/trash"
+
+type trashStorageProvider struct {
+	underlying fileshare.StorageProvider
+}
+
+func NewTrashStorageProvider(storage fileshare.StorageProvider, cfg fileshare.StorageTrash) fileshare.TrashStorageProvider {
+	p := &trashStorageProvider{storage}
+	if cfg.Retention > 0 {
+		go p.purgeForever(cfg.Retention)
+	}
+
+	return p
+}
+
+func (p *trashStorageProvider) purgeForever(retention time.Duration) {
+	interval := min(retention, time.Hour)
+	for {
+		if err := p.PurgeTrash(context.Background(), time.Now().Add(-retention)); err != nil {
+			log.WithError(err).WithField("module", "storage").Errorf("failed purging trash")
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// userDir returns the trash directory of the user, the nickname is escaped to a single path element.
+func (p *trashStorageProvider) userDir(nickname string) (string, error) {
+	if len(nickname) == 0 {
+		return "", fmt.Errorf("invalid trash user: %w", fs.ErrNotExist)
+	}
+
+	// escaping does not touch dots, but "%" is always escaped so this cannot clash with other nicknames
+	escaped := url.PathEscape(nickname)
+	if escaped == "." || escaped == ".." {
+		escaped = strings.ReplaceAll(escaped, ".", "%2E")
+	}
+
+	return filepath.Join(trashDir, escaped), nil
+}
+
+func (p *trashStorageProvider) Unwrap() fileshare.StorageProvider {
+	return p.underlying
+}
+
+func (p *trashStorageProvider) CreateFile(ctx context.Context, name string) (fileshare.FileWriter, error) {
+	return p.underlying.CreateFile(ctx, name)
+}
+
+func (p *trashStorageProvider) OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	return p.underlying.OpenFile(ctx, name)
+}
+
+func (p *trashStorageProvider) Stat(ctx context.Context, name string) (*fileshare.FileStat, error) {
+	return p.underlying.Stat(ctx, name)
+}
+
+func (p *trashStorageProvider) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	return p.underlying.ReadDir(ctx, name)
+}
+
+func (p *trashStorageProvider) Mkdir(ctx context.Context, name string) error {
+	return p.underlying.Mkdir(ctx, name)
+}
+
+func (p *trashStorageProvider) Rename(ctx context.Context, oldname string, newname string) error {
+	return p.underlying.Rename(ctx, oldname, newname)
+}
+
+func (p *trashStorageProvider) Remove(ctx context.Context, name string) error {
+	return p.underlying.Remove(ctx, name)
+}
+
+func (p *trashStorageProvider) MoveToTrash(ctx context.Context, name string, nickname string) error {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return fmt.Errorf("cannot trash root directory")
+	}
+
+	file, info, err := p.underlying.OpenFile(ctx, name)
+	if err != nil {
+		return err
+	} else if file != nil {
+		_ = file.Close()
+	}
+
+	idBytes := make([]byte, 8)
+	_, _ = rand.Read(idBytes)
+
+	now := time.Now()
+	item := fileshare.TrashItem{
+		ID:        fmt.Sprintf("%d-%s", now.Unix(), hex.EncodeToString(idBytes)),
+		Path:      name,
+		User:      nickname,
+		DeletedAt: now,
+		Dir:       info.IsDir(),
+	}
+
+	dir, err := p.userDir(nickname)
+	if err != nil {
+		return err
+	} else if err := mkdirAll(ctx, p.underlying, dir); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&item)
+	if err != nil {
+		return err
+	}
+
+	meta, err := p.underlying.CreateFile(ctx, filepath.Join(dir, item.ID+".json"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := meta.Write(data); err != nil {
+		_ = meta.Abort()
+		return err
+	} else if err := meta.Close(); err != nil {
+		return err
+	}
+
+	if err := p.underlying.Rename(ctx, name, filepath.Join(dir, item.ID)); err != nil {
+		_ = p.underlying.Remove(ctx, filepath.Join(dir, item.ID+".json"))
+		return err
+	}
+
+	return nil
+}
+
+func (p *trashStorageProvider) readItem(ctx context.Context, dir string, id string) (*fileshare.TrashItem, error) {
+	file, _, err := p.underlying.OpenFile(ctx, filepath.Join(dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	var item fileshare.TrashItem
+	if err := json.NewDecoder(file).Decode(&item); err != nil {
+		return nil, fmt.Errorf("invalid trash item %s: %w", id, err)
+	}
+
+	return &item, nil
+}
+
+func (p *trashStorageProvider) ListTrash(ctx context.Context, nickname string) ([]fileshare.TrashItem, error) {
+	var dirs []string
+	if len(nickname) > 0 {
+		dir, err := p.userDir(nickname)
+		if err != nil {
+			return nil, err
+		}
+
+		dirs = append(dirs, dir)
+	} else {
+		entries, err := p.underlying.ReadDir(ctx, trashDir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dirs = append(dirs, filepath.Join(trashDir, entry.Name()))
+			}
+		}
+	}
+
+	var items []fileshare.TrashItem
+	for _, dir := range dirs {
+		entries, err := p.underlying.ReadDir(ctx, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			id, ok := strings.CutSuffix(entry.Name(), ".json")
+			if !ok || entry.IsDir() {
+				continue
+			}
+
+			item, err := p.readItem(ctx, dir, id)
+			if err != nil {
+				log.WithError(err).WithField("module", "storage").Warnf("skipping invalid trash item %s", id)
+				continue
+			}
+
+			items = append(items, *item)
+		}
+	}
+
+	return items, nil
+}
+
+func (p *trashStorageProvider) GetTrashItem(ctx context.Context, nickname string, id string) (*fileshare.TrashItem, error) {
+	if strings.ContainsAny(id, "/.") {
+		return nil, fmt.Errorf("invalid trash item %s: %w", id, fs.ErrNotExist)
+	}
+
+	dir, err := p.userDir(nickname)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.readItem(ctx, dir, id)
+}
+
+func (p *trashStorageProvider) RestoreFromTrash(ctx context.Context, nickname string, id string) error {
+	item, err := p.GetTrashItem(ctx, nickname, id)
+	if err != nil {
+		return err
+	}
+
+	// do not overwrite anything that took its place
+	if file, _, err := p.underlying.OpenFile(ctx, item.Path); err == nil {
+		if file != nil {
+			_ = file.Close()
+		}
+
+		return fileshare.NewError("cannot restore item", fs.ErrExist, fmt.Errorf("%s already exists", item.Path))
+	}
+
+	if err := mkdirAll(ctx, p.underlying, filepath.Dir(item.Path)); err != nil {
+		return err
+	}
+
+	dir, err := p.userDir(nickname)
+	if err != nil {
+		return err
+	} else if err := p.underlying.Rename(ctx, filepath.Join(dir, item.ID), item.Path); err != nil {
+		return err
+	}
+
+	return p.underlying.Remove(ctx, filepath.Join(dir, item.ID+".json"))
+}
+
+func (p *trashStorageProvider) PurgeTrash(ctx context.Context, before time.Time) error {
+	items, err := p.ListTrash(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if item.DeletedAt.After(before) {
+			continue
+		}
+
+		dir, err := p.userDir(item.User)
+		if err != nil {
+			return err
+		} else if err := p.underlying.Remove(ctx, filepath.Join(dir, item.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		} else if err := p.underlying.Remove(ctx, filepath.Join(dir, item.ID+".json")); err != nil {
+			return err
+		}
+
+		log.WithField("module", "storage").Debugf("purged %s from trash of %s", item.Path, item.User)
+	}
+
+	return nil
+}
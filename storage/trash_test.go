@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrashStorageProvider(t *testing.T) {
+	base := t.TempDir()
+	storage := NewTrashStorageProvider(newTestLocalStorageProvider(t, base, ""), fileshare.StorageTrash{})
+
+	_ = os.MkdirAll(filepath.Join(base, "dir"), 0755)
+	writeTestFile(t, storage, "dir/a.txt", "hello")
+
+	if err := storage.MoveToTrash(context.Background(), "dir/a.txt", "pippo"); err != nil {
+		t.Fatalf("failed trashing: %v", err)
+	} else if _, err := os.Stat(filepath.Join(base, "dir", "a.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected trashed file to be gone: %v", err)
+	}
+
+	items, err := storage.ListTrash(context.Background(), "pippo")
+	if err != nil {
+		t.Fatalf("failed listing trash: %v", err)
+	} else if len(items) != 1 || items[0].Path != "/dir/a.txt" || items[0].User != "pippo" || items[0].Dir {
+		t.Fatalf("unexpected items: %+v", items)
+	} else if items, _ := storage.ListTrash(context.Background(), "pluto"); len(items) != 0 {
+		t.Fatalf("unexpected items of another user: %+v", items)
+	}
+
+	// restoring recreates the parents and never overwrites
+	_ = os.RemoveAll(filepath.Join(base, "dir"))
+	if err := storage.RestoreFromTrash(context.Background(), "pluto", items[0].ID); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected item of another user not to be found: %v", err)
+	} else if err := storage.RestoreFromTrash(context.Background(), "pippo", items[0].ID); err != nil {
+		t.Fatalf("failed restoring: %v", err)
+	} else if data, _ := os.ReadFile(filepath.Join(base, "dir", "a.txt")); string(data) != "hello" {
+		t.Fatalf("unexpected restored content: %s", data)
+	} else if items, _ := storage.ListTrash(context.Background(), "pippo"); len(items) != 0 {
+		t.Fatalf("unexpected items after restore: %+v", items)
+	}
+
+	if err := storage.MoveToTrash(context.Background(), "dir/a.txt", "pippo"); err != nil {
+		t.Fatalf("failed trashing: %v", err)
+	}
+
+	writeTestFile(t, storage, "dir/a.txt", "other")
+	items, _ = storage.ListTrash(context.Background(), "pippo")
+	if err := storage.RestoreFromTrash(context.Background(), "pippo", items[0].ID); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected existing file not to be overwritten: %v", err)
+	}
+}
+
+func TestTrashStorageProvider_Purge(t *testing.T) {
+	base := t.TempDir()
+	storage := NewTrashStorageProvider(newTestLocalStorageProvider(t, base, ""), fileshare.StorageTrash{})
+
+	_ = os.MkdirAll(filepath.Join(base, "dir"), 0755)
+	writeTestFile(t, storage, "dir/a.txt", "hello")
+
+	for _, name := range []string{"dir/a.txt", "dir"} {
+		if err := storage.MoveToTrash(context.Background(), name, "pippo"); err != nil {
+			t.Fatalf("failed trashing %s: %v", name, err)
+		}
+	}
+
+	if err := storage.PurgeTrash(context.Background(), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("failed purging: %v", err)
+	} else if items, _ := storage.ListTrash(context.Background(), ""); len(items) != 2 {
+		t.Fatalf("expected recent items to be kept: %+v", items)
+	}
+
+	if err := storage.PurgeTrash(context.Background(), time.Now()); err != nil {
+		t.Fatalf("failed purging: %v", err)
+	} else if items, _ := storage.ListTrash(context.Background(), ""); len(items) != 0 {
+		t.Fatalf("unexpected items after purge: %+v", items)
+	} else if entries, _ := os.ReadDir(filepath.Join(base, trashDir, "pippo")); len(entries) != 0 {
+		t.Fatalf("unexpected leftovers: %v", entries)
+	}
+}
+
+func TestTrashStorageProvider_Nickname(t *testing.T) {
+	base := t.TempDir()
+	storage := NewTrashStorageProvider(newTestLocalStorageProvider(t, base, ""), fileshare.StorageTrash{})
+
+	// the trash of a user must not be shared with the others or escape the trash directory
+	for _, nickname := range []string{".", "..", "a/../..", "a.b"} {
+		writeTestFile(t, storage, "a.txt", nickname)
+		if err := storage.MoveToTrash(context.Background(), "a.txt", nickname); err != nil {
+			t.Fatalf("%s: failed trashing: %v", nickname, err)
+		} else if items, err := storage.ListTrash(context.Background(), nickname); err != nil || len(items) != 1 || items[0].User != nickname {
+			t.Fatalf("%s: unexpected items: %+v: %v", nickname, items, err)
+		}
+	}
+
+	if entries, _ := os.ReadDir(filepath.Join(base, trashDir)); len(entries) != 4 {
+		t.Fatalf("unexpected trash directories: %v", entries)
+	} else if items, _ := storage.ListTrash(context.Background(), ""); len(items) != 4 {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+
+	writeTestFile(t, storage, "a.txt", "anonymous")
+	if err := storage.MoveToTrash(context.Background(), "a.txt", ""); err == nil {
+		t.Fatalf("expected empty nickname to be rejected")
+	} else if _, err := storage.GetTrashItem(context.Background(), "", "x"); err == nil {
+		t.Fatalf("expected empty nickname to be rejected")
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// reservedDir is where storage providers keep their own data, users can never access it.
+const reservedDir = ".fileshare"
+
+// uploadsDir is where files are written before being moved to their final location.
+const uploadsDir = reservedDir + "/uploads"
+
+// removePartialUploads removes the temporary files left behind by uploads that were interrupted, the
+// server must not be serving requests yet.
+func removePartialUploads(dir string) error {
+	partials, err := filepath.Glob(filepath.Join(dir, "upload-*"))
+	if err != nil {
+		return err
+	}
+
+	for _, partial := range partials {
+		log.WithField("module", "storage").Debugf("removing partial upload %s", filepath.Base(partial))
+		if err := os.Remove(partial); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isReservedPath(name string) bool {
+	name = filepath.Clean("/" + name)
+	return name == "/"+reservedDir || strings.HasPrefix(name, "/"+reservedDir+"/")
+}
+
+// mkdirAll creates the directory and all its parents, like os.MkdirAll.
+func mkdirAll(ctx context.Context, storage fileshare.StorageProvider, name string) error {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return nil
+	}
+
+	if err := mkdirAll(ctx, storage, filepath.Dir(name)); err != nil {
+		return err
+	}
+
+	if err := storage.Mkdir(ctx, name); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	return nil
+}
+
+// storageUnwrapper is implemented by storage providers that wrap another one.
+type storageUnwrapper interface {
+	Unwrap() fileshare.StorageProvider
+}
+
+// findStorage walks the chain of wrapped storage providers looking for one of the given type.
+func findStorage[T any](storage fileshare.StorageProvider) (T, bool) {
+	for storage != nil {
+		if found, ok := storage.(T); ok {
+			return found, true
+		}
+
+		unwrapper, ok := storage.(storageUnwrapper)
+		if !ok {
+			break
+		}
+
+		storage = unwrapper.Unwrap()
+	}
+
+	var zero T
+	return zero, false
+}
+
+// contextFile is a file whose reads fail once the context is done, so that long copies stop promptly.
+type contextFile struct {
+	ctx  context.Context
+	file *os.File
+}
+
+func (f *contextFile) Read(b []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return f.file.Read(b)
+}
+
+func (f *contextFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+func (f *contextFile) Close() error {
+	return f.file.Close()
+}
+
+// detectMimeType guesses the MIME type from the extension, or sniffs it from the content if that fails.
+func detectMimeType(name string, open func() (io.ReadCloser, error)) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(name)); len(mimeType) > 0 {
+		return mimeType
+	}
+
+	file, err := open()
+	if err != nil {
+		return ""
+	}
+
+	defer func() { _ = file.Close() }()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return ""
+	}
+
+	return http.DetectContentType(buf[:n])
+}
+
+// newFileStat builds the metadata from the file info, open is used only if the content must be sniffed.
+func newFileStat(info fs.FileInfo, open func() (io.ReadCloser, error)) *fileshare.FileStat {
+	stat := &fileshare.FileStat{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+
+	if !stat.IsDir {
+		stat.MimeType = detectMimeType(stat.Name, open)
+	}
+
+	return stat
+}
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// versionsDir is where old versions are kept, each file has a directory containing its versions.
+const versionsDir = reservedDir + "/versions"
+
+type versioningStorageProvider struct {
+	underlying fileshare.StorageProvider
+	keep       int
+	maxAge     time.Duration
+}
+
+func NewVersioningStorageProvider(storage fileshare.StorageProvider, cfg fileshare.StorageVersions) fileshare.VersionedStorageProvider {
+	p := &versioningStorageProvider{storage, cfg.Keep, cfg.MaxAge}
+	if cfg.MaxAge > 0 {
+		// versions of files that are not written anymore expire too
+		go func() {
+			if err := p.pruneExpired(context.Background(), versionsDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.WithError(err).WithField("module", "storage").Errorf("failed pruning expired versions")
+			}
+		}()
+	}
+
+	return p
+}
+
+func (p *versioningStorageProvider) versionsPath(name string) string {
+	return filepath.Join(versionsDir, filepath.Clean("/"+name))
+}
+
+// snapshot copies the current content of the file to a new version, if the file exists.
+func (p *versioningStorageProvider) snapshot(ctx context.Context, name string) error {
+	file, info, err := p.underlying.OpenFile(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if info.IsDir() {
+		return nil
+	}
+
+	defer func() { _ = file.Close() }()
+
+	dir := p.versionsPath(name)
+	if err := mkdirAll(ctx, p.underlying, dir); err != nil {
+		return err
+	}
+
+	version, err := p.underlying.CreateFile(ctx, filepath.Join(dir, strconv.FormatInt(time.Now().UnixNano(), 10)))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(version, file); err != nil {
+		_ = version.Abort()
+		return err
+	}
+
+	return version.Close()
+}
+
+// prune removes the versions that exceed the configured count or age, returning the ones left.
+func (p *versioningStorageProvider) prune(ctx context.Context, name string) ([]fileshare.FileVersion, error) {
+	versions, err := p.listVersions(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := versions[:0]
+	for i, version := range versions {
+		if (p.keep > 0 && i >= p.keep) || p.expired(version) {
+			if err := p.underlying.Remove(ctx, filepath.Join(p.versionsPath(name), version.ID)); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		kept = append(kept, version)
+	}
+
+	return kept, nil
+}
+
+func (p *versioningStorageProvider) expired(version fileshare.FileVersion) bool {
+	return p.maxAge > 0 && time.Since(version.ModTime) > p.maxAge
+}
+
+// pruneExpired removes the expired versions below the versions directory dir.
+func (p *versioningStorageProvider) pruneExpired(ctx context.Context, dir string) error {
+	entries, err := p.underlying.ReadDir(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if err := p.pruneExpired(ctx, name); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil || !p.expired(fileshare.FileVersion{ModTime: time.Unix(0, nanos)}) {
+			continue
+		}
+
+		if err := p.underlying.Remove(ctx, name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *versioningStorageProvider) Unwrap() fileshare.StorageProvider {
+	return p.underlying
+}
+
+func (p *versioningStorageProvider) CreateFile(ctx context.Context, name string) (fileshare.FileWriter, error) {
+	file, err := p.underlying.CreateFile(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &versioningFileWriter{FileWriter: file, ctx: ctx, p: p, name: name}, nil
+}
+
+func (p *versioningStorageProvider) OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	return p.underlying.OpenFile(ctx, name)
+}
+
+func (p *versioningStorageProvider) Stat(ctx context.Context, name string) (*fileshare.FileStat, error) {
+	return p.underlying.Stat(ctx, name)
+}
+
+func (p *versioningStorageProvider) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	return p.underlying.ReadDir(ctx, name)
+}
+
+func (p *versioningStorageProvider) Mkdir(ctx context.Context, name string) error {
+	return p.underlying.Mkdir(ctx, name)
+}
+
+func (p *versioningStorageProvider) Rename(ctx context.Context, oldname string, newname string) error {
+	if err := p.underlying.Rename(ctx, oldname, newname); err != nil {
+		return err
+	}
+
+	// move the versions along with the file
+	if _, _, err := p.underlying.OpenFile(ctx, p.versionsPath(oldname)); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err := mkdirAll(ctx, p.underlying, filepath.Dir(p.versionsPath(newname))); err != nil {
+		return err
+	} else if err := p.underlying.Rename(ctx, p.versionsPath(oldname), p.versionsPath(newname)); err != nil {
+		log.WithError(err).WithField("module", "storage").Warnf("failed moving versions of %s", oldname)
+	}
+
+	return nil
+}
+
+func (p *versioningStorageProvider) Remove(ctx context.Context, name string) error {
+	if err := p.underlying.Remove(ctx, name); err != nil {
+		return err
+	}
+
+	// the versions directory mirrors the tree, this works for directories too
+	if err := p.underlying.Remove(ctx, p.versionsPath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.WithError(err).WithField("module", "storage").Warnf("failed removing versions of %s", name)
+	}
+
+	return nil
+}
+
+// ListVersions returns the versions of the file, the expired ones are removed on the way.
+func (p *versioningStorageProvider) ListVersions(ctx context.Context, name string) ([]fileshare.FileVersion, error) {
+	return p.prune(ctx, name)
+}
+
+func (p *versioningStorageProvider) listVersions(ctx context.Context, name string) ([]fileshare.FileVersion, error) {
+	entries, err := p.underlying.ReadDir(ctx, p.versionsPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var versions []fileshare.FileVersion
+	for _, entry := range entries {
+		if entry.IsDir() {
+			// this is a versions directory for a child
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, fileshare.FileVersion{
+			ID:      entry.Name(),
+			Size:    info.Size(),
+			ModTime: time.Unix(0, nanos),
+		})
+	}
+
+	// newest first
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ModTime.After(versions[j].ModTime)
+	})
+
+	return versions, nil
+}
+
+func (p *versioningStorageProvider) OpenVersion(ctx context.Context, name string, id string) (io.ReadCloser, fs.FileInfo, error) {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, nil, fmt.Errorf("invalid version %s: %w", id, fs.ErrNotExist)
+	}
+
+	return p.underlying.OpenFile(ctx, filepath.Join(p.versionsPath(name), id))
+}
+
+func (p *versioningStorageProvider) RestoreVersion(ctx context.Context, name string, id string) error {
+	version, _, err := p.OpenVersion(ctx, name, id)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = version.Close() }()
+
+	// save the current content as a new version, prune only after we are done with the old one
+	if err := p.snapshot(ctx, name); err != nil {
+		return fmt.Errorf("failed saving version: %w", err)
+	}
+
+	file, err := p.underlying.CreateFile(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, version); err != nil {
+		_ = file.Abort()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	_, err = p.prune(ctx, name)
+	return err
+}
+
+// versioningFileWriter saves the current content as a version only when the new one is committed.
+type versioningFileWriter struct {
+	fileshare.FileWriter
+	ctx  context.Context
+	p    *versioningStorageProvider
+	name string
+	done bool
+}
+
+func (w *versioningFileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	if err := w.p.snapshot(w.ctx, w.name); err != nil {
+		_ = w.FileWriter.Abort()
+		return fmt.Errorf("failed saving version: %w", err)
+	} else if err := w.FileWriter.Close(); err != nil {
+		return err
+	}
+
+	_, err := w.p.prune(w.ctx, w.name)
+	return err
+}
+
+func (w *versioningFileWriter) Abort() error {
+	w.done = true
+	return w.FileWriter.Abort()
+}
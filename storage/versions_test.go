@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/devgianlu/go-fileshare"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func readTestVersion(t *testing.T, storage fileshare.VersionedStorageProvider, name string, id string) string {
+	file, _, err := storage.OpenVersion(context.Background(), name, id)
+	if err != nil {
+		t.Fatalf("failed opening version %s of %s: %v", id, name, err)
+	}
+
+	defer func() { _ = file.Close() }()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("failed reading version %s of %s: %v", id, name, err)
+	}
+
+	return string(data)
+}
+
+func TestVersioningStorageProvider(t *testing.T) {
+	base := t.TempDir()
+	storage := NewVersioningStorageProvider(newTestLocalStorageProvider(t, base, ""), fileshare.StorageVersions{Keep: 2})
+
+	for _, data := range []string{"one", "two", "three"} {
+		writeTestFile(t, storage, "a.txt", data)
+	}
+
+	versions, err := storage.ListVersions(context.Background(), "a.txt")
+	if err != nil {
+		t.Fatalf("failed listing versions: %v", err)
+	} else if len(versions) != 2 {
+		t.Fatalf("unexpected versions: %+v", versions)
+	} else if data := readTestVersion(t, storage, "a.txt", versions[0].ID); data != "two" || versions[0].Size != 3 {
+		t.Fatalf("unexpected newest version: %s", data)
+	} else if data := readTestVersion(t, storage, "a.txt", versions[1].ID); data != "one" {
+		t.Fatalf("unexpected oldest version: %s", data)
+	}
+
+	// restoring keeps the current content as a version, the oldest one goes over the limit
+	if err := storage.RestoreVersion(context.Background(), "a.txt", versions[1].ID); err != nil {
+		t.Fatalf("failed restoring version: %v", err)
+	} else if data, _ := os.ReadFile(filepath.Join(base, "a.txt")); string(data) != "one" {
+		t.Fatalf("unexpected restored content: %s", data)
+	}
+
+	versions, _ = storage.ListVersions(context.Background(), "a.txt")
+	if len(versions) != 2 || readTestVersion(t, storage, "a.txt", versions[0].ID) != "three" || readTestVersion(t, storage, "a.txt", versions[1].ID) != "two" {
+		t.Fatalf("unexpected versions after restore: %+v", versions)
+	}
+
+	if _, _, err := storage.OpenVersion(context.Background(), "a.txt", "../a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected invalid version: %v", err)
+	}
+
+	// the versions follow the file
+	if err := storage.Rename(context.Background(), "a.txt", "b.txt"); err != nil {
+		t.Fatalf("failed renaming: %v", err)
+	} else if versions, _ := storage.ListVersions(context.Background(), "b.txt"); len(versions) != 2 {
+		t.Fatalf("unexpected versions after rename: %+v", versions)
+	} else if versions, _ := storage.ListVersions(context.Background(), "a.txt"); len(versions) != 0 {
+		t.Fatalf("unexpected versions left behind: %+v", versions)
+	}
+
+	if err := storage.Remove(context.Background(), "b.txt"); err != nil {
+		t.Fatalf("failed removing: %v", err)
+	} else if versions, _ := storage.ListVersions(context.Background(), "b.txt"); len(versions) != 0 {
+		t.Fatalf("unexpected versions after remove: %+v", versions)
+	}
+}
+
+func TestVersioningStorageProvider_MaxAge(t *testing.T) {
+	base := t.TempDir()
+	local := newTestLocalStorageProvider(t, base, "")
+
+	old := strconv.FormatInt(time.Now().Add(-2*time.Hour).UnixNano(), 10)
+	_ = os.MkdirAll(filepath.Join(base, versionsDir, "dir", "a.txt"), 0755)
+	_ = os.WriteFile(filepath.Join(base, versionsDir, "dir", "a.txt", old), []byte("old"), 0644)
+
+	// expired versions are removed at startup, even if the file is never written again
+	storage := NewVersioningStorageProvider(local, fileshare.StorageVersions{MaxAge: time.Hour})
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(base, versionsDir, "dir", "a.txt", old)); errors.Is(err, fs.ErrNotExist) {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expired version was not removed: %v", err)
+		}
+	}
+
+	// and when listing
+	writeTestFile(t, storage, "b.txt", "one")
+	writeTestFile(t, storage, "b.txt", "two")
+	_ = os.WriteFile(filepath.Join(base, versionsDir, "b.txt", old), []byte("old"), 0644)
+
+	if versions, err := storage.ListVersions(context.Background(), "b.txt"); err != nil || len(versions) != 1 || versions[0].ID == old {
+		t.Fatalf("unexpected versions: %+v: %v", versions, err)
+	} else if _, err := os.Stat(filepath.Join(base, versionsDir, "b.txt", old)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expired version was not removed: %v", err)
+	}
+}
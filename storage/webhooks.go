@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/devgianlu/go-fileshare"
+	"hash"
+	"io"
+	"io/fs"
+)
+
+// webhookStorageProvider notifies the changes made through the server, along with who made them.
+type webhookStorageProvider struct {
+	underlying fileshare.StorageProvider
+	dispatcher fileshare.WebhookDispatcher
+}
+
+func NewWebhookStorageProvider(storage fileshare.StorageProvider, dispatcher fileshare.WebhookDispatcher) fileshare.StorageProvider {
+	return &webhookStorageProvider{storage, dispatcher}
+}
+
+func (p *webhookStorageProvider) dispatch(ctx context.Context, event fileshare.WebhookEvent) {
+	var ok bool
+	if event.ChangeEvent, ok = normalizeChange(event.ChangeEvent); !ok {
+		return
+	}
+
+	if user := fileshare.UserFromUserContext(ctx); user != nil {
+		event.User = user.Nickname
+	}
+
+	p.dispatcher.Dispatch(event)
+}
+
+func (p *webhookStorageProvider) Unwrap() fileshare.StorageProvider {
+	return p.underlying
+}
+
+func (p *webhookStorageProvider) CreateFile(ctx context.Context, name string) (fileshare.FileWriter, error) {
+	file, err := p.underlying.CreateFile(ctx, name)
+	if err != nil || isReservedPath(name) {
+		return file, err
+	}
+
+	changeType := fileshare.ChangeCreated
+	if _, err := p.underlying.Stat(ctx, name); err == nil {
+		changeType = fileshare.ChangeModified
+	}
+
+	return &webhookFileWriter{FileWriter: file, ctx: ctx, p: p, name: name, changeType: changeType, hash: sha256.New()}, nil
+}
+
+func (p *webhookStorageProvider) OpenFile(ctx context.Context, name string) (io.ReadCloser, fs.FileInfo, error) {
+	return p.underlying.OpenFile(ctx, name)
+}
+
+func (p *webhookStorageProvider) Stat(ctx context.Context, name string) (*fileshare.FileStat, error) {
+	return p.underlying.Stat(ctx, name)
+}
+
+func (p *webhookStorageProvider) ReadDir(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	return p.underlying.ReadDir(ctx, name)
+}
+
+func (p *webhookStorageProvider) Mkdir(ctx context.Context, name string) error {
+	if err := p.underlying.Mkdir(ctx, name); err != nil {
+		return err
+	}
+
+	p.dispatch(ctx, fileshare.WebhookEvent{ChangeEvent: fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: name}})
+	return nil
+}
+
+func (p *webhookStorageProvider) Rename(ctx context.Context, oldname string, newname string) error {
+	if err := p.underlying.Rename(ctx, oldname, newname); err != nil {
+		return err
+	}
+
+	p.dispatch(ctx, fileshare.WebhookEvent{ChangeEvent: fileshare.ChangeEvent{Type: fileshare.ChangeRenamed, Path: newname, OldPath: oldname}})
+	return nil
+}
+
+func (p *webhookStorageProvider) Remove(ctx context.Context, name string) error {
+	if err := p.underlying.Remove(ctx, name); err != nil {
+		return err
+	}
+
+	p.dispatch(ctx, fileshare.WebhookEvent{ChangeEvent: fileshare.ChangeEvent{Type: fileshare.ChangeDeleted, Path: name}})
+	return nil
+}
+
+type webhookFileWriter struct {
+	fileshare.FileWriter
+	ctx        context.Context
+	p          *webhookStorageProvider
+	name       string
+	changeType string
+	hash       hash.Hash
+	size       int64
+	done       bool
+}
+
+func (w *webhookFileWriter) Write(b []byte) (int, error) {
+	n, err := w.FileWriter.Write(b)
+	w.hash.Write(b[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *webhookFileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	if err := w.FileWriter.Close(); err != nil {
+		return err
+	}
+
+	w.p.dispatch(w.ctx, fileshare.WebhookEvent{
+		ChangeEvent: fileshare.ChangeEvent{Type: w.changeType, Path: w.name},
+		Size:        w.size,
+		SHA256:      hex.EncodeToString(w.hash.Sum(nil)),
+	})
+	return nil
+}
+
+func (w *webhookFileWriter) Abort() error {
+	w.done = true
+	return w.FileWriter.Abort()
+}
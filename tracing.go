@@ -0,0 +1,9 @@
+package fileshare
+
+// Tracing exports OpenTelemetry traces to an OTLP/HTTP collector.
+type Tracing struct {
+	Endpoint    string            `yaml:"endpoint"`
+	Insecure    bool              `yaml:"insecure"`
+	Headers     map[string]string `yaml:"headers"`
+	SampleRatio *float64          `yaml:"sample_ratio"`
+}
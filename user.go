@@ -6,12 +6,36 @@ type User struct {
 	Nickname string
 	Admin    bool
 	ACL      []PathACL
+
+	// Groups the user belongs to, their permissions are added to the user's.
+	Groups []string `yaml:"groups"`
+
+	// SSHKeys are the public keys in authorized_keys format the user can log in to SFTP with.
+	SSHKeys []string `yaml:"ssh_keys"`
+
+	// S3Keys are the access keys the user can sign S3 requests with.
+	S3Keys []S3Key `yaml:"s3_keys"`
 }
 
 func (u User) Anonymous() bool {
 	return u.Nickname == UserNicknameAnonymous
 }
 
+// Group gives its permissions to all of its members.
+type Group struct {
+	Admin bool
+	ACL   []PathACL
+}
+
 type UsersProvider interface {
 	GetUser(nickname string) (*User, error)
 }
+
+// ExternalUsersProvider also knows the users whose groups are managed by an auth provider.
+type ExternalUsersProvider interface {
+	UsersProvider
+
+	// SetExternalGroups replaces the groups given to the user by the auth provider, users that are
+	// not configured are known only while they have some.
+	SetExternalGroups(nickname string, groups []string)
+}
@@ -0,0 +1,7 @@
+package fileshare
+
+// WebDAV serves the storage over WebDAV on its own address, Prefix is stripped from the request paths.
+type WebDAV struct {
+	Listen string `yaml:"listen"`
+	Prefix string `yaml:"prefix"`
+}
@@ -0,0 +1,35 @@
+package fileshare
+
+import "time"
+
+type Webhook struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Path   string   `yaml:"path"`
+	Events []string `yaml:"events"`
+}
+
+// WebhookEvent is the payload sent to webhooks, size and checksum are set only for uploads.
+type WebhookEvent struct {
+	ChangeEvent
+	User      string    `json:"user,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type WebhookDelivery struct {
+	ID         string       `json:"id"`
+	URL        string       `json:"url"`
+	Event      WebhookEvent `json:"event"`
+	Attempts   int          `json:"attempts"`
+	StatusCode int          `json:"status_code,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Delivered  bool         `json:"delivered"`
+	UpdatedAt  time.Time    `json:"updated_at"`
+}
+
+type WebhookDispatcher interface {
+	Dispatch(event WebhookEvent)
+	Deliveries() []WebhookDelivery
+}
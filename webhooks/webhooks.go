@@ -0,0 +1,191 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/devgianlu/go-fileshare"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAttempts is how many times a delivery is tried before giving up.
+	maxAttempts = 6
+	// maxDeliveries is how many deliveries are kept in the log.
+	maxDeliveries = 200
+)
+
+type webhookDispatcher struct {
+	hooks   []fileshare.Webhook
+	client  *http.Client
+	backoff time.Duration
+
+	lock       sync.Mutex
+	deliveries []*fileshare.WebhookDelivery
+}
+
+func NewWebhookDispatcher(hooks []fileshare.Webhook) (fileshare.WebhookDispatcher, error) {
+	for i, hook := range hooks {
+		if len(hook.URL) == 0 {
+			return nil, fmt.Errorf("missing url for webhook %d", i)
+		} else if len(hook.Secret) == 0 {
+			return nil, fmt.Errorf("missing secret for webhook %s", hook.URL)
+		}
+
+		for _, event := range hook.Events {
+			switch event {
+			case fileshare.ChangeCreated, fileshare.ChangeModified, fileshare.ChangeDeleted, fileshare.ChangeRenamed:
+			default:
+				return nil, fmt.Errorf("unknown event %s for webhook %s", event, hook.URL)
+			}
+		}
+	}
+
+	return &webhookDispatcher{
+		hooks:   hooks,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: time.Second,
+	}, nil
+}
+
+// matches checks if the event is relevant for the webhook, the path filter matches the directory and everything below it.
+func matches(hook fileshare.Webhook, event fileshare.WebhookEvent) bool {
+	if len(hook.Events) > 0 && !slices.Contains(hook.Events, event.Type) {
+		return false
+	}
+
+	prefix := filepath.Clean("/" + hook.Path)
+	if prefix == "/" {
+		return true
+	}
+
+	for _, path := range []string{event.Path, event.OldPath} {
+		if len(path) == 0 {
+			continue
+		}
+
+		path = filepath.Clean("/" + path)
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sign computes the signature sent in the X-Fileshare-Signature header.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *webhookDispatcher) Dispatch(event fileshare.WebhookEvent) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	for _, hook := range d.hooks {
+		if !matches(hook, event) {
+			continue
+		}
+
+		id := make([]byte, 8)
+		_, _ = rand.Read(id)
+
+		delivery := &fileshare.WebhookDelivery{ID: hex.EncodeToString(id), URL: hook.URL, Event: event, UpdatedAt: time.Now()}
+
+		d.lock.Lock()
+		d.deliveries = append(d.deliveries, delivery)
+		if len(d.deliveries) > maxDeliveries {
+			d.deliveries = d.deliveries[len(d.deliveries)-maxDeliveries:]
+		}
+		d.lock.Unlock()
+
+		go d.deliver(hook, delivery)
+	}
+}
+
+func (d *webhookDispatcher) deliver(hook fileshare.Webhook, delivery *fileshare.WebhookDelivery) {
+	body, err := json.Marshal(&delivery.Event)
+	if err != nil {
+		log.WithError(err).WithField("module", "webhooks").Errorf("failed encoding event for %s", hook.URL)
+		return
+	}
+
+	backoff := d.backoff
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		statusCode, err := d.send(hook, delivery.ID, delivery.Event.Type, body)
+
+		d.lock.Lock()
+		delivery.Attempts = attempt
+		delivery.StatusCode = statusCode
+		delivery.Delivered = err == nil
+		delivery.UpdatedAt = time.Now()
+		if err != nil {
+			delivery.Error = err.Error()
+		} else {
+			delivery.Error = ""
+		}
+		d.lock.Unlock()
+
+		if err == nil {
+			log.WithField("module", "webhooks").Debugf("delivered %s to %s", delivery.ID, hook.URL)
+			return
+		}
+
+		log.WithError(err).WithField("module", "webhooks").Warnf("failed delivering %s to %s (attempt %d)", delivery.ID, hook.URL, attempt)
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (d *webhookDispatcher) send(hook fileshare.Webhook, id string, event string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-fileshare")
+	req.Header.Set("X-Fileshare-Event", event)
+	req.Header.Set("X-Fileshare-Delivery", id)
+	req.Header.Set("X-Fileshare-Signature", Sign(hook.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func (d *webhookDispatcher) Deliveries() []fileshare.WebhookDelivery {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// newest first
+	deliveries := make([]fileshare.WebhookDelivery, len(d.deliveries))
+	for i, delivery := range d.deliveries {
+		deliveries[len(deliveries)-1-i] = *delivery
+	}
+
+	return deliveries
+}
@@ -0,0 +1,146 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"github.com/devgianlu/go-fileshare"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+// newTestReceiver starts a local HTTP server that fails the first requests and records the others.
+func newTestReceiver(t *testing.T, failures int) (*httptest.Server, <-chan receivedWebhook) {
+	var lock sync.Mutex
+	received := make(chan receivedWebhook, 16)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedWebhook{r.Header.Get("X-Fileshare-Event"), r.Header.Get("X-Fileshare-Signature"), body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, received
+}
+
+func newTestDispatcher(t *testing.T, hooks []fileshare.Webhook) *webhookDispatcher {
+	dispatcher, err := NewWebhookDispatcher(hooks)
+	if err != nil {
+		t.Fatalf("failed creating dispatcher: %v", err)
+	}
+
+	d := dispatcher.(*webhookDispatcher)
+	d.backoff = 10 * time.Millisecond
+	return d
+}
+
+func waitReceived(t *testing.T, received <-chan receivedWebhook) receivedWebhook {
+	select {
+	case r := <-received:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for webhook")
+		return receivedWebhook{}
+	}
+}
+
+// waitDelivery waits for the latest delivery to satisfy the condition.
+func waitDelivery(t *testing.T, d *webhookDispatcher, cond func(delivery fileshare.WebhookDelivery) bool) fileshare.WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if deliveries := d.Deliveries(); len(deliveries) > 0 && cond(deliveries[0]) {
+			return deliveries[0]
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for delivery")
+	return fileshare.WebhookDelivery{}
+}
+
+func TestWebhookDispatcher_Deliver(t *testing.T) {
+	server, received := newTestReceiver(t, 2)
+	d := newTestDispatcher(t, []fileshare.Webhook{{URL: server.URL, Secret: "secret", Path: "/datasets"}})
+
+	event := fileshare.WebhookEvent{
+		ChangeEvent: fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: "datasets/a.bin"},
+		User:        "pippo",
+		Size:        5,
+		SHA256:      "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+	d.Dispatch(event)
+
+	r := waitReceived(t, received)
+	if r.event != fileshare.ChangeCreated {
+		t.Fatalf("expected created event header, got %s", r.event)
+	} else if r.signature != Sign("secret", r.body) {
+		t.Fatalf("invalid signature %s", r.signature)
+	}
+
+	var payload fileshare.WebhookEvent
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	} else if payload.Path != event.Path || payload.User != event.User || payload.Size != event.Size || payload.SHA256 != event.SHA256 {
+		t.Fatalf("unexpected payload: %s", r.body)
+	}
+
+	// the delivery log is updated after the response is received
+	delivery := waitDelivery(t, d, func(delivery fileshare.WebhookDelivery) bool { return delivery.Delivered })
+	if delivery.Attempts != 3 || delivery.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected delivery: %+v", delivery)
+	} else if deliveries := d.Deliveries(); len(deliveries) != 1 {
+		t.Fatalf("expected 1 delivery, got %d", len(deliveries))
+	}
+}
+
+func TestWebhookDispatcher_Filter(t *testing.T) {
+	server, received := newTestReceiver(t, 0)
+	d := newTestDispatcher(t, []fileshare.Webhook{{URL: server.URL, Secret: "secret", Path: "/datasets", Events: []string{fileshare.ChangeCreated}}})
+
+	d.Dispatch(fileshare.WebhookEvent{ChangeEvent: fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: "other/a.bin"}})
+	d.Dispatch(fileshare.WebhookEvent{ChangeEvent: fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: "datasets2/a.bin"}})
+	d.Dispatch(fileshare.WebhookEvent{ChangeEvent: fileshare.ChangeEvent{Type: fileshare.ChangeDeleted, Path: "datasets/a.bin"}})
+	d.Dispatch(fileshare.WebhookEvent{ChangeEvent: fileshare.ChangeEvent{Type: fileshare.ChangeCreated, Path: "datasets/sub/b.bin"}})
+
+	var payload fileshare.WebhookEvent
+	if err := json.Unmarshal(waitReceived(t, received).body, &payload); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	} else if payload.Path != "datasets/sub/b.bin" {
+		t.Fatalf("unexpected webhook for %s", payload.Path)
+	}
+
+	if deliveries := d.Deliveries(); len(deliveries) != 1 {
+		t.Fatalf("expected 1 delivery, got %d", len(deliveries))
+	}
+}
+
+func TestWebhookDispatcher_GiveUp(t *testing.T) {
+	server, _ := newTestReceiver(t, maxAttempts)
+	d := newTestDispatcher(t, []fileshare.Webhook{{URL: server.URL, Secret: "secret"}})
+
+	d.Dispatch(fileshare.WebhookEvent{ChangeEvent: fileshare.ChangeEvent{Type: fileshare.ChangeDeleted, Path: "a.bin"}})
+
+	delivery := waitDelivery(t, d, func(delivery fileshare.WebhookDelivery) bool { return delivery.Attempts == maxAttempts })
+	if delivery.Delivered || delivery.StatusCode != http.StatusServiceUnavailable || len(delivery.Error) == 0 {
+		t.Fatalf("unexpected delivery: %+v", delivery)
+	}
+}